@@ -2,18 +2,38 @@ package claude
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 // ErrBudgetExceeded is returned when the budget limit is exceeded
 var ErrBudgetExceeded = errors.New("budget limit exceeded")
 
+// ErrInvalidAmount is returned when a negative amount is spent without AllowRefunds
+var ErrInvalidAmount = errors.New("invalid spend amount")
+
 // BudgetConfig controls spending limits and notifications
 type BudgetConfig struct {
 	// MaxBudgetUSD is the maximum allowed spend in USD
 	MaxBudgetUSD float64
 	// WarningThreshold is the percentage (0.0-1.0) at which to emit warnings
 	WarningThreshold float64
+	// WarningResetMargin is the percentage (0.0-1.0) spending must drop below the
+	// warning threshold before the warning can fire again, preventing repeated alerts
+	WarningResetMargin float64
+	// CallbackThrottle coalesces warning callbacks so they fire at most once per interval
+	// A warning suppressed by the throttle is delivered with the latest totals when the interval
+	// ends, even if no further spend arrives, or straight away ahead of an exceeded callback;
+	// the exceeded callback is never throttled
+	CallbackThrottle time.Duration
+	// AllowRefunds permits negative amounts in AddSpend to credit spending back
+	AllowRefunds bool
 	// OnBudgetWarning is called when spending exceeds the warning threshold
 	OnBudgetWarning func(current, max float64)
 	// OnBudgetExceeded is called when spending exceeds the budget
@@ -21,12 +41,24 @@ type BudgetConfig struct {
 }
 
 // BudgetTracker tracks cumulative spending across sessions
+// Budget callbacks run in order on a single worker goroutine, never under the tracker lock
 type BudgetTracker struct {
 	mu             sync.RWMutex
 	totalSpent     float64
 	sessionSpent   map[string]float64
 	config         *BudgetConfig
 	warningEmitted bool
+	warningPending bool
+	lastWarningAt  time.Time
+	// flushTimer delivers a throttled warning at the end of the interval
+	flushTimer afterTimer
+
+	cbMu      sync.Mutex
+	cbIdle    *sync.Cond
+	cbQueue   []func()
+	cbRunning bool
+	cbClosed  bool
+	cbSync    bool
 }
 
 // NewBudgetTracker creates a new BudgetTracker with the given configuration
@@ -34,10 +66,12 @@ func NewBudgetTracker(config *BudgetConfig) *BudgetTracker {
 	if config == nil {
 		config = &BudgetConfig{}
 	}
-	return &BudgetTracker{
+	bt := &BudgetTracker{
 		sessionSpent: make(map[string]float64),
 		config:       config,
 	}
+	bt.cbIdle = sync.NewCond(&bt.cbMu)
+	return bt
 }
 
 // TotalSpent returns the total amount spent across all sessions
@@ -68,6 +102,121 @@ func (bt *BudgetTracker) RemainingBudget() float64 {
 	return remaining
 }
 
+// budgetAdjusted returns the options for one run with BudgetDowngrade and BudgetPlanThreshold applied
+// for the tracker's remaining budget. opts is never modified, so an adjustment lasts only as long as
+// the budget stays low; a copy is returned when an adjustment applies
+func budgetAdjusted(opts *RunOptions) *RunOptions {
+	if opts == nil {
+		return nil
+	}
+	alias := budgetDowngradeAlias(opts.BudgetTracker, opts.BudgetDowngrade)
+	plan := budgetBelow(opts.BudgetTracker, opts.BudgetPlanThreshold)
+	if alias == "" && !plan {
+		return opts
+	}
+	adjusted := *opts
+	if alias != "" {
+		adjusted.ModelAlias = alias
+		adjusted.Model = ""
+	}
+	if plan {
+		adjusted.PermissionMode = PermissionModePlan
+	}
+	return &adjusted
+}
+
+// budgetDowngradeAlias returns the model alias for the lowest threshold above the tracker's remaining budget
+// It returns "" when there is no tracker, no budget limit, or no threshold has been crossed
+func budgetDowngradeAlias(tracker *BudgetTracker, thresholds map[float64]string) string {
+	if tracker == nil || len(thresholds) == 0 {
+		return ""
+	}
+	remaining := tracker.RemainingBudget()
+	if remaining < 0 {
+		return ""
+	}
+
+	alias, lowest := "", math.Inf(1)
+	for threshold, candidate := range thresholds {
+		if remaining < threshold && threshold < lowest {
+			alias, lowest = candidate, threshold
+		}
+	}
+	return alias
+}
+
+// budgetBelow reports whether the tracker's remaining budget has fallen below threshold
+// It returns false when there is no tracker, no budget limit, or no threshold
+func budgetBelow(tracker *BudgetTracker, threshold float64) bool {
+	if tracker == nil || threshold <= 0 {
+		return false
+	}
+	remaining := tracker.RemainingBudget()
+	return remaining >= 0 && remaining < threshold
+}
+
+// maxPrometheusSessions caps the per-session series written by WritePrometheus
+const maxPrometheusSessions = 20
+
+// prometheusLabelEscaper escapes label values for the Prometheus text format
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WritePrometheus writes the budget state as gauges in the Prometheus text exposition format
+// Per-session spend is limited to the maxPrometheusSessions highest-spending sessions
+// to bound label cardinality; without a budget limit the remaining gauge is +Inf
+func (bt *BudgetTracker) WritePrometheus(w io.Writer) error {
+	bt.mu.RLock()
+	spent := bt.totalSpent
+	maxBudget := bt.config.MaxBudgetUSD
+	type sessionSpend struct {
+		id     string
+		amount float64
+	}
+	sessions := make([]sessionSpend, 0, len(bt.sessionSpent))
+	for id, amount := range bt.sessionSpent {
+		sessions = append(sessions, sessionSpend{id, amount})
+	}
+	bt.mu.RUnlock()
+
+	remaining := math.Inf(1)
+	if maxBudget > 0 {
+		remaining = math.Max(maxBudget-spent, 0)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].amount != sessions[j].amount {
+			return sessions[i].amount > sessions[j].amount
+		}
+		return sessions[i].id < sessions[j].id
+	})
+	if len(sessions) > maxPrometheusSessions {
+		sessions = sessions[:maxPrometheusSessions]
+	}
+
+	var sb strings.Builder
+	gauge := func(name, help string, value float64) {
+		fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatPrometheusValue(value))
+	}
+	gauge("claude_budget_spent_usd", "Total spend tracked across all sessions in USD.", spent)
+	gauge("claude_budget_max_usd", "Configured budget limit in USD (0 = unlimited).", maxBudget)
+	gauge("claude_budget_remaining_usd", "Remaining budget in USD.", remaining)
+
+	sb.WriteString("# HELP claude_budget_session_spent_usd Spend per session in USD for the highest-spending sessions.\n")
+	sb.WriteString("# TYPE claude_budget_session_spent_usd gauge\n")
+	for _, session := range sessions {
+		fmt.Fprintf(&sb, "claude_budget_session_spent_usd{session_id=\"%s\"} %s\n",
+			prometheusLabelEscaper.Replace(session.id), formatPrometheusValue(session.amount))
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// formatPrometheusValue formats a sample value; FormatFloat already renders infinities as +Inf
+func formatPrometheusValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
 // CanSpend checks if the given amount can be spent within the budget
 func (bt *BudgetTracker) CanSpend(amount float64) bool {
 	if bt.config.MaxBudgetUSD <= 0 {
@@ -79,33 +228,280 @@ func (bt *BudgetTracker) CanSpend(amount float64) bool {
 }
 
 // AddSpend adds spending to the tracker and returns an error if budget is exceeded
+// A zero amount is a no-op; negative amounts are rejected with ErrInvalidAmount unless AllowRefunds is set
 func (bt *BudgetTracker) AddSpend(sessionID string, amount float64) error {
+	defer bt.waitIfSync() // runs after the unlock below
 	bt.mu.Lock()
 	defer bt.mu.Unlock()
 
+	if amount == 0 {
+		return nil
+	}
+	if amount < 0 && !bt.config.AllowRefunds {
+		return fmt.Errorf("%w: %.4f (negative amounts require AllowRefunds)", ErrInvalidAmount, amount)
+	}
+
 	bt.totalSpent += amount
 	bt.sessionSpent[sessionID] += amount
+	return bt.checkBudget()
+}
+
+// SpendEntry is a single charge applied by AddSpendBatch
+type SpendEntry struct {
+	SessionID string
+	Amount    float64
+}
+
+// BatchBudgetError is returned by AddSpendBatch when the batch takes spending over the budget
+// It unwraps to ErrBudgetExceeded
+type BatchBudgetError struct {
+	// Index is the first entry after which spending exceeded the budget
+	Index int
+	// Spent is the total spent once that entry was applied
+	Spent float64
+}
+
+// Error implements the error interface
+func (e *BatchBudgetError) Error() string {
+	return fmt.Sprintf("%s at batch entry %d ($%.4f spent)", ErrBudgetExceeded, e.Index, e.Spent)
+}
+
+// Unwrap returns ErrBudgetExceeded
+func (e *BatchBudgetError) Unwrap() error {
+	return ErrBudgetExceeded
+}
+
+// AddSpendBatch applies many spends under a single lock acquisition
+// Entries are validated as in AddSpend before any is applied, so an invalid amount rejects the whole batch.
+// Every valid entry is recorded; thresholds are checked once at the end and callbacks fire at most once per batch.
+// A BatchBudgetError is returned only when this batch took spending over the budget; a batch that adds to an
+// already exceeded budget returns ErrBudgetExceeded, and one that spends nothing or only refunds returns nil
+func (bt *BudgetTracker) AddSpendBatch(entries []SpendEntry) error {
+	defer bt.waitIfSync() // runs after the unlock below
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	for i, entry := range entries {
+		if entry.Amount < 0 && !bt.config.AllowRefunds {
+			return fmt.Errorf("%w: %.4f at batch entry %d (negative amounts require AllowRefunds)", ErrInvalidAmount, entry.Amount, i)
+		}
+	}
+
+	exceededAt := -1
+	var exceededSpent, net float64
+	applied := false
+	for i, entry := range entries {
+		if entry.Amount == 0 {
+			continue
+		}
+		wasOver := bt.overBudget()
+		bt.totalSpent += entry.Amount
+		bt.sessionSpent[entry.SessionID] += entry.Amount
+		net += entry.Amount
+		applied = true
+		if exceededAt < 0 && !wasOver && bt.overBudget() {
+			exceededAt, exceededSpent = i, bt.totalSpent
+		}
+	}
+	if !applied {
+		return nil
+	}
+
+	// Refunds that leave an exceeded budget exceeded only re-check the warning
+	if !bt.overBudget() || (exceededAt < 0 && net <= 0) {
+		bt.checkWarning()
+		return nil
+	}
+
+	err := bt.checkBudget()
+	if exceededAt >= 0 {
+		return &BatchBudgetError{Index: exceededAt, Spent: exceededSpent}
+	}
+	return err
+}
+
+// overBudget reports whether spending is over a configured budget
+// Must be called with the lock held
+func (bt *BudgetTracker) overBudget() bool {
+	return bt.config.MaxBudgetUSD > 0 && bt.totalSpent > bt.config.MaxBudgetUSD
+}
+
+// checkBudget fires the warning and exceeded callbacks for the current total
+// and returns ErrBudgetExceeded when it is over the limit
+// Must be called with the lock held
+func (bt *BudgetTracker) checkBudget() error {
+	bt.checkWarning()
+
+	// Check if budget exceeded
+	if bt.overBudget() {
+		// A throttled warning is delivered first so it never arrives after the exceeded notification
+		if bt.warningPending {
+			bt.deliverWarning(timeNow())
+		}
+		if bt.config.OnBudgetExceeded != nil {
+			bt.dispatch(bt.config.OnBudgetExceeded, bt.totalSpent, bt.config.MaxBudgetUSD)
+		}
+		return ErrBudgetExceeded
+	}
+
+	return nil
+}
+
+// checkWarning fires the warning callback once the current total reaches the warning threshold
+// Must be called with the lock held
+func (bt *BudgetTracker) checkWarning() {
+	bt.rearmWarning()
 
-	// Check warning threshold
 	if bt.config.MaxBudgetUSD > 0 && bt.config.WarningThreshold > 0 && !bt.warningEmitted {
 		warningAmount := bt.config.MaxBudgetUSD * bt.config.WarningThreshold
 		if bt.totalSpent >= warningAmount {
 			bt.warningEmitted = true
-			if bt.config.OnBudgetWarning != nil {
-				// Call callback outside of lock to prevent deadlocks
-				go bt.config.OnBudgetWarning(bt.totalSpent, bt.config.MaxBudgetUSD)
+			bt.warningPending = bt.config.OnBudgetWarning != nil
+		}
+	}
+	bt.flushWarning()
+}
+
+// flushWarning delivers a pending warning unless it falls within CallbackThrottle of the last one,
+// in which case a flush is scheduled for the end of the interval
+// Must be called with the lock held
+func (bt *BudgetTracker) flushWarning() {
+	if !bt.warningPending {
+		return
+	}
+	now := timeNow()
+	if bt.config.CallbackThrottle > 0 && !bt.lastWarningAt.IsZero() {
+		if wait := bt.lastWarningAt.Add(bt.config.CallbackThrottle).Sub(now); wait > 0 {
+			if bt.flushTimer == nil {
+				bt.flushTimer = afterFunc(wait, bt.flushThrottledWarning)
 			}
+			return
 		}
 	}
+	bt.deliverWarning(now)
+}
 
-	// Check if budget exceeded
-	if bt.config.MaxBudgetUSD > 0 && bt.totalSpent > bt.config.MaxBudgetUSD {
-		if bt.config.OnBudgetExceeded != nil {
-			go bt.config.OnBudgetExceeded(bt.totalSpent, bt.config.MaxBudgetUSD)
+// flushThrottledWarning runs when a throttle interval ends and delivers any warning still pending
+func (bt *BudgetTracker) flushThrottledWarning() {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	bt.flushTimer = nil
+	bt.flushWarning()
+}
+
+// deliverWarning dispatches the pending warning with the current totals
+// Must be called with the lock held
+func (bt *BudgetTracker) deliverWarning(now time.Time) {
+	if bt.flushTimer != nil {
+		bt.flushTimer.Stop()
+		bt.flushTimer = nil
+	}
+	bt.warningPending = false
+	bt.lastWarningAt = now
+	// Call callback outside of lock to prevent deadlocks
+	bt.dispatch(bt.config.OnBudgetWarning, bt.totalSpent, bt.config.MaxBudgetUSD)
+}
+
+// dispatch queues a budget callback for the worker goroutine, starting it if idle
+// Callbacks run in the order they were queued, so a warning always precedes an exceeded notification
+func (bt *BudgetTracker) dispatch(fn func(current, max float64), current, max float64) {
+	bt.cbMu.Lock()
+	defer bt.cbMu.Unlock()
+
+	if bt.cbClosed {
+		return
+	}
+	bt.cbQueue = append(bt.cbQueue, func() { fn(current, max) })
+	if !bt.cbRunning {
+		bt.cbRunning = true
+		go bt.runCallbacks()
+	}
+}
+
+// runCallbacks drains the callback queue and exits once it is empty
+func (bt *BudgetTracker) runCallbacks() {
+	for {
+		bt.cbMu.Lock()
+		if len(bt.cbQueue) == 0 || bt.cbClosed {
+			bt.cbQueue = nil
+			bt.cbRunning = false
+			bt.cbIdle.Broadcast()
+			bt.cbMu.Unlock()
+			return
 		}
-		return ErrBudgetExceeded
+		fn := bt.cbQueue[0]
+		bt.cbQueue = bt.cbQueue[1:]
+		bt.cbMu.Unlock()
+
+		fn()
 	}
+}
+
+// SetCallbackSync makes AddSpend return only after the callbacks it triggered have run
+// Intended for tests that need deterministic callback delivery; callbacks still run without the
+// tracker lock held but must not call AddSpend themselves while sync mode is on
+func (bt *BudgetTracker) SetCallbackSync(sync bool) {
+	bt.cbMu.Lock()
+	defer bt.cbMu.Unlock()
+	bt.cbSync = sync
+}
+
+// waitIfSync waits for queued callbacks when SetCallbackSync is enabled
+func (bt *BudgetTracker) waitIfSync() {
+	bt.cbMu.Lock()
+	sync := bt.cbSync
+	bt.cbMu.Unlock()
+	if sync {
+		bt.WaitCallbacks()
+	}
+}
 
+// WaitCallbacks blocks until all queued budget callbacks have completed
+func (bt *BudgetTracker) WaitCallbacks() {
+	bt.cbMu.Lock()
+	defer bt.cbMu.Unlock()
+	for bt.cbRunning {
+		bt.cbIdle.Wait()
+	}
+}
+
+// Close cancels budget callbacks that have not started yet and stops accepting new ones
+// A callback already running is allowed to finish; spending is still tracked after Close
+func (bt *BudgetTracker) Close() {
+	bt.mu.Lock()
+	if bt.flushTimer != nil {
+		bt.flushTimer.Stop()
+		bt.flushTimer = nil
+	}
+	bt.mu.Unlock()
+
+	bt.cbMu.Lock()
+	defer bt.cbMu.Unlock()
+	bt.cbClosed = true
+	bt.cbQueue = nil
+}
+
+// recordSpend charges a finished run to opts.BudgetTracker, using opts.CostSource when set
+// Exceeding the budget is reported as a CancelBudget *CancelCause
+func recordSpend(opts *RunOptions, result *ClaudeResult) error {
+	if opts.BudgetTracker == nil {
+		return nil
+	}
+	amount := result.CostUSD
+	if opts.CostSource != nil {
+		amount = opts.CostSource(result)
+	}
+	// Runs without a reported session (e.g. text output) are tagged individually rather than pooled under ""
+	sessionID := result.SessionID
+	if sessionID == "" {
+		sessionID = newSessionID()
+	}
+	if err := opts.BudgetTracker.AddSpend(sessionID, amount); err != nil {
+		if errors.Is(err, ErrBudgetExceeded) {
+			err = &CancelCause{Reason: CancelBudget, Err: err}
+		}
+		return err
+	}
 	return nil
 }
 
@@ -116,6 +512,8 @@ func (bt *BudgetTracker) Reset() {
 	bt.totalSpent = 0
 	bt.sessionSpent = make(map[string]float64)
 	bt.warningEmitted = false
+	bt.warningPending = false
+	bt.lastWarningAt = time.Time{}
 }
 
 // ResetSession resets spending for a specific session
@@ -126,6 +524,21 @@ func (bt *BudgetTracker) ResetSession(sessionID string) {
 		bt.totalSpent -= spent
 		delete(bt.sessionSpent, sessionID)
 	}
+	bt.rearmWarning()
+}
+
+// rearmWarning allows the warning to fire again once spending has dropped
+// below the warning threshold minus the reset margin
+// Must be called with the lock held
+func (bt *BudgetTracker) rearmWarning() {
+	if !bt.warningEmitted || bt.config.MaxBudgetUSD <= 0 || bt.config.WarningThreshold <= 0 {
+		return
+	}
+	resetAmount := bt.config.MaxBudgetUSD * (bt.config.WarningThreshold - bt.config.WarningResetMargin)
+	if bt.totalSpent < resetAmount {
+		bt.warningEmitted = false
+		bt.warningPending = false
+	}
 }
 
 // Config returns the budget configuration
@@ -139,4 +552,5 @@ func (bt *BudgetTracker) UpdateConfig(config *BudgetConfig) {
 	defer bt.mu.Unlock()
 	bt.config = config
 	bt.warningEmitted = false // Reset warning state when config changes
+	bt.warningPending = false
 }
@@ -1,8 +1,14 @@
 package claude
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestNewBudgetTracker(t *testing.T) {
@@ -73,11 +79,10 @@ func TestBudgetTracker_AddSpend(t *testing.T) {
 		})
 
 		_ = bt.AddSpend("session1", 6.0) // 60% of budget, exceeds 50% threshold
-		// Give goroutine time to execute
-		for i := 0; i < 100 && !warningCalled; i++ {
-			// Small busy wait for callback
+		bt.WaitCallbacks()
+		if !warningCalled {
+			t.Error("OnBudgetWarning was not called")
 		}
-		// Note: In real tests we'd use channels or sync primitives
 	})
 
 	t.Run("exceeded callback", func(t *testing.T) {
@@ -90,9 +95,354 @@ func TestBudgetTracker_AddSpend(t *testing.T) {
 		})
 
 		_ = bt.AddSpend("session1", 6.0)
-		// Give goroutine time to execute
-		for i := 0; i < 100 && !exceededCalled; i++ {
-			// Small busy wait for callback
+		bt.WaitCallbacks()
+		if !exceededCalled {
+			t.Error("OnBudgetExceeded was not called")
+		}
+	})
+}
+
+func TestBudgetTracker_CallbackOrdering(t *testing.T) {
+	var events []string
+	bt := NewBudgetTracker(&BudgetConfig{
+		MaxBudgetUSD:     5.0,
+		WarningThreshold: 0.5,
+		OnBudgetWarning: func(current, max float64) {
+			time.Sleep(10 * time.Millisecond)
+			events = append(events, "warning")
+		},
+		OnBudgetExceeded: func(current, max float64) {
+			events = append(events, "exceeded")
+		},
+	})
+
+	// A single spend crosses both the warning threshold and the limit
+	if err := bt.AddSpend("session1", 6.0); err != ErrBudgetExceeded {
+		t.Fatalf("AddSpend() error = %v, want ErrBudgetExceeded", err)
+	}
+	bt.WaitCallbacks()
+
+	if len(events) != 2 || events[0] != "warning" || events[1] != "exceeded" {
+		t.Errorf("events = %v, want [warning exceeded]", events)
+	}
+}
+
+func TestBudgetTracker_Close(t *testing.T) {
+	release := make(chan struct{})
+	var exceeded int
+	bt := NewBudgetTracker(&BudgetConfig{
+		MaxBudgetUSD:     5.0,
+		WarningThreshold: 0.5,
+		OnBudgetWarning: func(current, max float64) {
+			<-release
+		},
+		OnBudgetExceeded: func(current, max float64) {
+			exceeded++
+		},
+	})
+
+	_ = bt.AddSpend("session1", 6.0)
+	// The warning callback is blocked; closing drops the queued exceeded callback
+	bt.Close()
+	close(release)
+	bt.WaitCallbacks()
+
+	_ = bt.AddSpend("session1", 1.0)
+	bt.WaitCallbacks()
+
+	if exceeded != 0 {
+		t.Errorf("OnBudgetExceeded called %d times after Close, want 0", exceeded)
+	}
+	if bt.TotalSpent() != 7.0 {
+		t.Errorf("TotalSpent() = %v, want 7.0", bt.TotalSpent())
+	}
+}
+
+func TestBudgetTracker_InvalidAmounts(t *testing.T) {
+	t.Run("negative rejected", func(t *testing.T) {
+		bt := NewBudgetTracker(&BudgetConfig{MaxBudgetUSD: 10.0})
+		_ = bt.AddSpend("session1", 5.0)
+
+		err := bt.AddSpend("session1", -2.0)
+		if !errors.Is(err, ErrInvalidAmount) {
+			t.Errorf("AddSpend() error = %v, want ErrInvalidAmount", err)
+		}
+		if bt.TotalSpent() != 5.0 || bt.SessionSpent("session1") != 5.0 {
+			t.Errorf("spending changed after rejected amount: total=%v session=%v", bt.TotalSpent(), bt.SessionSpent("session1"))
+		}
+	})
+
+	t.Run("zero is a no-op", func(t *testing.T) {
+		bt := NewBudgetTracker(&BudgetConfig{MaxBudgetUSD: 10.0})
+
+		if err := bt.AddSpend("session1", 0); err != nil {
+			t.Errorf("AddSpend() returned error for zero: %v", err)
+		}
+		if bt.TotalSpent() != 0 {
+			t.Errorf("TotalSpent() = %v, want 0", bt.TotalSpent())
+		}
+		if _, ok := bt.sessionSpent["session1"]; ok {
+			t.Error("zero spend should not create a session entry")
+		}
+	})
+
+	t.Run("refunds allowed", func(t *testing.T) {
+		bt := NewBudgetTracker(&BudgetConfig{MaxBudgetUSD: 10.0, AllowRefunds: true})
+		_ = bt.AddSpend("session1", 5.0)
+
+		if err := bt.AddSpend("session1", -2.0); err != nil {
+			t.Errorf("AddSpend() returned error for refund: %v", err)
+		}
+		if bt.TotalSpent() != 3.0 || bt.SessionSpent("session1") != 3.0 {
+			t.Errorf("refund not applied: total=%v session=%v", bt.TotalSpent(), bt.SessionSpent("session1"))
+		}
+	})
+}
+
+func TestBudgetTracker_WarningHysteresis(t *testing.T) {
+	var fired []float64
+	bt := NewBudgetTracker(&BudgetConfig{
+		MaxBudgetUSD:       10.0,
+		WarningThreshold:   0.5,
+		WarningResetMargin: 0.1,
+		OnBudgetWarning: func(current, max float64) {
+			fired = append(fired, current)
+		},
+	})
+	bt.SetCallbackSync(true)
+
+	expectWarnings := func(want int) {
+		t.Helper()
+		if len(fired) != want {
+			t.Errorf("expected %d warnings, got %v", want, fired)
+		}
+	}
+
+	_ = bt.AddSpend("base", 4.5)
+	_ = bt.AddSpend("x", 1.0) // 5.5 crosses the 5.0 threshold
+	expectWarnings(1)
+
+	bt.ResetSession("x")      // 4.5, still above the 4.0 reset point
+	_ = bt.AddSpend("y", 1.0) // 5.5 again
+	expectWarnings(1)
+
+	bt.ResetSession("y")
+	bt.ResetSession("base")   // 0.0, below the reset point
+	_ = bt.AddSpend("z", 5.0) // crosses again
+	expectWarnings(2)
+}
+
+func TestBudgetTracker_CallbackSync(t *testing.T) {
+	var events []string
+	bt := NewBudgetTracker(&BudgetConfig{
+		MaxBudgetUSD:     1.0,
+		WarningThreshold: 0.5,
+		OnBudgetWarning: func(current, max float64) {
+			events = append(events, fmt.Sprintf("warning %.2f", current))
+		},
+		OnBudgetExceeded: func(current, max float64) {
+			events = append(events, fmt.Sprintf("exceeded %.2f", current))
+		},
+	})
+	bt.SetCallbackSync(true)
+
+	_ = bt.AddSpend("s", 0.6)
+	if len(events) != 1 || events[0] != "warning 0.60" {
+		t.Fatalf("expected warning delivered before AddSpend returned, got %v", events)
+	}
+
+	if err := bt.AddSpend("s", 0.5); !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("expected ErrBudgetExceeded, got %v", err)
+	}
+	if len(events) != 2 || events[1] != "exceeded 1.10" {
+		t.Errorf("expected exceeded delivered before AddSpend returned, got %v", events)
+	}
+}
+
+func TestBudgetTracker_CallbackThrottle(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	originalTimeNow := timeNow
+	originalAfterFunc := afterFunc
+	timeNow = func() time.Time { return now }
+	afterFunc = func(d time.Duration, f func()) afterTimer { return &fakeTimer{fire: f} }
+	defer func() {
+		timeNow = originalTimeNow
+		afterFunc = originalAfterFunc
+	}()
+
+	var mu sync.Mutex
+	var warnings, exceeded []float64
+	bt := NewBudgetTracker(&BudgetConfig{
+		MaxBudgetUSD:       10.0,
+		WarningThreshold:   0.5,
+		WarningResetMargin: 0.1,
+		CallbackThrottle:   time.Minute,
+		OnBudgetWarning: func(current, max float64) {
+			mu.Lock()
+			warnings = append(warnings, current)
+			mu.Unlock()
+		},
+		OnBudgetExceeded: func(current, max float64) {
+			mu.Lock()
+			exceeded = append(exceeded, current)
+			mu.Unlock()
+		},
+	})
+	defer bt.Close()
+
+	// Rapid crossings within the window coalesce into the first warning
+	_ = bt.AddSpend("a", 6.0)
+	bt.ResetSession("a")
+	_ = bt.AddSpend("b", 5.5)
+	bt.ResetSession("b")
+	_ = bt.AddSpend("c", 5.0)
+	_ = bt.AddSpend("c", 0.5)
+	bt.WaitCallbacks()
+
+	mu.Lock()
+	if len(warnings) != 1 || warnings[0] != 6.0 {
+		t.Errorf("expected a single warning at 6.0 within the window, got %v", warnings)
+	}
+	mu.Unlock()
+
+	// The pending warning is delivered with the latest totals once the window has passed
+	now = now.Add(2 * time.Minute)
+	_ = bt.AddSpend("c", 0.25)
+	bt.WaitCallbacks()
+
+	mu.Lock()
+	if len(warnings) != 2 || warnings[1] != 5.75 {
+		t.Errorf("expected coalesced warning at 5.75, got %v", warnings)
+	}
+	mu.Unlock()
+
+	// Exceeded callbacks are never throttled
+	if err := bt.AddSpend("c", 5.0); err == nil {
+		t.Error("expected budget exceeded error")
+	}
+	bt.WaitCallbacks()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(exceeded) != 1 {
+		t.Errorf("expected immediate exceeded callback, got %v", exceeded)
+	}
+	if len(warnings) != 2 {
+		t.Errorf("expected no extra warnings, got %v", warnings)
+	}
+}
+
+func TestBudgetTracker_CallbackThrottleFlush(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	originalTimeNow := timeNow
+	originalAfterFunc := afterFunc
+	var timers []*fakeTimer
+	var waits []time.Duration
+	timeNow = func() time.Time { return now }
+	afterFunc = func(d time.Duration, f func()) afterTimer {
+		timer := &fakeTimer{fire: f}
+		timers = append(timers, timer)
+		waits = append(waits, d)
+		return timer
+	}
+	defer func() {
+		timeNow = originalTimeNow
+		afterFunc = originalAfterFunc
+	}()
+
+	var events []string
+	bt := NewBudgetTracker(&BudgetConfig{
+		MaxBudgetUSD:       10.0,
+		WarningThreshold:   0.5,
+		WarningResetMargin: 0.1,
+		CallbackThrottle:   time.Minute,
+		OnBudgetWarning:    func(current, max float64) { events = append(events, fmt.Sprintf("warning %.2f", current)) },
+		OnBudgetExceeded:   func(current, max float64) { events = append(events, fmt.Sprintf("exceeded %.2f", current)) },
+	})
+	bt.SetCallbackSync(true)
+	defer bt.Close()
+
+	// A second crossing within the window is held back, and no further spend arrives
+	_ = bt.AddSpend("a", 6.0)
+	bt.ResetSession("a")
+	now = now.Add(20 * time.Second)
+	_ = bt.AddSpend("b", 5.5)
+	if len(timers) != 1 || waits[0] != 40*time.Second {
+		t.Fatalf("expected a flush scheduled for the end of the window, got %v", waits)
+	}
+
+	now = now.Add(40 * time.Second)
+	timers[0].fire()
+	bt.WaitCallbacks()
+	if want := []string{"warning 6.00", "warning 5.50"}; !reflect.DeepEqual(events, want) {
+		t.Errorf("expected the held warning to be flushed at the end of the window, got %v", events)
+	}
+
+	// A held warning is delivered ahead of the exceeded callback
+	events = nil
+	bt.ResetSession("b")
+	_ = bt.AddSpend("c", 5.25)
+	_ = bt.AddSpend("c", 5.0)
+	if want := []string{"warning 10.25", "exceeded 10.25"}; !reflect.DeepEqual(events, want) {
+		t.Errorf("expected the warning to precede the exceeded callback, got %v", events)
+	}
+
+	// The timer scheduled for the delivered warning has nothing left to send
+	timers[len(timers)-1].fire()
+	bt.WaitCallbacks()
+	if len(events) != 2 {
+		t.Errorf("expected no duplicate warning from a stale flush, got %v", events)
+	}
+}
+
+func TestBudgetTracker_WritePrometheus(t *testing.T) {
+	bt := NewBudgetTracker(&BudgetConfig{MaxBudgetUSD: 10.0})
+	_ = bt.AddSpend("session-a", 1.5)
+	_ = bt.AddSpend("session-b", 2.25)
+	_ = bt.AddSpend(`quote"d`, 0.25)
+
+	var sb strings.Builder
+	if err := bt.WritePrometheus(&sb); err != nil {
+		t.Fatalf("WritePrometheus() error = %v", err)
+	}
+	out := sb.String()
+
+	for _, line := range []string{
+		"# TYPE claude_budget_spent_usd gauge",
+		"claude_budget_spent_usd 4",
+		"claude_budget_max_usd 10",
+		"claude_budget_remaining_usd 6",
+		"# TYPE claude_budget_session_spent_usd gauge",
+		`claude_budget_session_spent_usd{session_id="session-a"} 1.5`,
+		`claude_budget_session_spent_usd{session_id="session-b"} 2.25`,
+		`claude_budget_session_spent_usd{session_id="quote\"d"} 0.25`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing line %q in output:\n%s", line, out)
+		}
+	}
+	if strings.Index(out, "session-b") > strings.Index(out, "session-a") {
+		t.Error("expected sessions ordered by spend")
+	}
+
+	t.Run("caps session labels", func(t *testing.T) {
+		bt := NewBudgetTracker(nil)
+		for i := 0; i < maxPrometheusSessions+5; i++ {
+			_ = bt.AddSpend(fmt.Sprintf("s%02d", i), float64(i+1))
+		}
+
+		var sb strings.Builder
+		_ = bt.WritePrometheus(&sb)
+		out := sb.String()
+
+		if n := strings.Count(out, "claude_budget_session_spent_usd{"); n != maxPrometheusSessions {
+			t.Errorf("expected %d session series, got %d", maxPrometheusSessions, n)
+		}
+		if strings.Contains(out, `session_id="s00"`) {
+			t.Error("expected the lowest-spending session to be dropped")
+		}
+		if !strings.Contains(out, "claude_budget_remaining_usd +Inf\n") {
+			t.Errorf("expected +Inf remaining without a limit:\n%s", out)
 		}
 	})
 }
@@ -212,3 +562,355 @@ func TestBudgetTracker_Concurrent(t *testing.T) {
 		t.Errorf("TotalSpent() after concurrent adds = %v, want 100.0", bt.TotalSpent())
 	}
 }
+
+func TestBudgetTracker_AddSpendBatch(t *testing.T) {
+	entries := []SpendEntry{
+		{"a", 0.25}, {"b", 1.5}, {"a", 0}, {"c", 0.125}, {"b", 2.0}, {"a", 0.5},
+	}
+
+	single := NewBudgetTracker(&BudgetConfig{MaxBudgetUSD: 100})
+	for _, entry := range entries {
+		_ = single.AddSpend(entry.SessionID, entry.Amount)
+	}
+	batch := NewBudgetTracker(&BudgetConfig{MaxBudgetUSD: 100})
+	if err := batch.AddSpendBatch(entries); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if batch.TotalSpent() != single.TotalSpent() {
+		t.Errorf("batch total = %v, individual total = %v", batch.TotalSpent(), single.TotalSpent())
+	}
+	for _, session := range []string{"a", "b", "c"} {
+		if batch.SessionSpent(session) != single.SessionSpent(session) {
+			t.Errorf("session %s: batch = %v, individual = %v", session, batch.SessionSpent(session), single.SessionSpent(session))
+		}
+	}
+
+	t.Run("exceeded", func(t *testing.T) {
+		var warnings, exceeded int
+		bt := NewBudgetTracker(&BudgetConfig{
+			MaxBudgetUSD:     2,
+			WarningThreshold: 0.5,
+			OnBudgetWarning:  func(current, max float64) { warnings++ },
+			OnBudgetExceeded: func(current, max float64) { exceeded++ },
+		})
+		bt.SetCallbackSync(true)
+
+		err := bt.AddSpendBatch(entries)
+		var batchErr *BatchBudgetError
+		if !errors.As(err, &batchErr) || !errors.Is(err, ErrBudgetExceeded) {
+			t.Fatalf("expected a BatchBudgetError wrapping ErrBudgetExceeded, got %v", err)
+		}
+		if batchErr.Index != 4 || batchErr.Spent != 3.875 {
+			t.Errorf("expected the budget to be exceeded at entry 4 with $3.875 spent, got %d and %v", batchErr.Index, batchErr.Spent)
+		}
+		if bt.TotalSpent() != 4.375 {
+			t.Errorf("expected every entry to be recorded, got %v", bt.TotalSpent())
+		}
+		if warnings != 1 || exceeded != 1 {
+			t.Errorf("expected one warning and one exceeded callback per batch, got %d and %d", warnings, exceeded)
+		}
+	})
+
+	t.Run("already exceeded", func(t *testing.T) {
+		var exceeded int
+		bt := NewBudgetTracker(&BudgetConfig{
+			MaxBudgetUSD:     1,
+			AllowRefunds:     true,
+			OnBudgetExceeded: func(current, max float64) { exceeded++ },
+		})
+		bt.SetCallbackSync(true)
+		_ = bt.AddSpend("a", 3)
+		exceeded = 0
+
+		for name, batch := range map[string][]SpendEntry{
+			"empty":        nil,
+			"all zero":     {{"a", 0}, {"b", 0}},
+			"refund above": {{"a", -0.5}, {"a", -0.5}},
+		} {
+			if err := bt.AddSpendBatch(batch); err != nil {
+				t.Errorf("%s: expected no error, got %v", name, err)
+			}
+		}
+		if exceeded != 0 {
+			t.Errorf("expected no exceeded callback for batches that add no spending, got %d", exceeded)
+		}
+
+		err := bt.AddSpendBatch([]SpendEntry{{"a", 0.5}})
+		var batchErr *BatchBudgetError
+		if !errors.Is(err, ErrBudgetExceeded) || errors.As(err, &batchErr) {
+			t.Errorf("expected a plain ErrBudgetExceeded when adding to an exceeded budget, got %v", err)
+		}
+		if exceeded != 1 {
+			t.Errorf("expected one exceeded callback, got %d", exceeded)
+		}
+
+		err = bt.AddSpendBatch([]SpendEntry{{"a", -2}, {"b", 0.25}, {"b", 1}})
+		if !errors.As(err, &batchErr) || batchErr.Index != 2 || batchErr.Spent != 1.75 {
+			t.Errorf("expected the batch to report crossing the budget again at entry 2, got %v", err)
+		}
+	})
+
+	t.Run("invalid amount", func(t *testing.T) {
+		bt := NewBudgetTracker(&BudgetConfig{})
+		err := bt.AddSpendBatch([]SpendEntry{{"a", 1}, {"a", -0.5}})
+		if !errors.Is(err, ErrInvalidAmount) {
+			t.Errorf("expected ErrInvalidAmount, got %v", err)
+		}
+		if bt.TotalSpent() != 0 {
+			t.Errorf("expected an invalid batch to be rejected whole, got %v spent", bt.TotalSpent())
+		}
+	})
+}
+
+func BenchmarkBudgetTracker_AddSpend(b *testing.B) {
+	const batchSize = 64
+	entries := make([]SpendEntry, batchSize)
+	for i := range entries {
+		entries[i] = SpendEntry{SessionID: fmt.Sprintf("session-%d", i%8), Amount: 0.001}
+	}
+
+	b.Run("individual", func(b *testing.B) {
+		bt := NewBudgetTracker(&BudgetConfig{})
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				for _, entry := range entries {
+					_ = bt.AddSpend(entry.SessionID, entry.Amount)
+				}
+			}
+		})
+	})
+	b.Run("batch", func(b *testing.B) {
+		bt := NewBudgetTracker(&BudgetConfig{})
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				_ = bt.AddSpendBatch(entries)
+			}
+		})
+	})
+}
+
+func TestRunPrompt_CostSource(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	jsonOutput := `{"type":"result","subtype":"success","total_cost_usd":0.25,"num_turns":1,"result":"ok","session_id":"cost-session"}`
+	client := &ClaudeClient{BinPath: "claude"}
+	run := func(opts *RunOptions) (*ClaudeResult, error) {
+		execCommand = mockExecCommandContext(t, []string{"-p", "Price it", "--output-format", "json"}, jsonOutput, 0)
+		opts.Format = JSONOutput
+		return client.RunPromptCtx(context.Background(), "Price it", opts)
+	}
+
+	t.Run("defaults to reported cost", func(t *testing.T) {
+		tracker := NewBudgetTracker(&BudgetConfig{})
+		if _, err := run(&RunOptions{BudgetTracker: tracker}); err != nil {
+			t.Fatalf("RunPromptCtx() error = %v", err)
+		}
+		if tracker.SessionSpent("cost-session") != 0.25 {
+			t.Errorf("SessionSpent() = %v, want 0.25", tracker.SessionSpent("cost-session"))
+		}
+	})
+
+	t.Run("custom source doubles cost", func(t *testing.T) {
+		tracker := NewBudgetTracker(&BudgetConfig{})
+		double := func(result *ClaudeResult) float64 { return result.CostUSD * 2 }
+		if _, err := run(&RunOptions{BudgetTracker: tracker, CostSource: double}); err != nil {
+			t.Fatalf("RunPromptCtx() error = %v", err)
+		}
+		if tracker.TotalSpent() != 0.5 {
+			t.Errorf("TotalSpent() = %v, want 0.5", tracker.TotalSpent())
+		}
+	})
+
+	t.Run("exceeded budget still returns result", func(t *testing.T) {
+		tracker := NewBudgetTracker(&BudgetConfig{MaxBudgetUSD: 0.3})
+		double := func(result *ClaudeResult) float64 { return result.CostUSD * 2 }
+		result, err := run(&RunOptions{BudgetTracker: tracker, CostSource: double})
+		if !errors.Is(err, ErrBudgetExceeded) {
+			t.Errorf("RunPromptCtx() error = %v, want ErrBudgetExceeded", err)
+		}
+		if result == nil || result.Result != "ok" {
+			t.Errorf("expected result alongside budget error, got %+v", result)
+		}
+	})
+
+	t.Run("stdin runs are charged", func(t *testing.T) {
+		execCommand = mockExecCommandContext(t, []string{"-p", "Price it", "--output-format", "json"}, jsonOutput, 0)
+		tracker := NewBudgetTracker(&BudgetConfig{MaxBudgetUSD: 0.3})
+		double := func(result *ClaudeResult) float64 { return result.CostUSD * 2 }
+		opts := &RunOptions{Format: JSONOutput, BudgetTracker: tracker, CostSource: double}
+		result, err := client.RunFromStdinCtx(context.Background(), strings.NewReader("input"), "Price it", opts)
+		if !errors.Is(err, ErrBudgetExceeded) || result == nil {
+			t.Errorf("expected the result alongside ErrBudgetExceeded, got %+v, %v", result, err)
+		}
+		if tracker.SessionSpent("cost-session") != 0.5 {
+			t.Errorf("SessionSpent() = %v, want 0.5", tracker.SessionSpent("cost-session"))
+		}
+	})
+
+	t.Run("streams are charged", func(t *testing.T) {
+		command, _ := mockStreamCommand(streamScript{lines: []string{jsonOutput}})
+		execCommand = command
+		tracker := NewBudgetTracker(&BudgetConfig{MaxBudgetUSD: 0.2})
+		messages, err := collectStream(client.StreamPrompt(context.Background(), "Price it", &RunOptions{BudgetTracker: tracker}))
+		var cause *CancelCause
+		if !errors.As(err, &cause) || cause.Reason != CancelBudget {
+			t.Errorf("expected a CancelBudget cause after the result, got %v", err)
+		}
+		if len(messages) != 1 || messages[0].Type != "result" {
+			t.Errorf("expected the result to be delivered before the budget error, got %+v", messages)
+		}
+		if tracker.SessionSpent("cost-session") != 0.25 {
+			t.Errorf("SessionSpent() = %v, want 0.25", tracker.SessionSpent("cost-session"))
+		}
+	})
+}
+
+func TestBudgetDowngrade(t *testing.T) {
+	tracker := NewBudgetTracker(&BudgetConfig{MaxBudgetUSD: 10.0})
+	defer tracker.Close()
+	downgrade := map[float64]string{5.0: "sonnet", 1.0: "haiku"}
+
+	argsFor := func() []string {
+		opts := &RunOptions{ModelAlias: "opus", BudgetTracker: tracker, BudgetDowngrade: downgrade}
+		if err := PreprocessOptions(opts); err != nil {
+			t.Fatalf("PreprocessOptions() error = %v", err)
+		}
+		return BuildArgs("", budgetAdjusted(opts))
+	}
+
+	steps := []struct {
+		spend float64
+		model string
+	}{
+		{2.0, "opus"},   // $8 remaining
+		{4.0, "sonnet"}, // $4 remaining
+		{3.5, "haiku"},  // $0.50 remaining
+	}
+	for _, step := range steps {
+		_ = tracker.AddSpend("session", step.spend)
+		if args := argsFor(); !containsFlag(args, "--model", step.model) {
+			t.Errorf("after spending %.2f expected --model %s, got %v", tracker.TotalSpent(), step.model, args)
+		}
+	}
+
+	t.Run("unlimited budget", func(t *testing.T) {
+		unlimited := NewBudgetTracker(&BudgetConfig{})
+		defer unlimited.Close()
+		opts := &RunOptions{ModelAlias: "opus", BudgetTracker: unlimited, BudgetDowngrade: downgrade}
+		if err := PreprocessOptions(opts); err != nil || budgetAdjusted(opts).ModelAlias != "opus" {
+			t.Errorf("expected no downgrade without a limit, got %q, %v", budgetAdjusted(opts).ModelAlias, err)
+		}
+	})
+
+	t.Run("per run", func(t *testing.T) {
+		originalExecCommand := execCommand
+		defer func() { execCommand = originalExecCommand }()
+
+		low := NewBudgetTracker(&BudgetConfig{MaxBudgetUSD: 10.0})
+		defer low.Close()
+		_ = low.AddSpend("session", 9.5)
+
+		client := NewClient("claude")
+		client.DefaultOptions.Model = "claude-opus-4-1"
+		client.DefaultOptions.BudgetTracker = low
+		client.DefaultOptions.BudgetDowngrade = downgrade
+
+		execCommand = mockExecCommandContext(t, []string{"-p", "Hi", "--output-format", "text", "--model", "haiku"}, "Hello", 0)
+		if _, err := client.RunPrompt("Hi", nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if client.DefaultOptions.Model != "claude-opus-4-1" || client.DefaultOptions.ModelAlias != "" {
+			t.Errorf("expected the client defaults to be left untouched, got %q / %q", client.DefaultOptions.Model, client.DefaultOptions.ModelAlias)
+		}
+
+		command, calls := mockStreamCommand(streamScript{lines: []string{`{"type":"result","result":"Hello","session_id":"s"}`}})
+		execCommand = command
+		if _, err := collectStream(client.StreamPrompt(context.Background(), "Hi", nil)); err != nil {
+			t.Fatalf("unexpected stream error: %v", err)
+		}
+		if args := calls(); len(args) != 1 || !containsFlag(args[0], "--model", "haiku") {
+			t.Errorf("expected streams to be downgraded too, got %v", args)
+		}
+	})
+
+	t.Run("invalid alias", func(t *testing.T) {
+		opts := &RunOptions{BudgetTracker: tracker, BudgetDowngrade: map[float64]string{1.0: "gpt"}}
+		if err := PreprocessOptions(opts); err == nil {
+			t.Error("expected validation error for an unknown alias")
+		}
+	})
+}
+
+func TestBudgetPlanThreshold(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() { execCommand = originalExecCommand }()
+
+	tracker := NewBudgetTracker(&BudgetConfig{MaxBudgetUSD: 10.0})
+	defer tracker.Close()
+
+	client := NewClient("claude")
+	client.DefaultOptions.PermissionMode = PermissionModeAcceptEdits
+	client.DefaultOptions.BudgetTracker = tracker
+	client.DefaultOptions.BudgetPlanThreshold = 1.0
+
+	// planned runs a prompt and a stream and reports whether each was started in plan mode
+	planned := func() (run, stream bool) {
+		t.Helper()
+		command, calls := mockStreamCommand(streamScript{lines: []string{`{"type":"result","result":"Plan","session_id":"s"}`}})
+		execCommand = command
+		if _, err := client.RunPrompt("Fix the bug", nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := collectStream(client.StreamPrompt(context.Background(), "Fix the bug", nil)); err != nil {
+			t.Fatalf("unexpected stream error: %v", err)
+		}
+		args := calls()
+		return containsFlag(args[0], "--permission-mode", "plan"), containsFlag(args[1], "--permission-mode", "plan")
+	}
+
+	_ = tracker.AddSpend("session", 8.5) // $1.50 remaining
+	if run, stream := planned(); run || stream {
+		t.Errorf("expected no plan mode with budget to spare, got run %v and stream %v", run, stream)
+	}
+
+	_ = tracker.AddSpend("session", 1.0) // $0.50 remaining
+	if run, stream := planned(); !run || !stream {
+		t.Errorf("expected plan mode once the remaining budget is low, got run %v and stream %v", run, stream)
+	}
+	if client.DefaultOptions.PermissionMode != PermissionModeAcceptEdits {
+		t.Errorf("expected the client defaults to be left untouched, got %q", client.DefaultOptions.PermissionMode)
+	}
+
+	tracker.Reset()
+	if run, stream := planned(); run || stream {
+		t.Errorf("expected plan mode to end once the budget is restored, got run %v and stream %v", run, stream)
+	}
+
+	t.Run("unlimited budget", func(t *testing.T) {
+		unlimited := NewBudgetTracker(&BudgetConfig{})
+		defer unlimited.Close()
+		opts := &RunOptions{BudgetTracker: unlimited, BudgetPlanThreshold: 1.0}
+		if budgetAdjusted(opts).PermissionMode == PermissionModePlan {
+			t.Error("expected no plan mode without a limit")
+		}
+	})
+
+	t.Run("negative threshold", func(t *testing.T) {
+		if err := PreprocessOptions(&RunOptions{BudgetPlanThreshold: -1}); err == nil {
+			t.Error("expected validation error for a negative threshold")
+		}
+	})
+}
+
+// containsFlag reports whether args contains flag immediately followed by value
+func containsFlag(args []string, flag, value string) bool {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == flag && args[i+1] == value {
+			return true
+		}
+	}
+	return false
+}
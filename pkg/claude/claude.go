@@ -4,13 +4,22 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"math"
+	"os"
 	"os/exec"
+	"reflect"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 // execCommand is a variable to allow mocking of exec.CommandContext for testing
@@ -34,6 +43,9 @@ type ClaudeClient struct {
 	BinPath string
 	// DefaultOptions are the default options to use for all requests
 	DefaultOptions *RunOptions
+
+	// middleware wraps RunPromptCtx and StreamPrompt; see Use
+	middleware []RunMiddleware
 }
 
 // RunOptions configures how Claude Code is executed
@@ -46,22 +58,40 @@ type RunOptions struct {
 	AppendPrompt string
 	// MCPConfigPath is the path to the MCP configuration file
 	MCPConfigPath string
+	// MCPConfig is an inline alternative to MCPConfigPath
+	// It is written to a temporary file for the duration of each run; set one or the other, not both
+	MCPConfig *MCPConfig
 	// AllowedTools is a list of tools that Claude is allowed to use
 	// Supports both legacy format ("Bash") and enhanced format ("Bash(git log:*)")
 	AllowedTools []string
 	// DisallowedTools is a list of tools that Claude is not allowed to use
 	// Supports both legacy format ("Bash") and enhanced format ("Bash(git log:*)")
 	DisallowedTools []string
+	// KnownTools enables strict validation of AllowedTools and DisallowedTools names
+	// Use BuiltinTools plus any custom tools; MCP tools are always accepted if well-formed
+	KnownTools []string `json:"-"`
+	// AdditionalDirs grants the CLI access to directories outside the working directory
+	// Each entry is passed as --add-dir and must be an existing directory
+	AdditionalDirs []string
 	// PermissionTool is the MCP tool for handling permission prompts
 	PermissionTool string
 	// ResumeID is the session ID to resume
 	ResumeID string
 	// Continue indicates whether to continue the most recent conversation
 	Continue bool
+	// AutoResume resumes the session automatically when a stream ends before its result message
+	// Only applies to StreamPrompt; resume attempts are capped, and messages the resumed session
+	// replays are delivered only once
+	AutoResume bool
+	// StreamBufferSize sets the capacity of the StreamPrompt message channel so slow consumers
+	// don't stall output parsing; 0 uses defaultStreamBufferSize and a negative value disables buffering
+	StreamBufferSize int
 	// MaxTurns limits the number of agentic turns in non-interactive mode
 	MaxTurns int
 	// Verbose enables verbose logging
 	Verbose bool
+	// IncludePartialMessages streams incremental "stream_event" messages while a response is generated
+	IncludePartialMessages bool
 	// Model specifies the model to use (full model name)
 	Model string
 
@@ -70,6 +100,49 @@ type RunOptions struct {
 	ModelAlias string
 	// Timeout specifies the maximum duration for command execution
 	Timeout time.Duration
+	// IncludeThinking keeps extended thinking blocks in streamed assistant messages
+	// By default they are stripped, and messages carrying only thinking are not emitted
+	IncludeThinking bool
+	// MessageFilter drops streamed messages it returns false for before they reach the channel
+	// Permission checks, tool timeouts and OnComplete still see every message
+	MessageFilter func(Message) bool `json:"-"`
+	// FilterPluginMessages also withholds messages dropped by MessageFilter from plugin OnMessage hooks
+	// By default plugins observe the full stream
+	FilterPluginMessages bool
+	// AbortPatterns stops a streaming run when assistant text matches any of the expressions,
+	// e.g. a leaked secret or a model announcing it is stuck; the run returns an *AbortPatternError
+	// The matching message is not delivered
+	AbortPatterns []*regexp.Regexp `json:"-"`
+	// IdleTimeout aborts a streaming run when no message arrives from the CLI for this long (0 = disabled)
+	// Unlike Timeout it restarts with every message, so it catches stuck runs without capping long ones
+	IdleTimeout time.Duration
+	// ToolTimeouts bounds how long individual tools may run, keyed by tool name
+	// A streamed tool call that overruns its timeout aborts the run
+	ToolTimeouts map[string]time.Duration `json:"-"`
+	// DefaultToolTimeout applies to tools without an entry in ToolTimeouts (0 = unlimited)
+	DefaultToolTimeout time.Duration
+	// ToolRetry re-issues failed calls of flaky tools up to the given number of times, keyed by tool name
+	// Only applies to StreamPrompt: retries re-prompt a resumed session rather than replaying the call.
+	// The model and the message channel have already seen the failed tool_result; the run is then stopped,
+	// the session resumed and Claude asked to repeat the call, so consumers receive the failure followed by
+	// the retried call. Plugins only see OnToolResult for the final attempt
+	// Destructive tools (Bash, Write, Edit, MultiEdit, NotebookEdit) are skipped unless RetryDestructiveTools is set,
+	// and a run is resumed for retries at most 10 times in total
+	ToolRetry map[string]int `json:"-"`
+	// RetryDestructiveTools lets ToolRetry re-issue destructive tools
+	RetryDestructiveTools bool
+	// CaptureStderr surfaces the CLI's stderr on ClaudeResult.Stderr and ClaudeError.Stderr
+	// Captured output is bounded to the most recent maxCapturedStderr bytes
+	CaptureStderr bool
+	// DisablePromptCache turns off the CLI's automatic prompt caching via DISABLE_PROMPT_CACHING
+	// Cache activity is reported on ClaudeResult.Usage
+	DisablePromptCache bool
+	// MaxOutputTokens caps the tokens generated in a single turn via CLAUDE_CODE_MAX_OUTPUT_TOKENS (0 = CLI default)
+	// Runs that hit the cap have ClaudeResult.OutputTruncated set
+	MaxOutputTokens int
+	// MaxResultBytes caps the size of the final result text (0 = unlimited)
+	// Truncated results have ClaudeResult.Truncated set
+	MaxResultBytes int
 	// ConfigFile specifies path to Claude configuration file
 	ConfigFile string
 	// Help shows help information
@@ -87,6 +160,21 @@ type RunOptions struct {
 	// PermissionCallback is called before each tool use to determine permission
 	// If nil, default behavior based on PermissionMode is used
 	PermissionCallback PermissionCallback `json:"-"`
+	// DefaultPermission applies to tool calls when PermissionCallback is nil and PermissionMode is default
+	// Empty means PermissionAllow; PermissionDeny gives a deny-by-default posture without a callback
+	DefaultPermission PermissionBehavior
+	// RecordTo receives every raw stream-json line read from the CLI during streaming runs,
+	// producing a transcript that ClaudeClient.Replay can play back
+	RecordTo io.Writer `json:"-"`
+	// ToolCallDenyMode controls whether a plugin rejecting a tool call in OnToolCall aborts the run
+	// (AbortRun, the default) or only denies that call (DenyTool)
+	ToolCallDenyMode ToolCallDenyMode
+	// ToolSchemas maps tool names to JSON schemas their input must match
+	// Non-conforming tool calls are denied before the permission callback runs; checkSchema's keyword subset applies
+	ToolSchemas map[string]string
+	// StrictPermissions turns conflicting permission settings, such as bypassPermissions combined
+	// with a PermissionCallback or AllowedTools, into a validation error instead of a logged warning
+	StrictPermissions bool
 
 	// MaxBudgetUSD sets the maximum spending limit in USD
 	// Execution stops if this limit is exceeded
@@ -94,6 +182,18 @@ type RunOptions struct {
 	// BudgetTracker tracks cumulative spending across sessions
 	// If nil, a new tracker is created for each execution
 	BudgetTracker *BudgetTracker `json:"-"`
+	// LatencyTracker records the end-to-end duration of each run, successful or not
+	LatencyTracker *RunLatencyTracker `json:"-"`
+	// CostSource computes the amount charged to BudgetTracker for a finished run
+	// If nil, the CLI's reported CostUSD is used
+	CostSource func(result *ClaudeResult) float64 `json:"-"`
+	// BudgetDowngrade maps remaining-budget thresholds in USD to cheaper model aliases
+	// Before each run the lowest threshold above BudgetTracker's remaining budget selects the model,
+	// e.g. {1.0: "haiku"} switches to haiku once less than $1 remains
+	BudgetDowngrade map[float64]string `json:"-"`
+	// BudgetPlanThreshold runs in plan mode while BudgetTracker's remaining budget is
+	// below this many USD, so a run close to the limit still produces a plan instead of failing
+	BudgetPlanThreshold float64 `json:"-"`
 
 	// Agents defines specialized sub-agents that can be invoked by the main agent
 	// Each agent has its own description, prompt, allowed tools, and model
@@ -121,6 +221,178 @@ type ClaudeResult struct {
 	IsError       bool    `json:"is_error"`
 	NumTurns      int     `json:"num_turns"`
 	SessionID     string  `json:"session_id"`
+	// Truncated is set when Result was cut to RunOptions.MaxResultBytes
+	Truncated bool `json:"truncated,omitempty"`
+	// Stderr holds the CLI's stderr when RunOptions.CaptureStderr is enabled
+	Stderr string `json:"stderr,omitempty"`
+	// Metrics holds the output of a MetricsPlugin attached to the run, if any
+	Metrics map[string]interface{} `json:"metrics,omitempty"`
+	// Usage holds the token counts reported by the CLI, including prompt cache activity
+	Usage *Usage `json:"usage,omitempty"`
+	// StopReason is the reason generation stopped, e.g. "end_turn" or "max_tokens"
+	StopReason string `json:"stop_reason,omitempty"`
+	// MaxOutputTokens is the RunOptions.MaxOutputTokens cap the run was started with
+	MaxOutputTokens int `json:"max_output_tokens,omitempty"`
+	// OutputTruncated is set when generation stopped at MaxOutputTokens
+	OutputTruncated bool `json:"output_truncated,omitempty"`
+	// EffectiveOptions is a sanitized copy of the options the run was executed with, for logging and audit
+	// See EffectiveOptions for what is removed
+	EffectiveOptions *RunOptions `json:"effective_options,omitempty"`
+}
+
+// Usage reports token consumption for a run
+type Usage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+}
+
+// commandError converts a failed CLI invocation into a *ClaudeError classified from stderr
+// A non-zero exit is wrapped in an *ExitError; other failures (e.g. the binary could not start) count as code 1
+func commandError(err error, stderr string, opts *RunOptions) *ClaudeError {
+	exitCode := 1
+	original := err
+	if exitError, ok := err.(*exec.ExitError); ok {
+		exitCode = exitError.ExitCode()
+		original = &ExitError{Code: exitCode, Stderr: capturedStderr(stderr), Err: err}
+	}
+
+	claudeErr := ParseError(stderr, exitCode)
+	claudeErr.Original = original
+	if opts.CaptureStderr {
+		claudeErr.Stderr = capturedStderr(stderr)
+	}
+	return claudeErr
+}
+
+// maxCapturedStderr bounds the stderr kept by CaptureStderr
+const maxCapturedStderr = 64 * 1024
+
+// capturedStderr returns stderr bounded to its last maxCapturedStderr bytes,
+// since the most recent diagnostics are usually the ones explaining a failure
+func capturedStderr(stderr string) string {
+	if len(stderr) <= maxCapturedStderr {
+		return stderr
+	}
+	tail := stderr[len(stderr)-maxCapturedStderr:]
+	for len(tail) > 0 && !utf8.RuneStart(tail[0]) {
+		tail = tail[1:]
+	}
+	return "...(truncated)\n" + tail
+}
+
+// truncate cuts Result to at most maxBytes without splitting a UTF-8 character
+// Cost and turn metadata are left intact; maxBytes <= 0 means unlimited
+func (r *ClaudeResult) truncate(maxBytes int) {
+	if maxBytes <= 0 || len(r.Result) <= maxBytes {
+		return
+	}
+	r.Result = truncateUTF8(r.Result, maxBytes)
+	r.Truncated = true
+}
+
+// truncateUTF8 cuts s to at most maxBytes, backing off to the start of a UTF-8 character
+func truncateUTF8(s string, maxBytes int) string {
+	if len(s) <= maxBytes {
+		return s
+	}
+	cut := maxBytes
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut]
+}
+
+// Clone returns a deep copy of the result, so it can be handed out without sharing Usage, Metrics or EffectiveOptions
+func (r *ClaudeResult) Clone() *ClaudeResult {
+	if r == nil {
+		return nil
+	}
+
+	clone := *r
+	if r.Usage != nil {
+		usage := *r.Usage
+		clone.Usage = &usage
+	}
+	if r.Metrics != nil {
+		clone.Metrics = deepCopyValue(r.Metrics).(map[string]interface{})
+	}
+	clone.EffectiveOptions = copyOptionData(r.EffectiveOptions)
+	return &clone
+}
+
+// deepCopyValue copies the maps and slices of a JSON-like value; other values are returned as-is
+func deepCopyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			copied[key] = deepCopyValue(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = deepCopyValue(item)
+		}
+		return copied
+	case map[string]int:
+		copied := make(map[string]int, len(v))
+		for key, item := range v {
+			copied[key] = item
+		}
+		return copied
+	case map[string]float64:
+		copied := make(map[string]float64, len(v))
+		for key, item := range v {
+			copied[key] = item
+		}
+		return copied
+	case []string:
+		return append([]string(nil), v...)
+	default:
+		return value
+	}
+}
+
+// applyOutputCap records the output token cap and whether generation stopped because of it
+func (r *ClaudeResult) applyOutputCap(maxTokens int) {
+	if maxTokens <= 0 {
+		return
+	}
+	r.MaxOutputTokens = maxTokens
+	r.OutputTruncated = r.StopReason == "max_tokens" || (r.Usage != nil && r.Usage.OutputTokens >= maxTokens)
+}
+
+// warnf is a variable to allow capturing configuration warnings in tests
+var warnf = log.Printf
+
+// costPrecision is the number of decimal places used by FormatCost
+var costPrecision = 4
+
+// SetCostPrecision sets the number of decimal places used when formatting costs
+// Negative values are treated as zero
+func SetCostPrecision(n int) {
+	if n < 0 {
+		n = 0
+	}
+	costPrecision = n
+}
+
+// Duration returns the run's total wall-clock time as reported by the CLI in DurationMS
+func (r *ClaudeResult) Duration() time.Duration {
+	return time.Duration(r.DurationMS) * time.Millisecond
+}
+
+// APIDuration returns the time the run spent waiting on the API, as reported by the CLI in DurationAPIMS
+func (r *ClaudeResult) APIDuration() time.Duration {
+	return time.Duration(r.DurationAPIMS) * time.Millisecond
+}
+
+// FormatCost renders the cost in USD with a "$" prefix (e.g., "$0.0123")
+func (r *ClaudeResult) FormatCost() string {
+	return fmt.Sprintf("$%.*f", costPrecision, r.CostUSD)
 }
 
 // Message represents a message from Claude Code in streaming mode
@@ -129,6 +401,8 @@ type Message struct {
 	Subtype   string          `json:"subtype,omitempty"`
 	Message   json.RawMessage `json:"message,omitempty"`
 	SessionID string          `json:"session_id"`
+	// UUID identifies the message; a resumed session replays earlier messages with their original UUIDs
+	UUID string `json:"uuid,omitempty"`
 	// Additional fields for system/result messages
 	CostUSD       float64  `json:"total_cost_usd,omitempty"`
 	DurationMS    int64    `json:"duration_ms,omitempty"`
@@ -137,6 +411,7 @@ type Message struct {
 	NumTurns      int      `json:"num_turns,omitempty"`
 	Result        string   `json:"result,omitempty"`
 	Tools         []string `json:"tools,omitempty"`
+	Usage         *Usage   `json:"usage,omitempty"`
 	MCPServers    []struct {
 		Name   string `json:"name"`
 		Status string `json:"status"`
@@ -149,11 +424,15 @@ type Message struct {
 
 	// Sub-agent fields (for system subtype="subagent_start"/"subagent_end")
 	AgentName   string `json:"agent_name,omitempty"`
-	AgentType   string `json:"agent_type,omitempty"`   // e.g., "Explore", "Plan", "general-purpose"
+	AgentType   string `json:"agent_type,omitempty"`  // e.g., "Explore", "Plan", "general-purpose"
 	Description string `json:"description,omitempty"` // Task description
 
-	// Permission request fields (for type="permission_request" messages)
-	// These are emitted when PermissionCallback returns PermissionAsk
+	// Event is the raw API event of a type="stream_event" message, emitted with IncludePartialMessages
+	Event json.RawMessage `json:"event,omitempty"`
+
+	// Permission request fields (for type="permission_request" and type="tool_denied" messages)
+	// permission_request is emitted when PermissionCallback returns PermissionAsk;
+	// tool_denied when a plugin rejects a tool call under ToolCallDenyMode DenyTool
 	PermissionMessage string            `json:"permission_message,omitempty"`
 	PermissionResult  *PermissionResult `json:"permission_result,omitempty"`
 }
@@ -167,6 +446,148 @@ type ToolUseMessage struct {
 	SessionID string                 `json:"session_id"`
 }
 
+// toolUse is a tool invocation extracted from a streamed message
+type toolUse struct {
+	ID    string
+	Name  string
+	Input map[string]interface{}
+}
+
+// extractToolUses returns the tool invocations carried by a streamed message
+// Both "tool_use" messages and assistant messages with tool_use content blocks are supported
+func extractToolUses(msg Message) []toolUse {
+	if msg.Type == "tool_use" && msg.ToolName != "" {
+		return []toolUse{{ID: msg.ToolID, Name: msg.ToolName, Input: msg.ToolInput}}
+	}
+	if msg.Type != "assistant" || len(msg.Message) == 0 {
+		return nil
+	}
+
+	var body struct {
+		Content []struct {
+			Type  string                 `json:"type"`
+			ID    string                 `json:"id"`
+			Name  string                 `json:"name"`
+			Input map[string]interface{} `json:"input"`
+		} `json:"content"`
+	}
+	if err := json.Unmarshal(msg.Message, &body); err != nil {
+		return nil
+	}
+
+	var uses []toolUse
+	for _, block := range body.Content {
+		if block.Type == "tool_use" {
+			uses = append(uses, toolUse{ID: block.ID, Name: block.Name, Input: block.Input})
+		}
+	}
+	return uses
+}
+
+// withoutThinking strips thinking blocks from a streamed assistant message
+// It reports false when nothing but thinking was left, in which case the message should be dropped
+func withoutThinking(msg Message) (Message, bool) {
+	if msg.Type != "assistant" || !bytes.Contains(msg.Message, []byte("thinking")) {
+		return msg, true
+	}
+
+	var body map[string]json.RawMessage
+	var content []json.RawMessage
+	if err := json.Unmarshal(msg.Message, &body); err != nil {
+		return msg, true
+	}
+	if err := json.Unmarshal(body["content"], &content); err != nil {
+		return msg, true
+	}
+
+	kept := make([]json.RawMessage, 0, len(content))
+	for _, block := range content {
+		var header struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(block, &header); err == nil && (header.Type == "thinking" || header.Type == "redacted_thinking") {
+			continue
+		}
+		kept = append(kept, block)
+	}
+	if len(kept) == len(content) {
+		return msg, true
+	}
+	if len(kept) == 0 {
+		return msg, false
+	}
+
+	body["content"], _ = json.Marshal(kept)
+	stripped, err := json.Marshal(body)
+	if err != nil {
+		return msg, true
+	}
+	msg.Message = stripped
+	return msg, true
+}
+
+// toolResult is the outcome of a tool invocation reported back in a streamed message
+type toolResult struct {
+	ToolUseID string
+	Output    string
+	IsError   bool
+}
+
+// extractToolResults returns the tool results carried by a streamed user message
+func extractToolResults(msg Message) []toolResult {
+	if msg.Type != "user" || len(msg.Message) == 0 {
+		return nil
+	}
+
+	var body struct {
+		Content []struct {
+			Type      string          `json:"type"`
+			ToolUseID string          `json:"tool_use_id"`
+			Content   json.RawMessage `json:"content"`
+			IsError   bool            `json:"is_error"`
+		} `json:"content"`
+	}
+	if err := json.Unmarshal(msg.Message, &body); err != nil {
+		return nil
+	}
+
+	var results []toolResult
+	for _, block := range body.Content {
+		if block.Type != "tool_result" {
+			continue
+		}
+		results = append(results, toolResult{
+			ToolUseID: block.ToolUseID,
+			Output:    toolResultText(block.Content),
+			IsError:   block.IsError,
+		})
+	}
+	return results
+}
+
+// toolResultText flattens tool result content, which is either a string or a list of text blocks
+func toolResultText(content json.RawMessage) string {
+	var text string
+	if err := json.Unmarshal(content, &text); err == nil {
+		return text
+	}
+
+	var blocks []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(content, &blocks); err != nil {
+		return ""
+	}
+	parts := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		if block.Type == "text" {
+			parts = append(parts, block.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
 // ParseToolInput converts a raw tool input map to a structured ToolInput
 func ParseToolInput(raw map[string]interface{}) ToolInput {
 	input := ToolInput{Raw: raw}
@@ -242,6 +663,16 @@ func PreprocessOptions(opts *RunOptions) error {
 		}
 	}
 
+	// Validate tool names against the known tools
+	if len(opts.KnownTools) > 0 {
+		if err := ValidateToolPermissionsStrict(opts.AllowedTools, opts.KnownTools); err != nil {
+			return NewValidationError(err.Error(), "AllowedTools", opts.AllowedTools)
+		}
+		if err := ValidateToolPermissionsStrict(opts.DisallowedTools, opts.KnownTools); err != nil {
+			return NewValidationError(err.Error(), "DisallowedTools", opts.DisallowedTools)
+		}
+	}
+
 	// Validate model alias
 	if opts.ModelAlias != "" {
 		if !isValidModelAlias(opts.ModelAlias) {
@@ -249,221 +680,1112 @@ func PreprocessOptions(opts *RunOptions) error {
 		}
 	}
 
-	// Validate timeout
-	if opts.Timeout < 0 {
-		return NewValidationError("Timeout cannot be negative", "Timeout", opts.Timeout)
+	// Validate timeout
+	if opts.Timeout < 0 {
+		return NewValidationError("Timeout cannot be negative", "Timeout", opts.Timeout)
+	}
+	if opts.MaxOutputTokens < 0 {
+		return NewValidationError("MaxOutputTokens cannot be negative", "MaxOutputTokens", opts.MaxOutputTokens)
+	}
+	if opts.MaxResultBytes < 0 {
+		return NewValidationError("MaxResultBytes cannot be negative", "MaxResultBytes", opts.MaxResultBytes)
+	}
+	if opts.IdleTimeout < 0 {
+		return NewValidationError("IdleTimeout cannot be negative", "IdleTimeout", opts.IdleTimeout)
+	}
+	if opts.DefaultToolTimeout < 0 {
+		return NewValidationError("DefaultToolTimeout cannot be negative", "DefaultToolTimeout", opts.DefaultToolTimeout)
+	}
+	for tool, timeout := range opts.ToolTimeouts {
+		if timeout < 0 {
+			return NewValidationError(fmt.Sprintf("Timeout for tool %s cannot be negative", tool), "ToolTimeouts", timeout)
+		}
+	}
+	for tool, retries := range opts.ToolRetry {
+		if retries < 0 {
+			return NewValidationError(fmt.Sprintf("Retries for tool %s cannot be negative", tool), "ToolRetry", retries)
+		}
+	}
+
+	switch opts.ToolCallDenyMode {
+	case "", AbortRun, DenyTool:
+	default:
+		return NewValidationError("Invalid tool call deny mode", "ToolCallDenyMode", opts.ToolCallDenyMode)
+	}
+
+	switch opts.DefaultPermission {
+	case "", PermissionAllow, PermissionDeny, PermissionAsk:
+	default:
+		return NewValidationError("Invalid default permission", "DefaultPermission", opts.DefaultPermission)
+	}
+
+	if opts.MCPConfig != nil {
+		if opts.MCPConfigPath != "" {
+			return NewValidationError("MCPConfig and MCPConfigPath cannot both be set", "MCPConfig", opts.MCPConfigPath)
+		}
+		if err := opts.MCPConfig.Validate(); err != nil {
+			return NewValidationError(err.Error(), "MCPConfig", opts.MCPConfig)
+		}
+	}
+
+	for tool, schema := range opts.ToolSchemas {
+		if _, err := parseToolSchema(schema); err != nil {
+			return NewValidationError(fmt.Sprintf("Invalid schema for tool %s: %v", tool, err), "ToolSchemas", tool)
+		}
+	}
+
+	if conflict := permissionConflict(opts); conflict != "" {
+		if opts.StrictPermissions {
+			return NewValidationError(conflict, "PermissionMode", opts.PermissionMode)
+		}
+		warnConflictOnce(opts, conflict)
+	}
+
+	for _, dir := range opts.AdditionalDirs {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return NewValidationError(fmt.Sprintf("Additional directory %s is not accessible: %v", dir, err), "AdditionalDirs", dir)
+		}
+		if !info.IsDir() {
+			return NewValidationError(fmt.Sprintf("Additional directory %s is not a directory", dir), "AdditionalDirs", dir)
+		}
+	}
+
+	for threshold, alias := range opts.BudgetDowngrade {
+		if threshold <= 0 {
+			return NewValidationError("Budget downgrade threshold must be positive", "BudgetDowngrade", threshold)
+		}
+		if !isValidModelAlias(alias) {
+			return NewValidationError("Invalid model alias", "BudgetDowngrade", alias)
+		}
+	}
+	if opts.BudgetPlanThreshold < 0 {
+		return NewValidationError("Budget plan threshold cannot be negative", "BudgetPlanThreshold", opts.BudgetPlanThreshold)
+	}
+
+	// Validate session ID format if provided
+	if opts.ResumeID != "" {
+		if !isValidSessionID(opts.ResumeID) {
+			return NewValidationError("Invalid session ID format", "ResumeID", opts.ResumeID)
+		}
+	}
+
+	// Validate subagent configurations
+	if len(opts.Agents) > 0 {
+		for name, agent := range opts.Agents {
+			if agent == nil {
+				return NewValidationError("Subagent config cannot be nil", "Agents", name)
+			}
+			if err := agent.Validate(); err != nil {
+				return NewValidationError(fmt.Sprintf("Invalid subagent '%s': %v", name, err), "Agents", name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// permissionConflict describes permission settings that contradict each other, or returns ""
+func permissionConflict(opts *RunOptions) string {
+	if opts.PermissionMode != PermissionModeBypassPermissions {
+		return ""
+	}
+	switch {
+	case opts.PermissionCallback != nil && len(opts.AllowedTools) > 0:
+		return "PermissionMode is bypassPermissions but PermissionCallback and AllowedTools still restrict tool calls"
+	case opts.PermissionCallback != nil:
+		return "PermissionMode is bypassPermissions but PermissionCallback still decides every tool call"
+	case len(opts.AllowedTools) > 0:
+		return "PermissionMode is bypassPermissions but AllowedTools still restricts the available tools"
+	}
+	return ""
+}
+
+// warnedConflicts remembers the permission conflicts already reported by warnConflictOnce, oldest first in order
+var warnedConflicts = struct {
+	sync.Mutex
+	keys  map[string]bool
+	order []string
+}{keys: make(map[string]bool)}
+
+// maxWarnedConflicts bounds the conflicts remembered by warnConflictOnce; the oldest is forgotten first
+const maxWarnedConflicts = 1000
+
+// warnConflictOnce reports a permission conflict the first time it is seen for a given callback and tool list,
+// so options reused across runs, or inherited by every subagent run, do not repeat the warning
+func warnConflictOnce(opts *RunOptions, conflict string) {
+	var callback uintptr
+	if opts.PermissionCallback != nil {
+		callback = reflect.ValueOf(opts.PermissionCallback).Pointer()
+	}
+	key := fmt.Sprintf("%s|%x|%s", conflict, callback, strings.Join(opts.AllowedTools, ","))
+
+	warnedConflicts.Lock()
+	seen := warnedConflicts.keys[key]
+	if !seen {
+		if len(warnedConflicts.order) >= maxWarnedConflicts {
+			delete(warnedConflicts.keys, warnedConflicts.order[0])
+			warnedConflicts.order = warnedConflicts.order[1:]
+		}
+		warnedConflicts.keys[key] = true
+		warnedConflicts.order = append(warnedConflicts.order, key)
+	}
+	warnedConflicts.Unlock()
+	if !seen {
+		warnf("claude: warning: %s", conflict)
+	}
+}
+
+// isValidModelAlias checks if the model alias is supported
+func isValidModelAlias(alias string) bool {
+	validAliases := []string{"sonnet", "opus", "haiku"}
+	for _, valid := range validAliases {
+		if alias == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// isValidSessionID validates session ID format (should be UUID-like)
+func isValidSessionID(sessionID string) bool {
+	// Be more lenient with session ID validation to avoid breaking existing usage
+	// Just check for basic non-empty string for now
+	// TODO: Implement stricter UUID validation when backward compatibility isn't a concern
+	return strings.TrimSpace(sessionID) != ""
+}
+
+// newSessionID is a variable to allow deterministic session IDs in tests
+// It tags runs the CLI did not report a session for, and audit records before the CLI assigns one
+var newSessionID = randomSessionID
+
+// ResetSessionIDGenerator restores the default random session ID generator after a test override
+func ResetSessionIDGenerator() {
+	newSessionID = randomSessionID
+}
+
+// randomSessionID returns a random version 4 UUID
+func randomSessionID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// NewClient creates a new Claude client with the specified binary path
+func NewClient(binPath string) *ClaudeClient {
+	return &ClaudeClient{
+		BinPath: binPath,
+		DefaultOptions: &RunOptions{
+			Format: TextOutput,
+		},
+	}
+}
+
+// ClaudePathEnv names the environment variable NewClientAuto checks before searching PATH
+const ClaudePathEnv = "CLAUDE_CODE_PATH"
+
+// NewClientAuto creates a new Claude client, locating the claude binary automatically
+// CLAUDE_CODE_PATH takes precedence and may hold a path or a command name; otherwise claude is looked up on PATH
+func NewClientAuto() (*ClaudeClient, error) {
+	name, source := "claude", "PATH"
+	if override := os.Getenv(ClaudePathEnv); override != "" {
+		name, source = override, ClaudePathEnv
+	}
+	binPath, err := exec.LookPath(name)
+	if err != nil {
+		claudeErr := NewClaudeError(ErrorCommand, fmt.Sprintf(
+			"claude CLI not found via %s (%q): install Claude Code, add it to PATH, or set %s to the binary path",
+			source, name, ClaudePathEnv))
+		claudeErr.Original = err
+		return nil, claudeErr
+	}
+	return NewClient(binPath), nil
+}
+
+// RunPrompt executes a prompt with Claude Code and returns the result
+func (c *ClaudeClient) RunPrompt(prompt string, opts *RunOptions) (*ClaudeResult, error) {
+	return c.RunPromptCtx(context.Background(), prompt, opts)
+}
+
+// RunPromptCtx executes a prompt with Claude Code and returns the result with context support
+// The run passes through any middleware registered with Use
+func (c *ClaudeClient) RunPromptCtx(ctx context.Context, prompt string, opts *RunOptions) (*ClaudeResult, error) {
+	if opts == nil {
+		opts = c.DefaultOptions
+	}
+	if len(c.middleware) > 0 {
+		return c.runner().RunPromptCtx(ctx, prompt, opts)
+	}
+	return c.runPromptCtx(ctx, prompt, opts)
+}
+
+// runPromptCtx is RunPromptCtx without middleware
+func (c *ClaudeClient) runPromptCtx(ctx context.Context, prompt string, opts *RunOptions) (*ClaudeResult, error) {
+	if opts == nil {
+		opts = c.DefaultOptions
+	}
+
+	// Preprocess and validate options
+	if err := PreprocessOptions(opts); err != nil {
+		return nil, err
+	}
+	opts = budgetAdjusted(opts)
+	defer recordLatency(opts, timeNow())
+
+	// Add timeout support if specified
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, opts.Timeout, &CancelCause{Reason: CancelTimeout, Err: context.DeadlineExceeded})
+		defer cancel()
+	}
+
+	// An inline MCP config only exists on disk while the CLI runs
+	if opts.MCPConfig != nil {
+		runOpts := *opts
+		cleanup, err := MaterializeMCPConfig(&runOpts)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+		opts = &runOpts
+	}
+
+	if opts.PluginManager != nil {
+		if err := opts.PluginManager.OnStreamStart(ctx, prompt); err != nil {
+			return nil, &CancelCause{Reason: CancelPlugin, Err: err}
+		}
+	}
+
+	args := BuildArgs(prompt, opts)
+
+	cmd := execCommand(ctx, c.BinPath, args...)
+	applyCommandEnv(cmd, opts)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		if cause, ok := cancelCause(ctx); ok {
+			return nil, cause
+		}
+
+		return nil, commandError(err, stderr.String(), opts)
+	}
+
+	res, err := parseResult(opts.Format, stdout.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return finishResult(ctx, opts, res, stderr.String())
+}
+
+// finishResult applies the result options of a completed run, notifies plugins and charges the budget
+func finishResult(ctx context.Context, opts *RunOptions, res *ClaudeResult, stderr string) (*ClaudeResult, error) {
+	res.truncate(opts.MaxResultBytes)
+	res.applyOutputCap(opts.MaxOutputTokens)
+	res.EffectiveOptions = EffectiveOptions(opts)
+	if opts.CaptureStderr {
+		res.Stderr = capturedStderr(stderr)
+	}
+
+	if opts.PluginManager != nil {
+		if err := opts.PluginManager.OnComplete(ctx, res); err != nil {
+			return nil, &CancelCause{Reason: CancelPlugin, Err: err}
+		}
+		res.Metrics = opts.PluginManager.collectMetrics()
+	}
+
+	// The run already happened, so the result is returned even when the budget is exceeded
+	if err := recordSpend(opts, res); err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
+
+// parseResult converts the CLI's output in format to a ClaudeResult
+// JSON and stream-json output carry timing, cost and usage; text output is returned as is
+func parseResult(format OutputFormat, output []byte) (*ClaudeResult, error) {
+	switch format {
+	case JSONOutput:
+		res := &ClaudeResult{}
+		if err := json.Unmarshal(output, res); err != nil {
+			return nil, NewClaudeError(ErrorValidation, fmt.Sprintf("failed to parse JSON response: %v", err))
+		}
+		return res, nil
+	case StreamJSONOutput:
+		// The final result message summarizes the run; output without one is treated as text
+		if res, ok := streamResult(output); ok {
+			return res, nil
+		}
+		fallthrough
+	default:
+		// For text output, just return the raw text
+		return &ClaudeResult{
+			Result:  string(output),
+			IsError: false,
+		}, nil
+	}
+}
+
+// streamResult returns the last result message of stream-json output
+func streamResult(output []byte) (*ClaudeResult, bool) {
+	var res *ClaudeResult
+	for _, line := range bytes.Split(output, []byte("\n")) {
+		var msg Message
+		if err := json.Unmarshal(line, &msg); err == nil && msg.Type == "result" {
+			res = resultFromMessage(msg)
+		}
+	}
+	return res, res != nil
+}
+
+// maxAutoResumeAttempts caps how many times a dropped stream is resumed
+const maxAutoResumeAttempts = 3
+
+// autoResumePrompt is sent when resuming a stream that ended unexpectedly
+const autoResumePrompt = "Continue from where you left off."
+
+// defaultStreamBufferSize is the StreamPrompt message channel capacity when StreamBufferSize is 0
+const defaultStreamBufferSize = 16
+
+// streamBufferSize returns the message channel capacity for opts.StreamBufferSize
+func streamBufferSize(opts *RunOptions) int {
+	switch {
+	case opts.StreamBufferSize == 0:
+		return defaultStreamBufferSize
+	case opts.StreamBufferSize < 0:
+		return 0
+	}
+	return opts.StreamBufferSize
+}
+
+// streamState tracks progress across the attempts of a single streaming run
+type streamState struct {
+	sessionID string
+	sawResult bool
+
+	// toolNames maps tool_use ids to tool names and toolRetries counts the ToolRetry attempts behind each call
+	toolNames   map[string]string
+	toolRetries map[string]int
+	// retry is the failed call the resumed session was asked to re-issue and retries counts those resumes
+	retry   *toolRetry
+	retries int
+
+	// seen holds the UUIDs delivered so far, oldest first in seenOrder, so resumed sessions don't repeat messages
+	seen      map[string]struct{}
+	seenOrder []string
+}
+
+// maxSeenMessages bounds the message UUIDs remembered for deduplication during a run
+const maxSeenMessages = 10000
+
+// seenBefore reports whether a message with the given UUID was already delivered, remembering it if not
+// Messages without a UUID are never treated as duplicates
+func (s *streamState) seenBefore(uuid string) bool {
+	if uuid == "" {
+		return false
+	}
+	if _, ok := s.seen[uuid]; ok {
+		return true
+	}
+	if s.seen == nil {
+		s.seen = make(map[string]struct{})
+	}
+	if len(s.seenOrder) >= maxSeenMessages {
+		delete(s.seen, s.seenOrder[0])
+		s.seenOrder = s.seenOrder[1:]
+	}
+	s.seen[uuid] = struct{}{}
+	s.seenOrder = append(s.seenOrder, uuid)
+	return false
+}
+
+// toolRetry is a failed tool call being re-issued under RunOptions.ToolRetry
+type toolRetry struct {
+	name    string
+	output  string
+	attempt int
+}
+
+// errToolRetry stops a stream attempt so a failed tool call can be re-issued in a resumed session
+var errToolRetry = errors.New("tool call scheduled for retry")
+
+// destructiveTools are never re-issued by ToolRetry unless RetryDestructiveTools is set
+var destructiveTools = map[string]bool{
+	"Bash":         true,
+	"Write":        true,
+	"Edit":         true,
+	"MultiEdit":    true,
+	"NotebookEdit": true,
+}
+
+// maxToolRetryResumes caps how many times a streaming run is resumed to re-issue failed tool calls,
+// across all calls, so a run whose calls keep failing cannot loop indefinitely
+const maxToolRetryResumes = 10
+
+// maxToolRetryOutput bounds how much of a failed tool's output is quoted in the retry prompt
+const maxToolRetryOutput = 1000
+
+// trackToolCall records a tool call, linking it to the failed call it re-issues when a retry is pending
+func (s *streamState) trackToolCall(id, name string) {
+	if id == "" {
+		return
+	}
+	if s.toolNames == nil {
+		s.toolNames = make(map[string]string)
+		s.toolRetries = make(map[string]int)
+	}
+	s.toolNames[id] = name
+	if s.retry != nil && s.retry.name == name {
+		s.toolRetries[id] = s.retry.attempt
+		s.retry = nil
+	}
+}
+
+// scheduleRetry decides whether a failed tool result should be re-issued and records the retry if so
+// Nothing is retried without a session to resume or once the run has used maxToolRetryResumes
+func (s *streamState) scheduleRetry(opts *RunOptions, result toolResult) bool {
+	if !result.IsError || s.sessionID == "" || s.retries >= maxToolRetryResumes {
+		return false
+	}
+	name, ok := s.toolNames[result.ToolUseID]
+	if !ok || (destructiveTools[name] && !opts.RetryDestructiveTools) {
+		return false
+	}
+	attempt := s.toolRetries[result.ToolUseID] + 1
+	if attempt > opts.ToolRetry[name] {
+		return false
+	}
+	s.retry = &toolRetry{name: name, output: result.Output, attempt: attempt}
+	s.retries++
+	return true
+}
+
+// prompt asks the resumed session to repeat the failed call
+func (r *toolRetry) prompt() string {
+	output := r.output
+	if len(output) > maxToolRetryOutput {
+		output = output[:maxToolRetryOutput] + "..."
+	}
+	return fmt.Sprintf("The %s tool call failed with: %s\nThis failure may be transient. Retry the same %s call with the same input, then continue.",
+		r.name, output, r.name)
+}
+
+// afterTimer is the part of *time.Timer used by the stream idle timeout and budget warning flushes
+type afterTimer interface {
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+// afterFunc starts a timer that calls f after d; tests replace it to fire timers deterministically
+var afterFunc = func(d time.Duration, f func()) afterTimer {
+	return time.AfterFunc(d, f)
+}
+
+// StreamPrompt executes a prompt with Claude Code and streams the results through a channel
+// The run passes through any middleware registered with Use
+func (c *ClaudeClient) StreamPrompt(ctx context.Context, prompt string, opts *RunOptions) (<-chan Message, <-chan error) {
+	if opts == nil {
+		opts = c.DefaultOptions
+	}
+	if len(c.middleware) > 0 {
+		return c.runner().StreamPrompt(ctx, prompt, opts)
+	}
+	return c.streamPrompt(ctx, prompt, opts)
+}
+
+// streamPrompt is StreamPrompt without middleware
+func (c *ClaudeClient) streamPrompt(ctx context.Context, prompt string, opts *RunOptions) (<-chan Message, <-chan error) {
+	if opts == nil {
+		opts = c.DefaultOptions
+	}
+	if err := PreprocessOptions(opts); err != nil {
+		return failedStream(err)
+	}
+
+	messageCh := make(chan Message, streamBufferSize(opts))
+	errCh := make(chan error, 1)
+
+	// Force stream-json format for streaming
+	streamOpts := *budgetAdjusted(opts)
+	streamOpts.Format = StreamJSONOutput
+
+	// Claude CLI requires --verbose when using --output-format=stream-json with --print
+	streamOpts.Verbose = true
+
+	go func() {
+		defer close(messageCh)
+		defer close(errCh)
+
+		if streamOpts.PluginManager != nil {
+			if err := streamOpts.PluginManager.OnStreamStart(ctx, prompt); err != nil {
+				errCh <- &CancelCause{Reason: CancelPlugin, Err: err}
+				return
+			}
+		}
+
+		defer recordLatency(&streamOpts, timeNow())
+
+		cleanup, err := MaterializeMCPConfig(&streamOpts)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer cleanup()
+
+		state := &streamState{}
+		currentPrompt := prompt
+		resumes := 0
+
+		for {
+			args := BuildArgs(currentPrompt, &streamOpts)
+			resumable, err := c.streamAttempt(ctx, args, &streamOpts, messageCh, state)
+
+			// A failed tool call under ToolRetry is re-prompted in the resumed session; attempts are capped per call
+			// and in total. The failed tool_result was already delivered, so consumers see it before the retried call
+			if errors.Is(err, errToolRetry) {
+				if state.sessionID == "" {
+					errCh <- fmt.Errorf("cannot retry %s tool call: no session to resume", state.retry.name)
+					return
+				}
+				streamOpts.ResumeID = state.sessionID
+				streamOpts.Continue = false
+				currentPrompt = state.retry.prompt()
+				continue
+			}
+
+			// Resume only when the stream dropped before its result and we know which session to resume
+			if !resumable || !streamOpts.AutoResume || state.sawResult || state.sessionID == "" || resumes >= maxAutoResumeAttempts {
+				if err != nil {
+					errCh <- err
+				}
+				return
+			}
+
+			resumes++
+			streamOpts.ResumeID = state.sessionID
+			streamOpts.Continue = false
+			currentPrompt = autoResumePrompt
+		}
+	}()
+
+	return messageCh, errCh
+}
+
+// StreamText executes a prompt and streams only the response text as it is generated
+// Deltas come from the stream's text_delta events; if the CLI emits none, whole assistant
+// text blocks are sent instead. Both channels are closed when the run ends or ctx is canceled
+func (c *ClaudeClient) StreamText(ctx context.Context, prompt string, opts *RunOptions) (<-chan string, <-chan error) {
+	if opts == nil {
+		opts = c.DefaultOptions
+	}
+	textOpts := *opts
+	textOpts.IncludePartialMessages = true
+
+	messageCh, streamErrCh := c.StreamPrompt(ctx, prompt, &textOpts)
+	textCh := make(chan string, cap(messageCh))
+	errCh := make(chan error, 1)
+
+	go func() {
+		defer close(textCh)
+		defer close(errCh)
+
+		sawDelta := false
+		for msg := range messageCh {
+			var texts []string
+			if delta, ok := textDelta(msg); ok {
+				sawDelta = true
+				texts = append(texts, delta)
+			} else if !sawDelta {
+				texts = assistantTexts(msg)
+			}
+
+			for _, text := range texts {
+				select {
+				case textCh <- text:
+				case <-ctx.Done():
+					errCh <- ctx.Err()
+					return
+				}
+			}
+		}
+		if err := <-streamErrCh; err != nil {
+			errCh <- err
+		}
+	}()
+
+	return textCh, errCh
+}
+
+// textDelta returns the text of a content_block_delta stream event carrying a text_delta
+func textDelta(msg Message) (string, bool) {
+	if msg.Type != "stream_event" || len(msg.Event) == 0 {
+		return "", false
+	}
+	var event struct {
+		Type  string `json:"type"`
+		Delta struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"delta"`
+	}
+	if err := json.Unmarshal(msg.Event, &event); err != nil {
+		return "", false
+	}
+	if event.Type != "content_block_delta" || event.Delta.Type != "text_delta" {
+		return "", false
+	}
+	return event.Delta.Text, true
+}
+
+// assistantTexts returns the text blocks of a streamed assistant message
+func assistantTexts(msg Message) []string {
+	if msg.Type != "assistant" || len(msg.Message) == 0 {
+		return nil
+	}
+	var body struct {
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+	}
+	if err := json.Unmarshal(msg.Message, &body); err != nil {
+		return nil
+	}
+	var texts []string
+	for _, block := range body.Content {
+		if block.Type == "text" && block.Text != "" {
+			texts = append(texts, block.Text)
+		}
+	}
+	return texts
+}
+
+// streamAttempt runs the CLI once and forwards parsed messages to messageCh
+// It reports whether the failure (if any) came from the process terminating, in which case the run may be resumed
+func (c *ClaudeClient) streamAttempt(ctx context.Context, args []string, opts *RunOptions, messageCh chan<- Message, state *streamState) (bool, error) {
+	// Stopping the run for a known reason cancels the attempt with a CancelCause that is reported back
+	ctx, cancelAttempt := context.WithCancelCause(ctx)
+	defer cancelAttempt(nil)
+
+	// Create a custom command that supports context
+	cmd := execCommand(ctx, c.BinPath, args...)
+	applyCommandEnv(cmd, opts)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return false, fmt.Errorf("failed to get stdout pipe: %w", err)
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return false, fmt.Errorf("failed to get stderr pipe: %w", err)
+	}
+
+	// Start capturing stderr in a goroutine
+	stderrBuf := new(bytes.Buffer)
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		_, _ = io.Copy(stderrBuf, stderr)
+	}()
+
+	if err := cmd.Start(); err != nil {
+		return false, fmt.Errorf("failed to start command: %w", err)
 	}
 
-	// Validate session ID format if provided
-	if opts.ResumeID != "" {
-		if !isValidSessionID(opts.ResumeID) {
-			return NewValidationError("Invalid session ID format", "ResumeID", opts.ResumeID)
-		}
+	watch := newToolWatch(opts, func() { _ = cmd.Process.Kill() })
+	defer watch.stop()
+
+	// The idle timer restarts on every line read from the CLI and kills the process when it fires
+	var idleExpired atomic.Bool
+	resetIdle := func() {}
+	if opts.IdleTimeout > 0 {
+		idle := afterFunc(opts.IdleTimeout, func() {
+			idleExpired.Store(true)
+			cancelAttempt(&CancelCause{Reason: CancelIdle, Err: &IdleTimeoutError{Timeout: opts.IdleTimeout}})
+			_ = cmd.Process.Kill()
+		})
+		defer idle.Stop()
+		resetIdle = func() { idle.Reset(opts.IdleTimeout) }
 	}
 
-	// Validate subagent configurations
-	if len(opts.Agents) > 0 {
-		for name, agent := range opts.Agents {
-			if agent == nil {
-				return NewValidationError("Subagent config cannot be nil", "Agents", name)
+	scanner := bufio.NewScanner(stdout)
+	// Increase buffer size to 10MB to handle large tool results (file contents)
+	const maxScannerBuffer = 10 * 1024 * 1024
+	scanner.Buffer(make([]byte, 64*1024), maxScannerBuffer)
+
+	for scanner.Scan() {
+		resetIdle()
+		line := scanner.Text()
+
+		if opts.RecordTo != nil {
+			if _, err := io.WriteString(opts.RecordTo, line+"\n"); err != nil {
+				_ = cmd.Process.Kill()
+				_ = cmd.Wait()
+				return false, fmt.Errorf("failed to record stream: %w", err)
 			}
-			if err := agent.Validate(); err != nil {
-				return NewValidationError(fmt.Sprintf("Invalid subagent '%s': %v", name, err), "Agents", name)
+		}
+
+		if err := handleStreamLine(ctx, line, opts, messageCh, state, watch); err != nil {
+			if cause, ok := err.(*CancelCause); ok {
+				cancelAttempt(cause)
 			}
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+			return false, err
 		}
 	}
 
-	return nil
-}
+	// A stuck stream was killed by the idle timer; report that rather than the exit status
+	if idleExpired.Load() {
+		_ = cmd.Wait()
+		return false, &CancelCause{Reason: CancelIdle, Err: &IdleTimeoutError{Timeout: opts.IdleTimeout, SessionID: state.sessionID}}
+	}
 
-// isValidModelAlias checks if the model alias is supported
-func isValidModelAlias(alias string) bool {
-	validAliases := []string{"sonnet", "opus", "haiku"}
-	for _, valid := range validAliases {
-		if alias == valid {
-			return true
+	// A tool that overran its timeout killed the process; report that rather than the exit status
+	if err := watch.expiredError(ctx); err != nil {
+		_ = cmd.Wait()
+		return false, err
+	}
+
+	if err := scanner.Err(); err != nil {
+		_ = cmd.Wait()
+		return true, fmt.Errorf("scanner error: %w", err)
+	}
+
+	<-stderrDone
+	if err := cmd.Wait(); err != nil {
+		if cause, ok := cancelCause(ctx); ok {
+			return false, cause
 		}
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+
+		return true, commandError(err, stderrBuf.String(), opts)
 	}
-	return false
-}
 
-// isValidSessionID validates session ID format (should be UUID-like)
-func isValidSessionID(sessionID string) bool {
-	// Be more lenient with session ID validation to avoid breaking existing usage
-	// Just check for basic non-empty string for now
-	// TODO: Implement stricter UUID validation when backward compatibility isn't a concern
-	return strings.TrimSpace(sessionID) != ""
+	return true, nil
 }
 
-// NewClient creates a new Claude client with the specified binary path
-func NewClient(binPath string) *ClaudeClient {
-	return &ClaudeClient{
-		BinPath: binPath,
-		DefaultOptions: &RunOptions{
-			Format: TextOutput,
-		},
+// handleStreamLine parses one stream-json line and runs it through the stream pipeline:
+// session tracking, thinking filtering, delivery to messageCh, plugins, permission gating and tool timeouts
+// Plugin failures are returned as a *CancelCause; the caller stops the run on any error
+func handleStreamLine(ctx context.Context, line string, opts *RunOptions, messageCh chan<- Message, state *streamState, watch *toolWatch) error {
+	// Skip empty lines
+	if strings.TrimSpace(line) == "" {
+		return nil
 	}
-}
 
-// RunPrompt executes a prompt with Claude Code and returns the result
-func (c *ClaudeClient) RunPrompt(prompt string, opts *RunOptions) (*ClaudeResult, error) {
-	return c.RunPromptCtx(context.Background(), prompt, opts)
-}
+	var msg Message
+	if err := json.Unmarshal([]byte(line), &msg); err != nil {
+		return fmt.Errorf("failed to parse JSON message: %w", err)
+	}
 
-// RunPromptCtx executes a prompt with Claude Code and returns the result with context support
-func (c *ClaudeClient) RunPromptCtx(ctx context.Context, prompt string, opts *RunOptions) (*ClaudeResult, error) {
-	if opts == nil {
-		opts = c.DefaultOptions
+	// Messages replayed by a resumed session are neither re-delivered nor re-gated
+	if state.seenBefore(msg.UUID) {
+		return nil
 	}
 
-	// Preprocess and validate options
-	if err := PreprocessOptions(opts); err != nil {
-		return nil, err
+	if msg.SessionID != "" {
+		state.sessionID = msg.SessionID
+	}
+	if msg.Type == "result" {
+		state.sawResult = true
 	}
 
-	// Add timeout support if specified
-	if opts.Timeout > 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
-		defer cancel()
+	if !opts.IncludeThinking {
+		var ok bool
+		if msg, ok = withoutThinking(msg); !ok {
+			return nil
+		}
 	}
 
-	args := BuildArgs(prompt, opts)
+	if err := matchAbortPatterns(opts, msg); err != nil {
+		return &CancelCause{Reason: CancelAbortPattern, Err: err}
+	}
 
-	cmd := execCommand(ctx, c.BinPath, args...)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	if err := emitMessage(ctx, opts, messageCh, msg); err != nil {
+		return err
+	}
 
-	err := cmd.Run()
-	if err != nil {
-		// Enhanced error parsing
-		var exitCode int
-		if exitError, ok := err.(*exec.ExitError); ok {
-			exitCode = exitError.ExitCode()
-		} else {
-			exitCode = 1
+	if msg.Type == "result" && opts.PluginManager != nil {
+		if err := opts.PluginManager.OnComplete(ctx, resultFromMessage(msg)); err != nil {
+			return &CancelCause{Reason: CancelPlugin, Err: err}
 		}
+	}
 
-		claudeErr := ParseError(stderr.String(), exitCode)
-		claudeErr.Original = err
-		return nil, claudeErr
+	// The result was already delivered, so exceeding the budget is reported on the error channel after it
+	if msg.Type == "result" {
+		if err := recordSpend(opts, resultFromMessage(msg)); err != nil {
+			return err
+		}
 	}
 
-	if opts.Format == JSONOutput {
-		var res ClaudeResult
-		if err := json.Unmarshal(stdout.Bytes(), &res); err != nil {
-			return nil, NewClaudeError(ErrorValidation, fmt.Sprintf("failed to parse JSON response: %v", err))
+	// Gate tool calls through the permission callback and plugins
+	for _, use := range extractToolUses(msg) {
+		input := ParseToolInput(use.Input)
+		input.ToolUseID = use.ID
+		state.trackToolCall(use.ID, use.Name)
+		result, err := resolvePermission(ctx, opts, use.Name, input)
+		if err == nil && result.Behavior == PermissionDeny {
+			claudeErr := NewClaudeError(ErrorPermission, fmt.Sprintf("tool %s denied: %s", use.Name, result.Message))
+			claudeErr.Original = &PermissionDeniedError{ToolName: use.Name, Reason: result.Message}
+			err = claudeErr
+		}
+		if err == nil && result.Behavior == PermissionAsk {
+			err = emitMessage(ctx, opts, messageCh, Message{
+				Type:              "permission_request",
+				SessionID:         msg.SessionID,
+				ToolName:          use.Name,
+				ToolInput:         use.Input,
+				ToolID:            use.ID,
+				PermissionMessage: result.Message,
+				PermissionResult:  &result,
+			})
+		}
+		if err == nil && opts.PluginManager != nil {
+			if err = opts.PluginManager.OnToolCall(ctx, use.Name, input); err != nil {
+				if opts.ToolCallDenyMode != DenyTool {
+					return &CancelCause{Reason: CancelPlugin, Err: err}
+				}
+				denied := Deny(err.Error())
+				err = emitMessage(ctx, opts, messageCh, Message{
+					Type:              "tool_denied",
+					SessionID:         msg.SessionID,
+					ToolName:          use.Name,
+					ToolInput:         use.Input,
+					ToolID:            use.ID,
+					PermissionMessage: denied.Message,
+					PermissionResult:  &denied,
+				})
+				if err == nil {
+					continue
+				}
+			}
+		}
+		if err != nil {
+			return err
 		}
-		return &res, nil
+		watch.start(use.ID, use.Name, input)
 	}
 
-	// For text output, just return the raw text
-	return &ClaudeResult{
-		Result:  stdout.String(),
-		IsError: false,
-	}, nil
+	for _, result := range extractToolResults(msg) {
+		if len(opts.ToolRetry) > 0 && state.scheduleRetry(opts, result) {
+			watch.discard(result.ToolUseID)
+			return errToolRetry
+		}
+		if err := watch.finish(ctx, result); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// StreamPrompt executes a prompt with Claude Code and streams the results through a channel
-func (c *ClaudeClient) StreamPrompt(ctx context.Context, prompt string, opts *RunOptions) (<-chan Message, <-chan error) {
-	messageCh := make(chan Message)
-	errCh := make(chan error, 1)
+// resultFromMessage converts a streamed result message to a ClaudeResult
+func resultFromMessage(msg Message) *ClaudeResult {
+	return &ClaudeResult{
+		Type:          msg.Type,
+		Subtype:       msg.Subtype,
+		Result:        msg.Result,
+		CostUSD:       msg.CostUSD,
+		DurationMS:    msg.DurationMS,
+		DurationAPIMS: msg.DurationAPIMS,
+		IsError:       msg.IsError,
+		NumTurns:      msg.NumTurns,
+		SessionID:     msg.SessionID,
+		Usage:         msg.Usage,
+	}
+}
 
-	if opts == nil {
-		opts = c.DefaultOptions
+// matchAbortPatterns returns an *AbortPatternError if an assistant text block matches one of opts.AbortPatterns
+func matchAbortPatterns(opts *RunOptions, msg Message) error {
+	if len(opts.AbortPatterns) == 0 {
+		return nil
+	}
+	for _, text := range assistantTexts(msg) {
+		for _, pattern := range opts.AbortPatterns {
+			if loc := pattern.FindStringIndex(text); loc != nil {
+				return &AbortPatternError{Pattern: pattern.String(), Match: text[loc[0]:loc[1]], SessionID: msg.SessionID}
+			}
+		}
 	}
+	return nil
+}
 
-	// Force stream-json format for streaming
-	streamOpts := *opts
-	streamOpts.Format = StreamJSONOutput
+// emitMessage passes msg to plugin OnMessage hooks and delivers it to messageCh, applying opts.MessageFilter
+func emitMessage(ctx context.Context, opts *RunOptions, messageCh chan<- Message, msg Message) error {
+	keep := opts.MessageFilter == nil || opts.MessageFilter(msg)
+	if opts.PluginManager != nil && (keep || !opts.FilterPluginMessages) {
+		if err := opts.PluginManager.OnMessage(ctx, msg); err != nil {
+			return &CancelCause{Reason: CancelPlugin, Err: err}
+		}
+	}
+	if !keep {
+		return nil
+	}
+	return sendMessage(ctx, messageCh, msg)
+}
 
-	// Claude CLI requires --verbose when using --output-format=stream-json with --print
-	streamOpts.Verbose = true
+// sendMessage delivers msg to messageCh unless the context is canceled first
+func sendMessage(ctx context.Context, messageCh chan<- Message, msg Message) error {
+	select {
+	case messageCh <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	args := BuildArgs(prompt, &streamOpts)
+// toolWatch enforces per-tool timeouts for the tool calls of a single stream attempt
+type toolWatch struct {
+	opts    *RunOptions
+	kill    func()
+	mu      sync.Mutex
+	pending map[string]*pendingTool
+	expired *pendingTool
+}
 
-	go func() {
-		defer close(messageCh)
-		defer close(errCh)
+// pendingTool is a tool call awaiting its result
+type pendingTool struct {
+	name     string
+	input    ToolInput
+	timeout  time.Duration
+	timer    *time.Timer
+	timedOut bool
+}
 
-		// Create a custom command that supports context
-		cmd := execCommand(ctx, c.BinPath, args...)
+func newToolWatch(opts *RunOptions, kill func()) *toolWatch {
+	return &toolWatch{
+		opts:    opts,
+		kill:    kill,
+		pending: make(map[string]*pendingTool),
+	}
+}
 
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			errCh <- fmt.Errorf("failed to get stdout pipe: %w", err)
-			return
-		}
+// timeoutFor returns the configured timeout for a tool, falling back to DefaultToolTimeout
+func (w *toolWatch) timeoutFor(toolName string) time.Duration {
+	if timeout, ok := w.opts.ToolTimeouts[toolName]; ok {
+		return timeout
+	}
+	return w.opts.DefaultToolTimeout
+}
 
-		stderr, err := cmd.StderrPipe()
-		if err != nil {
-			errCh <- fmt.Errorf("failed to get stderr pipe: %w", err)
-			return
-		}
+// start records a tool call and arms its timeout, killing the process if the timeout fires
+func (w *toolWatch) start(id, toolName string, input ToolInput) {
+	if id == "" {
+		return
+	}
 
-		// Start capturing stderr in a goroutine
-		stderrBuf := new(bytes.Buffer)
-		go func() {
-			_, _ = io.Copy(stderrBuf, stderr)
-		}()
+	pending := &pendingTool{name: toolName, input: input, timeout: w.timeoutFor(toolName)}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending[id] = pending
+	if pending.timeout > 0 {
+		pending.timer = time.AfterFunc(pending.timeout, func() {
+			w.mu.Lock()
+			pending.timedOut = true
+			if w.expired == nil {
+				w.expired = pending
+			}
+			w.mu.Unlock()
+			w.kill()
+		})
+	}
+}
 
-		if err := cmd.Start(); err != nil {
-			errCh <- fmt.Errorf("failed to start command: %w", err)
-			return
+// finish matches a tool result to its call and reports it to plugins
+// It returns an error when the call timed out or a plugin rejects the result
+func (w *toolWatch) finish(ctx context.Context, result toolResult) error {
+	w.mu.Lock()
+	pending, ok := w.pending[result.ToolUseID]
+	if ok {
+		delete(w.pending, result.ToolUseID)
+		if pending.timer != nil {
+			pending.timer.Stop()
+		}
+		if pending.timedOut && w.expired == pending {
+			w.expired = nil
 		}
+	}
+	w.mu.Unlock()
 
-		scanner := bufio.NewScanner(stdout)
-		// Increase buffer size to 10MB to handle large tool results (file contents)
-		const maxScannerBuffer = 10 * 1024 * 1024
-		scanner.Buffer(make([]byte, 64*1024), maxScannerBuffer)
+	if !ok {
+		return nil
+	}
 
-		for scanner.Scan() {
-			line := scanner.Text()
+	var toolErr error
+	switch {
+	case pending.timedOut:
+		toolErr = toolTimeoutError(pending)
+	case result.IsError:
+		toolErr = fmt.Errorf("tool %s failed: %s", pending.name, result.Output)
+	}
 
-			// Skip empty lines
-			if strings.TrimSpace(line) == "" {
-				continue
-			}
+	if w.opts.PluginManager != nil {
+		if err := w.opts.PluginManager.OnToolResult(ctx, pending.name, pending.input, result.Output, toolErr); err != nil {
+			return err
+		}
+	}
 
-			var msg Message
-			if err := json.Unmarshal([]byte(line), &msg); err != nil {
-				errCh <- fmt.Errorf("failed to parse JSON message: %w", err)
-				return
-			}
+	if pending.timedOut {
+		return toolErr
+	}
+	return nil
+}
 
-			select {
-			case messageCh <- msg:
-				// Message sent successfully
-			case <-ctx.Done():
-				// Context was canceled
-				errCh <- ctx.Err()
-				return
-			}
+// discard forgets a tool call without reporting its result, as when the call is about to be re-issued
+func (w *toolWatch) discard(id string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if pending, ok := w.pending[id]; ok {
+		delete(w.pending, id)
+		if pending.timer != nil {
+			pending.timer.Stop()
 		}
+	}
+}
 
-		if err := scanner.Err(); err != nil {
-			errCh <- fmt.Errorf("scanner error: %w", err)
-			return
-		}
+// expiredError reports a tool call whose timeout fired before its result arrived
+func (w *toolWatch) expiredError(ctx context.Context) error {
+	w.mu.Lock()
+	pending := w.expired
+	w.mu.Unlock()
 
-		if err := cmd.Wait(); err != nil {
-			// Enhanced error parsing for streaming
-			var exitCode int
-			if exitError, ok := err.(*exec.ExitError); ok {
-				exitCode = exitError.ExitCode()
-			} else {
-				exitCode = 1
-			}
+	if pending == nil {
+		return nil
+	}
 
-			claudeErr := ParseError(stderrBuf.String(), exitCode)
-			claudeErr.Original = err
-			errCh <- claudeErr
-			return
+	toolErr := toolTimeoutError(pending)
+	if w.opts.PluginManager != nil {
+		_ = w.opts.PluginManager.OnToolResult(ctx, pending.name, pending.input, "", toolErr)
+	}
+	return toolErr
+}
+
+// stop disarms all outstanding tool timeouts
+func (w *toolWatch) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, pending := range w.pending {
+		if pending.timer != nil {
+			pending.timer.Stop()
 		}
-	}()
+	}
+}
 
-	return messageCh, errCh
+// toolTimeoutError builds the error reported when a tool overruns its timeout
+func toolTimeoutError(pending *pendingTool) *ClaudeError {
+	claudeErr := NewClaudeError(ErrorTimeout, fmt.Sprintf("tool %s exceeded its timeout of %s", pending.name, pending.timeout))
+	claudeErr.Details["tool"] = pending.name
+	claudeErr.Details["timeout"] = pending.timeout.String()
+	return claudeErr
 }
 
 // RunFromStdin runs Claude Code with input from stdin
@@ -481,17 +1803,37 @@ func (c *ClaudeClient) RunFromStdinCtx(ctx context.Context, stdin io.Reader, pro
 	if err := PreprocessOptions(opts); err != nil {
 		return nil, err
 	}
+	opts = budgetAdjusted(opts)
+	defer recordLatency(opts, timeNow())
 
 	// Add timeout support if specified
 	if opts.Timeout > 0 {
 		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		ctx, cancel = context.WithTimeoutCause(ctx, opts.Timeout, &CancelCause{Reason: CancelTimeout, Err: context.DeadlineExceeded})
 		defer cancel()
 	}
 
+	// An inline MCP config only exists on disk while the CLI runs
+	if opts.MCPConfig != nil {
+		runOpts := *opts
+		cleanup, err := MaterializeMCPConfig(&runOpts)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+		opts = &runOpts
+	}
+
+	if opts.PluginManager != nil {
+		if err := opts.PluginManager.OnStreamStart(ctx, prompt); err != nil {
+			return nil, &CancelCause{Reason: CancelPlugin, Err: err}
+		}
+	}
+
 	args := BuildArgs(prompt, opts)
 
 	cmd := execCommand(ctx, c.BinPath, args...)
+	applyCommandEnv(cmd, opts)
 	cmd.Stdin = stdin
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
@@ -499,32 +1841,42 @@ func (c *ClaudeClient) RunFromStdinCtx(ctx context.Context, stdin io.Reader, pro
 
 	err := cmd.Run()
 	if err != nil {
-		// Enhanced error parsing
-		var exitCode int
-		if exitError, ok := err.(*exec.ExitError); ok {
-			exitCode = exitError.ExitCode()
-		} else {
-			exitCode = 1
+		if cause, ok := cancelCause(ctx); ok {
+			return nil, cause
 		}
 
-		claudeErr := ParseError(stderr.String(), exitCode)
-		claudeErr.Original = err
-		return nil, claudeErr
+		return nil, commandError(err, stderr.String(), opts)
 	}
 
-	if opts.Format == JSONOutput {
-		var res ClaudeResult
-		if err := json.Unmarshal(stdout.Bytes(), &res); err != nil {
-			return nil, NewClaudeError(ErrorValidation, fmt.Sprintf("failed to parse JSON response: %v", err))
-		}
-		return &res, nil
+	res, err := parseResult(opts.Format, stdout.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return finishResult(ctx, opts, res, stderr.String())
+}
+
+// commandEnv returns the environment variables that configure the CLI for options without a flag
+func commandEnv(opts *RunOptions) []string {
+	var env []string
+	if opts.DisablePromptCache {
+		env = append(env, "DISABLE_PROMPT_CACHING=1")
 	}
+	if opts.MaxOutputTokens > 0 {
+		env = append(env, fmt.Sprintf("CLAUDE_CODE_MAX_OUTPUT_TOKENS=%d", opts.MaxOutputTokens))
+	}
+	return env
+}
 
-	// For text output, just return the raw text
-	return &ClaudeResult{
-		Result:  stdout.String(),
-		IsError: false,
-	}, nil
+// applyCommandEnv adds commandEnv to cmd, on top of the current environment when cmd has none of its own
+func applyCommandEnv(cmd *exec.Cmd, opts *RunOptions) {
+	env := commandEnv(opts)
+	if len(env) == 0 {
+		return
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, env...)
 }
 
 // BuildArgs constructs the command-line arguments for Claude Code
@@ -561,6 +1913,15 @@ func BuildArgs(prompt string, opts *RunOptions) []string {
 		args = append(args, "--disallowedTools", strings.Join(opts.DisallowedTools, ","))
 	}
 
+	// Plan mode must reach the CLI to stop execution; other modes are applied by permission handling
+	if opts.PermissionMode == PermissionModePlan {
+		args = append(args, "--permission-mode", string(PermissionModePlan))
+	}
+
+	for _, dir := range opts.AdditionalDirs {
+		args = append(args, "--add-dir", dir)
+	}
+
 	if opts.PermissionTool != "" {
 		args = append(args, "--permission-prompt-tool", opts.PermissionTool)
 	}
@@ -579,6 +1940,10 @@ func BuildArgs(prompt string, opts *RunOptions) []string {
 		args = append(args, "--verbose")
 	}
 
+	if opts.IncludePartialMessages {
+		args = append(args, "--include-partial-messages")
+	}
+
 	// Model selection - prefer ModelAlias over Model for better UX
 	if opts.ModelAlias != "" {
 		args = append(args, "--model", opts.ModelAlias)
@@ -666,10 +2031,38 @@ func (c *ClaudeClient) ResumeConversation(prompt string, sessionID string) (*Cla
 
 // ResumeConversationCtx is a convenience method for resuming a specific conversation with context support
 func (c *ClaudeClient) ResumeConversationCtx(ctx context.Context, prompt string, sessionID string) (*ClaudeResult, error) {
-	return c.RunPromptCtx(ctx, prompt, &RunOptions{
+	return c.ResumeConversationWith(ctx, prompt, sessionID, nil)
+}
+
+// ResumeOptions adjusts a resumed run; empty fields keep the original settings
+type ResumeOptions struct {
+	// SystemPrompt replaces the system prompt for the resumed run while keeping the conversation history
+	SystemPrompt string
+	// AppendPrompt is appended to the system prompt of the resumed run
+	AppendPrompt string
+}
+
+// apply sets the resume overrides on opts
+func (ro *ResumeOptions) apply(opts *RunOptions) {
+	if ro == nil {
+		return
+	}
+	if ro.SystemPrompt != "" {
+		opts.SystemPrompt = ro.SystemPrompt
+	}
+	if ro.AppendPrompt != "" {
+		opts.AppendPrompt = ro.AppendPrompt
+	}
+}
+
+// ResumeConversationWith resumes a specific conversation with new instructions from resume
+func (c *ClaudeClient) ResumeConversationWith(ctx context.Context, prompt string, sessionID string, resume *ResumeOptions) (*ClaudeResult, error) {
+	opts := &RunOptions{
 		Format:   JSONOutput,
 		ResumeID: sessionID,
-	})
+	}
+	resume.apply(opts)
+	return c.RunPromptCtx(ctx, prompt, opts)
 }
 
 // RetryPolicy defines the retry behavior for failed requests
@@ -713,6 +2106,11 @@ func (c *ClaudeClient) RunPromptWithRetry(prompt string, opts *RunOptions, retry
 
 // RunPromptWithRetryCtx executes a prompt with context support and intelligent retry logic
 func (c *ClaudeClient) RunPromptWithRetryCtx(ctx context.Context, prompt string, opts *RunOptions, retryPolicy *RetryPolicy) (*ClaudeResult, error) {
+	return RunWithRetry(ctx, c, prompt, opts, retryPolicy)
+}
+
+// RunWithRetry executes a prompt on runner, retrying recoverable errors according to retryPolicy
+func RunWithRetry(ctx context.Context, runner Runner, prompt string, opts *RunOptions, retryPolicy *RetryPolicy) (*ClaudeResult, error) {
 	if retryPolicy == nil {
 		retryPolicy = DefaultRetryPolicy()
 	}
@@ -732,7 +2130,7 @@ func (c *ClaudeClient) RunPromptWithRetryCtx(ctx context.Context, prompt string,
 			}
 		}
 
-		result, err := c.RunPromptCtx(ctx, prompt, opts)
+		result, err := runner.RunPromptCtx(ctx, prompt, opts)
 		if err == nil {
 			return result, nil
 		}
@@ -781,3 +2179,119 @@ func (c *ClaudeClient) RunPromptEnhancedCtx(ctx context.Context, prompt string,
 func ValidateOptions(opts *RunOptions) error {
 	return PreprocessOptions(opts)
 }
+
+// MergeOptions layers override on top of base and returns a new RunOptions
+// Neither argument is modified, and a nil argument is treated as empty options
+//
+// Rules, applied to every field:
+//   - scalars (strings, numbers, durations, modes) take the override value when it is non-zero
+//   - booleans are true if set in either; an override cannot switch a base flag off
+//   - slices and maps are replaced wholesale by a non-nil override, never appended or merged
+//   - callbacks and shared pointers (PermissionCallback, CostSource, BudgetTracker,
+//     PluginManager) fall back to base when nil in override
+//   - ParsedAllowedTools and ParsedDisallowedTools are cleared; they are recomputed on run
+func MergeOptions(base, override *RunOptions) *RunOptions {
+	merged := &RunOptions{}
+	if base != nil {
+		*merged = *base
+	}
+	if override != nil {
+		dst := reflect.ValueOf(merged).Elem()
+		src := reflect.ValueOf(override).Elem()
+		for i := 0; i < src.NumField(); i++ {
+			if field := src.Field(i); !field.IsZero() {
+				dst.Field(i).Set(field)
+			}
+		}
+	}
+
+	merged.ParsedAllowedTools = nil
+	merged.ParsedDisallowedTools = nil
+	return merged
+}
+
+// redactedValue replaces sensitive option values in EffectiveOptions
+const redactedValue = "[REDACTED]"
+
+// EffectiveOptions returns a copy of opts that is safe to log after preprocessing has been applied
+//   - callbacks and shared pointers (PermissionCallback, CostSource, MessageFilter,
+//     BudgetTracker, LatencyTracker, PluginManager, RecordTo) and Agents are cleared
+//   - SystemPrompt and AppendPrompt are redacted since prompts may embed secrets or user data
+//   - an inline MCPConfig is cleared since server env and headers often hold credentials
+//   - slices and maps are copied so the snapshot does not alias the caller's options
+func EffectiveOptions(opts *RunOptions) *RunOptions {
+	if opts == nil {
+		return nil
+	}
+
+	effective := copyOptionData(opts)
+	effective.PermissionCallback = nil
+	effective.CostSource = nil
+	effective.MessageFilter = nil
+	effective.BudgetTracker = nil
+	effective.LatencyTracker = nil
+	effective.RecordTo = nil
+	effective.PluginManager = nil
+	effective.Agents = nil
+	effective.MCPConfig = nil
+	effective.ParsedAllowedTools = nil
+	effective.ParsedDisallowedTools = nil
+
+	if effective.SystemPrompt != "" {
+		effective.SystemPrompt = redactedValue
+	}
+	if effective.AppendPrompt != "" {
+		effective.AppendPrompt = redactedValue
+	}
+	return effective
+}
+
+// copyOptionData returns a copy of opts whose string slices and maps of plain values do not alias the original
+// Callbacks, shared pointers, Agents and parsed permissions are copied by reference
+func copyOptionData(opts *RunOptions) *RunOptions {
+	if opts == nil {
+		return nil
+	}
+
+	copied := *opts
+	copied.AllowedTools = copyStrings(opts.AllowedTools)
+	copied.DisallowedTools = copyStrings(opts.DisallowedTools)
+	copied.KnownTools = copyStrings(opts.KnownTools)
+	copied.AdditionalDirs = copyStrings(opts.AdditionalDirs)
+	if opts.AbortPatterns != nil {
+		copied.AbortPatterns = append([]*regexp.Regexp(nil), opts.AbortPatterns...)
+	}
+	if opts.ToolSchemas != nil {
+		copied.ToolSchemas = make(map[string]string, len(opts.ToolSchemas))
+		for tool, schema := range opts.ToolSchemas {
+			copied.ToolSchemas[tool] = schema
+		}
+	}
+	if opts.ToolTimeouts != nil {
+		copied.ToolTimeouts = make(map[string]time.Duration, len(opts.ToolTimeouts))
+		for tool, timeout := range opts.ToolTimeouts {
+			copied.ToolTimeouts[tool] = timeout
+		}
+	}
+	if opts.ToolRetry != nil {
+		copied.ToolRetry = make(map[string]int, len(opts.ToolRetry))
+		for tool, retries := range opts.ToolRetry {
+			copied.ToolRetry[tool] = retries
+		}
+	}
+	if opts.BudgetDowngrade != nil {
+		copied.BudgetDowngrade = make(map[float64]string, len(opts.BudgetDowngrade))
+		for threshold, alias := range opts.BudgetDowngrade {
+			copied.BudgetDowngrade[threshold] = alias
+		}
+	}
+	return &copied
+}
+
+// copyStrings returns a copy of values, preserving nil
+func copyStrings(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	return append([]string(nil), values...)
+}
@@ -3,10 +3,18 @@ package claude
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -48,14 +56,102 @@ func TestHelperProcess(t *testing.T) {
 
 	output := os.Getenv("GO_HELPER_OUTPUT")
 	exitCode := int(os.Getenv("GO_HELPER_EXIT_CODE")[0] - '0')
+	if name := os.Getenv("GO_HELPER_ECHO_ENV"); name != "" {
+		output = name + "=" + os.Getenv(name)
+	}
 
 	if output != "" {
 		os.Stdout.Write([]byte(output))
 	}
+	if diagnostics := os.Getenv("GO_HELPER_STDERR"); diagnostics != "" {
+		os.Stderr.Write([]byte(diagnostics))
+	}
+
+	os.Exit(exitCode)
+}
+
+// echoEnvCommand makes a mockExecCommandContext command print "<name>=<value>" of its environment
+// instead of its output, so tests can check the environment the CLI was started with
+func echoEnvCommand(base func(context.Context, string, ...string) *exec.Cmd, name string) func(context.Context, string, ...string) *exec.Cmd {
+	return func(ctx context.Context, cmdName string, arg ...string) *exec.Cmd {
+		cmd := base(ctx, cmdName, arg...)
+		cmd.Env = append(cmd.Env, "GO_HELPER_ECHO_ENV="+name)
+		return cmd
+	}
+}
+
+// streamScript describes the stdout lines and exit code of one mocked CLI invocation
+type streamScript struct {
+	lines    []string
+	exitCode int
+}
+
+// mockStreamCommand returns an execCommand replacement that plays one script per invocation
+// (repeating the last one) and records the arguments of every invocation
+func mockStreamCommand(scripts ...streamScript) (func(context.Context, string, ...string) *exec.Cmd, func() [][]string) {
+	var mu sync.Mutex
+	var calls [][]string
+
+	command := func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+		mu.Lock()
+		idx := len(calls)
+		calls = append(calls, arg)
+		mu.Unlock()
+
+		script := scripts[len(scripts)-1]
+		if idx < len(scripts) {
+			script = scripts[idx]
+		}
+
+		cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=TestHelperStreamProcess", "--")
+		cmd.Env = []string{
+			"GO_WANT_HELPER_STREAM=1",
+			"GO_HELPER_STREAM_LINES=" + strings.Join(script.lines, "\n"),
+			"GO_HELPER_EXIT_CODE=" + strconv.Itoa(script.exitCode),
+		}
+		return cmd
+	}
+
+	recorded := func() [][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([][]string(nil), calls...)
+	}
+
+	return command, recorded
+}
+
+// TestHelperStreamProcess isn't a real test - it plays a streamScript for mockStreamCommand
+func TestHelperStreamProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_STREAM") != "1" {
+		return
+	}
+
+	if lines := os.Getenv("GO_HELPER_STREAM_LINES"); lines != "" {
+		for _, line := range strings.Split(lines, "\n") {
+			// "sleep <duration>" lines simulate a slow tool between messages
+			if delay, ok := strings.CutPrefix(line, "sleep "); ok {
+				d, _ := time.ParseDuration(delay)
+				time.Sleep(d)
+				continue
+			}
+			fmt.Println(line)
+		}
+	}
 
+	exitCode, _ := strconv.Atoi(os.Getenv("GO_HELPER_EXIT_CODE"))
 	os.Exit(exitCode)
 }
 
+// collectStream drains both streaming channels
+func collectStream(messageCh <-chan Message, errCh <-chan error) ([]Message, error) {
+	var messages []Message
+	for msg := range messageCh {
+		messages = append(messages, msg)
+	}
+	return messages, <-errCh
+}
+
 func TestRunPrompt(t *testing.T) {
 	// Save the original execCommand and restore it after the test
 	originalExecCommand := execCommand
@@ -164,147 +260,1670 @@ func main() {
 		for err := range errCh {
 			streamErr = err
 		}
-	}()
+	}()
+
+	// Collect messages
+	for msg := range messageCh {
+		messages = append(messages, msg)
+	}
+
+	// Check for streaming errors
+	if streamErr != nil {
+		t.Fatalf("Streaming error: %v", streamErr)
+	}
+
+	// Verify we got the expected messages
+	if len(messages) != 3 {
+		t.Fatalf("Expected 3 messages, got %d", len(messages))
+	}
+
+	// Check first message (init)
+	if messages[0].Type != "system" || messages[0].Subtype != "init" {
+		t.Errorf("First message should be system/init, got %s/%s", messages[0].Type, messages[0].Subtype)
+	}
+
+	// Check last message (result)
+	if messages[2].Type != "result" || messages[2].CostUSD != 0.002 {
+		t.Errorf("Last message should be result with cost 0.002, got %s with cost %f",
+			messages[2].Type, messages[2].CostUSD)
+	}
+}
+
+func TestStreamPrompt_PermissionGate(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	script := streamScript{
+		lines: []string{
+			`{"type":"assistant","message":{"content":[{"type":"tool_use","id":"tool-1","name":"Bash","input":{"command":"rm -rf /tmp/x"}}]},"session_id":"perm-session"}`,
+			`{"type":"result","subtype":"success","total_cost_usd":0.001,"session_id":"perm-session"}`,
+		},
+	}
+
+	run := func(t *testing.T, callback PermissionCallback) (*mockPlugin, []Message, error) {
+		command, _ := mockStreamCommand(script)
+		execCommand = command
+
+		plugin := newMockPlugin("observer", "1.0.0")
+		pm := NewPluginManager()
+		if err := pm.Register(plugin, nil); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+
+		client := &ClaudeClient{BinPath: "claude"}
+		opts := &RunOptions{PermissionCallback: callback, PluginManager: pm}
+		messages, err := collectStream(client.StreamPrompt(context.Background(), "Clean up", opts))
+		return plugin, messages, err
+	}
+
+	t.Run("plugin observes allow", func(t *testing.T) {
+		plugin, messages, err := run(t, nil)
+		if err != nil {
+			t.Fatalf("Streaming error: %v", err)
+		}
+		if len(plugin.prompts) != 1 || plugin.prompts[0] != "Clean up" {
+			t.Errorf("Expected OnStreamStart with prompt, got %v", plugin.prompts)
+		}
+		if len(plugin.results) != 1 || plugin.results[0].CostUSD != 0.001 || plugin.results[0].SessionID != "perm-session" {
+			t.Errorf("Expected OnComplete with streamed result, got %+v", plugin.results)
+		}
+		if len(messages) != 2 {
+			t.Errorf("Expected 2 messages, got %d", len(messages))
+		}
+		if len(plugin.permissions) != 1 || plugin.permissions[0].Behavior != PermissionAllow {
+			t.Errorf("Expected plugin to observe allow, got %+v", plugin.permissions)
+		}
+	})
+
+	t.Run("deny aborts stream", func(t *testing.T) {
+		var gotCommand string
+		callback := func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
+			gotCommand = input.Command
+			return Deny("destructive"), nil
+		}
+
+		plugin, _, err := run(t, callback)
+		var claudeErr *ClaudeError
+		if !errors.As(err, &claudeErr) || claudeErr.Type != ErrorPermission {
+			t.Fatalf("Expected permission error, got %v", err)
+		}
+		var deniedErr *PermissionDeniedError
+		if !errors.As(err, &deniedErr) || deniedErr.ToolName != "Bash" {
+			t.Errorf("Expected PermissionDeniedError for Bash, got %v", err)
+		}
+		if gotCommand != "rm -rf /tmp/x" {
+			t.Errorf("Expected callback to receive command, got %q", gotCommand)
+		}
+		if len(plugin.permissions) != 1 || plugin.permissions[0].Message != "destructive" {
+			t.Errorf("Expected plugin to observe deny, got %+v", plugin.permissions)
+		}
+	})
+
+	t.Run("ask emits permission request", func(t *testing.T) {
+		callback := func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
+			return Ask("confirm deletion"), nil
+		}
+
+		_, messages, err := run(t, callback)
+		if err != nil {
+			t.Fatalf("Streaming error: %v", err)
+		}
+		if len(messages) != 3 {
+			t.Fatalf("Expected 3 messages, got %d", len(messages))
+		}
+		request := messages[1]
+		if request.Type != "permission_request" || request.ToolName != "Bash" || request.ToolID != "tool-1" {
+			t.Errorf("Unexpected permission request: %+v", request)
+		}
+		if request.PermissionMessage != "confirm deletion" {
+			t.Errorf("Expected permission message, got %q", request.PermissionMessage)
+		}
+	})
+}
+
+func TestStreamPrompt_BufferSize(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	const messageCount = 50
+	var lines []string
+	for i := 0; i < messageCount; i++ {
+		lines = append(lines, fmt.Sprintf(`{"type":"assistant","message":{},"session_id":"buf","result":"chunk %d"}`, i))
+	}
+	lines = append(lines, `{"type":"result","subtype":"success","session_id":"buf"}`)
+
+	client := &ClaudeClient{BinPath: "claude"}
+	for _, tt := range []struct {
+		size    int
+		wantCap int
+	}{
+		{0, defaultStreamBufferSize},
+		{4, 4},
+		{-1, 0},
+	} {
+		t.Run(fmt.Sprintf("size %d", tt.size), func(t *testing.T) {
+			command, _ := mockStreamCommand(streamScript{lines: lines})
+			execCommand = command
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			messageCh, errCh := client.StreamPrompt(ctx, "stream", &RunOptions{StreamBufferSize: tt.size})
+			if cap(messageCh) != tt.wantCap {
+				t.Errorf("channel capacity = %d, want %d", cap(messageCh), tt.wantCap)
+			}
+
+			// A slow consumer must still receive every message
+			received := 0
+			for range messageCh {
+				received++
+				time.Sleep(time.Millisecond)
+			}
+			if err := <-errCh; err != nil {
+				t.Fatalf("stream error: %v", err)
+			}
+			if received != messageCount+1 {
+				t.Errorf("received %d messages, want %d", received, messageCount+1)
+			}
+		})
+	}
+}
+
+func TestStreamPrompt_DefaultPermission(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	script := streamScript{
+		lines: []string{
+			`{"type":"assistant","message":{"content":[{"type":"tool_use","id":"tool-1","name":"Write","input":{"file_path":"out.txt","content":"x"}}]},"session_id":"default-perm"}`,
+			`{"type":"result","subtype":"success","session_id":"default-perm"}`,
+		},
+	}
+	client := &ClaudeClient{BinPath: "claude"}
+
+	tests := []struct {
+		name     string
+		opts     RunOptions
+		wantDeny bool
+	}{
+		{"unset allows", RunOptions{}, false},
+		{"explicit allow", RunOptions{DefaultPermission: PermissionAllow}, false},
+		{"deny by default", RunOptions{DefaultPermission: PermissionDeny}, true},
+		{"bypass mode ignores default", RunOptions{DefaultPermission: PermissionDeny, PermissionMode: PermissionModeBypassPermissions}, false},
+		{"callback takes precedence", RunOptions{
+			DefaultPermission: PermissionDeny,
+			PermissionCallback: func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
+				return Allow(), nil
+			},
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command, _ := mockStreamCommand(script)
+			execCommand = command
+
+			opts := tt.opts
+			_, err := collectStream(client.StreamPrompt(context.Background(), "Write a file", &opts))
+			var deniedErr *PermissionDeniedError
+			if tt.wantDeny {
+				if !errors.As(err, &deniedErr) || deniedErr.ToolName != "Write" {
+					t.Fatalf("Expected Write to be denied, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("Expected tool call to be allowed, got %v", err)
+			}
+		})
+	}
+
+	if err := ValidateOptions(&RunOptions{DefaultPermission: "maybe"}); err == nil {
+		t.Error("Expected validation error for unknown DefaultPermission")
+	}
+}
+func TestStreamPrompt_ToolSchemas(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	bashSchema := `{"type":"object","required":["command"],"properties":{"command":{"type":"string"}}}`
+	toolUse := func(input string) streamScript {
+		return streamScript{lines: []string{
+			`{"type":"assistant","message":{"content":[{"type":"tool_use","id":"tool-1","name":"Bash","input":` + input + `}]},"session_id":"schema-session"}`,
+			`{"type":"result","subtype":"success","session_id":"schema-session"}`,
+		}}
+	}
+	client := &ClaudeClient{BinPath: "claude"}
+
+	callbackCalls := 0
+	opts := &RunOptions{
+		ToolSchemas: map[string]string{"Bash": bashSchema},
+		PermissionCallback: func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
+			callbackCalls++
+			return Allow(), nil
+		},
+	}
+
+	command, _ := mockStreamCommand(toolUse(`{"command":"ls"}`))
+	execCommand = command
+	if _, err := collectStream(client.StreamPrompt(context.Background(), "List", opts)); err != nil {
+		t.Fatalf("expected conforming input to be allowed, got %v", err)
+	}
+	if callbackCalls != 1 {
+		t.Errorf("expected the callback to run for conforming input, ran %d times", callbackCalls)
+	}
+
+	for name, input := range map[string]string{
+		"missing command": `{"description":"list files"}`,
+		"wrong type":      `{"command":42}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			callbackCalls = 0
+			command, _ := mockStreamCommand(toolUse(input))
+			execCommand = command
+
+			_, err := collectStream(client.StreamPrompt(context.Background(), "List", opts))
+			var deniedErr *PermissionDeniedError
+			if !errors.As(err, &deniedErr) || !strings.Contains(deniedErr.Reason, "does not match schema") {
+				t.Fatalf("expected schema denial, got %v", err)
+			}
+			if callbackCalls != 0 {
+				t.Errorf("expected the callback to be skipped, ran %d times", callbackCalls)
+			}
+		})
+	}
+
+	if err := ValidateOptions(&RunOptions{ToolSchemas: map[string]string{"Bash": "{not json"}}); err == nil {
+		t.Error("expected validation error for an invalid schema")
+	}
+}
+
+func TestStreamPrompt_ToolCallDenyMode(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	script := streamScript{lines: []string{
+		`{"type":"assistant","message":{"content":[{"type":"tool_use","id":"tool-1","name":"WebFetch","input":{"url":"https://example.com"}}]},"session_id":"deny-mode"}`,
+		`{"type":"assistant","message":{"content":[{"type":"tool_use","id":"tool-2","name":"Read","input":{"file_path":"notes.txt"}}]},"session_id":"deny-mode"}`,
+		`{"type":"result","subtype":"success","result":"done","session_id":"deny-mode"}`,
+	}}
+	client := &ClaudeClient{BinPath: "claude"}
+
+	run := func(mode ToolCallDenyMode) (*MetricsPlugin, []Message, error) {
+		command, _ := mockStreamCommand(script)
+		execCommand = command
+
+		metrics := NewMetricsPlugin()
+		pm := NewPluginManager()
+		_ = pm.Register(NewToolFilterPlugin(map[string]string{"WebFetch": "no network access"}), &PluginConfig{Enabled: true, Priority: 10})
+		_ = pm.Register(metrics, &PluginConfig{Enabled: true, Priority: 20})
+
+		opts := &RunOptions{PluginManager: pm, ToolCallDenyMode: mode}
+		messages, err := collectStream(client.StreamPrompt(context.Background(), "Research", opts))
+		return metrics, messages, err
+	}
+
+	t.Run("abort by default", func(t *testing.T) {
+		_, _, err := run("")
+		if err == nil || !strings.Contains(err.Error(), "no network access") {
+			t.Fatalf("expected the plugin rejection to abort the run, got %v", err)
+		}
+	})
+
+	t.Run("deny tool", func(t *testing.T) {
+		metrics, messages, err := run(DenyTool)
+		if err != nil {
+			t.Fatalf("expected the run to continue, got %v", err)
+		}
+
+		var denied []Message
+		for _, msg := range messages {
+			if msg.Type == "tool_denied" {
+				denied = append(denied, msg)
+			}
+		}
+		if len(denied) != 1 || denied[0].ToolName != "WebFetch" || denied[0].ToolID != "tool-1" {
+			t.Fatalf("expected one tool_denied message for WebFetch, got %+v", denied)
+		}
+		if denied[0].PermissionResult == nil || denied[0].PermissionResult.Behavior != PermissionDeny ||
+			!strings.Contains(denied[0].PermissionMessage, "no network access") {
+			t.Errorf("expected a deny result carrying the plugin's reason, got %+v", denied[0])
+		}
+		if messages[len(messages)-1].Type != "result" {
+			t.Errorf("expected the run to reach its result, last message %+v", messages[len(messages)-1])
+		}
+		if calls := metrics.GetMetrics()["tool_calls"].(map[string]int); calls["Read"] != 1 || calls["WebFetch"] != 0 {
+			t.Errorf("expected later tool calls to be dispatched normally, got %v", calls)
+		}
+	})
+
+	if err := ValidateOptions(&RunOptions{ToolCallDenyMode: "ignore"}); err == nil {
+		t.Error("expected validation error for an unknown ToolCallDenyMode")
+	}
+}
+
+func TestStreamPrompt_ToolTimeouts(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	toolUse := `{"type":"assistant","message":{"content":[{"type":"tool_use","id":"tool-1","name":"mcp__flaky__fetch","input":{}}]},"session_id":"tool-session"}`
+	toolResult := `{"type":"user","message":{"content":[{"type":"tool_result","tool_use_id":"tool-1","content":[{"type":"text","text":"fetched"}]}]},"session_id":"tool-session"}`
+	done := `{"type":"result","subtype":"success","total_cost_usd":0.001,"session_id":"tool-session"}`
+
+	run := func(script streamScript, opts *RunOptions) (*mockPlugin, error) {
+		command, _ := mockStreamCommand(script)
+		execCommand = command
+
+		plugin := newMockPlugin("observer", "1.0.0")
+		opts.PluginManager = NewPluginManager()
+		_ = opts.PluginManager.Register(plugin, nil)
+
+		client := &ClaudeClient{BinPath: "claude"}
+		_, err := collectStream(client.StreamPrompt(context.Background(), "Fetch", opts))
+		return plugin, err
+	}
+
+	t.Run("tool overruns its timeout", func(t *testing.T) {
+		script := streamScript{lines: []string{toolUse, "sleep 5s", toolResult, done}}
+		start := time.Now()
+		plugin, err := run(script, &RunOptions{
+			ToolTimeouts: map[string]time.Duration{"mcp__flaky__fetch": 100 * time.Millisecond},
+		})
+
+		var claudeErr *ClaudeError
+		if !errors.As(err, &claudeErr) || claudeErr.Type != ErrorTimeout {
+			t.Fatalf("Expected timeout error, got %v", err)
+		}
+		if !strings.Contains(claudeErr.Message, "mcp__flaky__fetch") {
+			t.Errorf("Expected tool name in error, got %q", claudeErr.Message)
+		}
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("Expected run to abort promptly, took %v", elapsed)
+		}
+		if len(plugin.toolErrs) != 1 || !errors.As(plugin.toolErrs[0], &claudeErr) {
+			t.Errorf("Expected OnToolResult to receive the timeout error, got %v", plugin.toolErrs)
+		}
+	})
+
+	t.Run("default timeout applies", func(t *testing.T) {
+		script := streamScript{lines: []string{toolUse, "sleep 5s", toolResult, done}}
+		_, err := run(script, &RunOptions{DefaultToolTimeout: 100 * time.Millisecond})
+
+		var claudeErr *ClaudeError
+		if !errors.As(err, &claudeErr) || claudeErr.Type != ErrorTimeout {
+			t.Fatalf("Expected timeout error, got %v", err)
+		}
+	})
+
+	t.Run("tool within timeout completes", func(t *testing.T) {
+		script := streamScript{lines: []string{toolUse, toolResult, done}}
+		plugin, err := run(script, &RunOptions{
+			ToolTimeouts:       map[string]time.Duration{"mcp__flaky__fetch": 5 * time.Second},
+			DefaultToolTimeout: time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("Streaming error: %v", err)
+		}
+		if len(plugin.toolCalls) != 1 || len(plugin.toolErrs) != 1 || plugin.toolErrs[0] != nil {
+			t.Errorf("Expected one successful tool call, got calls=%v errs=%v", plugin.toolCalls, plugin.toolErrs)
+		}
+	})
+}
+
+func TestStreamPrompt_ToolUseID(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	// Two calls to the same tool whose results arrive in reverse order
+	command, _ := mockStreamCommand(streamScript{lines: []string{
+		`{"type":"assistant","message":{"content":[{"type":"tool_use","id":"toolu_a","name":"Read","input":{"file_path":"a.go"}},{"type":"tool_use","id":"toolu_b","name":"Read","input":{"file_path":"b.go"}}]},"session_id":"id-session"}`,
+		`{"type":"user","message":{"content":[{"type":"tool_result","tool_use_id":"toolu_b","content":"package b"}]},"session_id":"id-session"}`,
+		`{"type":"user","message":{"content":[{"type":"tool_result","tool_use_id":"toolu_a","content":"package a"}]},"session_id":"id-session"}`,
+		`{"type":"result","subtype":"success","session_id":"id-session"}`,
+	}})
+	execCommand = command
+
+	plugin := newMockPlugin("observer", "1.0.0")
+	pm := NewPluginManager()
+	_ = pm.Register(plugin, nil)
+	var permissionIDs []string
+	opts := &RunOptions{
+		PluginManager: pm,
+		PermissionCallback: func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
+			permissionIDs = append(permissionIDs, input.ToolUseID)
+			return Allow(), nil
+		},
+	}
+
+	client := &ClaudeClient{BinPath: "claude"}
+	if _, err := collectStream(client.StreamPrompt(context.Background(), "Read", opts)); err != nil {
+		t.Fatalf("Streaming error: %v", err)
+	}
+
+	if !reflect.DeepEqual(permissionIDs, []string{"toolu_a", "toolu_b"}) {
+		t.Errorf("Expected the permission callback to receive tool use ids, got %v", permissionIDs)
+	}
+	if len(plugin.toolInputs) != 2 || plugin.toolInputs[0].ToolUseID != "toolu_a" || plugin.toolInputs[1].ToolUseID != "toolu_b" {
+		t.Fatalf("Expected OnToolCall to receive tool use ids, got %+v", plugin.toolInputs)
+	}
+	if len(plugin.resultInputs) != 2 {
+		t.Fatalf("Expected two tool results, got %d", len(plugin.resultInputs))
+	}
+	for i, want := range []struct{ id, path string }{{"toolu_b", "b.go"}, {"toolu_a", "a.go"}} {
+		if got := plugin.resultInputs[i]; got.ToolUseID != want.id || got.FilePath != want.path {
+			t.Errorf("OnToolResult #%d got id=%q path=%q, want id=%q path=%q", i, got.ToolUseID, got.FilePath, want.id, want.path)
+		}
+	}
+}
+
+func TestStreamPrompt_ToolRetry(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	call := func(tool, id string) string {
+		return `{"type":"assistant","message":{"content":[{"type":"tool_use","id":"` + id + `","name":"` + tool + `","input":{"url":"https://example.com"}}]},"session_id":"retry-session"}`
+	}
+	failure := func(id string) string {
+		return `{"type":"user","message":{"content":[{"type":"tool_result","tool_use_id":"` + id + `","content":"503 Service Unavailable","is_error":true}]},"session_id":"retry-session"}`
+	}
+	success := func(id string) string {
+		return `{"type":"user","message":{"content":[{"type":"tool_result","tool_use_id":"` + id + `","content":"fetched"}]},"session_id":"retry-session"}`
+	}
+	start := `{"type":"system","subtype":"init","session_id":"retry-session"}`
+	done := `{"type":"result","subtype":"success","result":"done","session_id":"retry-session"}`
+
+	// The tool fails twice, then succeeds on its second retry; each attempt would finish on its own otherwise
+	scripts := func(tool string) []streamScript {
+		return []streamScript{
+			{lines: []string{start, call(tool, "tool-1"), failure("tool-1"), done}},
+			{lines: []string{call(tool, "tool-2"), failure("tool-2"), done}},
+			{lines: []string{call(tool, "tool-3"), success("tool-3"), done}},
+		}
+	}
+
+	run := func(tool string, opts *RunOptions) (*mockPlugin, [][]string, error) {
+		command, calls := mockStreamCommand(scripts(tool)...)
+		execCommand = command
+
+		plugin := newMockPlugin("observer", "1.0.0")
+		opts.PluginManager = NewPluginManager()
+		_ = opts.PluginManager.Register(plugin, nil)
+
+		client := &ClaudeClient{BinPath: "claude"}
+		_, err := collectStream(client.StreamPrompt(context.Background(), "Fetch", opts))
+		return plugin, calls(), err
+	}
+
+	t.Run("retryable tool succeeds after two failures", func(t *testing.T) {
+		plugin, calls, err := run("WebFetch", &RunOptions{ToolRetry: map[string]int{"WebFetch": 2}})
+		if err != nil {
+			t.Fatalf("Streaming error: %v", err)
+		}
+		if len(calls) != 3 {
+			t.Fatalf("Expected the call to be re-issued twice, got %d CLI invocations", len(calls))
+		}
+		for _, args := range calls[1:] {
+			joined := strings.Join(args, " ")
+			if !strings.Contains(joined, "--resume retry-session") || !strings.Contains(joined, "Retry the same WebFetch call") {
+				t.Errorf("Expected a resumed retry invocation, got %v", args)
+			}
+		}
+		if len(plugin.toolCalls) != 3 {
+			t.Errorf("Expected OnToolCall for every attempt, got %v", plugin.toolCalls)
+		}
+		if len(plugin.toolErrs) != 1 || plugin.toolErrs[0] != nil || plugin.resultInputs[0].ToolUseID != "tool-3" {
+			t.Errorf("Expected only the successful result to reach OnToolResult, got %v", plugin.toolErrs)
+		}
+	})
+
+	t.Run("consumers see each failure before its retry", func(t *testing.T) {
+		command, _ := mockStreamCommand(scripts("WebFetch")...)
+		execCommand = command
+
+		client := &ClaudeClient{BinPath: "claude"}
+		messages, err := collectStream(client.StreamPrompt(context.Background(), "Fetch", &RunOptions{ToolRetry: map[string]int{"WebFetch": 2}}))
+		if err != nil {
+			t.Fatalf("Streaming error: %v", err)
+		}
+
+		var got []string
+		for _, msg := range messages {
+			entry := msg.Type
+			for _, use := range extractToolUses(msg) {
+				entry += " call " + use.ID
+			}
+			for _, result := range extractToolResults(msg) {
+				entry += " result " + result.ToolUseID
+				if result.IsError {
+					entry += " failed"
+				}
+			}
+			got = append(got, entry)
+		}
+		want := []string{
+			"system",
+			"assistant call tool-1", "user result tool-1 failed",
+			"assistant call tool-2", "user result tool-2 failed",
+			"assistant call tool-3", "user result tool-3",
+			"result",
+		}
+		if strings.Join(got, ", ") != strings.Join(want, ", ") {
+			t.Errorf("Expected messages %v, got %v", want, got)
+		}
+	})
+
+	t.Run("retries are capped per call", func(t *testing.T) {
+		plugin, calls, err := run("WebFetch", &RunOptions{ToolRetry: map[string]int{"WebFetch": 1}})
+		if err != nil {
+			t.Fatalf("Streaming error: %v", err)
+		}
+		if len(calls) != 2 {
+			t.Fatalf("Expected a single retry, got %d CLI invocations", len(calls))
+		}
+		if len(plugin.toolErrs) != 1 || plugin.toolErrs[0] == nil {
+			t.Errorf("Expected the final failure to surface through OnToolResult, got %v", plugin.toolErrs)
+		}
+	})
+
+	t.Run("destructive tools are not retried by default", func(t *testing.T) {
+		plugin, calls, err := run("Bash", &RunOptions{ToolRetry: map[string]int{"Bash": 2}})
+		if err != nil {
+			t.Fatalf("Streaming error: %v", err)
+		}
+		if len(calls) != 1 {
+			t.Errorf("Expected no retry for Bash, got %d CLI invocations", len(calls))
+		}
+		if len(plugin.toolErrs) != 1 || plugin.toolErrs[0] == nil {
+			t.Errorf("Expected the failure to surface, got %v", plugin.toolErrs)
+		}
+
+		_, calls, err = run("Bash", &RunOptions{ToolRetry: map[string]int{"Bash": 2}, RetryDestructiveTools: true})
+		if err != nil || len(calls) != 3 {
+			t.Errorf("Expected Bash to be retried when allowed, got %d invocations, %v", len(calls), err)
+		}
+	})
+
+	t.Run("unlisted tools are not retried", func(t *testing.T) {
+		_, calls, err := run("WebFetch", &RunOptions{ToolRetry: map[string]int{"Read": 2}})
+		if err != nil || len(calls) != 1 {
+			t.Errorf("Expected no retry, got %d invocations, %v", len(calls), err)
+		}
+	})
+
+	t.Run("retries are capped per run", func(t *testing.T) {
+		// Every resumed session retries the last call successfully, then a new call fails
+		command, calls := mockStreamCommand(
+			streamScript{lines: []string{start, call("WebFetch", "tool-1"), failure("tool-1"), done}},
+			streamScript{lines: []string{call("WebFetch", "tool-2"), success("tool-2"), call("WebFetch", "tool-3"), failure("tool-3"), done}},
+		)
+		execCommand = command
+
+		client := &ClaudeClient{BinPath: "claude"}
+		_, err := collectStream(client.StreamPrompt(context.Background(), "Fetch", &RunOptions{ToolRetry: map[string]int{"WebFetch": 1}}))
+		if err != nil {
+			t.Fatalf("Streaming error: %v", err)
+		}
+		if len(calls()) != maxToolRetryResumes+1 {
+			t.Errorf("Expected %d CLI invocations, got %d", maxToolRetryResumes+1, len(calls()))
+		}
+	})
+
+	t.Run("no retry without a session", func(t *testing.T) {
+		command, calls := mockStreamCommand(streamScript{lines: []string{
+			`{"type":"assistant","message":{"content":[{"type":"tool_use","id":"tool-1","name":"WebFetch","input":{}}]}}`,
+			`{"type":"user","message":{"content":[{"type":"tool_result","tool_use_id":"tool-1","content":"503","is_error":true}]}}`,
+			`{"type":"result","subtype":"success","result":"done"}`,
+		}})
+		execCommand = command
+
+		client := &ClaudeClient{BinPath: "claude"}
+		_, err := collectStream(client.StreamPrompt(context.Background(), "Fetch", &RunOptions{ToolRetry: map[string]int{"WebFetch": 2}}))
+		if err != nil || len(calls()) != 1 {
+			t.Errorf("Expected the failure to stand without a session to resume, got %d invocations, %v", len(calls()), err)
+		}
+	})
+
+	if err := PreprocessOptions(&RunOptions{ToolRetry: map[string]int{"WebFetch": -1}}); err == nil {
+		t.Error("Expected negative retries to be rejected")
+	}
+}
+
+// fakeTimer is a timer that only fires when the test calls fire
+type fakeTimer struct {
+	fire   func()
+	resets atomic.Int32
+}
+
+func (f *fakeTimer) Reset(d time.Duration) bool {
+	f.resets.Add(1)
+	return true
+}
+
+func (f *fakeTimer) Stop() bool { return true }
+
+func TestStreamPrompt_IdleTimeout(t *testing.T) {
+	originalExecCommand := execCommand
+	originalAfterFunc := afterFunc
+	defer func() {
+		execCommand = originalExecCommand
+		afterFunc = originalAfterFunc
+	}()
+
+	timers := make(chan *fakeTimer, 1)
+	afterFunc = func(d time.Duration, f func()) afterTimer {
+		timer := &fakeTimer{fire: f}
+		timers <- timer
+		return timer
+	}
+
+	init := `{"type":"system","subtype":"init","session_id":"idle-session"}`
+	assistant := `{"type":"assistant","message":{"content":[{"type":"text","text":"thinking"}]},"session_id":"idle-session"}`
+	done := `{"type":"result","subtype":"success","total_cost_usd":0.001,"session_id":"idle-session"}`
+	client := &ClaudeClient{BinPath: "claude"}
+
+	t.Run("quiet stream aborts", func(t *testing.T) {
+		command, _ := mockStreamCommand(streamScript{lines: []string{init, assistant, "sleep 30s", done}})
+		execCommand = command
+
+		messageCh, errCh := client.StreamPrompt(context.Background(), "Stuck", &RunOptions{IdleTimeout: 200 * time.Millisecond})
+		timer := <-timers
+
+		// The CLI stalls after two messages; fire the idle timer once both have arrived
+		var messages []Message
+		for len(messages) < 2 {
+			messages = append(messages, <-messageCh)
+		}
+		timer.fire()
+		rest, err := collectStream(messageCh, errCh)
+
+		var idleErr *IdleTimeoutError
+		if !errors.As(err, &idleErr) {
+			t.Fatalf("Expected IdleTimeoutError, got %v", err)
+		}
+		if idleErr.Timeout != 200*time.Millisecond || idleErr.SessionID != "idle-session" {
+			t.Errorf("Unexpected idle error: %+v", idleErr)
+		}
+		if len(rest) != 0 {
+			t.Errorf("Expected no messages after the stall, got %d", len(rest))
+		}
+	})
+
+	t.Run("steady stream completes", func(t *testing.T) {
+		command, _ := mockStreamCommand(streamScript{lines: []string{init, assistant, assistant, assistant, done}})
+		execCommand = command
+
+		messageCh, errCh := client.StreamPrompt(context.Background(), "Busy", &RunOptions{IdleTimeout: 400 * time.Millisecond})
+		timer := <-timers
+		messages, err := collectStream(messageCh, errCh)
+		if err != nil {
+			t.Fatalf("Streaming error: %v", err)
+		}
+		if len(messages) != 5 {
+			t.Errorf("Expected 5 messages, got %d", len(messages))
+		}
+		if resets := timer.resets.Load(); resets != 5 {
+			t.Errorf("Expected the idle timer to restart on every line, got %d restarts", resets)
+		}
+	})
+}
+
+func TestRunPrompt_CancelCause(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	session := `{"type":"system","subtype":"init","session_id":"cause-session"}`
+	result := `{"type":"result","subtype":"success","total_cost_usd":2.0,"result":"done","session_id":"cause-session"}`
+	toolUse := `{"type":"assistant","message":{"content":[{"type":"tool_use","id":"tool-1","name":"Bash","input":{"command":"ls"}}]},"session_id":"cause-session"}`
+	client := &ClaudeClient{BinPath: "claude"}
+
+	reasonOf := func(t *testing.T, err error) CancelReason {
+		t.Helper()
+		var cause *CancelCause
+		if !errors.As(err, &cause) {
+			t.Fatalf("expected a CancelCause, got %T: %v", err, err)
+		}
+		return cause.Reason
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		command, _ := mockStreamCommand(streamScript{lines: []string{"sleep 5s", result}})
+		execCommand = command
+
+		_, err := client.RunPrompt("Slow", &RunOptions{Format: StreamJSONOutput, Timeout: 100 * time.Millisecond})
+		if reason := reasonOf(t, err); reason != CancelTimeout {
+			t.Errorf("expected timeout, got %s", reason)
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected the cause to wrap context.DeadlineExceeded, got %v", err)
+		}
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		command, _ := mockStreamCommand(streamScript{lines: []string{session, "sleep 5s", result}})
+		execCommand = command
+
+		_, err := collectStream(client.StreamPrompt(context.Background(), "Stuck", &RunOptions{IdleTimeout: 100 * time.Millisecond}))
+		if reason := reasonOf(t, err); reason != CancelIdle {
+			t.Errorf("expected idle, got %s", reason)
+		}
+		var idleErr *IdleTimeoutError
+		if !errors.As(err, &idleErr) || idleErr.SessionID != "cause-session" {
+			t.Errorf("expected the cause to wrap IdleTimeoutError, got %v", err)
+		}
+	})
+
+	t.Run("plugin", func(t *testing.T) {
+		command, _ := mockStreamCommand(streamScript{lines: []string{toolUse, result}})
+		execCommand = command
+
+		pm := NewPluginManager()
+		_ = pm.Register(NewToolFilterPlugin(map[string]string{"Bash": "no shell"}), nil)
+		_, err := collectStream(client.StreamPrompt(context.Background(), "List", &RunOptions{PluginManager: pm}))
+		if reason := reasonOf(t, err); reason != CancelPlugin {
+			t.Errorf("expected plugin, got %s", reason)
+		}
+		var deniedErr *PermissionDeniedError
+		if !errors.As(err, &deniedErr) || deniedErr.Reason != "no shell" {
+			t.Errorf("expected the cause to wrap the plugin's error, got %v", err)
+		}
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		execCommand = mockExecCommandContext(t, []string{"-p", "Expensive", "--output-format", "json"}, result, 0)
+
+		tracker := NewBudgetTracker(&BudgetConfig{MaxBudgetUSD: 1.0})
+		defer tracker.Close()
+		res, err := client.RunPrompt("Expensive", &RunOptions{Format: JSONOutput, BudgetTracker: tracker})
+		if reason := reasonOf(t, err); reason != CancelBudget {
+			t.Errorf("expected budget, got %s", reason)
+		}
+		if !errors.Is(err, ErrBudgetExceeded) {
+			t.Errorf("expected the cause to wrap ErrBudgetExceeded, got %v", err)
+		}
+		if res == nil || res.Result != "done" {
+			t.Errorf("expected the finished run's result alongside the error, got %+v", res)
+		}
+	})
+
+	t.Run("caller cause", func(t *testing.T) {
+		command, _ := mockStreamCommand(streamScript{lines: []string{session, "sleep 5s", result}})
+		execCommand = command
+
+		ctx, cancel := context.WithCancelCause(context.Background())
+		time.AfterFunc(100*time.Millisecond, func() { cancel(&CancelCause{Reason: "shutdown"}) })
+		_, err := collectStream(client.StreamPrompt(ctx, "Work", &RunOptions{}))
+		if reason := reasonOf(t, err); reason != "shutdown" {
+			t.Errorf("expected the caller's reason, got %s", reason)
+		}
+	})
+}
+
+func TestStreamPrompt_IncludeThinking(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	script := streamScript{lines: []string{
+		`{"type":"assistant","message":{"id":"msg-1","content":[{"type":"thinking","thinking":"Let me plan this","signature":"sig"}]},"session_id":"think-session"}`,
+		`{"type":"assistant","message":{"id":"msg-2","content":[{"type":"thinking","thinking":"The answer is 4"},{"type":"text","text":"2 + 2 = 4"}]},"session_id":"think-session"}`,
+		`{"type":"result","subtype":"success","result":"2 + 2 = 4","session_id":"think-session"}`,
+	}}
+	client := &ClaudeClient{BinPath: "claude"}
+
+	run := func(opts *RunOptions) []Message {
+		command, _ := mockStreamCommand(script)
+		execCommand = command
+		messages, err := collectStream(client.StreamPrompt(context.Background(), "Add", opts))
+		if err != nil {
+			t.Fatalf("Streaming error: %v", err)
+		}
+		return messages
+	}
+
+	t.Run("excluded by default", func(t *testing.T) {
+		messages := run(&RunOptions{})
+		if len(messages) != 2 {
+			t.Fatalf("Expected the thinking-only message to be dropped, got %d messages", len(messages))
+		}
+		body := string(messages[0].Message)
+		if strings.Contains(body, "thinking") || !strings.Contains(body, "2 + 2 = 4") || !strings.Contains(body, `"id":"msg-2"`) {
+			t.Errorf("Expected only the text block to remain, got %s", body)
+		}
+	})
+
+	t.Run("included on request", func(t *testing.T) {
+		messages := run(&RunOptions{IncludeThinking: true})
+		if len(messages) != 3 {
+			t.Fatalf("Expected all messages, got %d", len(messages))
+		}
+		if !strings.Contains(string(messages[0].Message), "Let me plan this") || !strings.Contains(string(messages[1].Message), "The answer is 4") {
+			t.Errorf("Expected thinking content to be kept, got %s and %s", messages[0].Message, messages[1].Message)
+		}
+	})
+}
+
+func TestStreamPrompt_MessageFilter(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	script := streamScript{lines: []string{
+		`{"type":"system","subtype":"init","session_id":"filter-session"}`,
+		`{"type":"assistant","message":{"content":[{"type":"text","text":"Checking"}]},"session_id":"filter-session"}`,
+		`{"type":"assistant","message":{"content":[{"type":"tool_use","id":"tool-1","name":"Bash","input":{"command":"ls"}}]},"session_id":"filter-session"}`,
+		`{"type":"user","message":{"content":[{"type":"tool_result","tool_use_id":"tool-1","content":"main.go"}]},"session_id":"filter-session"}`,
+		`{"type":"result","subtype":"success","total_cost_usd":0.01,"result":"main.go","session_id":"filter-session"}`,
+	}}
+	client := &ClaudeClient{BinPath: "claude"}
+	assistantOnly := func(msg Message) bool { return msg.Type == "assistant" }
+
+	run := func(opts *RunOptions) (*MetricsPlugin, []Message) {
+		command, _ := mockStreamCommand(script)
+		execCommand = command
+		metrics := NewMetricsPlugin()
+		opts.PluginManager = NewPluginManager()
+		_ = opts.PluginManager.Register(metrics, nil)
+		messages, err := collectStream(client.StreamPrompt(context.Background(), "List", opts))
+		if err != nil {
+			t.Fatalf("Streaming error: %v", err)
+		}
+		return metrics, messages
+	}
+
+	t.Run("plugins see the full stream by default", func(t *testing.T) {
+		var checked int
+		metrics, messages := run(&RunOptions{
+			MessageFilter: assistantOnly,
+			PermissionCallback: func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
+				checked++
+				return Allow(), nil
+			},
+		})
+		if len(messages) != 2 || messages[0].Type != "assistant" || messages[1].Type != "assistant" {
+			t.Fatalf("Expected only the two assistant messages, got %+v", messages)
+		}
+		if checked != 1 {
+			t.Errorf("Expected filtered runs to still gate tool calls, got %d checks", checked)
+		}
+		stats := metrics.GetMetrics()
+		if stats["message_count"].(int) != 5 || stats["execution_count"].(int) != 1 {
+			t.Errorf("Expected plugins to observe every message and the result, got %v", stats)
+		}
+	})
+
+	t.Run("filtered for plugins on request", func(t *testing.T) {
+		metrics, messages := run(&RunOptions{MessageFilter: assistantOnly, FilterPluginMessages: true})
+		if len(messages) != 2 {
+			t.Fatalf("Expected only the two assistant messages, got %d", len(messages))
+		}
+		stats := metrics.GetMetrics()
+		if stats["message_count"].(int) != 2 || stats["execution_count"].(int) != 1 {
+			t.Errorf("Expected plugins to see only kept messages but still complete, got %v", stats)
+		}
+	})
+
+	t.Run("no filter keeps everything", func(t *testing.T) {
+		_, messages := run(&RunOptions{})
+		if len(messages) != 5 {
+			t.Errorf("Expected all messages without a filter, got %d", len(messages))
+		}
+	})
+}
+
+func TestStreamPrompt_AbortPatterns(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	script := streamScript{lines: []string{
+		`{"type":"system","subtype":"init","session_id":"abort-session"}`,
+		`{"type":"assistant","message":{"content":[{"type":"text","text":"Reading the config"}]},"session_id":"abort-session"}`,
+		`{"type":"assistant","message":{"content":[{"type":"text","text":"The key is sk-ant-abc123XYZ"}]},"session_id":"abort-session"}`,
+		`{"type":"result","subtype":"success","result":"done","session_id":"abort-session"}`,
+	}}
+	client := &ClaudeClient{BinPath: "claude"}
+	secret := regexp.MustCompile(`sk-ant-[A-Za-z0-9]+`)
+
+	command, _ := mockStreamCommand(script)
+	execCommand = command
+	messages, err := collectStream(client.StreamPrompt(context.Background(), "Check config", &RunOptions{
+		AbortPatterns: []*regexp.Regexp{regexp.MustCompile(`infinite loop`), secret},
+	}))
+
+	var abortErr *AbortPatternError
+	if !errors.As(err, &abortErr) {
+		t.Fatalf("Expected AbortPatternError, got %v", err)
+	}
+	if abortErr.Pattern != secret.String() || abortErr.Match != "sk-ant-abc123XYZ" || abortErr.SessionID != "abort-session" {
+		t.Errorf("Unexpected abort details: %+v", abortErr)
+	}
+	if cause, ok := err.(*CancelCause); !ok || cause.Reason != CancelAbortPattern {
+		t.Errorf("Expected a CancelAbortPattern cause, got %v", err)
+	}
+	if len(messages) != 2 {
+		t.Errorf("Expected the matching message to be withheld, got %d messages", len(messages))
+	}
+
+	command, _ = mockStreamCommand(script)
+	execCommand = command
+	if _, err := collectStream(client.StreamPrompt(context.Background(), "Check config", &RunOptions{
+		AbortPatterns: []*regexp.Regexp{regexp.MustCompile(`infinite loop`)},
+	})); err != nil {
+		t.Errorf("Expected the run to complete without a match, got %v", err)
+	}
+}
+
+func TestStreamText(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	delta := func(text string) string {
+		return `{"type":"stream_event","event":{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"` + text + `"}},"session_id":"text-session"}`
+	}
+	assistant := `{"type":"assistant","message":{"content":[{"type":"text","text":"Hello, world!"}]},"session_id":"text-session"}`
+	done := `{"type":"result","subtype":"success","result":"Hello, world!","session_id":"text-session"}`
+	client := &ClaudeClient{BinPath: "claude"}
+
+	collect := func(textCh <-chan string, errCh <-chan error) ([]string, error) {
+		var deltas []string
+		for text := range textCh {
+			deltas = append(deltas, text)
+		}
+		return deltas, <-errCh
+	}
+
+	t.Run("deltas concatenate to the final text", func(t *testing.T) {
+		command, calls := mockStreamCommand(streamScript{lines: []string{
+			`{"type":"stream_event","event":{"type":"message_start"},"session_id":"text-session"}`,
+			delta("Hel"), delta("lo, "), delta("world!"),
+			`{"type":"stream_event","event":{"type":"content_block_stop","index":0},"session_id":"text-session"}`,
+			assistant, done,
+		}})
+		execCommand = command
+
+		deltas, err := collect(client.StreamText(context.Background(), "Greet", &RunOptions{}))
+		if err != nil {
+			t.Fatalf("StreamText() error = %v", err)
+		}
+		if len(deltas) != 3 || strings.Join(deltas, "") != "Hello, world!" {
+			t.Errorf("Expected three deltas forming the final text, got %q", deltas)
+		}
+		if args := calls()[0]; !strings.Contains(strings.Join(args, " "), "--include-partial-messages") {
+			t.Errorf("Expected partial messages to be requested, got %v", args)
+		}
+	})
+
+	t.Run("falls back to whole text blocks", func(t *testing.T) {
+		command, _ := mockStreamCommand(streamScript{lines: []string{assistant, done}})
+		execCommand = command
+
+		deltas, err := collect(client.StreamText(context.Background(), "Greet", &RunOptions{}))
+		if err != nil || strings.Join(deltas, "") != "Hello, world!" {
+			t.Errorf("Expected the assistant text, got %q, %v", deltas, err)
+		}
+	})
+
+	t.Run("cancel closes the channels", func(t *testing.T) {
+		command, _ := mockStreamCommand(streamScript{lines: []string{delta("Hel"), "sleep 5s", done}})
+		execCommand = command
+
+		ctx, cancel := context.WithCancel(context.Background())
+		textCh, errCh := client.StreamText(ctx, "Greet", &RunOptions{})
+		if text := <-textCh; text != "Hel" {
+			t.Fatalf("Expected first delta, got %q", text)
+		}
+		cancel()
+
+		if _, err := collect(textCh, errCh); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	})
+}
+
+func TestStreamPrompt_AutoResume(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	disconnect := streamScript{
+		lines: []string{
+			`{"type":"system","subtype":"init","session_id":"resume-session"}`,
+			`{"type":"assistant","message":{},"session_id":"resume-session"}`,
+		},
+		exitCode: 1,
+	}
+	completion := streamScript{
+		lines: []string{
+			`{"type":"assistant","message":{},"session_id":"resume-session"}`,
+			`{"type":"result","subtype":"success","total_cost_usd":0.003,"num_turns":2,"session_id":"resume-session"}`,
+		},
+	}
+
+	t.Run("resumes after disconnect", func(t *testing.T) {
+		command, calls := mockStreamCommand(disconnect, completion)
+		execCommand = command
+
+		client := &ClaudeClient{BinPath: "claude"}
+		messages, err := collectStream(client.StreamPrompt(context.Background(), "Long task", &RunOptions{AutoResume: true}))
+		if err != nil {
+			t.Fatalf("Streaming error: %v", err)
+		}
+
+		if len(messages) != 4 {
+			t.Fatalf("Expected 4 messages, got %d", len(messages))
+		}
+		if messages[3].Type != "result" {
+			t.Errorf("Expected stream to end with result, got %s", messages[3].Type)
+		}
+
+		invocations := calls()
+		if len(invocations) != 2 {
+			t.Fatalf("Expected 2 CLI invocations, got %d", len(invocations))
+		}
+		resumeArgs := strings.Join(invocations[1], " ")
+		if !strings.Contains(resumeArgs, "--resume resume-session") {
+			t.Errorf("Expected resume invocation to pass --resume resume-session, got %v", invocations[1])
+		}
+	})
+
+	t.Run("caps resume attempts", func(t *testing.T) {
+		command, calls := mockStreamCommand(disconnect)
+		execCommand = command
+
+		client := &ClaudeClient{BinPath: "claude"}
+		_, err := collectStream(client.StreamPrompt(context.Background(), "Long task", &RunOptions{AutoResume: true}))
+		if err == nil {
+			t.Fatal("Expected error after exhausting resume attempts")
+		}
+		if got := len(calls()); got != maxAutoResumeAttempts+1 {
+			t.Errorf("Expected %d CLI invocations, got %d", maxAutoResumeAttempts+1, got)
+		}
+	})
+
+	t.Run("skips replayed messages", func(t *testing.T) {
+		replayed := streamScript{
+			lines: []string{
+				`{"type":"system","subtype":"init","uuid":"u-init","session_id":"resume-session"}`,
+				`{"type":"assistant","uuid":"u-1","message":{"content":[{"type":"tool_use","id":"toolu_1","name":"Read","input":{"file_path":"a.go"}}]},"session_id":"resume-session"}`,
+			},
+			exitCode: 1,
+		}
+		resumed := streamScript{
+			lines: []string{
+				`{"type":"system","subtype":"init","uuid":"u-init","session_id":"resume-session"}`,
+				`{"type":"assistant","uuid":"u-1","message":{"content":[{"type":"tool_use","id":"toolu_1","name":"Read","input":{"file_path":"a.go"}}]},"session_id":"resume-session"}`,
+				`{"type":"assistant","uuid":"u-2","message":{},"session_id":"resume-session"}`,
+				`{"type":"result","subtype":"success","uuid":"u-3","session_id":"resume-session"}`,
+			},
+		}
+		command, _ := mockStreamCommand(replayed, resumed)
+		execCommand = command
+
+		plugin := newMockPlugin("observer", "1.0.0")
+		pm := NewPluginManager()
+		if err := pm.Register(plugin, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		client := &ClaudeClient{BinPath: "claude"}
+		messages, err := collectStream(client.StreamPrompt(context.Background(), "Long task", &RunOptions{AutoResume: true, PluginManager: pm}))
+		if err != nil {
+			t.Fatalf("Streaming error: %v", err)
+		}
+
+		var uuids []string
+		for _, msg := range messages {
+			uuids = append(uuids, msg.UUID)
+		}
+		if want := []string{"u-init", "u-1", "u-2", "u-3"}; !reflect.DeepEqual(uuids, want) {
+			t.Errorf("Expected each message once, got %v", uuids)
+		}
+		if len(plugin.messages) != 4 || !reflect.DeepEqual(plugin.toolCalls, []string{"Read"}) {
+			t.Errorf("Expected plugins to see each message and tool call once, got %d messages and %v", len(plugin.messages), plugin.toolCalls)
+		}
+	})
+
+	t.Run("bounds remembered messages", func(t *testing.T) {
+		state := &streamState{}
+		for i := 0; i <= maxSeenMessages; i++ {
+			state.seenBefore(fmt.Sprintf("u-%d", i))
+		}
+		if len(state.seen) != maxSeenMessages || len(state.seenOrder) != maxSeenMessages {
+			t.Errorf("Expected at most %d remembered messages, got %d", maxSeenMessages, len(state.seen))
+		}
+		if !state.seenBefore("u-1") || state.seenBefore("u-0") || state.seenBefore("") {
+			t.Error("Expected the oldest message to be forgotten first and empty UUIDs to be ignored")
+		}
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		command, calls := mockStreamCommand(disconnect, completion)
+		execCommand = command
+
+		client := &ClaudeClient{BinPath: "claude"}
+		_, err := collectStream(client.StreamPrompt(context.Background(), "Long task", &RunOptions{}))
+		if err == nil {
+			t.Fatal("Expected disconnect error without AutoResume")
+		}
+		if got := len(calls()); got != 1 {
+			t.Errorf("Expected 1 CLI invocation, got %d", got)
+		}
+	})
+}
+
+func TestRunFromStdin(t *testing.T) {
+	origExecCommand := execCommand
+	defer func() {
+		execCommand = origExecCommand
+	}()
+
+	// Test with text input from stdin
+	execCommand = mockExecCommandContext(t, []string{"-p", "--output-format", "text"}, "Analyzed your input", 0)
+
+	client := &ClaudeClient{BinPath: "claude"}
+	stdin := bytes.NewBufferString("Code to analyze")
+
+	result, err := client.RunFromStdin(stdin, "", &RunOptions{Format: TextOutput})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if result.Result != "Analyzed your input" {
+		t.Errorf("Expected %q, got %q", "Analyzed your input", result.Result)
+	}
+}
+
+func TestBuildArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		prompt   string
+		opts     *RunOptions
+		expected []string
+	}{
+		{
+			name:     "Basic prompt",
+			prompt:   "Hello",
+			opts:     &RunOptions{},
+			expected: []string{"-p", "Hello"},
+		},
+		{
+			name:   "All options",
+			prompt: "Complete test",
+			opts: &RunOptions{
+				Format:          JSONOutput,
+				SystemPrompt:    "Custom system prompt",
+				AppendPrompt:    "Additional instructions",
+				MCPConfigPath:   "/path/to/mcp.json",
+				AllowedTools:    []string{"tool1", "tool2"},
+				DisallowedTools: []string{"bad1", "bad2"},
+				PermissionTool:  "permit_tool",
+				ResumeID:        "session123",
+				MaxTurns:        5,
+				Verbose:         true,
+				Model:           "claude-3-5-sonnet-20240620",
+			},
+			expected: []string{
+				"-p", "Complete test",
+				"--output-format", "json",
+				"--system-prompt", "Custom system prompt",
+				"--append-system-prompt", "Additional instructions",
+				"--mcp-config", "/path/to/mcp.json",
+				"--allowedTools", "tool1,tool2",
+				"--disallowedTools", "bad1,bad2",
+				"--permission-prompt-tool", "permit_tool",
+				"--resume", "session123",
+				"--max-turns", "5",
+				"--verbose",
+				"--model", "claude-3-5-sonnet-20240620",
+			},
+		},
+		{
+			name:   "Continue session",
+			prompt: "Continue",
+			opts: &RunOptions{
+				Continue: true,
+			},
+			expected: []string{"-p", "Continue", "--continue"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := BuildArgs(tt.prompt, tt.opts)
+
+			if len(args) != len(tt.expected) {
+				t.Errorf("Expected %d arguments, got %d", len(tt.expected), len(args))
+				t.Logf("Expected: %v", tt.expected)
+				t.Logf("Got: %v", args)
+				return
+			}
+
+			for i, arg := range args {
+				if arg != tt.expected[i] {
+					t.Errorf("Expected arg[%d] to be %q, got %q", i, tt.expected[i], arg)
+				}
+			}
+		})
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	client := NewClient("claude-bin-path")
+
+	if client.BinPath != "claude-bin-path" {
+		t.Errorf("Expected BinPath to be %q, got %q", "claude-bin-path", client.BinPath)
+	}
+
+	if client.DefaultOptions == nil {
+		t.Error("DefaultOptions should not be nil")
+	}
+
+	if client.DefaultOptions.Format != TextOutput {
+		t.Errorf("Expected default format to be %q, got %q", TextOutput, client.DefaultOptions.Format)
+	}
+}
+
+func TestNewClientAuto(t *testing.T) {
+	// writeFakeClaude creates an executable script named name in a new directory and returns its path
+	writeFakeClaude := func(t *testing.T, name string) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(path, []byte("#!/bin/sh\necho fake\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	t.Run("found on PATH", func(t *testing.T) {
+		fake := writeFakeClaude(t, "claude")
+		t.Setenv("PATH", filepath.Dir(fake))
+		t.Setenv(ClaudePathEnv, "")
+
+		client, err := NewClientAuto()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if client.BinPath != fake || client.DefaultOptions.Format != TextOutput {
+			t.Errorf("expected a default client for %q, got %q", fake, client.BinPath)
+		}
+	})
+
+	t.Run("env override", func(t *testing.T) {
+		onPath := writeFakeClaude(t, "claude")
+		override := writeFakeClaude(t, "claude-dev")
+		t.Setenv("PATH", filepath.Dir(onPath))
+		t.Setenv(ClaudePathEnv, override)
+
+		client, err := NewClientAuto()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if client.BinPath != override {
+			t.Errorf("expected %s to take precedence over PATH, got %q", ClaudePathEnv, client.BinPath)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		t.Setenv("PATH", t.TempDir())
+		for _, override := range []string{"", filepath.Join(t.TempDir(), "missing")} {
+			t.Setenv(ClaudePathEnv, override)
+			client, err := NewClientAuto()
+			var claudeErr *ClaudeError
+			if client != nil || !errors.As(err, &claudeErr) || claudeErr.Type != ErrorCommand {
+				t.Fatalf("expected a command error, got %v, %v", client, err)
+			}
+			if !errors.Is(err, exec.ErrNotFound) && !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("expected the lookup error to be wrapped, got %v", err)
+			}
+			if !strings.Contains(err.Error(), ClaudePathEnv) {
+				t.Errorf("expected guidance mentioning %s, got %q", ClaudePathEnv, err.Error())
+			}
+		}
+	})
+}
+
+func TestRunPrompt_Durations(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	client := &ClaudeClient{BinPath: "claude"}
+
+	t.Run("json", func(t *testing.T) {
+		output := `{"type":"result","subtype":"success","total_cost_usd":0.001,"duration_ms":1234,"duration_api_ms":1000,"num_turns":1,"result":"JSON response","session_id":"abc123"}`
+		execCommand = mockExecCommandContext(t, []string{"-p", "Time me", "--output-format", "json"}, output, 0)
+
+		result, err := client.RunPrompt("Time me", &RunOptions{Format: JSONOutput})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if result.DurationMS != 1234 || result.Duration() != 1234*time.Millisecond {
+			t.Errorf("Expected a 1.234s duration, got %d (%v)", result.DurationMS, result.Duration())
+		}
+		if result.DurationAPIMS != 1000 || result.APIDuration() != time.Second {
+			t.Errorf("Expected a 1s API duration, got %d (%v)", result.DurationAPIMS, result.APIDuration())
+		}
+	})
+
+	t.Run("stream-json", func(t *testing.T) {
+		output := strings.Join([]string{
+			`{"type":"system","subtype":"init","session_id":"stream123"}`,
+			`{"type":"assistant","message":{"content":[{"type":"text","text":"Streamed response"}]},"session_id":"stream123"}`,
+			`{"type":"result","subtype":"success","total_cost_usd":0.002,"duration_ms":2500,"duration_api_ms":2000,"num_turns":2,"result":"Streamed response","session_id":"stream123"}`,
+		}, "\n")
+		execCommand = mockExecCommandContext(t, []string{"-p", "Time me", "--output-format", "stream-json", "--verbose"}, output, 0)
+
+		result, err := client.RunPrompt("Time me", &RunOptions{Format: StreamJSONOutput, Verbose: true})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if result.Result != "Streamed response" || result.SessionID != "stream123" || result.NumTurns != 2 {
+			t.Errorf("Expected the result message to be parsed, got %+v", result)
+		}
+		if result.Duration() != 2500*time.Millisecond || result.APIDuration() != 2*time.Second {
+			t.Errorf("Expected 2.5s/2s durations, got %v/%v", result.Duration(), result.APIDuration())
+		}
+	})
+
+	t.Run("stream-json without a result is text", func(t *testing.T) {
+		output := `{"type":"system","subtype":"init","session_id":"stream123"}`
+		execCommand = mockExecCommandContext(t, []string{"-p", "Time me", "--output-format", "stream-json"}, output, 0)
+
+		result, err := client.RunPrompt("Time me", &RunOptions{Format: StreamJSONOutput})
+		if err != nil || result.Result != output || result.Duration() != 0 {
+			t.Errorf("Expected the raw output without durations, got %+v, %v", result, err)
+		}
+	})
+
+	if d := (&ClaudeResult{}).Duration(); d != 0 {
+		t.Errorf("Expected zero duration when the CLI reports none, got %v", d)
+	}
+}
+
+func TestRunPrompt_MaxResultBytes(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	longText := strings.Repeat("abcdefghij", 100)
+	jsonOutput := fmt.Sprintf(`{"type":"result","subtype":"success","total_cost_usd":0.02,"num_turns":3,"result":%q,"session_id":"abc123"}`, longText)
+	execCommand = mockExecCommandContext(t, []string{"-p", "Write a lot", "--output-format", "json"}, jsonOutput, 0)
+
+	client := &ClaudeClient{BinPath: "claude"}
+	result, err := client.RunPrompt("Write a lot", &RunOptions{Format: JSONOutput, MaxResultBytes: 64})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(result.Result) != 64 || result.Result != longText[:64] {
+		t.Errorf("Expected result truncated to 64 bytes, got %d", len(result.Result))
+	}
+	if !result.Truncated {
+		t.Error("Expected Truncated to be set")
+	}
+	if result.CostUSD != 0.02 || result.NumTurns != 3 || result.SessionID != "abc123" {
+		t.Errorf("Expected metadata intact, got %+v", result)
+	}
+
+	t.Run("short result untouched", func(t *testing.T) {
+		execCommand = mockExecCommandContext(t, []string{"-p", "Hi", "--output-format", "text"}, "Hello!", 0)
+		result, err := client.RunPrompt("Hi", &RunOptions{Format: TextOutput, MaxResultBytes: 64})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if result.Result != "Hello!" || result.Truncated {
+			t.Errorf("Expected untouched result, got %+v", result)
+		}
+	})
+
+	t.Run("stdin runs are truncated", func(t *testing.T) {
+		execCommand = mockExecCommandContext(t, []string{"-p", "Write a lot", "--output-format", "json"}, jsonOutput, 0)
+		result, err := client.RunFromStdinCtx(context.Background(), strings.NewReader("input"), "Write a lot", &RunOptions{Format: JSONOutput, MaxResultBytes: 64})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if result.Result != longText[:64] || !result.Truncated {
+			t.Errorf("Expected the stdin result truncated to 64 bytes, got %d bytes", len(result.Result))
+		}
+	})
+
+	t.Run("does not split runes", func(t *testing.T) {
+		res := &ClaudeResult{Result: "héllo"}
+		res.truncate(2)
+		if res.Result != "h" || !res.Truncated {
+			t.Errorf("Expected rune-safe truncation, got %q", res.Result)
+		}
+	})
+}
+
+func TestRunPrompt_PluginMetrics(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	jsonOutput := `{"type":"result","subtype":"success","total_cost_usd":0.05,"num_turns":2,"result":"done","session_id":"abc123"}`
+	execCommand = mockExecCommandContext(t, []string{"-p", "Refactor", "--output-format", "json"}, jsonOutput, 0)
+	client := &ClaudeClient{BinPath: "claude"}
+
+	t.Run("metrics plugin attached", func(t *testing.T) {
+		metrics := NewMetricsPlugin()
+		pm := NewPluginManager()
+		_ = pm.Register(metrics, nil)
+		_ = pm.OnToolCall(context.Background(), "Read", ToolInput{})
+		_ = pm.OnToolCall(context.Background(), "Read", ToolInput{})
+		_ = pm.OnToolCall(context.Background(), "Edit", ToolInput{})
+
+		result, err := client.RunPrompt("Refactor", &RunOptions{Format: JSONOutput, PluginManager: pm})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		toolCalls, ok := result.Metrics["tool_calls"].(map[string]int)
+		if !ok {
+			t.Fatalf("Expected tool_calls in metrics, got %+v", result.Metrics)
+		}
+		if toolCalls["Read"] != 2 || toolCalls["Edit"] != 1 {
+			t.Errorf("Unexpected tool counts: %v", toolCalls)
+		}
+		if result.Metrics["execution_count"] != 1 || result.Metrics["total_cost"] != 0.05 {
+			t.Errorf("Expected completion recorded in metrics, got %+v", result.Metrics)
+		}
+	})
+
+	t.Run("stdin runs", func(t *testing.T) {
+		metrics := NewMetricsPlugin()
+		pm := NewPluginManager()
+		_ = pm.Register(metrics, nil)
+
+		result, err := client.RunFromStdinCtx(context.Background(), strings.NewReader("diff"), "Refactor", &RunOptions{Format: JSONOutput, PluginManager: pm})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if result.Metrics["execution_count"] != 1 || result.Metrics["total_cost"] != 0.05 {
+			t.Errorf("Expected OnComplete to reach the metrics plugin, got %+v", result.Metrics)
+		}
+	})
+
+	t.Run("no metrics plugin", func(t *testing.T) {
+		pm := NewPluginManager()
+		_ = pm.Register(NewAuditPlugin(0), nil)
+
+		result, err := client.RunPrompt("Refactor", &RunOptions{Format: JSONOutput, PluginManager: pm})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if result.Metrics != nil {
+			t.Errorf("Expected nil metrics, got %+v", result.Metrics)
+		}
+	})
+}
+
+func TestRunPrompt_CaptureStderr(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	withStderr := func(base func(context.Context, string, ...string) *exec.Cmd, stderr string) func(context.Context, string, ...string) *exec.Cmd {
+		return func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+			cmd := base(ctx, name, arg...)
+			cmd.Env = append(cmd.Env, "GO_HELPER_STDERR="+stderr)
+			return cmd
+		}
+	}
+	client := &ClaudeClient{BinPath: "claude"}
+
+	t.Run("success", func(t *testing.T) {
+		execCommand = withStderr(mockExecCommandContext(t, []string{"-p", "Hi", "--output-format", "text"}, "Hello!", 0), "warning: config deprecated")
+
+		result, err := client.RunPrompt("Hi", &RunOptions{Format: TextOutput, CaptureStderr: true})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if result.Stderr != "warning: config deprecated" {
+			t.Errorf("Expected captured stderr, got %q", result.Stderr)
+		}
+	})
 
-	// Collect messages
-	for msg := range messageCh {
-		messages = append(messages, msg)
-	}
+	t.Run("failure", func(t *testing.T) {
+		execCommand = withStderr(mockExecCommandContext(t, []string{"-p", "Hi", "--output-format", "text"}, "", 1), "fatal: workspace is locked")
 
-	// Check for streaming errors
-	if streamErr != nil {
-		t.Fatalf("Streaming error: %v", streamErr)
-	}
+		_, err := client.RunPrompt("Hi", &RunOptions{Format: TextOutput, CaptureStderr: true})
+		var claudeErr *ClaudeError
+		if !errors.As(err, &claudeErr) {
+			t.Fatalf("Expected ClaudeError, got %v", err)
+		}
+		if claudeErr.Stderr != "fatal: workspace is locked" {
+			t.Errorf("Expected captured stderr on error, got %q", claudeErr.Stderr)
+		}
+		if !strings.Contains(err.Error(), "fatal: workspace is locked") {
+			t.Errorf("Expected stderr in error message, got %q", err.Error())
+		}
+	})
 
-	// Verify we got the expected messages
-	if len(messages) != 3 {
-		t.Fatalf("Expected 3 messages, got %d", len(messages))
-	}
+	t.Run("disabled", func(t *testing.T) {
+		execCommand = withStderr(mockExecCommandContext(t, []string{"-p", "Hi", "--output-format", "text"}, "Hello!", 0), "warning: config deprecated")
 
-	// Check first message (init)
-	if messages[0].Type != "system" || messages[0].Subtype != "init" {
-		t.Errorf("First message should be system/init, got %s/%s", messages[0].Type, messages[0].Subtype)
-	}
+		result, err := client.RunPrompt("Hi", &RunOptions{Format: TextOutput})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if result.Stderr != "" {
+			t.Errorf("Expected no stderr without CaptureStderr, got %q", result.Stderr)
+		}
+	})
 
-	// Check last message (result)
-	if messages[2].Type != "result" || messages[2].CostUSD != 0.002 {
-		t.Errorf("Last message should be result with cost 0.002, got %s with cost %f",
-			messages[2].Type, messages[2].CostUSD)
-	}
+	t.Run("bounded", func(t *testing.T) {
+		captured := capturedStderr(strings.Repeat("x", maxCapturedStderr) + "final complaint")
+		if !strings.HasSuffix(captured, "final complaint") || len(captured) > maxCapturedStderr+len("...(truncated)\n") {
+			t.Errorf("Expected bounded tail of stderr, got %d bytes", len(captured))
+		}
+	})
 }
 
-func TestRunFromStdin(t *testing.T) {
-	origExecCommand := execCommand
+func TestRunPrompt_ExitError(t *testing.T) {
+	originalExecCommand := execCommand
 	defer func() {
-		execCommand = origExecCommand
+		execCommand = originalExecCommand
 	}()
 
-	// Test with text input from stdin
-	execCommand = mockExecCommandContext(t, []string{"-p", "--output-format", "text"}, "Analyzed your input", 0)
-
 	client := &ClaudeClient{BinPath: "claude"}
-	stdin := bytes.NewBufferString("Code to analyze")
+	args := []string{"-p", "Hi", "--output-format", "text"}
+	for _, tt := range []struct {
+		code   int
+		stderr string
+		want   ErrorType
+	}{
+		{1, "Error: Invalid API key", ErrorAuthentication},
+		{2, "error: unknown option '--bogus'", ErrorCommand},
+	} {
+		mock := mockExecCommandContext(t, args, "", tt.code)
+		execCommand = func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+			cmd := mock(ctx, name, arg...)
+			cmd.Env = append(cmd.Env, "GO_HELPER_STDERR="+tt.stderr)
+			return cmd
+		}
 
-	result, err := client.RunFromStdin(stdin, "", &RunOptions{Format: TextOutput})
-	if err != nil {
-		t.Fatalf("Expected no error, got %v", err)
+		_, err := client.RunPrompt("Hi", &RunOptions{Format: TextOutput})
+		var exitErr *ExitError
+		if !errors.As(err, &exitErr) {
+			t.Fatalf("code %d: expected an ExitError, got %v", tt.code, err)
+		}
+		if exitErr.Code != tt.code || exitErr.Stderr != tt.stderr {
+			t.Errorf("expected code %d with stderr %q, got %d with %q", tt.code, tt.stderr, exitErr.Code, exitErr.Stderr)
+		}
+		var processErr *exec.ExitError
+		if !errors.As(err, &processErr) || processErr.ExitCode() != tt.code {
+			t.Errorf("code %d: expected the process error to stay reachable, got %v", tt.code, err)
+		}
+		var claudeErr *ClaudeError
+		if !errors.As(err, &claudeErr) || claudeErr.Type != tt.want || claudeErr.Code != tt.code {
+			t.Errorf("code %d: expected a %s ClaudeError, got %v", tt.code, tt.want, err)
+		}
 	}
 
-	if result.Result != "Analyzed your input" {
-		t.Errorf("Expected %q, got %q", "Analyzed your input", result.Result)
+	// A binary that cannot be started never exited, so there is no exit code to report
+	execCommand = exec.CommandContext
+	_, err := (&ClaudeClient{BinPath: filepath.Join(t.TempDir(), "missing")}).RunPrompt("Hi", &RunOptions{Format: TextOutput})
+	var exitErr *ExitError
+	if err == nil || errors.As(err, &exitErr) {
+		t.Errorf("expected a start failure without an ExitError, got %v", err)
 	}
 }
 
-func TestBuildArgs(t *testing.T) {
+func TestClaudeResult_FormatCost(t *testing.T) {
 	tests := []struct {
-		name     string
-		prompt   string
-		opts     *RunOptions
-		expected []string
+		name      string
+		cost      float64
+		precision int
+		want      string
 	}{
-		{
-			name:     "Basic prompt",
-			prompt:   "Hello",
-			opts:     &RunOptions{},
-			expected: []string{"-p", "Hello"},
-		},
-		{
-			name:   "All options",
-			prompt: "Complete test",
-			opts: &RunOptions{
-				Format:          JSONOutput,
-				SystemPrompt:    "Custom system prompt",
-				AppendPrompt:    "Additional instructions",
-				MCPConfigPath:   "/path/to/mcp.json",
-				AllowedTools:    []string{"tool1", "tool2"},
-				DisallowedTools: []string{"bad1", "bad2"},
-				PermissionTool:  "permit_tool",
-				ResumeID:        "session123",
-				MaxTurns:        5,
-				Verbose:         true,
-				Model:           "claude-3-5-sonnet-20240620",
-			},
-			expected: []string{
-				"-p", "Complete test",
-				"--output-format", "json",
-				"--system-prompt", "Custom system prompt",
-				"--append-system-prompt", "Additional instructions",
-				"--mcp-config", "/path/to/mcp.json",
-				"--allowedTools", "tool1,tool2",
-				"--disallowedTools", "bad1,bad2",
-				"--permission-prompt-tool", "permit_tool",
-				"--resume", "session123",
-				"--max-turns", "5",
-				"--verbose",
-				"--model", "claude-3-5-sonnet-20240620",
-			},
-		},
-		{
-			name:   "Continue session",
-			prompt: "Continue",
-			opts: &RunOptions{
-				Continue: true,
-			},
-			expected: []string{"-p", "Continue", "--continue"},
-		},
+		{"Typical cost", 0.0123, 4, "$0.0123"},
+		{"Rounds to precision", 0.123456, 4, "$0.1235"},
+		{"Near-zero cost", 0.00001, 4, "$0.0000"},
+		{"Zero cost", 0, 4, "$0.0000"},
+		{"Custom precision", 1.5, 2, "$1.50"},
+		{"Negative precision clamps to zero", 2.4, -1, "$2"},
 	}
 
+	defer SetCostPrecision(4)
+
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			args := BuildArgs(tt.prompt, tt.opts)
-
-			if len(args) != len(tt.expected) {
-				t.Errorf("Expected %d arguments, got %d", len(tt.expected), len(args))
-				t.Logf("Expected: %v", tt.expected)
-				t.Logf("Got: %v", args)
-				return
-			}
-
-			for i, arg := range args {
-				if arg != tt.expected[i] {
-					t.Errorf("Expected arg[%d] to be %q, got %q", i, tt.expected[i], arg)
-				}
+			SetCostPrecision(tt.precision)
+			result := &ClaudeResult{CostUSD: tt.cost}
+			if got := result.FormatCost(); got != tt.want {
+				t.Errorf("FormatCost() = %q, want %q", got, tt.want)
 			}
 		})
 	}
 }
 
-func TestNewClient(t *testing.T) {
-	client := NewClient("claude-bin-path")
-
-	if client.BinPath != "claude-bin-path" {
-		t.Errorf("Expected BinPath to be %q, got %q", "claude-bin-path", client.BinPath)
-	}
-
-	if client.DefaultOptions == nil {
-		t.Error("DefaultOptions should not be nil")
-	}
-
-	if client.DefaultOptions.Format != TextOutput {
-		t.Errorf("Expected default format to be %q, got %q", TextOutput, client.DefaultOptions.Format)
-	}
-}
-
 func TestValidateMCPToolName(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -378,6 +1997,83 @@ func TestRunWithMCPCtx(t *testing.T) {
 	}
 }
 
+func TestRunPrompt_InlineMCPConfig(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	config := &MCPConfig{MCPServers: map[string]MCPServer{
+		"filesystem": {Command: "npx", Args: []string{"-y", "@modelcontextprotocol/server-filesystem", "/tmp"}, Env: map[string]string{"DEBUG": "1"}},
+		"remote":     {Type: "http", URL: "https://mcp.example.com", Headers: map[string]string{"Authorization": "Bearer token"}},
+	}}
+
+	var configPath string
+	var written MCPConfig
+	streamCommand, _ := mockStreamCommand(streamScript{lines: []string{`{"type":"result","result":"done","session_id":"mcp-session"}`}})
+	execCommand = func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+		for i, a := range arg {
+			if a == "--mcp-config" && i+1 < len(arg) {
+				configPath = arg[i+1]
+			}
+		}
+		data, err := os.ReadFile(configPath)
+		if err != nil {
+			t.Errorf("expected MCP config file to exist during the run: %v", err)
+		} else if err := json.Unmarshal(data, &written); err != nil {
+			t.Errorf("failed to parse generated MCP config: %v", err)
+		}
+		return streamCommand(ctx, name, arg...)
+	}
+
+	client := &ClaudeClient{BinPath: "claude"}
+	opts := &RunOptions{MCPConfig: config}
+	if _, err := collectStream(client.StreamPrompt(context.Background(), "Use MCP", opts)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if configPath == "" {
+		t.Fatal("expected --mcp-config to be passed")
+	}
+	if !reflect.DeepEqual(&written, config) {
+		t.Errorf("generated config does not match the struct:\n got %+v\nwant %+v", written, *config)
+	}
+	if _, err := os.Stat(configPath); !os.IsNotExist(err) {
+		t.Errorf("expected MCP config file to be removed after the run, stat err: %v", err)
+	}
+	if opts.MCPConfigPath != "" {
+		t.Errorf("caller options should not be modified, got MCPConfigPath %q", opts.MCPConfigPath)
+	}
+
+	// RunPrompt cleans up the same way
+	configPath = ""
+	execCommand = func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+		for i, a := range arg {
+			if a == "--mcp-config" && i+1 < len(arg) {
+				configPath = arg[i+1]
+			}
+		}
+		return mockExecCommandContext(t, arg, "ok", 0)(ctx, name, arg...)
+	}
+	if _, err := client.RunPrompt("Use MCP", &RunOptions{Format: TextOutput, MCPConfig: config}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if configPath == "" {
+		t.Fatal("expected --mcp-config to be passed")
+	}
+	if _, err := os.Stat(configPath); !os.IsNotExist(err) {
+		t.Errorf("expected MCP config file to be removed after RunPrompt, stat err: %v", err)
+	}
+
+	_, err := client.RunPrompt("Use MCP", &RunOptions{MCPConfig: config, MCPConfigPath: "/path/to/config.json"})
+	if _, ok := err.(*ClaudeError); !ok || !strings.Contains(err.Error(), "cannot both be set") {
+		t.Errorf("expected validation error when both MCP config forms are set, got %v", err)
+	}
+	_, err = client.RunPrompt("Use MCP", &RunOptions{MCPConfig: &MCPConfig{MCPServers: map[string]MCPServer{"empty": {}}}})
+	if err == nil {
+		t.Error("expected validation error for a server without command or URL")
+	}
+}
+
 func TestRunWithSystemPrompt(t *testing.T) {
 	originalExecCommand := execCommand
 	defer func() {
@@ -505,6 +2201,25 @@ func TestResumeConversationCtx(t *testing.T) {
 	}
 }
 
+func TestResumeConversationWith(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	jsonOutput := `{"type":"result","subtype":"success","result":"Resumed with new instructions","session_id":"resume123"}`
+	execCommand = mockExecCommandContext(t, []string{"-p", "Resume", "--output-format", "json", "--system-prompt", "You are a tester", "--resume", "resume123"}, jsonOutput, 0)
+
+	client := &ClaudeClient{BinPath: "claude"}
+	result, err := client.ResumeConversationWith(context.Background(), "Resume", "resume123", &ResumeOptions{SystemPrompt: "You are a tester"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Result != "Resumed with new instructions" {
+		t.Errorf("Expected 'Resumed with new instructions', got %q", result.Result)
+	}
+}
+
 // Test error handling scenarios
 func TestRunPromptCtx_MCPValidationErrors(t *testing.T) {
 	client := &ClaudeClient{BinPath: "claude"}
@@ -620,6 +2335,127 @@ func TestRunFromStdinCtx_CommandFailure(t *testing.T) {
 	}
 }
 
+func TestRunPrompt_PromptCacheUsage(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() { execCommand = originalExecCommand }()
+
+	jsonOutput := `{"type":"result","subtype":"success","total_cost_usd":0.002,"is_error":false,"num_turns":1,"result":"cached","session_id":"cache-1","usage":{"input_tokens":12,"output_tokens":40,"cache_creation_input_tokens":0,"cache_read_input_tokens":2048}}`
+	execCommand = mockExecCommandContext(t, []string{"-p", "Cache test", "--output-format", "json"}, jsonOutput, 0)
+
+	// Caching is on by default, so no flag is passed and cache activity is read from usage
+	client := &ClaudeClient{BinPath: "claude"}
+	result, err := client.RunPrompt("Cache test", &RunOptions{Format: JSONOutput})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Usage == nil {
+		t.Fatal("Expected usage to be parsed")
+	}
+	if result.Usage.CacheReadInputTokens != 2048 || result.Usage.CacheCreationInputTokens != 0 {
+		t.Errorf("Unexpected cache token counts: %+v", result.Usage)
+	}
+	if result.Usage.InputTokens != 12 || result.Usage.OutputTokens != 40 {
+		t.Errorf("Unexpected token counts: %+v", result.Usage)
+	}
+
+	execCommand = echoEnvCommand(mockExecCommandContext(t, []string{"-p", "Cache test", "--output-format", "text"}, "", 0), "DISABLE_PROMPT_CACHING")
+	result, err = client.RunPrompt("Cache test", &RunOptions{Format: TextOutput, DisablePromptCache: true})
+	if err != nil || result.Result != "DISABLE_PROMPT_CACHING=1" {
+		t.Errorf("Expected DisablePromptCache to set DISABLE_PROMPT_CACHING in the CLI environment, got %+v, %v", result, err)
+	}
+}
+
+func TestRunPrompt_MaxOutputTokens(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() { execCommand = originalExecCommand }()
+
+	jsonOutput := `{"type":"result","subtype":"success","total_cost_usd":0.01,"is_error":false,"num_turns":1,"result":"partial","session_id":"cap-1","stop_reason":"max_tokens","usage":{"input_tokens":10,"output_tokens":256}}`
+	execCommand = mockExecCommandContext(t, []string{"-p", "Long answer", "--output-format", "json"}, jsonOutput, 0)
+
+	client := &ClaudeClient{BinPath: "claude"}
+	result, err := client.RunPrompt("Long answer", &RunOptions{Format: JSONOutput, MaxOutputTokens: 256})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.MaxOutputTokens != 256 || !result.OutputTruncated {
+		t.Errorf("Expected truncation at 256 tokens, got cap %d truncated %v", result.MaxOutputTokens, result.OutputTruncated)
+	}
+
+	jsonOutput = `{"type":"result","subtype":"success","total_cost_usd":0.01,"is_error":false,"num_turns":1,"result":"done","session_id":"cap-2","stop_reason":"end_turn","usage":{"input_tokens":10,"output_tokens":20}}`
+	execCommand = mockExecCommandContext(t, []string{"-p", "Short answer", "--output-format", "json"}, jsonOutput, 0)
+	result, err = client.RunPrompt("Short answer", &RunOptions{Format: JSONOutput, MaxOutputTokens: 256})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.OutputTruncated {
+		t.Error("Expected a run finishing under the cap not to be truncated")
+	}
+
+	// The cap reaches the CLI through its environment, not argv
+	execCommand = echoEnvCommand(mockExecCommandContext(t, []string{"-p", "Env", "--output-format", "text"}, "", 0), "CLAUDE_CODE_MAX_OUTPUT_TOKENS")
+	result, err = client.RunPrompt("Env", &RunOptions{Format: TextOutput, MaxOutputTokens: 256})
+	if err != nil || result.Result != "CLAUDE_CODE_MAX_OUTPUT_TOKENS=256" {
+		t.Errorf("Expected CLAUDE_CODE_MAX_OUTPUT_TOKENS=256 in the CLI environment, got %+v, %v", result, err)
+	}
+	command, calls := mockStreamCommand(streamScript{lines: []string{`{"type":"result","result":"done","session_id":"cap-3"}`}})
+	execCommand = command
+	if _, err := collectStream(client.StreamPrompt(context.Background(), "Env", &RunOptions{MaxOutputTokens: 256})); err != nil {
+		t.Fatalf("Unexpected stream error: %v", err)
+	}
+	for _, arg := range calls()[0] {
+		if strings.Contains(arg, "max-output-tokens") {
+			t.Errorf("Expected no max output tokens flag, got %v", calls()[0])
+		}
+	}
+
+	if err := PreprocessOptions(&RunOptions{MaxOutputTokens: -1}); err == nil {
+		t.Error("Expected validation error for negative MaxOutputTokens")
+	}
+}
+
+func TestNewSessionID_Override(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() { execCommand = originalExecCommand }()
+	defer ResetSessionIDGenerator()
+
+	next := 0
+	newSessionID = func() string {
+		next++
+		return fmt.Sprintf("test-session-%d", next)
+	}
+
+	// Text output reports no session, so the spend is tagged with a generated id
+	execCommand = mockExecCommandContext(t, []string{"-p", "Hello", "--output-format", "text"}, "Hi", 0)
+	tracker := NewBudgetTracker(&BudgetConfig{MaxBudgetUSD: 10})
+	defer tracker.Close()
+	client := &ClaudeClient{BinPath: "claude"}
+	opts := &RunOptions{
+		Format:        TextOutput,
+		BudgetTracker: tracker,
+		CostSource:    func(*ClaudeResult) float64 { return 0.25 },
+	}
+	if _, err := client.RunPrompt("Hello", opts); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if spent := tracker.SessionSpent("test-session-1"); spent != 0.25 {
+		t.Errorf("Expected spend tagged with test-session-1, got %v", spent)
+	}
+
+	audit := NewAuditPlugin(0)
+	pm := NewPluginManager()
+	_ = pm.Register(audit, nil)
+	_ = pm.OnStreamStart(context.Background(), "Audit")
+	_ = pm.OnToolCall(context.Background(), "Read", ToolInput{FilePath: "main.go"})
+	if records := audit.GetRecords(); len(records) != 1 || records[0].SessionID != "test-session-2" {
+		t.Errorf("Expected audit record tagged with test-session-2, got %+v", records)
+	}
+
+	ResetSessionIDGenerator()
+	if id := newSessionID(); !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+		t.Errorf("Expected a random UUID after reset, got %q", id)
+	}
+}
+
 func TestBuildArgs_EdgeCases(t *testing.T) {
 	// Test empty prompt
 	args := BuildArgs("", &RunOptions{Format: TextOutput})
@@ -747,3 +2583,75 @@ func TestHelperProcessError(t *testing.T) {
 	defer os.Exit(1)
 	os.Stderr.Write([]byte("command failed with error"))
 }
+
+func TestMergeOptions(t *testing.T) {
+	baseCallback := func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
+		return Deny("base"), nil
+	}
+	tracker := NewBudgetTracker(nil)
+	base := &RunOptions{
+		Format:             JSONOutput,
+		SystemPrompt:       "You are helpful",
+		AllowedTools:       []string{"Read", "Grep"},
+		MaxTurns:           10,
+		Verbose:            true,
+		ToolTimeouts:       map[string]time.Duration{"Bash": time.Minute},
+		PermissionCallback: baseCallback,
+		BudgetTracker:      tracker,
+	}
+
+	t.Run("scalar override", func(t *testing.T) {
+		merged := MergeOptions(base, &RunOptions{MaxTurns: 3, ModelAlias: "haiku"})
+		if merged.MaxTurns != 3 || merged.ModelAlias != "haiku" {
+			t.Errorf("Expected overridden scalars, got MaxTurns=%d ModelAlias=%q", merged.MaxTurns, merged.ModelAlias)
+		}
+		if merged.Format != JSONOutput || merged.SystemPrompt != "You are helpful" || !merged.Verbose {
+			t.Errorf("Expected base scalars to be kept, got %+v", merged)
+		}
+	})
+
+	t.Run("slice replacement", func(t *testing.T) {
+		merged := MergeOptions(base, &RunOptions{
+			AllowedTools: []string{"Bash"},
+			ToolTimeouts: map[string]time.Duration{"Read": time.Second},
+		})
+		if len(merged.AllowedTools) != 1 || merged.AllowedTools[0] != "Bash" {
+			t.Errorf("Expected AllowedTools to be replaced, got %v", merged.AllowedTools)
+		}
+		if _, ok := merged.ToolTimeouts["Bash"]; ok || len(merged.ToolTimeouts) != 1 {
+			t.Errorf("Expected ToolTimeouts to be replaced, got %v", merged.ToolTimeouts)
+		}
+		if len(base.AllowedTools) != 2 {
+			t.Errorf("Base options were modified: %v", base.AllowedTools)
+		}
+	})
+
+	t.Run("callback fallback", func(t *testing.T) {
+		merged := MergeOptions(base, &RunOptions{MaxTurns: 1})
+		if merged.PermissionCallback == nil || merged.BudgetTracker != tracker {
+			t.Fatal("Expected nil override callbacks to fall back to base")
+		}
+		result, _ := merged.PermissionCallback(context.Background(), "Read", ToolInput{})
+		if result.Message != "base" {
+			t.Errorf("Expected base callback, got %+v", result)
+		}
+
+		merged = MergeOptions(base, &RunOptions{
+			PermissionCallback: func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
+				return Allow(), nil
+			},
+		})
+		if result, _ := merged.PermissionCallback(context.Background(), "Read", ToolInput{}); result.Behavior != PermissionAllow {
+			t.Errorf("Expected override callback, got %+v", result)
+		}
+	})
+
+	t.Run("nil arguments", func(t *testing.T) {
+		if merged := MergeOptions(nil, nil); merged == nil || merged.MaxTurns != 0 {
+			t.Errorf("Expected empty options, got %+v", merged)
+		}
+		if merged := MergeOptions(nil, base); merged.MaxTurns != 10 || merged == base {
+			t.Errorf("Expected a copy of override, got %+v", merged)
+		}
+	})
+}
@@ -22,6 +22,9 @@ type DangerousClient struct {
 	mcpDebug     bool
 }
 
+// DangerousClient can be injected wherever a claude.Runner is accepted
+var _ claude.Runner = (*DangerousClient)(nil)
+
 // SecurityGate enforces access controls for dangerous operations
 type SecurityGate struct {
 	confirmed       bool
@@ -177,6 +180,17 @@ func (c *DangerousClient) runWithDangerousFlags(ctx context.Context, prompt stri
 		return nil, fmt.Errorf("dangerous options validation failed: %w", err)
 	}
 
+	// Write an inline MCP config to disk for the CLI, without touching the caller's options
+	if opts.MCPConfig != nil {
+		runOpts := *opts
+		cleanup, err := claude.MaterializeMCPConfig(&runOpts)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+		opts = &runOpts
+	}
+
 	// Build arguments using the main package's enhanced BuildArgs
 	args := claude.BuildArgs(prompt, opts)
 
@@ -2,6 +2,7 @@ package dangerous
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/lancekrogers/claude-code-go/pkg/claude"
@@ -198,3 +199,37 @@ func findInString(s, substr string) bool {
 	}
 	return false
 }
+
+func TestDangerousClient_InlineMCPConfig(t *testing.T) {
+	os.Setenv("CLAUDE_ENABLE_DANGEROUS", "i-accept-all-risks")
+	os.Setenv("NODE_ENV", "development")
+	defer os.Unsetenv("CLAUDE_ENABLE_DANGEROUS")
+	defer os.Unsetenv("NODE_ENV")
+
+	// The fake CLI prints the contents of the file passed to --mcp-config
+	bin := filepath.Join(t.TempDir(), "claude")
+	script := "#!/bin/sh\nwhile [ $# -gt 0 ]; do\n  if [ \"$1\" = --mcp-config ]; then cat \"$2\"; exit 0; fi\n  shift\ndone\necho missing --mcp-config\n"
+	if err := os.WriteFile(bin, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewDangerousClient(bin)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	opts := &claude.RunOptions{
+		MCPConfig: &claude.MCPConfig{MCPServers: map[string]claude.MCPServer{
+			"files": {Command: "mcp-files"},
+		}},
+	}
+	result, err := client.BYPASS_ALL_PERMISSIONS("hello", opts)
+	if err != nil {
+		t.Fatalf("BYPASS_ALL_PERMISSIONS() error = %v", err)
+	}
+	if !containsString(result.Result, `"mcp-files"`) {
+		t.Errorf("expected the inline MCP config to reach the CLI, got %q", result.Result)
+	}
+	if opts.MCPConfigPath != "" {
+		t.Errorf("expected the caller's options to be left alone, got MCPConfigPath %q", opts.MCPConfigPath)
+	}
+}
@@ -0,0 +1,82 @@
+package claude
+
+import "strings"
+
+// ResultDiff describes how a result differs from a baseline result
+// Deltas are computed as b minus a
+type ResultDiff struct {
+	// CostDelta is the change in CostUSD
+	CostDelta float64
+	// TurnDelta is the change in NumTurns
+	TurnDelta int
+	// ErrorChanged is set when exactly one of the results is an error
+	ErrorChanged bool
+	// OutputDiff is a line diff of the final outputs, empty when they match
+	// Removed lines are prefixed with "- ", added lines with "+ " and unchanged lines with "  "
+	OutputDiff string
+}
+
+// IsEmpty reports whether the two results were equivalent
+func (d ResultDiff) IsEmpty() bool {
+	return d.CostDelta == 0 && d.TurnDelta == 0 && !d.ErrorChanged && d.OutputDiff == ""
+}
+
+// DiffResults compares two results, typically a baseline run a and a new run b
+// A nil result is treated as an empty result
+func DiffResults(a, b *ClaudeResult) ResultDiff {
+	if a == nil {
+		a = &ClaudeResult{}
+	}
+	if b == nil {
+		b = &ClaudeResult{}
+	}
+
+	return ResultDiff{
+		CostDelta:    b.CostUSD - a.CostUSD,
+		TurnDelta:    b.NumTurns - a.NumTurns,
+		ErrorChanged: a.IsError != b.IsError,
+		OutputDiff:   diffLines(a.Result, b.Result),
+	}
+}
+
+// diffLines returns a line diff of a and b based on their longest common subsequence
+func diffLines(a, b string) string {
+	if a == b {
+		return ""
+	}
+	left := strings.Split(a, "\n")
+	right := strings.Split(b, "\n")
+
+	// lcs[i][j] is the LCS length of left[i:] and right[j:]
+	lcs := make([][]int, len(left)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(right)+1)
+	}
+	for i := len(left) - 1; i >= 0; i-- {
+		for j := len(right) - 1; j >= 0; j-- {
+			if left[i] == right[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var sb strings.Builder
+	i, j := 0, 0
+	for i < len(left) || j < len(right) {
+		switch {
+		case i < len(left) && j < len(right) && left[i] == right[j]:
+			sb.WriteString("  " + left[i] + "\n")
+			i++
+			j++
+		case i < len(left) && (j == len(right) || lcs[i+1][j] >= lcs[i][j+1]):
+			sb.WriteString("- " + left[i] + "\n")
+			i++
+		default:
+			sb.WriteString("+ " + right[j] + "\n")
+			j++
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,61 @@
+package claude
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDiffResults(t *testing.T) {
+	baseline := &ClaudeResult{
+		Type:     "result",
+		Result:   "Found 2 issues:\n- unchecked error\n- missing test",
+		CostUSD:  0.0125,
+		NumTurns: 3,
+	}
+
+	t.Run("identical results", func(t *testing.T) {
+		same := *baseline
+		diff := DiffResults(baseline, &same)
+		if !diff.IsEmpty() {
+			t.Errorf("expected empty diff, got %+v", diff)
+		}
+	})
+
+	t.Run("drifted result", func(t *testing.T) {
+		drifted := &ClaudeResult{
+			Type:     "result",
+			Result:   "Found 2 issues:\n- unchecked error\n- race condition",
+			CostUSD:  0.02,
+			NumTurns: 5,
+		}
+
+		diff := DiffResults(baseline, drifted)
+		if diff.IsEmpty() {
+			t.Fatal("expected non-empty diff")
+		}
+		if math.Abs(diff.CostDelta-0.0075) > 1e-9 {
+			t.Errorf("CostDelta = %v, want 0.0075", diff.CostDelta)
+		}
+		if diff.TurnDelta != 2 {
+			t.Errorf("TurnDelta = %d, want 2", diff.TurnDelta)
+		}
+		if diff.ErrorChanged {
+			t.Error("ErrorChanged should be false")
+		}
+
+		want := "  Found 2 issues:\n  - unchecked error\n- - missing test\n+ - race condition\n"
+		if diff.OutputDiff != want {
+			t.Errorf("OutputDiff =\n%s\nwant\n%s", diff.OutputDiff, want)
+		}
+	})
+
+	t.Run("error and nil results", func(t *testing.T) {
+		diff := DiffResults(nil, &ClaudeResult{IsError: true, Result: "failed"})
+		if !diff.ErrorChanged {
+			t.Error("expected ErrorChanged")
+		}
+		if diff.OutputDiff != "- \n+ failed\n" {
+			t.Errorf("OutputDiff = %q", diff.OutputDiff)
+		}
+	})
+}
@@ -1,6 +1,11 @@
 package claude
 
 import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -284,3 +289,97 @@ func TestRunPromptEnhanced_Integration(t *testing.T) {
 		t.Errorf("Expected cost 0.001, got %f", result.CostUSD)
 	}
 }
+
+func TestAdditionalDirs(t *testing.T) {
+	docs, shared := t.TempDir(), t.TempDir()
+	opts := &RunOptions{AdditionalDirs: []string{docs, shared}}
+
+	if err := PreprocessOptions(opts); err != nil {
+		t.Fatalf("PreprocessOptions() error = %v", err)
+	}
+	expected := []string{"-p", "test", "--add-dir", docs, "--add-dir", shared}
+	if args := BuildArgs("test", opts); !reflect.DeepEqual(args, expected) {
+		t.Errorf("BuildArgs() = %v, want %v", args, expected)
+	}
+
+	agent := &SubagentConfig{Description: "Docs writer", Prompt: "Write docs"}
+	if sub := agent.ToRunOptions(opts); !reflect.DeepEqual(sub.AdditionalDirs, opts.AdditionalDirs) {
+		t.Errorf("subagent AdditionalDirs = %v, want %v", sub.AdditionalDirs, opts.AdditionalDirs)
+	}
+
+	missing := filepath.Join(docs, "does-not-exist")
+	err := PreprocessOptions(&RunOptions{AdditionalDirs: []string{docs, missing}})
+	if claudeErr, ok := err.(*ClaudeError); !ok || claudeErr.Type != ErrorValidation {
+		t.Errorf("expected validation error for a nonexistent directory, got %v", err)
+	}
+}
+
+func TestPreprocessOptions_PermissionConflict(t *testing.T) {
+	originalWarnf := warnf
+	defer func() { warnf = originalWarnf }()
+	var warnings []string
+	warnf = func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+	warnedConflicts.Lock()
+	warnedConflicts.keys = make(map[string]bool)
+	warnedConflicts.order = nil
+	warnedConflicts.Unlock()
+
+	callback := func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
+		return Deny("restricted"), nil
+	}
+
+	clean := []*RunOptions{
+		{PermissionMode: PermissionModeBypassPermissions},
+		{PermissionMode: PermissionModeDefault, PermissionCallback: callback, AllowedTools: []string{"Read"}},
+	}
+	for _, opts := range clean {
+		if err := PreprocessOptions(opts); err != nil {
+			t.Errorf("PreprocessOptions(%+v) error = %v", opts, err)
+		}
+	}
+	if len(warnings) != 0 {
+		t.Errorf("expected no warnings for clean options, got %v", warnings)
+	}
+
+	conflicting := []*RunOptions{
+		{PermissionMode: PermissionModeBypassPermissions, PermissionCallback: callback},
+		{PermissionMode: PermissionModeBypassPermissions, AllowedTools: []string{"Read"}},
+	}
+	for _, opts := range conflicting {
+		if err := PreprocessOptions(opts); err != nil {
+			t.Errorf("expected only a warning without StrictPermissions, got %v", err)
+		}
+	}
+	if len(warnings) != 2 || !strings.Contains(warnings[0], "PermissionCallback") || !strings.Contains(warnings[1], "AllowedTools") {
+		t.Errorf("expected a warning per conflict, got %v", warnings)
+	}
+
+	// Reused or inherited options, as in repeated subagent runs, warn only once
+	for i := 0; i < 3; i++ {
+		_ = PreprocessOptions(&RunOptions{PermissionMode: PermissionModeBypassPermissions, PermissionCallback: callback})
+	}
+	if len(warnings) != 2 {
+		t.Errorf("expected repeated conflicts not to warn again, got %v", warnings)
+	}
+
+	// Options built per run, each with distinct tools, are remembered only up to the bound
+	for i := 0; i < maxWarnedConflicts+10; i++ {
+		_ = PreprocessOptions(&RunOptions{PermissionMode: PermissionModeBypassPermissions, AllowedTools: []string{fmt.Sprintf("Tool%d", i)}})
+	}
+	warnedConflicts.Lock()
+	remembered := len(warnedConflicts.keys)
+	warnedConflicts.Unlock()
+	if remembered != maxWarnedConflicts {
+		t.Errorf("expected %d remembered conflicts, got %d", maxWarnedConflicts, remembered)
+	}
+
+	for _, opts := range conflicting {
+		opts.StrictPermissions = true
+		err := PreprocessOptions(opts)
+		if claudeErr, ok := err.(*ClaudeError); !ok || claudeErr.Type != ErrorValidation {
+			t.Errorf("expected validation error with StrictPermissions, got %v", err)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package claude
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // ErrorType represents the category of error that occurred
@@ -74,19 +77,25 @@ func (e ErrorType) IsRetryable() bool {
 
 // ClaudeError represents a structured error from Claude Code operations
 type ClaudeError struct {
-	Type     ErrorType              `json:"type"`
-	Message  string                 `json:"message"`
-	Code     int                    `json:"code,omitempty"`
-	Details  map[string]interface{} `json:"details,omitempty"`
-	Original error                  `json:"-"`
+	Type    ErrorType              `json:"type"`
+	Message string                 `json:"message"`
+	Code    int                    `json:"code,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+	// Stderr is the CLI's captured stderr, set when RunOptions.CaptureStderr is enabled
+	Stderr   string `json:"stderr,omitempty"`
+	Original error  `json:"-"`
 }
 
 // Error implements the error interface
 func (e *ClaudeError) Error() string {
+	msg := e.Message
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg = fmt.Sprintf("%s: %s", msg, stderr)
+	}
 	if e.Code != 0 {
-		return fmt.Sprintf("claude error (%s, code=%d): %s", e.Type.String(), e.Code, e.Message)
+		return fmt.Sprintf("claude error (%s, code=%d): %s", e.Type.String(), e.Code, msg)
 	}
-	return fmt.Sprintf("claude error (%s): %s", e.Type.String(), e.Message)
+	return fmt.Sprintf("claude error (%s): %s", e.Type.String(), msg)
 }
 
 // Unwrap returns the original error for error unwrapping
@@ -94,6 +103,22 @@ func (e *ClaudeError) Unwrap() error {
 	return e.Original
 }
 
+// As lets errors.As extract a *RateLimitError from rate-limit and overload errors
+func (e *ClaudeError) As(target interface{}) bool {
+	rl, ok := target.(**RateLimitError)
+	if !ok || e.Type != ErrorRateLimit {
+		return false
+	}
+	*rl = &RateLimitError{Message: e.Message}
+	if overloaded, ok := e.Details["overloaded"].(bool); ok {
+		(*rl).Overloaded = overloaded
+	}
+	if seconds, ok := e.Details["retry_after"].(int); ok {
+		(*rl).RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return true
+}
+
 // IsRetryable returns true if this specific error is retryable
 func (e *ClaudeError) IsRetryable() bool {
 	// Check type-level retryability
@@ -165,6 +190,10 @@ func (e *ClaudeError) RetryDelay() int {
 	}
 }
 
+// overloadStatusPattern matches a 529 status reported next to "status", "error", "code" or "HTTP",
+// so unrelated numbers such as "529 files" are not mistaken for an API overload
+var overloadStatusPattern = regexp.MustCompile(`(?i)\b(?:status|error|code|http)\b[\s:=]*529\b`)
+
 // ParseError analyzes stderr output and exit code to create a structured ClaudeError
 // This is exported for use by the dangerous package
 func ParseError(stderr string, exitCode int) *ClaudeError {
@@ -187,9 +216,10 @@ func ParseError(stderr string, exitCode int) *ClaudeError {
 		}
 	}
 
-	// Rate limit errors
-	if containsAny(lowerStderr, []string{
-		"rate limit", "too many requests", "429", "quota exceeded",
+	// Rate limit and API overload errors
+	overloaded := strings.Contains(lowerStderr, "overloaded") || overloadStatusPattern.MatchString(stderr)
+	if overloaded || containsAny(lowerStderr, []string{
+		"rate limit", "rate_limit", "too many requests", "429", "quota exceeded",
 		"request limit", "usage limit",
 	}) {
 		retryAfter := extractRetryAfter(stderr)
@@ -201,9 +231,15 @@ func ParseError(stderr string, exitCode int) *ClaudeError {
 			details["retry_after"] = retryAfter
 		}
 
+		message := "Rate limit exceeded - please wait before retrying"
+		if overloaded {
+			details["overloaded"] = true
+			message = "API overloaded - please wait before retrying"
+		}
+
 		return &ClaudeError{
 			Type:    ErrorRateLimit,
-			Message: "Rate limit exceeded - please wait before retrying",
+			Message: message,
 			Code:    exitCode,
 			Details: details,
 		}
@@ -392,3 +428,146 @@ func NewValidationError(message string, field string, value interface{}) *Claude
 		},
 	}
 }
+
+// UnknownAgentError is returned when a subagent name is not registered
+type UnknownAgentError struct {
+	Name string
+}
+
+// Error implements the error interface
+func (e *UnknownAgentError) Error() string {
+	return fmt.Sprintf("unknown agent: %s", e.Name)
+}
+
+// PluginNotFoundError is returned when a plugin name is not registered
+type PluginNotFoundError struct {
+	Name string
+}
+
+// Error implements the error interface
+func (e *PluginNotFoundError) Error() string {
+	return fmt.Sprintf("plugin '%s' not found", e.Name)
+}
+
+// PermissionDeniedError is returned when a tool call is denied by a permission callback or plugin
+type PermissionDeniedError struct {
+	ToolName string
+	Reason   string
+}
+
+// Error implements the error interface
+func (e *PermissionDeniedError) Error() string {
+	return fmt.Sprintf("%s: %s", e.ToolName, e.Reason)
+}
+
+// ExitError reports a CLI process that exited with a non-zero code
+// It is the Original of the *ClaudeError returned for the run; use errors.As to obtain it
+type ExitError struct {
+	// Code is the process exit code
+	Code int
+	// Stderr is the CLI's stderr, bounded to its last 64 KiB
+	Stderr string
+	// Err is the underlying *exec.ExitError
+	Err error
+}
+
+// Error implements the error interface
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("claude CLI exited with code %d", e.Code)
+}
+
+// Unwrap returns the underlying error
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// RateLimitError describes a rate-limit or API overload failure reported by the CLI
+// Use errors.As on a run error to obtain it
+type RateLimitError struct {
+	// Overloaded is set when the API reported it was overloaded rather than rate limiting the caller
+	Overloaded bool
+	// RetryAfter is the server's retry hint, or zero if none was given
+	RetryAfter time.Duration
+	Message    string
+}
+
+// Error implements the error interface
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%s (retry after %s)", e.Message, e.RetryAfter)
+	}
+	return e.Message
+}
+
+// IdleTimeoutError is returned when a stream receives no message for RunOptions.IdleTimeout
+type IdleTimeoutError struct {
+	Timeout time.Duration
+	// SessionID is the session of the aborted run, if the CLI reported one before going quiet
+	SessionID string
+}
+
+// Error implements the error interface
+func (e *IdleTimeoutError) Error() string {
+	return fmt.Sprintf("stream idle for more than %s", e.Timeout)
+}
+
+// AbortPatternError is returned when streamed assistant text matches one of RunOptions.AbortPatterns
+type AbortPatternError struct {
+	// Pattern is the source of the matching expression
+	Pattern string
+	// Match is the text the pattern matched
+	Match     string
+	SessionID string
+}
+
+// Error implements the error interface
+func (e *AbortPatternError) Error() string {
+	return fmt.Sprintf("assistant output matched abort pattern %q", e.Pattern)
+}
+
+// CancelReason identifies what stopped a run
+type CancelReason string
+
+const (
+	// CancelBudget means the run pushed its BudgetTracker past the limit
+	CancelBudget CancelReason = "budget"
+	// CancelIdle means the stream went quiet for longer than RunOptions.IdleTimeout
+	CancelIdle CancelReason = "idle"
+	// CancelTimeout means the run exceeded RunOptions.Timeout
+	CancelTimeout CancelReason = "timeout"
+	// CancelPlugin means a plugin hook returned an error that stopped the run
+	CancelPlugin CancelReason = "plugin"
+	// CancelAbortPattern means assistant text matched one of RunOptions.AbortPatterns
+	CancelAbortPattern CancelReason = "abort_pattern"
+)
+
+// CancelCause is returned when a run is stopped for a known reason; extract it with errors.As
+// Err is the underlying error, e.g. ErrBudgetExceeded, an *IdleTimeoutError or the plugin's error.
+// Callers may cancel a run's context with context.WithCancelCause and a *CancelCause of their own;
+// the run then returns that cause instead of context.Canceled
+type CancelCause struct {
+	Reason CancelReason
+	Err    error
+}
+
+// Error implements the error interface
+func (e *CancelCause) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("run cancelled: %s", e.Reason)
+	}
+	return fmt.Sprintf("run cancelled (%s): %v", e.Reason, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *CancelCause) Unwrap() error {
+	return e.Err
+}
+
+// cancelCause returns the *CancelCause ctx was cancelled with, if any
+func cancelCause(ctx context.Context) (*CancelCause, bool) {
+	var cause *CancelCause
+	if errors.As(context.Cause(ctx), &cause) {
+		return cause, true
+	}
+	return nil, false
+}
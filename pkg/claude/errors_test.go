@@ -1,7 +1,11 @@
 package claude
 
 import (
+	"context"
+	"errors"
+	"os/exec"
 	"testing"
+	"time"
 )
 
 func TestErrorType_String(t *testing.T) {
@@ -502,3 +506,128 @@ func TestContainsAny(t *testing.T) {
 		})
 	}
 }
+
+func TestTypedErrors(t *testing.T) {
+	t.Run("UnknownAgentError", func(t *testing.T) {
+		manager := NewSubagentManager(NewClient("mock-claude"))
+		_, err := manager.RunAgent(context.Background(), "ghost", "hello", nil)
+
+		var agentErr *UnknownAgentError
+		if !errors.As(err, &agentErr) {
+			t.Fatalf("expected UnknownAgentError, got %T: %v", err, err)
+		}
+		if agentErr.Name != "ghost" || err.Error() != "unknown agent: ghost" {
+			t.Errorf("unexpected error: %+v (%q)", agentErr, err.Error())
+		}
+	})
+
+	t.Run("PluginNotFoundError", func(t *testing.T) {
+		pm := NewPluginManager()
+		err := pm.SetEnabled("missing", true)
+
+		var pluginErr *PluginNotFoundError
+		if !errors.As(err, &pluginErr) {
+			t.Fatalf("expected PluginNotFoundError, got %T: %v", err, err)
+		}
+		if pluginErr.Name != "missing" || err.Error() != "plugin 'missing' not found" {
+			t.Errorf("unexpected error: %+v (%q)", pluginErr, err.Error())
+		}
+	})
+
+	t.Run("PermissionDeniedError", func(t *testing.T) {
+		pm := NewPluginManager()
+		_ = pm.Register(NewToolFilterPlugin(map[string]string{"Bash": "no shell"}), nil)
+		err := pm.OnToolCall(context.Background(), "Bash", ToolInput{Command: "ls"})
+
+		var deniedErr *PermissionDeniedError
+		if !errors.As(err, &deniedErr) {
+			t.Fatalf("expected PermissionDeniedError, got %T: %v", err, err)
+		}
+		if deniedErr.ToolName != "Bash" || deniedErr.Reason != "no shell" {
+			t.Errorf("unexpected error fields: %+v", deniedErr)
+		}
+		if err.Error() != "plugin 'tool-filter' rejected tool call: Bash: no shell" {
+			t.Errorf("unexpected message: %q", err.Error())
+		}
+	})
+}
+
+func TestRateLimitError(t *testing.T) {
+	tests := []struct {
+		name           string
+		stderr         string
+		wantOverloaded bool
+		wantRetryAfter time.Duration
+	}{
+		{
+			name:           "overloaded",
+			stderr:         `API Error: 529 {"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+			wantOverloaded: true,
+		},
+		{
+			name:           "overloaded status without a message",
+			stderr:         "request failed with status code 529",
+			wantOverloaded: true,
+		},
+		{
+			name:           "rate limited with retry hint",
+			stderr:         "API Error: 429 {\"type\":\"error\",\"error\":{\"type\":\"rate_limit_error\",\"message\":\"Number of requests has exceeded your rate limit\"}}\nretry-after: 30",
+			wantRetryAfter: 30 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := error(ParseError(tt.stderr, 1))
+
+			var rateErr *RateLimitError
+			if !errors.As(err, &rateErr) {
+				t.Fatalf("expected RateLimitError, got %T: %v", err, err)
+			}
+			if rateErr.Overloaded != tt.wantOverloaded {
+				t.Errorf("Overloaded = %v, want %v", rateErr.Overloaded, tt.wantOverloaded)
+			}
+			if rateErr.RetryAfter != tt.wantRetryAfter {
+				t.Errorf("RetryAfter = %v, want %v", rateErr.RetryAfter, tt.wantRetryAfter)
+			}
+		})
+	}
+
+	t.Run("unrelated 529 is not an overload", func(t *testing.T) {
+		err := error(ParseError("Error: processed 529 files before the build broke", 1))
+		var rateErr *RateLimitError
+		if errors.As(err, &rateErr) {
+			t.Errorf("expected a stray 529 not to be treated as an overload, got %v", err)
+		}
+	})
+
+	t.Run("surfaced from a run", func(t *testing.T) {
+		originalExecCommand := execCommand
+		defer func() {
+			execCommand = originalExecCommand
+		}()
+
+		base := mockExecCommandContext(t, []string{"-p", "Hi", "--output-format", "json"}, "", 1)
+		execCommand = func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+			cmd := base(ctx, name, arg...)
+			cmd.Env = append(cmd.Env, "GO_HELPER_STDERR=API Error: 529 Overloaded. Please try again in 15 seconds")
+			return cmd
+		}
+
+		_, err := NewClient("claude").RunPrompt("Hi", &RunOptions{Format: JSONOutput})
+		var rateErr *RateLimitError
+		if !errors.As(err, &rateErr) {
+			t.Fatalf("expected RateLimitError, got %T: %v", err, err)
+		}
+		if !rateErr.Overloaded || rateErr.RetryAfter != 15*time.Second {
+			t.Errorf("unexpected rate limit error: %+v", rateErr)
+		}
+	})
+
+	t.Run("other errors", func(t *testing.T) {
+		var rateErr *RateLimitError
+		if errors.As(error(ParseError("permission denied", 1)), &rateErr) {
+			t.Error("permission errors should not be RateLimitError")
+		}
+	})
+}
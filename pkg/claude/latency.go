@@ -0,0 +1,108 @@
+package claude
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyWindow is the number of recent runs a RunLatencyTracker keeps when no window is given
+const DefaultLatencyWindow = 1000
+
+// RunLatencyTracker records end-to-end run durations and reports their distribution
+// Only the most recent runs are kept, in a ring buffer sized by the tracker's window, so Stats
+// describes a sliding window rather than the whole process lifetime and memory stays bounded.
+// Share one tracker across clients and runs through RunOptions.LatencyTracker; it is safe for concurrent use
+type RunLatencyTracker struct {
+	mu        sync.Mutex
+	window    int
+	durations []time.Duration
+	// next is the slot the next duration overwrites once the window is full
+	next int
+}
+
+// LatencyStats summarizes the run durations recorded by a RunLatencyTracker
+// Percentiles use the nearest-rank method, so each is one of the recorded durations
+type LatencyStats struct {
+	Count int
+	Min   time.Duration
+	Max   time.Duration
+	Mean  time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+}
+
+// NewRunLatencyTracker creates an empty RunLatencyTracker that keeps the last window runs
+// A window of zero or less uses DefaultLatencyWindow
+func NewRunLatencyTracker(window int) *RunLatencyTracker {
+	return &RunLatencyTracker{window: window}
+}
+
+// Record adds the duration of one run, replacing the oldest one once the window is full
+func (lt *RunLatencyTracker) Record(d time.Duration) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	window := lt.window
+	if window <= 0 {
+		window = DefaultLatencyWindow
+	}
+	if len(lt.durations) < window {
+		lt.durations = append(lt.durations, d)
+		return
+	}
+	lt.durations[lt.next] = d
+	lt.next = (lt.next + 1) % window
+}
+
+// Stats returns the distribution of the durations in the window; all fields are zero before the first run
+func (lt *RunLatencyTracker) Stats() LatencyStats {
+	lt.mu.Lock()
+	sorted := append([]time.Duration(nil), lt.durations...)
+	lt.mu.Unlock()
+
+	if len(sorted) == 0 {
+		return LatencyStats{}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	return LatencyStats{
+		Count: len(sorted),
+		Min:   sorted[0],
+		Max:   sorted[len(sorted)-1],
+		Mean:  total / time.Duration(len(sorted)),
+		P50:   nearestRank(sorted, 50),
+		P90:   nearestRank(sorted, 90),
+		P99:   nearestRank(sorted, 99),
+	}
+}
+
+// Reset discards all recorded durations
+func (lt *RunLatencyTracker) Reset() {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.durations = nil
+	lt.next = 0
+}
+
+// nearestRank returns the p-th percentile of sorted, which must be non-empty and in ascending order
+func nearestRank(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// recordLatency records the time since start on opts.LatencyTracker, if set
+func recordLatency(opts *RunOptions, start time.Time) {
+	if opts.LatencyTracker != nil {
+		opts.LatencyTracker.Record(timeNow().Sub(start))
+	}
+}
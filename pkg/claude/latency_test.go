@@ -0,0 +1,113 @@
+package claude
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunLatencyTracker_Stats(t *testing.T) {
+	tracker := NewRunLatencyTracker(0)
+	if stats := tracker.Stats(); stats != (LatencyStats{}) {
+		t.Errorf("expected zero stats before any run, got %+v", stats)
+	}
+
+	// Record 1s..100s out of order so percentiles map directly onto seconds
+	var wg sync.WaitGroup
+	for i := 100; i >= 1; i-- {
+		wg.Add(1)
+		go func(seconds int) {
+			defer wg.Done()
+			tracker.Record(time.Duration(seconds) * time.Second)
+		}(i)
+	}
+	wg.Wait()
+
+	want := LatencyStats{
+		Count: 100,
+		Min:   time.Second,
+		Max:   100 * time.Second,
+		Mean:  50500 * time.Millisecond,
+		P50:   50 * time.Second,
+		P90:   90 * time.Second,
+		P99:   99 * time.Second,
+	}
+	if stats := tracker.Stats(); stats != want {
+		t.Errorf("Stats() = %+v, want %+v", stats, want)
+	}
+
+	tracker.Reset()
+	for _, d := range []time.Duration{300 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond} {
+		tracker.Record(d)
+	}
+	stats := tracker.Stats()
+	if stats.P50 != 200*time.Millisecond || stats.P90 != 300*time.Millisecond || stats.P99 != 300*time.Millisecond {
+		t.Errorf("unexpected percentiles for a small sample: %+v", stats)
+	}
+}
+
+func TestRunLatencyTracker_Window(t *testing.T) {
+	tracker := NewRunLatencyTracker(3)
+	for seconds := 1; seconds <= 5; seconds++ {
+		tracker.Record(time.Duration(seconds) * time.Second)
+	}
+
+	// Only the last three runs (3s, 4s, 5s) remain in the window
+	stats := tracker.Stats()
+	if stats.Count != 3 || stats.Min != 3*time.Second || stats.Max != 5*time.Second || stats.Mean != 4*time.Second {
+		t.Errorf("expected stats over the last three runs, got %+v", stats)
+	}
+
+	tracker.Reset()
+	tracker.Record(time.Second)
+	if stats := tracker.Stats(); stats.Count != 1 || stats.Max != time.Second {
+		t.Errorf("expected Reset to empty the window, got %+v", stats)
+	}
+
+	unbounded := &RunLatencyTracker{}
+	for i := 0; i < DefaultLatencyWindow+10; i++ {
+		unbounded.Record(time.Millisecond)
+	}
+	if stats := unbounded.Stats(); stats.Count != DefaultLatencyWindow {
+		t.Errorf("expected the zero value to keep DefaultLatencyWindow runs, got %d", stats.Count)
+	}
+}
+
+func TestRunPrompt_LatencyTracker(t *testing.T) {
+	originalExecCommand := execCommand
+	originalTimeNow := timeNow
+	defer func() {
+		execCommand = originalExecCommand
+		timeNow = originalTimeNow
+	}()
+
+	// Each clock reading advances two seconds, so a run spans exactly one step
+	clock := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time {
+		clock = clock.Add(2 * time.Second)
+		return clock
+	}
+
+	tracker := NewRunLatencyTracker(0)
+	client := &ClaudeClient{BinPath: "claude"}
+
+	execCommand = mockExecCommandContext(t, []string{"-p", "Hello", "--output-format", "text"}, "Hi", 0)
+	if _, err := client.RunPrompt("Hello", &RunOptions{Format: TextOutput, LatencyTracker: tracker}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	command, _ := mockStreamCommand(streamScript{lines: []string{`{"type":"result","result":"Hi","session_id":"latency"}`}})
+	execCommand = command
+	if _, err := collectStream(client.StreamPrompt(context.Background(), "Hello", &RunOptions{LatencyTracker: tracker})); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stats := tracker.Stats()
+	if stats.Count != 2 {
+		t.Fatalf("expected both runs to be recorded, got %d", stats.Count)
+	}
+	if stats.Min != 2*time.Second || stats.Max != 2*time.Second {
+		t.Errorf("expected each run to take 2s on the mocked clock, got %+v", stats)
+	}
+}
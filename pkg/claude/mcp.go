@@ -0,0 +1,299 @@
+package claude
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+)
+
+// SubagentMCPServerName is the MCP server name used by AsMCPTools
+// Each agent is exposed to the main agent as the tool "mcp__subagents__<agent name>"
+const SubagentMCPServerName = "subagents"
+
+// mcpProtocolVersion is the MCP protocol version reported when the client does not request one
+const mcpProtocolVersion = "2025-03-26"
+
+// AsMCPTools exposes every registered agent as a tool the main agent can call
+// It starts an MCP server on a loopback port and writes a temporary MCP config pointing at it;
+// pass the returned path as RunOptions.MCPConfigPath and allow the "mcp__subagents__*" tools.
+//
+// Each tool call runs the agent through RunAgent with the prompt supplied by the main agent and
+// parentOpts, which should be the main run's options so its permission callback, budget and plugins
+// apply to the agents it launches. The tool list is read on demand, so agents registered later are picked up as well.
+//
+// Requests must carry the random bearer token written to the config's headers; requests without it,
+// or from a browser page of another origin, are rejected.
+// The server runs until cleanup is called, which stops it and removes the config file;
+// call cleanup once the main run has finished
+func (sm *SubagentManager) AsMCPTools(parentOpts *RunOptions) (configPath string, cleanup func(), err error) {
+	var secret [32]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return "", nil, fmt.Errorf("failed to generate subagent MCP token: %w", err)
+	}
+	token := hex.EncodeToString(secret[:])
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to start subagent MCP server: %w", err)
+	}
+	origin := fmt.Sprintf("http://%s", listener.Addr())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mcp", func(w http.ResponseWriter, r *http.Request) {
+		if !authorizedMCPRequest(r, token, origin) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		sm.serveMCP(w, r, parentOpts)
+	})
+	server := &http.Server{Handler: mux}
+	go func() { _ = server.Serve(listener) }()
+
+	config := MCPConfig{MCPServers: map[string]MCPServer{
+		SubagentMCPServerName: {
+			Type:    "http",
+			URL:     origin + "/mcp",
+			Headers: map[string]string{"Authorization": "Bearer " + token},
+		},
+	}}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err == nil {
+		configPath, err = writeTempFile("claude-subagents-*.json", data)
+	}
+	if err != nil {
+		_ = server.Close()
+		return "", nil, fmt.Errorf("failed to write subagent MCP config: %w", err)
+	}
+
+	var once sync.Once
+	cleanup = func() {
+		once.Do(func() {
+			_ = server.Close()
+			_ = os.Remove(configPath)
+		})
+	}
+	return configPath, cleanup, nil
+}
+
+// authorizedMCPRequest reports whether r carries the bearer token and, if it has an Origin, comes from origin
+// The CLI sends no Origin; browsers always do, so a page on another origin cannot call the server
+func authorizedMCPRequest(r *http.Request, token, origin string) bool {
+	if o := r.Header.Get("Origin"); o != "" && o != origin {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
+// MCPConfig is the MCP configuration file format read by the CLI's --mcp-config flag
+type MCPConfig struct {
+	MCPServers map[string]MCPServer `json:"mcpServers"`
+}
+
+// MCPServer describes one server in an MCPConfig
+// Stdio servers set Command with optional Args and Env; http and sse servers set URL with optional Headers
+type MCPServer struct {
+	Type    string            `json:"type,omitempty"`
+	Command string            `json:"command,omitempty"`
+	Args    []string          `json:"args,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Validate checks that every server has a name and either a command or a URL
+func (mc *MCPConfig) Validate() error {
+	for name, server := range mc.MCPServers {
+		if name == "" {
+			return fmt.Errorf("MCP server name cannot be empty")
+		}
+		if server.Command == "" && server.URL == "" {
+			return fmt.Errorf("MCP server %q must set a command or a URL", name)
+		}
+	}
+	return nil
+}
+
+// MaterializeMCPConfig writes opts.MCPConfig to a temporary file and points opts.MCPConfigPath at it
+// The returned cleanup removes the file; it is a no-op when opts has no inline MCP config
+// Callers that build CLI arguments themselves with BuildArgs must call it first, or the inline config is dropped
+func MaterializeMCPConfig(opts *RunOptions) (cleanup func(), err error) {
+	if opts.MCPConfig == nil {
+		return func() {}, nil
+	}
+	data, err := json.MarshalIndent(opts.MCPConfig, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode MCP config: %w", err)
+	}
+	path, err := writeTempFile("claude-mcp-*.json", data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write MCP config: %w", err)
+	}
+	opts.MCPConfigPath = path
+	return func() { _ = os.Remove(path) }, nil
+}
+
+// writeTempFile writes data to a new temporary file matching pattern and returns its path
+func writeTempFile(pattern string, data []byte) (string, error) {
+	file, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		_ = os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// mcpRequest is a JSON-RPC request or notification sent by the MCP client
+type mcpRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// mcpResponse is a JSON-RPC response
+type mcpResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *mcpError       `json:"error,omitempty"`
+}
+
+// mcpError is a JSON-RPC error object
+type mcpError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// mcpTool describes a tool in a tools/list response
+type mcpTool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	InputSchema map[string]interface{} `json:"inputSchema"`
+}
+
+// subagentToolSchema is the input schema shared by every subagent tool
+var subagentToolSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"prompt": map[string]interface{}{
+			"type":        "string",
+			"description": "The task for the agent to carry out",
+		},
+	},
+	"required": []string{"prompt"},
+}
+
+// serveMCP handles the MCP streamable HTTP transport with plain JSON responses
+// Agents launched by tools/call run with parentOpts
+func (sm *SubagentManager) serveMCP(w http.ResponseWriter, r *http.Request, parentOpts *RunOptions) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req mcpRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeMCPResponse(w, mcpResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &mcpError{Code: -32700, Message: "parse error"}})
+		return
+	}
+
+	// Notifications carry no id and expect no response body
+	if len(req.ID) == 0 {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	resp := mcpResponse{JSONRPC: "2.0", ID: req.ID}
+	switch req.Method {
+	case "initialize":
+		var params struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		_ = json.Unmarshal(req.Params, &params)
+		if params.ProtocolVersion == "" {
+			params.ProtocolVersion = mcpProtocolVersion
+		}
+		resp.Result = map[string]interface{}{
+			"protocolVersion": params.ProtocolVersion,
+			"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}},
+			"serverInfo":      map[string]string{"name": "claude-code-go-subagents", "version": "1.0.0"},
+		}
+	case "ping":
+		resp.Result = map[string]interface{}{}
+	case "tools/list":
+		resp.Result = map[string]interface{}{"tools": sm.mcpTools()}
+	case "tools/call":
+		result, err := sm.callMCPTool(r, req.Params, parentOpts)
+		if err != nil {
+			resp.Error = &mcpError{Code: -32602, Message: err.Error()}
+		} else {
+			resp.Result = result
+		}
+	default:
+		resp.Error = &mcpError{Code: -32601, Message: "method not found: " + req.Method}
+	}
+	writeMCPResponse(w, resp)
+}
+
+// mcpTools lists the registered agents as tools, sorted by name
+func (sm *SubagentManager) mcpTools() []mcpTool {
+	descriptions := sm.GetAgentDescriptions()
+	tools := make([]mcpTool, 0, len(descriptions))
+	for name, description := range descriptions {
+		tools = append(tools, mcpTool{Name: name, Description: description, InputSchema: subagentToolSchema})
+	}
+	sort.Slice(tools, func(i, j int) bool { return tools[i].Name < tools[j].Name })
+	return tools
+}
+
+// callMCPTool runs the agent named by a tools/call request
+// Agent failures are reported as tool errors so the main agent can react to them
+func (sm *SubagentManager) callMCPTool(r *http.Request, params json.RawMessage, parentOpts *RunOptions) (map[string]interface{}, error) {
+	var call struct {
+		Name      string `json:"name"`
+		Arguments struct {
+			Prompt string `json:"prompt"`
+		} `json:"arguments"`
+	}
+	if err := json.Unmarshal(params, &call); err != nil {
+		return nil, fmt.Errorf("invalid tools/call params: %w", err)
+	}
+	if _, ok := sm.GetAgent(call.Name); !ok {
+		return nil, &UnknownAgentError{Name: call.Name}
+	}
+
+	var text string
+	var isError bool
+	if result, err := sm.RunAgent(r.Context(), call.Name, call.Arguments.Prompt, parentOpts); err != nil {
+		text, isError = err.Error(), true
+	} else {
+		text, isError = result.Result, result.IsError
+	}
+
+	return map[string]interface{}{
+		"content": []map[string]string{{"type": "text", "text": text}},
+		"isError": isError,
+	}, nil
+}
+
+// writeMCPResponse encodes resp as the JSON body of the HTTP response
+func writeMCPResponse(w http.ResponseWriter, resp mcpResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,141 @@
+package claude
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+// newMCPRequest builds a JSON-RPC request to an MCP server URL with the given headers
+func newMCPRequest(url, method string, params interface{}, headers map[string]string) *http.Request {
+	body, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": method, "params": params})
+	req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	return req
+}
+
+// postMCP sends a JSON-RPC request to an MCP server URL and decodes the result into out
+func postMCP(t *testing.T, url string, headers map[string]string, method string, params interface{}, out interface{}) {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(newMCPRequest(url, method, params, headers))
+	if err != nil {
+		t.Fatalf("%s request failed: %v", method, err)
+	}
+	defer resp.Body.Close()
+
+	var decoded struct {
+		Result json.RawMessage `json:"result"`
+		Error  *mcpError       `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		t.Fatalf("%s response could not be decoded: %v", method, err)
+	}
+	if decoded.Error != nil {
+		t.Fatalf("%s returned error: %s", method, decoded.Error.Message)
+	}
+	if err := json.Unmarshal(decoded.Result, out); err != nil {
+		t.Fatalf("%s result could not be decoded: %v", method, err)
+	}
+}
+
+func TestSubagentManager_AsMCPTools(t *testing.T) {
+	var gotPrompt string
+	var gotOpts *RunOptions
+	manager := NewSubagentManager(NewMockClient(func(prompt string, opts *RunOptions) (*ClaudeResult, error) {
+		gotPrompt, gotOpts = prompt, opts
+		return &ClaudeResult{Type: "result", Subtype: "success", Result: "no issues found"}, nil
+	}))
+	_ = manager.RegisterAgent("reviewer", CodeReviewerAgent())
+	_ = manager.RegisterAgent("tester", TestAnalystAgent())
+
+	tracker := NewBudgetTracker(&BudgetConfig{MaxBudgetUSD: 10})
+	defer tracker.Close()
+	parent := &RunOptions{BudgetTracker: tracker, PermissionCallback: ReadOnlyCallback()}
+
+	configPath, cleanup, err := manager.AsMCPTools(parent)
+	if err != nil {
+		t.Fatalf("AsMCPTools() error = %v", err)
+	}
+	defer cleanup()
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatalf("failed to read generated config: %v", err)
+	}
+	var config struct {
+		MCPServers map[string]struct {
+			Type    string            `json:"type"`
+			URL     string            `json:"url"`
+			Headers map[string]string `json:"headers"`
+		} `json:"mcpServers"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatalf("generated config is not valid JSON: %v", err)
+	}
+	server, ok := config.MCPServers[SubagentMCPServerName]
+	if !ok || server.Type != "http" || server.URL == "" || !strings.HasPrefix(server.Headers["Authorization"], "Bearer ") {
+		t.Fatalf("unexpected MCP config: %s", data)
+	}
+
+	// Requests without the token, with a wrong one, or from another origin are rejected
+	rejected := []map[string]string{
+		nil,
+		{"Authorization": "Bearer wrong"},
+		{"Authorization": server.Headers["Authorization"], "Origin": "http://evil.example"},
+	}
+	for _, headers := range rejected {
+		resp, err := http.DefaultClient.Do(newMCPRequest(server.URL, "tools/list", nil, headers))
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected headers %v to be rejected, got status %d", headers, resp.StatusCode)
+		}
+	}
+
+	var list struct {
+		Tools []mcpTool `json:"tools"`
+	}
+	postMCP(t, server.URL, server.Headers, "tools/list", nil, &list)
+	descriptions := map[string]string{}
+	for _, tool := range list.Tools {
+		descriptions[tool.Name] = tool.Description
+	}
+	if len(descriptions) != 2 ||
+		descriptions["reviewer"] != CodeReviewerAgent().Description ||
+		descriptions["tester"] != TestAnalystAgent().Description {
+		t.Errorf("unexpected tools: %+v", list.Tools)
+	}
+
+	var call struct {
+		Content []struct {
+			Text string `json:"text"`
+		} `json:"content"`
+		IsError bool `json:"isError"`
+	}
+	postMCP(t, server.URL, server.Headers, "tools/call", map[string]interface{}{
+		"name":      "reviewer",
+		"arguments": map[string]string{"prompt": "Review main.go"},
+	}, &call)
+	if call.IsError || len(call.Content) != 1 || call.Content[0].Text != "no issues found" {
+		t.Errorf("unexpected tools/call result: %+v", call)
+	}
+	if gotPrompt != "Review main.go" {
+		t.Errorf("agent received prompt %q", gotPrompt)
+	}
+	if gotOpts.BudgetTracker != tracker || gotOpts.PermissionCallback == nil {
+		t.Error("expected the agent to run under the parent options")
+	}
+
+	cleanup()
+	if _, err := os.Stat(configPath); !os.IsNotExist(err) {
+		t.Errorf("expected cleanup to remove %s, got %v", configPath, err)
+	}
+}
@@ -0,0 +1,145 @@
+package claude
+
+import (
+	"context"
+	"time"
+)
+
+// RunMiddleware wraps a Runner to add behavior around every run, like HTTP middleware
+// Cross-cutting concerns such as logging, tracing, retry and budget enforcement can be
+// written once and applied to both RunPromptCtx and StreamPrompt
+type RunMiddleware func(next Runner) Runner
+
+// RunnerFuncs adapts functions to a Runner, which keeps middleware short
+// A nil Run or Stream delegates to Next
+type RunnerFuncs struct {
+	Next   Runner
+	Run    func(ctx context.Context, prompt string, opts *RunOptions) (*ClaudeResult, error)
+	Stream func(ctx context.Context, prompt string, opts *RunOptions) (<-chan Message, <-chan error)
+}
+
+// RunPromptCtx calls Run, or Next if Run is nil
+func (f RunnerFuncs) RunPromptCtx(ctx context.Context, prompt string, opts *RunOptions) (*ClaudeResult, error) {
+	if f.Run == nil {
+		return f.Next.RunPromptCtx(ctx, prompt, opts)
+	}
+	return f.Run(ctx, prompt, opts)
+}
+
+// StreamPrompt calls Stream, or Next if Stream is nil
+func (f RunnerFuncs) StreamPrompt(ctx context.Context, prompt string, opts *RunOptions) (<-chan Message, <-chan error) {
+	if f.Stream == nil {
+		return f.Next.StreamPrompt(ctx, prompt, opts)
+	}
+	return f.Stream(ctx, prompt, opts)
+}
+
+// WrapRunner applies middleware to runner; the first middleware is the outermost, so it runs first
+func WrapRunner(runner Runner, mw ...RunMiddleware) Runner {
+	for i := len(mw) - 1; i >= 0; i-- {
+		if mw[i] != nil {
+			runner = mw[i](runner)
+		}
+	}
+	return runner
+}
+
+// Use adds middleware around the client's RunPromptCtx and StreamPrompt, and the helpers built on them
+// Middleware runs in the order added; call Use while setting up the client, not concurrently with runs
+func (c *ClaudeClient) Use(mw ...RunMiddleware) {
+	c.middleware = append(c.middleware, mw...)
+}
+
+// runner returns the client's middleware chain around the CLI-backed implementation
+func (c *ClaudeClient) runner() Runner {
+	return WrapRunner(RunnerFuncs{Run: c.runPromptCtx, Stream: c.streamPrompt}, c.middleware...)
+}
+
+// TimingMiddleware reports how long each run took, including streams, which end when their channels close
+func TimingMiddleware(observe func(prompt string, elapsed time.Duration, err error)) RunMiddleware {
+	return func(next Runner) Runner {
+		return RunnerFuncs{
+			Run: func(ctx context.Context, prompt string, opts *RunOptions) (*ClaudeResult, error) {
+				start := timeNow()
+				result, err := next.RunPromptCtx(ctx, prompt, opts)
+				observe(prompt, timeNow().Sub(start), err)
+				return result, err
+			},
+			Stream: func(ctx context.Context, prompt string, opts *RunOptions) (<-chan Message, <-chan error) {
+				start := timeNow()
+				messageCh, errCh := next.StreamPrompt(ctx, prompt, opts)
+				return observeStream(ctx, messageCh, errCh, func(err error) {
+					observe(prompt, timeNow().Sub(start), err)
+				})
+			},
+		}
+	}
+}
+
+// BudgetMiddleware charges runs without a BudgetTracker of their own to tracker and refuses
+// to start runs once tracker's budget is spent, returning a CancelBudget *CancelCause
+func BudgetMiddleware(tracker *BudgetTracker) RunMiddleware {
+	withBudget := func(opts *RunOptions) (*RunOptions, error) {
+		if tracker.RemainingBudget() == 0 {
+			return nil, &CancelCause{Reason: CancelBudget, Err: ErrBudgetExceeded}
+		}
+		if opts != nil && opts.BudgetTracker != nil {
+			return opts, nil
+		}
+		budgeted := &RunOptions{}
+		if opts != nil {
+			budgeted = copyOptionData(opts)
+		}
+		budgeted.BudgetTracker = tracker
+		return budgeted, nil
+	}
+
+	return func(next Runner) Runner {
+		return RunnerFuncs{
+			Run: func(ctx context.Context, prompt string, opts *RunOptions) (*ClaudeResult, error) {
+				opts, err := withBudget(opts)
+				if err != nil {
+					return nil, err
+				}
+				return next.RunPromptCtx(ctx, prompt, opts)
+			},
+			Stream: func(ctx context.Context, prompt string, opts *RunOptions) (<-chan Message, <-chan error) {
+				opts, err := withBudget(opts)
+				if err != nil {
+					return failedStream(err)
+				}
+				return next.StreamPrompt(ctx, prompt, opts)
+			},
+		}
+	}
+}
+
+// observeStream relays a stream unchanged and calls done with its error once it has ended
+// If ctx is canceled while the consumer is not reading, the relay stops and reports ctx.Err()
+func observeStream(ctx context.Context, messageCh <-chan Message, errCh <-chan error, done func(err error)) (<-chan Message, <-chan error) {
+	outMsgCh := make(chan Message, cap(messageCh))
+	outErrCh := make(chan error, 1)
+
+	go func() {
+		defer close(outErrCh)
+		for msg := range messageCh {
+			select {
+			case outMsgCh <- msg:
+			case <-ctx.Done():
+				close(outMsgCh)
+				done(ctx.Err())
+				outErrCh <- ctx.Err()
+				return
+			}
+		}
+		close(outMsgCh)
+
+		err := <-errCh
+		done(err)
+		if err != nil {
+			outErrCh <- err
+		}
+	}()
+
+	return outMsgCh, outErrCh
+}
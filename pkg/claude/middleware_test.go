@@ -0,0 +1,233 @@
+package claude
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tracingMiddleware appends "<name>:before" and "<name>:after" around every run
+func tracingMiddleware(name string, mu *sync.Mutex, events *[]string) RunMiddleware {
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		*events = append(*events, name+":"+event)
+	}
+	return func(next Runner) Runner {
+		return RunnerFuncs{
+			Run: func(ctx context.Context, prompt string, opts *RunOptions) (*ClaudeResult, error) {
+				record("before")
+				defer record("after")
+				return next.RunPromptCtx(ctx, prompt, opts)
+			},
+			Stream: func(ctx context.Context, prompt string, opts *RunOptions) (<-chan Message, <-chan error) {
+				record("stream")
+				return next.StreamPrompt(ctx, prompt, opts)
+			},
+		}
+	}
+}
+
+func TestWrapRunner_Order(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+
+	mock := NewMockClient(func(prompt string, opts *RunOptions) (*ClaudeResult, error) {
+		mu.Lock()
+		events = append(events, "run:"+prompt)
+		mu.Unlock()
+		return &ClaudeResult{Result: "ok"}, nil
+	})
+	runner := WrapRunner(mock,
+		tracingMiddleware("outer", &mu, &events),
+		nil,
+		tracingMiddleware("inner", &mu, &events),
+	)
+
+	result, err := runner.RunPromptCtx(context.Background(), "Hello", &RunOptions{})
+	if err != nil || result.Result != "ok" {
+		t.Fatalf("unexpected result %+v, %v", result, err)
+	}
+	want := []string{"outer:before", "inner:before", "run:Hello", "inner:after", "outer:after"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %v, want %v", events, want)
+	}
+
+	events = nil
+	if _, err := collectStream(runner.StreamPrompt(context.Background(), "Hi", &RunOptions{})); err != nil {
+		t.Fatalf("unexpected stream error: %v", err)
+	}
+	want = []string{"outer:stream", "inner:stream", "run:Hi"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("stream events = %v, want %v", events, want)
+	}
+
+	if WrapRunner(mock) != Runner(mock) {
+		t.Error("expected WrapRunner without middleware to return the runner unchanged")
+	}
+}
+
+func TestClaudeClient_Use(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	var mu sync.Mutex
+	var events []string
+	client := NewClient("claude")
+	client.Use(tracingMiddleware("first", &mu, &events), tracingMiddleware("second", &mu, &events))
+
+	execCommand = mockExecCommandContext(t, []string{"-p", "Hello", "--output-format", "text"}, "Hi", 0)
+	result, err := client.RunPrompt("Hello", nil)
+	if err != nil || result.Result != "Hi" {
+		t.Fatalf("unexpected result %+v, %v", result, err)
+	}
+	want := []string{"first:before", "second:before", "second:after", "first:after"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %v, want %v", events, want)
+	}
+
+	events = nil
+	command, _ := mockStreamCommand(streamScript{lines: []string{`{"type":"result","result":"Hi","session_id":"mw"}`}})
+	execCommand = command
+	if _, err := collectStream(client.StreamPrompt(context.Background(), "Hello", nil)); err != nil {
+		t.Fatalf("unexpected stream error: %v", err)
+	}
+	if want := []string{"first:stream", "second:stream"}; !reflect.DeepEqual(events, want) {
+		t.Errorf("stream events = %v, want %v", events, want)
+	}
+}
+
+func TestTimingMiddleware(t *testing.T) {
+	originalTimeNow := timeNow
+	defer func() { timeNow = originalTimeNow }()
+
+	// Each clock reading advances one second, so every run spans exactly one step
+	clock := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+
+	type observation struct {
+		prompt  string
+		elapsed time.Duration
+		err     error
+	}
+	var observed []observation
+	timing := TimingMiddleware(func(prompt string, elapsed time.Duration, err error) {
+		observed = append(observed, observation{prompt, elapsed, err})
+	})
+
+	failure := errors.New("boom")
+	runner := WrapRunner(NewMockClient(func(prompt string, opts *RunOptions) (*ClaudeResult, error) {
+		if prompt == "fail" {
+			return nil, failure
+		}
+		return &ClaudeResult{Result: prompt}, nil
+	}), timing)
+
+	ctx := context.Background()
+	_, _ = runner.RunPromptCtx(ctx, "ok", &RunOptions{})
+	_, _ = runner.RunPromptCtx(ctx, "fail", &RunOptions{})
+	messages, err := collectStream(runner.StreamPrompt(ctx, "stream", &RunOptions{}))
+	if err != nil || len(messages) != 1 || messages[0].Result != "stream" {
+		t.Fatalf("expected the stream to be relayed unchanged, got %+v, %v", messages, err)
+	}
+	if _, err := collectStream(runner.StreamPrompt(ctx, "fail", &RunOptions{})); !errors.Is(err, failure) {
+		t.Errorf("expected the stream error to be relayed, got %v", err)
+	}
+
+	want := []observation{
+		{"ok", time.Second, nil},
+		{"fail", time.Second, failure},
+		{"stream", time.Second, nil},
+		{"fail", time.Second, failure},
+	}
+	if !reflect.DeepEqual(observed, want) {
+		t.Errorf("observed %+v, want %+v", observed, want)
+	}
+}
+
+func TestTimingMiddleware_CanceledStream(t *testing.T) {
+	// The upstream stream emits until canceled and nobody reads the relayed messages
+	upstream := RunnerFuncs{
+		Stream: func(ctx context.Context, prompt string, opts *RunOptions) (<-chan Message, <-chan error) {
+			messageCh := make(chan Message)
+			errCh := make(chan error, 1)
+			go func() {
+				defer close(messageCh)
+				defer close(errCh)
+				for {
+					select {
+					case messageCh <- Message{Type: "assistant"}:
+					case <-ctx.Done():
+						errCh <- ctx.Err()
+						return
+					}
+				}
+			}()
+			return messageCh, errCh
+		},
+	}
+
+	observed := make(chan error, 1)
+	runner := WrapRunner(upstream, TimingMiddleware(func(prompt string, elapsed time.Duration, err error) {
+		observed <- err
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, errCh := runner.StreamPrompt(ctx, "stalled", &RunOptions{})
+	cancel()
+
+	if err := <-errCh; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the relay to stop with context.Canceled, got %v", err)
+	}
+	if err := <-observed; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the run to be observed as canceled, got %v", err)
+	}
+}
+
+func TestBudgetMiddleware(t *testing.T) {
+	tracker := NewBudgetTracker(&BudgetConfig{MaxBudgetUSD: 1})
+	defer tracker.Close()
+
+	var seen []*BudgetTracker
+	runner := WrapRunner(NewMockClient(func(prompt string, opts *RunOptions) (*ClaudeResult, error) {
+		seen = append(seen, opts.BudgetTracker)
+		return &ClaudeResult{}, nil
+	}), BudgetMiddleware(tracker))
+
+	ctx := context.Background()
+	opts := &RunOptions{}
+	if _, err := runner.RunPromptCtx(ctx, "Hello", opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.BudgetTracker != nil {
+		t.Error("expected the caller's options to be left untouched")
+	}
+
+	own := NewBudgetTracker(&BudgetConfig{MaxBudgetUSD: 5})
+	defer own.Close()
+	_, _ = runner.RunPromptCtx(ctx, "Hello", &RunOptions{BudgetTracker: own})
+	if len(seen) != 2 || seen[0] != tracker || seen[1] != own {
+		t.Errorf("expected runs to be charged to the middleware tracker unless they have their own, got %v", seen)
+	}
+
+	_ = tracker.AddSpend("session", 1)
+	_, err := runner.RunPromptCtx(ctx, "Hello", opts)
+	var cause *CancelCause
+	if !errors.As(err, &cause) || cause.Reason != CancelBudget || !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("expected a budget cancel cause once the budget is spent, got %v", err)
+	}
+	if _, err := collectStream(runner.StreamPrompt(ctx, "Hello", opts)); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("expected streams to be refused too, got %v", err)
+	}
+	if len(seen) != 2 {
+		t.Errorf("expected refused runs not to reach the runner, got %d runs", len(seen))
+	}
+}
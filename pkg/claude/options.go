@@ -0,0 +1,81 @@
+package claude
+
+import (
+	"context"
+	"time"
+)
+
+// RunOption configures a RunOptions; combine them with NewRunOptions or RunPromptWith
+type RunOption func(*RunOptions)
+
+// NewRunOptions builds RunOptions from functional options, applied in order
+func NewRunOptions(options ...RunOption) *RunOptions {
+	opts := &RunOptions{}
+	for _, option := range options {
+		option(opts)
+	}
+	return opts
+}
+
+// RunPromptWith executes a prompt with options built from the client's DefaultOptions plus options
+func (c *ClaudeClient) RunPromptWith(ctx context.Context, prompt string, options ...RunOption) (*ClaudeResult, error) {
+	opts := &RunOptions{}
+	if c.DefaultOptions != nil {
+		opts = copyOptionData(c.DefaultOptions)
+	}
+	for _, option := range options {
+		option(opts)
+	}
+	return c.RunPromptCtx(ctx, prompt, opts)
+}
+
+// WithModel selects the model; aliases (sonnet, opus, haiku) set ModelAlias, anything else sets Model
+func WithModel(model string) RunOption {
+	return func(opts *RunOptions) {
+		if isValidModelAlias(model) {
+			opts.ModelAlias, opts.Model = model, ""
+		} else {
+			opts.Model, opts.ModelAlias = model, ""
+		}
+	}
+}
+
+// WithBudget charges the run to tracker
+func WithBudget(tracker *BudgetTracker) RunOption {
+	return func(opts *RunOptions) { opts.BudgetTracker = tracker }
+}
+
+// WithPlugins runs the plugins registered with pm
+func WithPlugins(pm *PluginManager) RunOption {
+	return func(opts *RunOptions) { opts.PluginManager = pm }
+}
+
+// WithMaxTurns limits the number of agentic turns
+func WithMaxTurns(turns int) RunOption {
+	return func(opts *RunOptions) { opts.MaxTurns = turns }
+}
+
+// WithFormat sets the output format
+func WithFormat(format OutputFormat) RunOption {
+	return func(opts *RunOptions) { opts.Format = format }
+}
+
+// WithSystemPrompt overrides the default system prompt
+func WithSystemPrompt(prompt string) RunOption {
+	return func(opts *RunOptions) { opts.SystemPrompt = prompt }
+}
+
+// WithAllowedTools appends tools to AllowedTools
+func WithAllowedTools(tools ...string) RunOption {
+	return func(opts *RunOptions) { opts.AllowedTools = append(opts.AllowedTools, tools...) }
+}
+
+// WithTimeout bounds the run
+func WithTimeout(timeout time.Duration) RunOption {
+	return func(opts *RunOptions) { opts.Timeout = timeout }
+}
+
+// WithPermissionCallback decides tool permissions at runtime
+func WithPermissionCallback(callback PermissionCallback) RunOption {
+	return func(opts *RunOptions) { opts.PermissionCallback = callback }
+}
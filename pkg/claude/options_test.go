@@ -0,0 +1,71 @@
+package claude
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewRunOptions(t *testing.T) {
+	tracker := NewBudgetTracker(&BudgetConfig{MaxBudgetUSD: 5})
+	defer tracker.Close()
+	pm := NewPluginManager()
+
+	opts := NewRunOptions(
+		WithModel("sonnet"),
+		WithBudget(tracker),
+		WithPlugins(pm),
+		WithMaxTurns(5),
+		WithFormat(JSONOutput),
+		WithSystemPrompt("Be terse"),
+		WithAllowedTools("Read"),
+		WithAllowedTools("Grep", "Glob"),
+		WithTimeout(time.Minute),
+	)
+
+	want := &RunOptions{
+		ModelAlias:    "sonnet",
+		BudgetTracker: tracker,
+		PluginManager: pm,
+		MaxTurns:      5,
+		Format:        JSONOutput,
+		SystemPrompt:  "Be terse",
+		AllowedTools:  []string{"Read", "Grep", "Glob"},
+		Timeout:       time.Minute,
+	}
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("NewRunOptions() = %+v, want %+v", opts, want)
+	}
+
+	// Later options win, and a full model name replaces an alias
+	opts = NewRunOptions(WithModel("opus"), WithModel("claude-sonnet-4-20250514"), WithMaxTurns(1), WithMaxTurns(3))
+	if opts.Model != "claude-sonnet-4-20250514" || opts.ModelAlias != "" || opts.MaxTurns != 3 {
+		t.Errorf("expected later options to override earlier ones, got %+v", opts)
+	}
+
+	if opts := NewRunOptions(); !reflect.DeepEqual(opts, &RunOptions{}) {
+		t.Errorf("expected zero options without arguments, got %+v", opts)
+	}
+}
+
+func TestRunPromptWith(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	execCommand = mockExecCommandContext(t, []string{"-p", "Hello", "--output-format", "text", "--max-turns", "2", "--model", "haiku"}, "Hi", 0)
+
+	client := NewClient("claude")
+	result, err := client.RunPromptWith(context.Background(), "Hello", WithModel("haiku"), WithMaxTurns(2))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Result != "Hi" {
+		t.Errorf("expected %q, got %q", "Hi", result.Result)
+	}
+	if client.DefaultOptions.MaxTurns != 0 || client.DefaultOptions.ModelAlias != "" {
+		t.Errorf("expected DefaultOptions to be left untouched, got %+v", client.DefaultOptions)
+	}
+}
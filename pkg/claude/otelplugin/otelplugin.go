@@ -0,0 +1,178 @@
+// Package otelplugin provides an OpenTelemetry tracing plugin for the Claude Code Go SDK.
+//
+// It lives in its own module so the core SDK stays free of third-party dependencies.
+//
+// USAGE EXAMPLE:
+//
+//	tracer := otel.Tracer("my-service")
+//	pm := claude.NewPluginManager()
+//	_ = pm.Register(otelplugin.New(tracer), nil)
+//
+//	result, err := client.RunPromptCtx(ctx, "Review this code", &claude.RunOptions{
+//	    Format:        claude.JSONOutput,
+//	    PluginManager: pm,
+//	})
+//
+// Each run produces a "claude.run" span with a "claude.tool" child span per tool call.
+//
+// Runs that fail (for example on a CLI error or cancellation) never reach OnComplete. Their spans
+// stay open until the plugin's next OnStreamStart, which ends them with an error status.
+package otelplugin
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/lancekrogers/claude-code-go/pkg/claude"
+)
+
+// Span names used by OTelPlugin
+const (
+	RunSpanName  = "claude.run"
+	ToolSpanName = "claude.tool"
+)
+
+// OTelPlugin records a span per run and a child span per tool call
+// A plugin instance traces one run at a time; register separate instances for concurrent runs
+type OTelPlugin struct {
+	claude.BasePlugin
+	tracer trace.Tracer
+
+	mu        sync.Mutex
+	runCtx    context.Context
+	runSpan   trace.Span
+	toolSpans map[string][]trace.Span // toolSpanKey -> open spans in call order
+}
+
+// staleRunMessage is the error status given to spans of a run that never completed
+const staleRunMessage = "run ended without completing"
+
+// toolSpanKey identifies the span of a tool call by its tool_use id
+// Calls without an id fall back to the tool name and are matched in call order
+func toolSpanKey(toolName string, input claude.ToolInput) string {
+	if input.ToolUseID != "" {
+		return "id:" + input.ToolUseID
+	}
+	return "name:" + toolName
+}
+
+// New creates an OTelPlugin that starts spans with the given tracer
+func New(tracer trace.Tracer) *OTelPlugin {
+	return &OTelPlugin{
+		BasePlugin: claude.BasePlugin{
+			PluginName:    "otel",
+			PluginVersion: "1.0.0",
+		},
+		tracer:    tracer,
+		toolSpans: make(map[string][]trace.Span),
+	}
+}
+
+// OnStreamStart starts the run span as a child of any span in ctx
+// Spans left open by a previous run that never completed are ended with an error status first
+func (p *OTelPlugin) OnStreamStart(ctx context.Context, prompt string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.endStaleRun()
+	p.runCtx, p.runSpan = p.tracer.Start(ctx, RunSpanName,
+		trace.WithAttributes(attribute.Int("claude.prompt_length", len(prompt))))
+	return nil
+}
+
+// OnToolCall starts a tool span under the current run span
+func (p *OTelPlugin) OnToolCall(ctx context.Context, toolName string, input claude.ToolInput) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	parent := ctx
+	if p.runCtx != nil {
+		parent = p.runCtx
+	}
+	attrs := []attribute.KeyValue{attribute.String("claude.tool_name", toolName)}
+	if input.ToolUseID != "" {
+		attrs = append(attrs, attribute.String("claude.tool_use_id", input.ToolUseID))
+	}
+	_, span := p.tracer.Start(parent, ToolSpanName, trace.WithAttributes(attrs...))
+	key := toolSpanKey(toolName, input)
+	p.toolSpans[key] = append(p.toolSpans[key], span)
+	return nil
+}
+
+// OnToolResult ends the span of the tool call, recording any error
+func (p *OTelPlugin) OnToolResult(ctx context.Context, toolName string, input claude.ToolInput, output string, err error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := toolSpanKey(toolName, input)
+	spans := p.toolSpans[key]
+	if len(spans) == 0 {
+		return nil
+	}
+	span := spans[0]
+	if len(spans) == 1 {
+		delete(p.toolSpans, key)
+	} else {
+		p.toolSpans[key] = spans[1:]
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	return nil
+}
+
+// OnComplete records the run's cost and turns and ends the run span
+func (p *OTelPlugin) OnComplete(ctx context.Context, result *claude.ClaudeResult) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.runSpan == nil {
+		return nil
+	}
+	p.runSpan.SetAttributes(
+		attribute.Float64("claude.cost_usd", result.CostUSD),
+		attribute.Int("claude.num_turns", result.NumTurns),
+		attribute.String("claude.session_id", result.SessionID),
+	)
+	if result.IsError {
+		p.runSpan.SetStatus(codes.Error, result.Subtype)
+	}
+	p.endRun()
+	return nil
+}
+
+// endStaleRun ends the spans of a run that never reached OnComplete with an error status
+// Must be called with the lock held
+func (p *OTelPlugin) endStaleRun() {
+	for _, spans := range p.toolSpans {
+		for _, span := range spans {
+			span.SetStatus(codes.Error, staleRunMessage)
+		}
+	}
+	if p.runSpan != nil {
+		p.runSpan.SetStatus(codes.Error, staleRunMessage)
+	}
+	p.endRun()
+}
+
+// endRun ends any open tool spans and the run span
+// Must be called with the lock held
+func (p *OTelPlugin) endRun() {
+	for name, spans := range p.toolSpans {
+		for _, span := range spans {
+			span.End()
+		}
+		delete(p.toolSpans, name)
+	}
+	if p.runSpan != nil {
+		p.runSpan.End()
+	}
+	p.runCtx, p.runSpan = nil, nil
+}
@@ -0,0 +1,153 @@
+package otelplugin
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/lancekrogers/claude-code-go/pkg/claude"
+)
+
+func newTestPlugin() (*OTelPlugin, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	return New(provider.Tracer("test")), exporter
+}
+
+func attr(span tracetest.SpanStub, key string) (attribute.Value, bool) {
+	for _, kv := range span.Attributes {
+		if string(kv.Key) == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestOTelPluginSpanHierarchy(t *testing.T) {
+	plugin, exporter := newTestPlugin()
+	pm := claude.NewPluginManager()
+	if err := pm.Register(plugin, nil); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	ctx := context.Background()
+	_ = pm.OnStreamStart(ctx, "Review this code")
+	_ = pm.OnToolCall(ctx, "Read", claude.ToolInput{FilePath: "main.go"})
+	_ = pm.OnToolCall(ctx, "Bash", claude.ToolInput{Command: "go test"})
+	_ = pm.OnToolResult(ctx, "Read", claude.ToolInput{}, "package main", nil)
+	_ = pm.OnToolResult(ctx, "Bash", claude.ToolInput{}, "", errors.New("exit status 1"))
+	_ = pm.OnComplete(ctx, &claude.ClaudeResult{CostUSD: 0.0125, NumTurns: 3, SessionID: "otel-session"})
+
+	spans := exporter.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(spans))
+	}
+
+	var run tracetest.SpanStub
+	tools := map[string]tracetest.SpanStub{}
+	for _, span := range spans {
+		switch span.Name {
+		case RunSpanName:
+			run = span
+		case ToolSpanName:
+			name, _ := attr(span, "claude.tool_name")
+			tools[name.AsString()] = span
+		}
+	}
+
+	if run.Name == "" {
+		t.Fatal("missing run span")
+	}
+	if cost, _ := attr(run, "claude.cost_usd"); cost.AsFloat64() != 0.0125 {
+		t.Errorf("cost attribute = %v, want 0.0125", cost.AsFloat64())
+	}
+	if turns, _ := attr(run, "claude.num_turns"); turns.AsInt64() != 3 {
+		t.Errorf("turns attribute = %v, want 3", turns.AsInt64())
+	}
+
+	for _, name := range []string{"Read", "Bash"} {
+		tool, ok := tools[name]
+		if !ok {
+			t.Fatalf("missing tool span for %s", name)
+		}
+		if tool.Parent.SpanID() != run.SpanContext.SpanID() {
+			t.Errorf("%s span is not a child of the run span", name)
+		}
+	}
+	if tools["Read"].Status.Code == codes.Error {
+		t.Error("expected Read span without error status")
+	}
+	if tools["Bash"].Status.Code != codes.Error || len(tools["Bash"].Events) == 0 {
+		t.Errorf("expected Bash span to record the error, got %+v", tools["Bash"].Status)
+	}
+}
+
+func TestOTelPluginMatchesToolSpansByID(t *testing.T) {
+	plugin, exporter := newTestPlugin()
+	ctx := context.Background()
+
+	// Two concurrent Read calls finish in the opposite order to how they started
+	_ = plugin.OnStreamStart(ctx, "Read both")
+	_ = plugin.OnToolCall(ctx, "Read", claude.ToolInput{ToolUseID: "tool-1", FilePath: "a.go"})
+	_ = plugin.OnToolCall(ctx, "Read", claude.ToolInput{ToolUseID: "tool-2", FilePath: "b.go"})
+	_ = plugin.OnToolResult(ctx, "Read", claude.ToolInput{ToolUseID: "tool-2"}, "", errors.New("no such file"))
+	_ = plugin.OnToolResult(ctx, "Read", claude.ToolInput{ToolUseID: "tool-1"}, "package a", nil)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected both tool spans to be ended, got %d", len(spans))
+	}
+	for _, span := range spans {
+		id, _ := attr(span, "claude.tool_use_id")
+		if failed := span.Status.Code == codes.Error; failed != (id.AsString() == "tool-2") {
+			t.Errorf("span for %s: error status = %v, want it only on tool-2", id.AsString(), failed)
+		}
+	}
+}
+
+func TestOTelPluginEndsStaleRunSpans(t *testing.T) {
+	plugin, exporter := newTestPlugin()
+	ctx := context.Background()
+
+	// The first run fails before OnComplete, leaving its spans open
+	_ = plugin.OnStreamStart(ctx, "Failing task")
+	_ = plugin.OnToolCall(ctx, "Bash", claude.ToolInput{ToolUseID: "tool-1"})
+	if spans := exporter.GetSpans(); len(spans) != 0 {
+		t.Fatalf("expected the failed run's spans to stay open until the next run, got %d", len(spans))
+	}
+
+	_ = plugin.OnStreamStart(ctx, "Next task")
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected the stale tool and run spans to be ended, got %d", len(spans))
+	}
+	for _, span := range spans {
+		if span.Status.Code != codes.Error || span.Status.Description != staleRunMessage {
+			t.Errorf("expected %s span to be ended with an error status, got %+v", span.Name, span.Status)
+		}
+	}
+}
+
+func TestOTelPluginEndsDanglingToolSpans(t *testing.T) {
+	plugin, exporter := newTestPlugin()
+	ctx := context.Background()
+
+	_ = plugin.OnStreamStart(ctx, "Long task")
+	_ = plugin.OnToolCall(ctx, "WebFetch", claude.ToolInput{})
+	_ = plugin.OnComplete(ctx, &claude.ClaudeResult{IsError: true, Subtype: "error_max_turns"})
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected tool and run spans to be ended, got %d", len(spans))
+	}
+	for _, span := range spans {
+		if span.Name == RunSpanName && span.Status.Code != codes.Error {
+			t.Errorf("expected errored run status, got %+v", span.Status)
+		}
+	}
+}
@@ -1,10 +1,18 @@
 package claude
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"os"
+	"path"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 // PermissionBehavior defines how to handle a tool permission request
@@ -44,6 +52,9 @@ type ToolInput struct {
 	NewString string `json:"new_string,omitempty"`
 	// Raw contains the full input as a map for custom processing
 	Raw map[string]interface{} `json:"raw,omitempty"`
+	// ToolUseID is the id of the streamed tool_use block, matching the tool_use_id of its result
+	// Plugins can use it to correlate OnToolCall with OnToolResult
+	ToolUseID string `json:"tool_use_id,omitempty"`
 }
 
 // PermissionCallback is called when Claude wants to use a tool
@@ -60,6 +71,20 @@ const (
 	PermissionModeAcceptEdits PermissionMode = "acceptEdits"
 	// PermissionModeBypassPermissions skips all permission checks (use with caution)
 	PermissionModeBypassPermissions PermissionMode = "bypassPermissions"
+	// PermissionModePlan lets Claude analyze and plan without executing tools or editing files
+	PermissionModePlan PermissionMode = "plan"
+)
+
+// ToolCallDenyMode controls how a plugin rejecting a tool call in OnToolCall is handled
+type ToolCallDenyMode string
+
+const (
+	// AbortRun stops the run with the plugin's error (the default)
+	AbortRun ToolCallDenyMode = "abort"
+	// DenyTool denies only the rejected call: it is reported as a tool_denied message, is not tracked
+	// for tool timeouts, and the run continues. The CLI has no channel for the verdict in print mode,
+	// so consumers act on the message
+	DenyTool ToolCallDenyMode = "deny"
 )
 
 // Allow returns a PermissionResult that allows the tool
@@ -92,21 +117,23 @@ func ReadOnlyCallback() PermissionCallback {
 	}
 }
 
+// defaultBlockedBashPatterns are the command fragments blocked by SafeBashCallback by default
+var defaultBlockedBashPatterns = []string{
+	"rm -rf",
+	"rm -r",
+	"> /dev/",
+	"dd if=",
+	"mkfs",
+	":(){:|:&};:",
+	"chmod -R 777",
+	"curl | sh",
+	"wget | sh",
+}
+
 // SafeBashCallback returns a permission callback that blocks dangerous bash commands
 func SafeBashCallback(blockedPatterns []string) PermissionCallback {
 	if len(blockedPatterns) == 0 {
-		// Default blocked patterns
-		blockedPatterns = []string{
-			"rm -rf",
-			"rm -r",
-			"> /dev/",
-			"dd if=",
-			"mkfs",
-			":(){:|:&};:",
-			"chmod -R 777",
-			"curl | sh",
-			"wget | sh",
-		}
+		blockedPatterns = defaultBlockedBashPatterns
 	}
 	return func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
 		if toolName != "Bash" {
@@ -121,8 +148,212 @@ func SafeBashCallback(blockedPatterns []string) PermissionCallback {
 	}
 }
 
+// SafeBashOptions adjusts the default SafeBashCallback patterns
+type SafeBashOptions struct {
+	// Extra lists additional patterns to block
+	Extra []string
+	// Remove lists default patterns to stop blocking; entries must match a default exactly
+	Remove []string
+}
+
+// SafeBashCallbackWith returns a SafeBashCallback using the default patterns adjusted by opts
+func SafeBashCallbackWith(opts SafeBashOptions) PermissionCallback {
+	removed := make(map[string]bool, len(opts.Remove))
+	for _, pattern := range opts.Remove {
+		removed[pattern] = true
+	}
+
+	patterns := make([]string, 0, len(defaultBlockedBashPatterns)+len(opts.Extra))
+	for _, pattern := range defaultBlockedBashPatterns {
+		if !removed[pattern] {
+			patterns = append(patterns, pattern)
+		}
+	}
+	patterns = append(patterns, opts.Extra...)
+
+	if len(patterns) == 0 {
+		// SafeBashCallback would fall back to the defaults the caller just removed
+		return func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
+			return Allow(), nil
+		}
+	}
+	return SafeBashCallback(patterns)
+}
+
+// shellChainOperators are shell constructs that could smuggle a second command or a file write past a prefix check:
+// sequencing, pipes, background jobs, command and process substitution, and redirection
+var shellChainOperators = []string{";", "&&", "||", "|", "&", "`", "$(", "<(", ">(", ">", "<", "\n"}
+
+// BashAllowlistCallback returns a permission callback that only allows Bash commands
+// starting with one of the allowed prefixes (e.g., "git ", "go test")
+// Commands that chain, background, substitute or redirect are denied; non-Bash tools are allowed
+func BashAllowlistCallback(allowedPrefixes []string) PermissionCallback {
+	return func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
+		if toolName != "Bash" {
+			return Allow(), nil
+		}
+
+		command := strings.TrimSpace(input.Command)
+		for _, op := range shellChainOperators {
+			if strings.Contains(command, op) {
+				return Deny(fmt.Sprintf("Command chaining and redirection are not allowed: %s", op)), nil
+			}
+		}
+
+		for _, prefix := range allowedPrefixes {
+			if strings.HasPrefix(command, prefix) {
+				return Allow(), nil
+			}
+		}
+		return Deny(fmt.Sprintf("Command is not in the allowlist: %s", command)), nil
+	}
+}
+
+// GitSafetyCallback returns a permission callback that asks for confirmation before destructive git operations:
+// force pushes, "git reset --hard", forced "git clean" and forced branch deletion
+// Other Bash commands, including read-only git commands, are allowed
+func GitSafetyCallback() PermissionCallback {
+	return func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
+		if toolName != "Bash" {
+			return Allow(), nil
+		}
+		for _, segment := range splitShellCommands(input.Command) {
+			if reason := destructiveGitOperation(strings.Fields(segment)); reason != "" {
+				return Ask(fmt.Sprintf("Destructive git operation (%s) requires confirmation: %s", reason, strings.TrimSpace(segment))), nil
+			}
+		}
+		return Allow(), nil
+	}
+}
+
+// splitShellCommands splits a command line on shell chaining operators
+func splitShellCommands(command string) []string {
+	segments := []string{command}
+	for _, op := range shellChainOperators {
+		var split []string
+		for _, segment := range segments {
+			split = append(split, strings.Split(segment, op)...)
+		}
+		segments = split
+	}
+	return segments
+}
+
+// destructiveGitOperation describes the first destructive operation among the git invocations in a command, or returns ""
+// Every git invocation is checked, including ones run through wrappers such as xargs or env
+func destructiveGitOperation(fields []string) string {
+	for i, field := range fields {
+		if filepath.Base(field) != "git" {
+			continue
+		}
+		if reason := destructiveGitInvocation(fields[i+1:]); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// destructiveGitInvocation describes the destructive operation of the git arguments that follow "git", or returns ""
+func destructiveGitInvocation(fields []string) string {
+	// Skip git's global options to reach the subcommand
+	i := 0
+	for ; i < len(fields) && strings.HasPrefix(fields[i], "-"); i++ {
+		if fields[i] == "-C" || fields[i] == "-c" {
+			i++
+		}
+	}
+	if i >= len(fields) {
+		return ""
+	}
+	subcommand, args := fields[i], fields[i+1:]
+
+	hasShortFlag := func(flag byte) bool {
+		for _, arg := range args {
+			if len(arg) > 1 && arg[0] == '-' && arg[1] != '-' && strings.IndexByte(arg[1:], flag) >= 0 {
+				return true
+			}
+		}
+		return false
+	}
+	hasLongFlag := func(prefix string) bool {
+		for _, arg := range args {
+			if strings.HasPrefix(arg, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch subcommand {
+	case "push":
+		if hasShortFlag('f') || hasLongFlag("--force") {
+			return "force push"
+		}
+		for _, arg := range args {
+			if strings.HasPrefix(arg, "+") {
+				return "force push"
+			}
+		}
+	case "reset":
+		if hasLongFlag("--hard") {
+			return "hard reset"
+		}
+	case "clean":
+		if hasShortFlag('f') || hasLongFlag("--force") {
+			return "forced clean"
+		}
+	case "branch":
+		if hasShortFlag('D') || ((hasShortFlag('d') || hasLongFlag("--delete")) && (hasShortFlag('f') || hasLongFlag("--force"))) {
+			return "forced branch deletion"
+		}
+	}
+	return ""
+}
+
+// BudgetAwareCallback returns a permission callback that denies tool calls once the tracker
+// cannot afford estimatePerCall more spend, and otherwise delegates to inner (allowing if nil)
+func BudgetAwareCallback(tracker *BudgetTracker, estimatePerCall float64, inner PermissionCallback) PermissionCallback {
+	return func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
+		if tracker != nil && !tracker.CanSpend(estimatePerCall) {
+			return Deny(fmt.Sprintf("Budget exhausted: $%.4f remaining, tool call estimated at $%.4f",
+				tracker.RemainingBudget(), estimatePerCall)), nil
+		}
+		if inner == nil {
+			return Allow(), nil
+		}
+		return inner(ctx, toolName, input)
+	}
+}
+
 // FilePathCallback returns a permission callback that restricts file operations to allowed paths
+// Denied paths are checked first; see FilePathCallbackWith to let a more specific allowed path win
 func FilePathCallback(allowedPaths []string, deniedPaths []string) PermissionCallback {
+	return FilePathCallbackWith(FilePathOptions{Allowed: allowedPaths, Denied: deniedPaths})
+}
+
+// PathPrecedence decides between allowed and denied path prefixes that both match a file
+type PathPrecedence string
+
+const (
+	// DenyFirst denies any path under a denied prefix (the default)
+	DenyFirst PathPrecedence = "deny_first"
+	// LongestMatch applies the longest matching prefix, so allowing /etc/myapp/ carves it out of a denied /etc/
+	// Equally long allowed and denied prefixes deny
+	LongestMatch PathPrecedence = "longest_match"
+)
+
+// FilePathOptions configures FilePathCallbackWith
+type FilePathOptions struct {
+	// Allowed lists path prefixes file tools may access; empty allows any path that is not denied
+	Allowed []string
+	// Denied lists path prefixes file tools may not access
+	Denied []string
+	// Precedence decides which list wins when both match; empty means DenyFirst
+	Precedence PathPrecedence
+}
+
+// FilePathCallbackWith returns a permission callback that restricts file operations by path prefix
+func FilePathCallbackWith(opts FilePathOptions) PermissionCallback {
 	return func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
 		fileTools := map[string]bool{
 			"Read":  true,
@@ -138,27 +369,249 @@ func FilePathCallback(allowedPaths []string, deniedPaths []string) PermissionCal
 			return Allow(), nil
 		}
 
-		// Check denied paths first
-		for _, denied := range deniedPaths {
-			if strings.HasPrefix(filePath, denied) {
-				return Deny(fmt.Sprintf("Access to path %s is denied", denied)), nil
+		denied := longestPrefix(filePath, opts.Denied)
+		allowed := longestPrefix(filePath, opts.Allowed)
+		if denied != "" && (opts.Precedence != LongestMatch || len(denied) >= len(allowed)) {
+			return Deny(fmt.Sprintf("Access to path %s is denied", denied)), nil
+		}
+
+		// If allowed paths are specified, the file must be under one of them
+		if len(opts.Allowed) > 0 && allowed == "" {
+			return Deny(fmt.Sprintf("File path %s is not in allowed paths", filePath)), nil
+		}
+
+		return Allow(), nil
+	}
+}
+
+// longestPrefix returns the longest of prefixes that filePath starts with, or "" if none does
+func longestPrefix(filePath string, prefixes []string) string {
+	longest := ""
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(filePath, prefix) && len(prefix) > len(longest) {
+			longest = prefix
+		}
+	}
+	return longest
+}
+
+// GlobFilePathCallback returns a permission callback that restricts file operations using glob patterns
+// Patterns support "*", "?" and character classes within a segment and "**" across segments,
+// e.g. "**/*.go" or "**/secrets/*"; denied patterns take precedence over allowed ones
+func GlobFilePathCallback(allowed, denied []string) PermissionCallback {
+	return func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
+		fileTools := map[string]bool{
+			"Read":  true,
+			"Write": true,
+			"Edit":  true,
+		}
+		if !fileTools[toolName] || input.FilePath == "" {
+			return Allow(), nil
+		}
+
+		filePath := normalizeGlobPath(input.FilePath)
+		for _, pattern := range denied {
+			if matchGlob(pattern, filePath) {
+				return Deny(fmt.Sprintf("Access to path %s is denied by pattern %s", filePath, pattern)), nil
 			}
 		}
 
-		// If allowed paths are specified, check them
-		if len(allowedPaths) > 0 {
-			allowed := false
-			for _, path := range allowedPaths {
-				if strings.HasPrefix(filePath, path) {
-					allowed = true
-					break
+		if len(allowed) == 0 {
+			return Allow(), nil
+		}
+		for _, pattern := range allowed {
+			if matchGlob(pattern, filePath) {
+				return Allow(), nil
+			}
+		}
+		return Deny(fmt.Sprintf("File path %s does not match any allowed pattern", filePath)), nil
+	}
+}
+
+// normalizeGlobPath cleans a path and converts it to forward slashes for matching
+func normalizeGlobPath(p string) string {
+	return filepath.ToSlash(filepath.Clean(p))
+}
+
+// matchGlob reports whether filePath matches pattern, where "**" matches any number of segments
+func matchGlob(pattern, filePath string) bool {
+	return matchGlobSegments(strings.Split(normalizeGlobPath(pattern), "/"), strings.Split(filePath, "/"))
+}
+
+// matchGlobSegments matches path segments against pattern segments
+func matchGlobSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			if len(rest) == 0 {
+				return true
+			}
+			for i := range segments {
+				if matchGlobSegments(rest, segments[i:]) {
+					return true
 				}
 			}
-			if !allowed {
-				return Deny(fmt.Sprintf("File path %s is not in allowed paths", filePath)), nil
+			return false
+		}
+
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], segments[0]); err != nil || !ok {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+// JailCallback returns a permission callback that denies file paths resolving outside root
+// Relative paths are taken relative to root, and symlinks are resolved before the prefix check
+// so neither ".." traversal nor links pointing out of the jail can escape it
+func JailCallback(root string) PermissionCallback {
+	return func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
+		if input.FilePath == "" {
+			return Allow(), nil
+		}
+
+		jail, err := resolveJailPath(root)
+		if err != nil {
+			return Deny(fmt.Sprintf("jail root %s cannot be resolved: %v", root, err)), nil
+		}
+
+		target := input.FilePath
+		if !filepath.IsAbs(target) {
+			target = jail + string(filepath.Separator) + target
+		}
+		resolved, err := resolveJailPath(target)
+		if err != nil {
+			return Deny(fmt.Sprintf("file path %s cannot be resolved: %v", input.FilePath, err)), nil
+		}
+
+		if resolved != jail && !strings.HasPrefix(resolved, jail+string(filepath.Separator)) {
+			return Deny(fmt.Sprintf("File path %s escapes jail %s", input.FilePath, root)), nil
+		}
+		return Allow(), nil
+	}
+}
+
+// resolveJailPath returns the absolute, symlink-free form of p
+// Components are resolved left to right as the OS would, so "link/.." climbs out of the link's
+// target rather than being cleaned away lexically; components that do not exist yet
+// (e.g. a file about to be written) are kept as-is
+func resolveJailPath(p string) (string, error) {
+	if !filepath.IsAbs(p) {
+		wd, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		p = wd + string(filepath.Separator) + p
+	}
+
+	volume := filepath.VolumeName(p)
+	resolved := volume + string(filepath.Separator)
+	for _, part := range strings.Split(filepath.ToSlash(p[len(volume):]), "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(next)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return "", err
+			}
+			resolved = next
+			continue
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if next, err = filepath.EvalSymlinks(next); err != nil {
+				return "", err
 			}
 		}
+		resolved = next
+	}
+	return resolved, nil
+}
+
+// parseToolSchema decodes a ToolSchemas entry, which must be a JSON object
+func parseToolSchema(schema string) (map[string]interface{}, error) {
+	var parsed map[string]interface{}
+	if err := json.Unmarshal([]byte(schema), &parsed); err != nil {
+		return nil, err
+	}
+	if parsed == nil {
+		return nil, fmt.Errorf("schema must be a JSON object")
+	}
+	return parsed, nil
+}
+
+// checkToolSchema validates input against the schema configured for toolName, if any
+func checkToolSchema(opts *RunOptions, toolName string, input ToolInput) error {
+	schema, ok := opts.ToolSchemas[toolName]
+	if !ok {
+		return nil
+	}
+	parsed, err := parseToolSchema(schema)
+	if err != nil {
+		return fmt.Errorf("invalid schema: %v", err)
+	}
+	raw := input.Raw
+	if raw == nil {
+		raw = map[string]interface{}{}
+	}
+	return checkSchema(parsed, raw, "$")
+}
+
+// resolvePermission decides whether a tool call may proceed under opts
+// Inputs failing their ToolSchemas entry are denied outright; otherwise the permission callback is consulted
+// (falling back to DefaultPermission when none is set). Plugins observe the outcome either way
+func resolvePermission(ctx context.Context, opts *RunOptions, toolName string, input ToolInput) (PermissionResult, error) {
+	result := Allow()
+	if err := checkToolSchema(opts, toolName, input); err != nil {
+		result = Deny(fmt.Sprintf("input does not match schema for %s: %v", toolName, err))
+	} else if opts.PermissionCallback != nil {
+		var err error
+		result, err = opts.PermissionCallback(ctx, toolName, input)
+		if err != nil {
+			return PermissionResult{}, fmt.Errorf("permission callback failed for %s: %w", toolName, err)
+		}
+	} else if opts.PermissionMode == "" || opts.PermissionMode == PermissionModeDefault {
+		switch opts.DefaultPermission {
+		case PermissionDeny:
+			result = Deny("denied by default permission policy")
+		case PermissionAsk:
+			result = Ask("no permission callback configured")
+		}
+	}
+
+	if opts.PluginManager != nil {
+		if err := opts.PluginManager.OnPermission(ctx, toolName, input, result); err != nil {
+			return PermissionResult{}, err
+		}
+	}
+
+	return result, nil
+}
 
+// MCPToolPolicyCallback returns a permission callback with preconfigured results for MCP tools
+// Keys are exact tool names ("mcp__server__tool") or server wildcards ("mcp__server__*")
+// Exact matches take precedence over wildcards; unlisted tools are allowed
+func MCPToolPolicyCallback(policies map[string]PermissionResult) PermissionCallback {
+	return func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
+		if result, ok := policies[toolName]; ok {
+			return result, nil
+		}
+		if validateMCPToolName(toolName) {
+			server := strings.SplitN(strings.TrimPrefix(toolName, "mcp__"), "__", 2)[0]
+			if result, ok := policies["mcp__"+server+"__*"]; ok {
+				return result, nil
+			}
+		}
 		return Allow(), nil
 	}
 }
@@ -184,6 +637,212 @@ func ChainCallbacks(callbacks ...PermissionCallback) PermissionCallback {
 	}
 }
 
+// ToolCall pairs a tool name with its input, as evaluated by EvaluatePermissions
+type ToolCall struct {
+	ToolName string
+	Input    ToolInput
+}
+
+// EvaluatePermissions runs cb against each call without starting Claude, which is handy for
+// unit-testing permission policies. A nil callback allows every call
+// If cb fails, the results gathered so far are returned along with the error
+func EvaluatePermissions(ctx context.Context, cb PermissionCallback, calls []ToolCall) ([]PermissionResult, error) {
+	results := make([]PermissionResult, 0, len(calls))
+	for i, call := range calls {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		if cb == nil {
+			results = append(results, Allow())
+			continue
+		}
+		result, err := cb(ctx, call.ToolName, call.Input)
+		if err != nil {
+			return results, fmt.Errorf("permission callback failed for call %d (%s): %w", i, call.ToolName, err)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// SafeDefaults returns a conservative RunOptions preset for new integrations
+// It restricts Claude to read-only tools, blocks dangerous Bash, caps turns and spending
+// Treat it as a starting point to loosen deliberately, not as a security guarantee
+func SafeDefaults() *RunOptions {
+	return &RunOptions{
+		Format:             JSONOutput,
+		PermissionMode:     PermissionModeDefault,
+		PermissionCallback: ChainCallbacks(ReadOnlyCallback(), SafeBashCallback(nil)),
+		MaxTurns:           10,
+		BudgetTracker: NewBudgetTracker(&BudgetConfig{
+			MaxBudgetUSD:     1.0,
+			WarningThreshold: 0.8,
+		}),
+	}
+}
+
+// ToolRouter dispatches permission checks to callbacks registered per tool name
+type ToolRouter struct {
+	mu       sync.RWMutex
+	handlers map[string]PermissionCallback
+	fallback PermissionCallback
+}
+
+// NewToolRouter creates an empty ToolRouter that allows tools without a handler
+func NewToolRouter() *ToolRouter {
+	return &ToolRouter{
+		handlers: make(map[string]PermissionCallback),
+	}
+}
+
+// Handle registers the callback for a tool, replacing any previous handler
+func (tr *ToolRouter) Handle(tool string, cb PermissionCallback) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.handlers[tool] = cb
+}
+
+// Default sets the callback for tools without a registered handler
+func (tr *ToolRouter) Default(cb PermissionCallback) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.fallback = cb
+}
+
+// Callback returns a PermissionCallback that dispatches by tool name
+// Handlers registered after Callback is called still take effect
+func (tr *ToolRouter) Callback() PermissionCallback {
+	return func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
+		tr.mu.RLock()
+		cb, ok := tr.handlers[toolName]
+		if !ok {
+			cb = tr.fallback
+		}
+		tr.mu.RUnlock()
+
+		if cb == nil {
+			return Allow(), nil
+		}
+		return cb(ctx, toolName, input)
+	}
+}
+
+// PendingApproval is a tool call waiting for a decision in an ApprovalQueue
+type PendingApproval struct {
+	ID       string
+	ToolName string
+	Input    ToolInput
+	// Message is the reason given by the callback that asked for approval
+	Message   string
+	CreatedAt time.Time
+}
+
+// ApprovalQueue holds Ask decisions until they are resolved, typically from a UI
+// Runs using AskHandler block on each queued call until Resolve is called or their context ends
+type ApprovalQueue struct {
+	mu      sync.Mutex
+	nextID  int
+	pending map[string]*queuedApproval
+}
+
+// queuedApproval is a pending approval with the channel its caller waits on
+type queuedApproval struct {
+	PendingApproval
+	seq      int
+	decision chan PermissionBehavior
+}
+
+// NewApprovalQueue creates an empty ApprovalQueue
+func NewApprovalQueue() *ApprovalQueue {
+	return &ApprovalQueue{pending: make(map[string]*queuedApproval)}
+}
+
+// Pending returns the approvals awaiting a decision, oldest first
+func (q *ApprovalQueue) Pending() []PendingApproval {
+	q.mu.Lock()
+	queued := make([]*queuedApproval, 0, len(q.pending))
+	for _, approval := range q.pending {
+		queued = append(queued, approval)
+	}
+	q.mu.Unlock()
+
+	sort.Slice(queued, func(i, j int) bool { return queued[i].seq < queued[j].seq })
+	pending := make([]PendingApproval, len(queued))
+	for i, approval := range queued {
+		pending[i] = approval.PendingApproval
+	}
+	return pending
+}
+
+// Resolve decides a pending approval with PermissionAllow or PermissionDeny
+func (q *ApprovalQueue) Resolve(id string, behavior PermissionBehavior) error {
+	if behavior != PermissionAllow && behavior != PermissionDeny {
+		return fmt.Errorf("approval must be resolved with allow or deny, got %q", behavior)
+	}
+
+	q.mu.Lock()
+	approval, ok := q.pending[id]
+	delete(q.pending, id)
+	q.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no pending approval with id %q", id)
+	}
+	approval.decision <- behavior
+	return nil
+}
+
+// AskHandler returns a permission callback that queues calls inner answers with Ask
+// and blocks until they are resolved; a nil inner queues every call
+// If ctx ends first the approval is withdrawn and the context error is returned
+func (q *ApprovalQueue) AskHandler(inner PermissionCallback) PermissionCallback {
+	return func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
+		result := Ask("")
+		if inner != nil {
+			var err error
+			if result, err = inner(ctx, toolName, input); err != nil || result.Behavior != PermissionAsk {
+				return result, err
+			}
+		}
+
+		approval := q.enqueue(toolName, input, result.Message)
+		select {
+		case behavior := <-approval.decision:
+			if behavior == PermissionDeny {
+				return Deny("denied by approver"), nil
+			}
+			return Allow(), nil
+		case <-ctx.Done():
+			q.mu.Lock()
+			delete(q.pending, approval.ID)
+			q.mu.Unlock()
+			return PermissionResult{}, ctx.Err()
+		}
+	}
+}
+
+// enqueue adds a new pending approval
+func (q *ApprovalQueue) enqueue(toolName string, input ToolInput, message string) *queuedApproval {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.nextID++
+	approval := &queuedApproval{
+		PendingApproval: PendingApproval{
+			ID:        fmt.Sprintf("approval-%d", q.nextID),
+			ToolName:  toolName,
+			Input:     input,
+			Message:   message,
+			CreatedAt: timeNow(),
+		},
+		seq: q.nextID,
+		// Buffered so Resolve never blocks on a caller that has already given up
+		decision: make(chan PermissionBehavior, 1),
+	}
+	q.pending[approval.ID] = approval
+	return approval
+}
+
 // ToolPermission represents a parsed tool permission with optional command and pattern constraints
 type ToolPermission struct {
 	Tool     string // e.g., "Bash", "Write", "mcp__filesystem__read_file"
@@ -269,6 +928,191 @@ func ValidateToolPermissions(permissions []string) error {
 	return err
 }
 
+// LoadPermissionsFromFile reads tool permissions from a JSON policy file of the form
+//
+//	{"permissions": ["Read", "Bash(git log:*)", {"tool": "Write", "command": "src/**"}]}
+//
+// Entries are strings in ParseToolPermission format or objects with tool, command and pattern fields;
+// every entry is validated by ParseToolPermission, and the file is rejected if any entry is invalid.
+// Only JSON is supported, so the SDK stays free of third-party dependencies; .yaml and .yml files
+// are accepted only when they hold a JSON document, which is also valid YAML
+func LoadPermissionsFromFile(path string) ([]ToolPermission, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read permission policy: %w", err)
+	}
+	if isYAMLPolicyPath(path) && !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return nil, fmt.Errorf("failed to parse permission policy %s: only JSON policies are supported; convert the YAML to JSON", path)
+	}
+
+	var policy struct {
+		Permissions []json.RawMessage `json:"permissions"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&policy); err != nil {
+		return nil, fmt.Errorf("failed to parse permission policy %s: %w", path, err)
+	}
+
+	permissions := make([]ToolPermission, 0, len(policy.Permissions))
+	for i, raw := range policy.Permissions {
+		perm, err := parsePolicyEntry(raw)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing permission at index %d in %s: %w", i, path, err)
+		}
+		permissions = append(permissions, *perm)
+	}
+	return permissions, nil
+}
+
+// parsePolicyEntry parses one entry of a permission policy file
+func parsePolicyEntry(raw json.RawMessage) (*ToolPermission, error) {
+	var permission string
+	if err := json.Unmarshal(raw, &permission); err == nil {
+		return ParseToolPermission(permission)
+	}
+
+	var entry struct {
+		Tool    string `json:"tool"`
+		Command string `json:"command"`
+		Pattern string `json:"pattern"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&entry); err != nil {
+		return nil, fmt.Errorf("permission must be a string or an object with tool, command and pattern: %w", err)
+	}
+	return ParseToolPermission(formatToolPermission(entry.Tool, entry.Command, entry.Pattern))
+}
+
+// formatToolPermission builds a permission string from its parts
+// A pattern without a command yields a string ParseToolPermission rejects
+func formatToolPermission(tool, command, pattern string) string {
+	switch {
+	case command == "" && pattern == "":
+		return tool
+	case pattern == "":
+		return fmt.Sprintf("%s(%s)", tool, command)
+	default:
+		return fmt.Sprintf("%s(%s:%s)", tool, command, pattern)
+	}
+}
+
+// isYAMLPolicyPath reports whether a policy file is YAML, judging by its extension
+func isYAMLPolicyPath(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// SavePermissionsToFile writes permissions to path as a JSON policy file readable by LoadPermissionsFromFile,
+// whatever the extension of path
+// Each permission is saved as its Original string, or rebuilt from its parts when Original is empty;
+// nothing is written if any permission fails ParseToolPermission
+func SavePermissionsToFile(path string, permissions []ToolPermission) error {
+	policy := struct {
+		Permissions []string `json:"permissions"`
+	}{Permissions: make([]string, 0, len(permissions))}
+
+	for i, perm := range permissions {
+		permission := perm.Original
+		if permission == "" {
+			permission = formatToolPermission(perm.Tool, perm.Command, perm.Pattern)
+		}
+		if _, err := ParseToolPermission(permission); err != nil {
+			return fmt.Errorf("error saving permission at index %d: %w", i, err)
+		}
+		policy.Permissions = append(policy.Permissions, permission)
+	}
+
+	data, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode permission policy: %w", err)
+	}
+	data = append(data, '\n')
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write permission policy: %w", err)
+	}
+	return nil
+}
+
+// BuiltinTools lists the tool names built into the Claude Code CLI
+var BuiltinTools = []string{
+	"Bash", "BashOutput", "Edit", "ExitPlanMode", "Glob", "Grep", "KillShell", "LS",
+	"MultiEdit", "NotebookEdit", "NotebookRead", "Read", "SlashCommand", "Task",
+	"TodoWrite", "WebFetch", "WebSearch", "Write",
+}
+
+// ValidateToolPermissionsStrict validates permission syntax and checks that every tool is either
+// in known (BuiltinTools if nil) or a well-formed MCP tool
+// Unknown tools close to a known name produce a "did you mean" suggestion
+func ValidateToolPermissionsStrict(permissions []string, known []string) error {
+	parsed, err := ParseToolPermissions(permissions)
+	if err != nil {
+		return err
+	}
+	if known == nil {
+		known = BuiltinTools
+	}
+
+	knownSet := make(map[string]bool, len(known))
+	for _, tool := range known {
+		knownSet[tool] = true
+	}
+
+	for _, perm := range parsed {
+		if knownSet[perm.Tool] {
+			continue
+		}
+		if strings.HasPrefix(perm.Tool, "mcp__") {
+			if err := validateMCPTools([]string{perm.Tool}); err != nil {
+				return err
+			}
+			continue
+		}
+		if suggestion := closestToolName(perm.Tool, known); suggestion != "" {
+			return fmt.Errorf("unknown tool %q (did you mean %q?)", perm.Tool, suggestion)
+		}
+		return fmt.Errorf("unknown tool %q", perm.Tool)
+	}
+	return nil
+}
+
+// closestToolName returns the known tool within a small edit distance of name, if any
+func closestToolName(name string, known []string) string {
+	const maxDistance = 2
+
+	best := ""
+	bestDistance := maxDistance + 1
+	for _, tool := range known {
+		d := editDistance(strings.ToLower(name), strings.ToLower(tool))
+		if d < bestDistance {
+			best, bestDistance = tool, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
 // String returns the original permission string representation
 func (tp *ToolPermission) String() string {
 	return tp.Original
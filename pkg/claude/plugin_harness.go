@@ -0,0 +1,105 @@
+package claude
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// PluginTestHarness drives a single plugin through the lifecycle of a run, for use in plugin tests
+// Hooks are dispatched through a PluginManager, so panic recovery and input limits behave as in a real run.
+// Tool calls get sequential tool use ids ("toolu_1", "toolu_2", ...) so tests are deterministic
+type PluginTestHarness struct {
+	// Manager is the PluginManager the plugin is registered with
+	Manager *PluginManager
+
+	ctx    context.Context
+	mu     sync.Mutex
+	errs   []error
+	nextID int
+}
+
+// NewPluginTestHarness registers and initializes p with a default configuration
+// Registration and initialization errors are recorded and reported by Errors
+func NewPluginTestHarness(p Plugin) *PluginTestHarness {
+	h := &PluginTestHarness{
+		Manager: NewPluginManager(),
+		ctx:     context.Background(),
+	}
+	if err := h.Manager.Register(p, nil); err != nil {
+		h.record(err)
+		return h
+	}
+	h.record(h.Manager.Initialize(h.ctx))
+	return h
+}
+
+// Start fires OnStreamStart, as when a run begins
+func (h *PluginTestHarness) Start(prompt string) error {
+	return h.record(h.Manager.OnStreamStart(h.ctx, prompt))
+}
+
+// FireToolCall fires OnPermission with an allow decision and then OnToolCall, as for an allowed tool call
+// input.ToolUseID is assigned when empty; the input that was fired is returned for use with FireToolResult
+func (h *PluginTestHarness) FireToolCall(toolName string, input ToolInput) (ToolInput, error) {
+	if input.ToolUseID == "" {
+		h.mu.Lock()
+		h.nextID++
+		input.ToolUseID = fmt.Sprintf("toolu_%d", h.nextID)
+		h.mu.Unlock()
+	}
+	if err := h.record(h.Manager.OnPermission(h.ctx, toolName, input, Allow())); err != nil {
+		return input, err
+	}
+	return input, h.record(h.Manager.OnToolCall(h.ctx, toolName, input))
+}
+
+// FireToolResult fires OnToolResult, with toolErr set for a failed call
+func (h *PluginTestHarness) FireToolResult(toolName string, input ToolInput, output string, toolErr error) error {
+	return h.record(h.Manager.OnToolResult(h.ctx, toolName, input, output, toolErr))
+}
+
+// FireMessage fires OnMessage
+func (h *PluginTestHarness) FireMessage(msg Message) error {
+	return h.record(h.Manager.OnMessage(h.ctx, msg))
+}
+
+// FireComplete fires OnComplete; a nil result is replaced by an empty success result
+func (h *PluginTestHarness) FireComplete(result *ClaudeResult) error {
+	if result == nil {
+		result = &ClaudeResult{Type: "result", Subtype: "success"}
+	}
+	return h.record(h.Manager.OnComplete(h.ctx, result))
+}
+
+// FireError fires OnComplete with the error result the CLI reports when a run fails with err
+func (h *PluginTestHarness) FireError(err error) error {
+	return h.FireComplete(&ClaudeResult{
+		Type:    "result",
+		Subtype: "error_during_execution",
+		Result:  err.Error(),
+		IsError: true,
+	})
+}
+
+// Close fires Shutdown
+func (h *PluginTestHarness) Close() error {
+	return h.record(h.Manager.Shutdown(h.ctx))
+}
+
+// Errors returns every error the plugin returned so far, in order
+func (h *PluginTestHarness) Errors() []error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]error(nil), h.errs...)
+}
+
+// record keeps err, if any, and returns it
+func (h *PluginTestHarness) record(err error) error {
+	if err != nil {
+		h.mu.Lock()
+		h.errs = append(h.errs, err)
+		h.mu.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package claude
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestPluginTestHarness(t *testing.T) {
+	plugin := newMockPlugin("observer", "1.0.0")
+	h := NewPluginTestHarness(plugin)
+	if plugin.initCalled != 1 {
+		t.Errorf("expected the plugin to be initialized once, got %d", plugin.initCalled)
+	}
+
+	if err := h.Start("Fix the bug"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	first, err := h.FireToolCall("Read", ToolInput{FilePath: "main.go"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, _ := h.FireToolCall("Bash", ToolInput{Command: "go test"})
+	if first.ToolUseID != "toolu_1" || second.ToolUseID != "toolu_2" {
+		t.Errorf("expected sequential tool use ids, got %q and %q", first.ToolUseID, second.ToolUseID)
+	}
+	if kept, _ := h.FireToolCall("Read", ToolInput{ToolUseID: "custom"}); kept.ToolUseID != "custom" {
+		t.Errorf("expected an explicit tool use id to be kept, got %q", kept.ToolUseID)
+	}
+
+	toolErr := errors.New("exit status 1")
+	_ = h.FireToolResult("Bash", second, "FAIL", toolErr)
+	_ = h.FireMessage(Message{Type: "assistant"})
+	_ = h.FireComplete(nil)
+	_ = h.FireError(errors.New("model overloaded"))
+	_ = h.Close()
+
+	if !reflect.DeepEqual(plugin.prompts, []string{"Fix the bug"}) {
+		t.Errorf("expected OnStreamStart with the prompt, got %v", plugin.prompts)
+	}
+	if !reflect.DeepEqual(plugin.toolCalls, []string{"Read", "Bash", "Read"}) || len(plugin.permissions) != 3 {
+		t.Errorf("expected each tool call to pass OnPermission and OnToolCall, got %v / %v", plugin.toolCalls, plugin.permissions)
+	}
+	if len(plugin.resultInputs) != 1 || plugin.resultInputs[0].ToolUseID != "toolu_2" || plugin.toolErrs[0] != toolErr {
+		t.Errorf("expected the tool result to carry its call's id and error, got %+v / %v", plugin.resultInputs, plugin.toolErrs)
+	}
+	if len(plugin.messages) != 1 || len(plugin.results) != 2 {
+		t.Fatalf("expected one message and two completions, got %d and %d", len(plugin.messages), len(plugin.results))
+	}
+	if plugin.results[0].IsError || !plugin.results[1].IsError || plugin.results[1].Result != "model overloaded" {
+		t.Errorf("expected a success then an error result, got %+v and %+v", plugin.results[0], plugin.results[1])
+	}
+	if plugin.shutdownCount != 1 {
+		t.Errorf("expected Shutdown once, got %d", plugin.shutdownCount)
+	}
+	if errs := h.Errors(); len(errs) != 0 {
+		t.Errorf("expected no errors, got %v", errs)
+	}
+}
+
+func TestPluginTestHarness_Errors(t *testing.T) {
+	plugin := newMockPlugin("strict", "1.0.0")
+	plugin.toolCallErr = errors.New("tool blocked")
+	plugin.completeErr = errors.New("complete failed")
+	h := NewPluginTestHarness(plugin)
+
+	if _, err := h.FireToolCall("Bash", ToolInput{}); !errors.Is(err, plugin.toolCallErr) {
+		t.Errorf("expected the OnToolCall error, got %v", err)
+	}
+	if err := h.FireComplete(nil); !errors.Is(err, plugin.completeErr) {
+		t.Errorf("expected the OnComplete error, got %v", err)
+	}
+	if errs := h.Errors(); len(errs) != 2 || !errors.Is(errs[0], plugin.toolCallErr) || !errors.Is(errs[1], plugin.completeErr) {
+		t.Errorf("expected both errors to be captured in order, got %v", errs)
+	}
+
+	broken := newMockPlugin("broken", "1.0.0")
+	broken.initErr = errors.New("init failed")
+	if errs := NewPluginTestHarness(broken).Errors(); len(errs) != 1 || !errors.Is(errs[0], broken.initErr) {
+		t.Errorf("expected the initialization error to be captured, got %v", errs)
+	}
+}
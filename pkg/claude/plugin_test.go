@@ -3,10 +3,14 @@ package claude
 import (
 	"context"
 	"errors"
+	"fmt"
+	"reflect"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
 )
 
 // mockPlugin is a test implementation of the Plugin interface
@@ -19,9 +23,15 @@ type mockPlugin struct {
 	completeErr   error
 	shutdownErr   error
 	initCalled    int
+	prompts       []string
 	toolCalls     []string
+	toolInputs    []ToolInput
 	messages      []Message
 	results       []*ClaudeResult
+	permissions   []PermissionResult
+	toolErrs      []error
+	resultInputs  []ToolInput
+	permissionErr error
 	shutdownCount int
 	mu            sync.Mutex
 }
@@ -46,10 +56,18 @@ func (mp *mockPlugin) Initialize(ctx context.Context) error {
 	return mp.initErr
 }
 
+func (mp *mockPlugin) OnStreamStart(ctx context.Context, prompt string) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.prompts = append(mp.prompts, prompt)
+	return nil
+}
+
 func (mp *mockPlugin) OnToolCall(ctx context.Context, toolName string, input ToolInput) error {
 	mp.mu.Lock()
 	defer mp.mu.Unlock()
 	mp.toolCalls = append(mp.toolCalls, toolName)
+	mp.toolInputs = append(mp.toolInputs, input)
 	return mp.toolCallErr
 }
 
@@ -67,6 +85,21 @@ func (mp *mockPlugin) OnComplete(ctx context.Context, result *ClaudeResult) erro
 	return mp.completeErr
 }
 
+func (mp *mockPlugin) OnToolResult(ctx context.Context, toolName string, input ToolInput, output string, err error) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.toolErrs = append(mp.toolErrs, err)
+	mp.resultInputs = append(mp.resultInputs, input)
+	return nil
+}
+
+func (mp *mockPlugin) OnPermission(ctx context.Context, toolName string, input ToolInput, result PermissionResult) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.permissions = append(mp.permissions, result)
+	return mp.permissionErr
+}
+
 func (mp *mockPlugin) Shutdown(ctx context.Context) error {
 	mp.mu.Lock()
 	defer mp.mu.Unlock()
@@ -135,6 +168,67 @@ func TestPluginManagerPriority(t *testing.T) {
 	}
 }
 
+func TestPluginManagerPhases(t *testing.T) {
+	pm := NewPluginManager()
+
+	_ = pm.Register(newMockPlugin("post-early", "1.0.0"), &PluginConfig{Enabled: true, Phase: PhasePost, Priority: 1})
+	_ = pm.Register(newMockPlugin("main-late", "1.0.0"), &PluginConfig{Enabled: true, Priority: 500})
+	_ = pm.Register(newMockPlugin("pre-late", "1.0.0"), &PluginConfig{Enabled: true, Phase: PhasePre, Priority: 900})
+	_ = pm.Register(newMockPlugin("main-early", "1.0.0"), &PluginConfig{Enabled: true, Phase: PhaseMain, Priority: 10})
+	_ = pm.Register(newMockPlugin("pre-early", "1.0.0"), &PluginConfig{Enabled: true, Phase: PhasePre, Priority: 5})
+	_ = pm.Register(newMockPlugin("defaulted", "1.0.0"), nil)
+
+	names := pm.List()
+	expected := []string{"pre-early", "pre-late", "main-early", "defaulted", "main-late", "post-early"}
+	if len(names) != len(expected) {
+		t.Fatalf("expected %d plugins, got %v", len(expected), names)
+	}
+	for i, name := range names {
+		if name != expected[i] {
+			t.Errorf("expected %s at index %d, got %s (order %v)", expected[i], i, name, names)
+		}
+	}
+
+	err := pm.Register(newMockPlugin("bad-phase", "1.0.0"), &PluginConfig{Enabled: true, Phase: "later"})
+	if err == nil {
+		t.Error("expected error for unknown phase")
+	}
+}
+
+// configuredPlugin embeds BasePlugin and reads its settings through GetConfig
+type configuredPlugin struct {
+	BasePlugin
+}
+
+func TestBasePluginConfig(t *testing.T) {
+	pm := NewPluginManager()
+	plugin := &configuredPlugin{BasePlugin: BasePlugin{PluginName: "configured", PluginVersion: "1.0.0"}}
+
+	err := pm.Register(plugin, &PluginConfig{
+		Enabled: true,
+		Config:  map[string]interface{}{"endpoint": "https://example.com", "retries": 3},
+	})
+	if err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	if endpoint, ok := plugin.GetConfig("endpoint"); !ok || endpoint != "https://example.com" {
+		t.Errorf("GetConfig(endpoint) = %v, %v", endpoint, ok)
+	}
+	if retries, ok := plugin.GetConfig("retries"); !ok || retries != 3 {
+		t.Errorf("GetConfig(retries) = %v, %v", retries, ok)
+	}
+	if _, ok := plugin.GetConfig("missing"); ok {
+		t.Error("GetConfig(missing) should report false")
+	}
+
+	unconfigured := &configuredPlugin{BasePlugin: BasePlugin{PluginName: "plain", PluginVersion: "1.0.0"}}
+	_ = pm.Register(unconfigured, nil)
+	if _, ok := unconfigured.GetConfig("endpoint"); ok {
+		t.Error("expected no config for a plugin registered without one")
+	}
+}
+
 func TestPluginManagerUnregister(t *testing.T) {
 	pm := NewPluginManager()
 	plugin := newMockPlugin("test-plugin", "1.0.0")
@@ -370,6 +464,50 @@ func TestPluginManagerSetEnabled(t *testing.T) {
 	})
 }
 
+func TestPluginManagerSnapshotRestore(t *testing.T) {
+	pm := NewPluginManager()
+	_ = pm.Register(newMockPlugin("alpha", "1.0.0"), nil)
+	_ = pm.Register(newMockPlugin("beta", "1.0.0"), &PluginConfig{Enabled: false})
+	_ = pm.Register(newMockPlugin("gamma", "1.0.0"), &PluginConfig{Enabled: true})
+
+	snapshot := pm.SnapshotState()
+	expected := map[string]bool{"alpha": true, "beta": false, "gamma": true}
+	for name, enabled := range expected {
+		if snapshot[name] != enabled {
+			t.Errorf("snapshot[%s] = %v, want %v", name, snapshot[name], enabled)
+		}
+	}
+
+	for _, name := range pm.List() {
+		_ = pm.SetEnabled(name, false)
+	}
+	for name, enabled := range pm.SnapshotState() {
+		if enabled {
+			t.Errorf("expected %s to be disabled", name)
+		}
+	}
+
+	if err := pm.RestoreState(snapshot); err != nil {
+		t.Fatalf("RestoreState() error = %v", err)
+	}
+	restored := pm.SnapshotState()
+	for name, enabled := range expected {
+		if restored[name] != enabled {
+			t.Errorf("restored[%s] = %v, want %v", name, restored[name], enabled)
+		}
+	}
+
+	t.Run("unknown plugin errors without changes", func(t *testing.T) {
+		err := pm.RestoreState(map[string]bool{"alpha": false, "missing": true})
+		if err == nil {
+			t.Fatal("expected error for unknown plugin")
+		}
+		if !pm.SnapshotState()["alpha"] {
+			t.Error("expected alpha to remain enabled after failed restore")
+		}
+	})
+}
+
 func TestBasePlugin(t *testing.T) {
 	bp := &BasePlugin{
 		PluginName:    "base",
@@ -424,6 +562,116 @@ func TestLoggingPlugin(t *testing.T) {
 	if len(logs) != 3 {
 		t.Errorf("expected 3 log entries, got %d", len(logs))
 	}
+
+	var completeLog string
+	lp.Logger = func(format string, args ...interface{}) {
+		completeLog = fmt.Sprintf(format, args...)
+	}
+	_ = lp.OnComplete(ctx, &ClaudeResult{CostUSD: 0.01})
+	if !strings.Contains(completeLog, "cost=$0.0100") {
+		t.Errorf("expected formatted cost in log, got %q", completeLog)
+	}
+}
+
+func TestSecureLoggingPlugin(t *testing.T) {
+	ctx := context.Background()
+	secretContent := "DATABASE_PASSWORD=hunter2hunter2"
+	apiKey := "sk-abcdefghijklmnopqrstuvwx"
+
+	input := ToolInput{
+		Command:   "curl -H 'Authorization: " + apiKey + "' example.com",
+		Content:   secretContent,
+		NewString: "token: deadbeefcafe",
+		Raw: map[string]interface{}{
+			"command":    "curl -H 'Authorization: " + apiKey + "' example.com",
+			"content":    secretContent,
+			"new_string": "token: deadbeefcafe",
+			"timeout":    30,
+		},
+	}
+
+	t.Run("redacts by default", func(t *testing.T) {
+		var logs []string
+		lp := NewSecureLoggingPlugin(func(format string, args ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		})
+		if !lp.RedactInput {
+			t.Fatal("expected secure logging plugin to redact input")
+		}
+
+		_ = lp.OnToolCall(ctx, "Write", input)
+
+		if len(logs) != 1 {
+			t.Fatalf("expected 1 log entry, got %d", len(logs))
+		}
+		for _, secret := range []string{"hunter2", apiKey, "deadbeefcafe"} {
+			if strings.Contains(logs[0], secret) {
+				t.Errorf("log entry leaks %q: %s", secret, logs[0])
+			}
+		}
+		if input.Raw["content"] != secretContent {
+			t.Error("redaction should not mutate the caller's input")
+		}
+	})
+
+	t.Run("redacts nested edits", func(t *testing.T) {
+		var logs []string
+		lp := NewSecureLoggingPlugin(func(format string, args ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		})
+
+		edits := []interface{}{
+			map[string]interface{}{"old_string": "API_KEY=oldsecretvalue", "new_string": "API_KEY=newsecretvalue"},
+			map[string]interface{}{"old_string": "x", "new_string": "y", "note": "password: nestedpassword"},
+		}
+		multiEdit := ToolInput{
+			FilePath:  ".env",
+			OldString: "STRIPE=oldstripesecret",
+			Raw:       map[string]interface{}{"file_path": ".env", "edits": edits},
+		}
+		_ = lp.OnToolCall(ctx, "MultiEdit", multiEdit)
+
+		for _, secret := range []string{"oldsecretvalue", "newsecretvalue", "nestedpassword", "oldstripesecret"} {
+			if strings.Contains(logs[0], secret) {
+				t.Errorf("log entry leaks %q: %s", secret, logs[0])
+			}
+		}
+		if !strings.Contains(logs[0], ".env") {
+			t.Errorf("expected non-secret fields to be kept, got %s", logs[0])
+		}
+		if edits[0].(map[string]interface{})["old_string"] != "API_KEY=oldsecretvalue" {
+			t.Error("redaction should not mutate nested values of the caller's input")
+		}
+	})
+
+	t.Run("custom redactor", func(t *testing.T) {
+		var logs []string
+		lp := NewSecureLoggingPlugin(func(format string, args ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		})
+		lp.Redactor = func(in ToolInput) ToolInput {
+			return ToolInput{Command: "<custom>"}
+		}
+
+		_ = lp.OnToolCall(ctx, "Bash", input)
+
+		if !strings.Contains(logs[0], "<custom>") || strings.Contains(logs[0], apiKey) {
+			t.Errorf("expected custom redactor output, got %s", logs[0])
+		}
+	})
+
+	t.Run("plain logging plugin does not redact", func(t *testing.T) {
+		var logs []string
+		lp := NewLoggingPlugin(func(format string, args ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		})
+
+		_ = lp.OnToolCall(ctx, "Write", ToolInput{Content: "visible"})
+
+		if !strings.Contains(logs[0], "visible") {
+			t.Errorf("expected unredacted content, got %s", logs[0])
+		}
+	})
 }
 
 func TestMetricsPlugin(t *testing.T) {
@@ -467,6 +715,139 @@ func TestMetricsPlugin(t *testing.T) {
 	}
 }
 
+func TestMergeMetrics(t *testing.T) {
+	ctx := context.Background()
+
+	first := NewMetricsPlugin()
+	_ = first.OnToolCall(ctx, "Bash", ToolInput{})
+	_ = first.OnToolCall(ctx, "Read", ToolInput{})
+	_ = first.OnMessage(ctx, Message{})
+	_ = first.OnComplete(ctx, &ClaudeResult{CostUSD: 0.25})
+
+	second := NewMetricsPlugin()
+	_ = second.OnToolCall(ctx, "Bash", ToolInput{})
+	_ = second.OnToolCall(ctx, "Bash", ToolInput{})
+	_ = second.OnMessage(ctx, Message{})
+	_ = second.OnMessage(ctx, Message{})
+	_ = second.OnComplete(ctx, &ClaudeResult{CostUSD: 0.5})
+	_ = second.OnComplete(ctx, &ClaudeResult{CostUSD: 0.25})
+
+	merged := MergeMetrics(first, nil, second)
+	toolCalls := merged["tool_calls"].(map[string]int)
+	if toolCalls["Bash"] != 3 || toolCalls["Read"] != 1 {
+		t.Errorf("expected summed tool counts, got %v", toolCalls)
+	}
+	if merged["message_count"].(int) != 3 {
+		t.Errorf("expected 3 messages, got %v", merged["message_count"])
+	}
+	if merged["total_cost"].(float64) != 1.0 {
+		t.Errorf("expected total cost 1.0, got %v", merged["total_cost"])
+	}
+	if merged["execution_count"].(int) != 3 {
+		t.Errorf("expected 3 executions, got %v", merged["execution_count"])
+	}
+
+	toolCalls["Bash"] = 99
+	if first.GetMetrics()["tool_calls"].(map[string]int)["Bash"] != 1 {
+		t.Error("merged view should not alias plugin state")
+	}
+}
+
+func TestMetricsPlugin_Rates(t *testing.T) {
+	originalTimeNow := timeNow
+	defer func() { timeNow = originalTimeNow }()
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	timeNow = func() time.Time { return now }
+
+	ctx := context.Background()
+	mp := NewMetricsPlugin()
+	if !mp.StartTime.Equal(start) {
+		t.Errorf("expected StartTime %v, got %v", start, mp.StartTime)
+	}
+
+	metrics := mp.GetMetrics()
+	if metrics["messages_per_second"].(float64) != 0 || metrics["cost_per_minute"].(float64) != 0 {
+		t.Errorf("expected zero rates before any time has elapsed, got %v", metrics)
+	}
+
+	for i := 0; i < 30; i++ {
+		_ = mp.OnMessage(ctx, Message{})
+	}
+	_ = mp.OnComplete(ctx, &ClaudeResult{CostUSD: 1.5})
+	now = start.Add(30 * time.Second)
+
+	metrics = mp.GetMetrics()
+	if metrics["start_time"].(time.Time) != start || metrics["elapsed"].(time.Duration) != 30*time.Second {
+		t.Errorf("unexpected start_time/elapsed: %v", metrics)
+	}
+	if rate := metrics["messages_per_second"].(float64); rate != 1 {
+		t.Errorf("expected 1 message per second, got %v", rate)
+	}
+	if rate := metrics["cost_per_minute"].(float64); rate != 3 {
+		t.Errorf("expected $3 per minute, got %v", rate)
+	}
+
+	// An older plugin sets the window for merged rates
+	other := NewMetricsPlugin()
+	other.StartTime = start.Add(-30 * time.Second)
+	_ = other.OnMessage(ctx, Message{})
+	merged := MergeMetrics(mp, other)
+	if merged["start_time"].(time.Time) != other.StartTime {
+		t.Errorf("expected merged start_time to be the earliest, got %v", merged["start_time"])
+	}
+	if rate := merged["messages_per_second"].(float64); rate != 31.0/60 {
+		t.Errorf("expected merged rate over 60s, got %v", rate)
+	}
+
+	mp.Reset()
+	if !mp.StartTime.Equal(now) {
+		t.Errorf("expected Reset to restart the clock at %v, got %v", now, mp.StartTime)
+	}
+	now = now.Add(time.Minute)
+	_ = mp.OnComplete(ctx, &ClaudeResult{CostUSD: 0.5})
+	if rate := mp.GetMetrics()["cost_per_minute"].(float64); rate != 0.5 {
+		t.Errorf("expected rates to cover only the time since Reset, got %v", rate)
+	}
+}
+
+func TestMetricsPlugin_CostAttributor(t *testing.T) {
+	ctx := context.Background()
+
+	mp := NewMetricsPlugin()
+	_ = mp.OnToolCall(ctx, "Bash", ToolInput{})
+	if toolCost := mp.GetMetrics()["tool_cost"].(map[string]float64); len(toolCost) != 0 {
+		t.Errorf("expected no tool cost without an attributor, got %v", toolCost)
+	}
+
+	prices := map[string]float64{"Bash": 0.25, "WebFetch": 0.5}
+	mp = NewMetricsPlugin()
+	mp.CostAttributor = func(toolName string, input ToolInput) float64 {
+		return prices[toolName]
+	}
+	_ = mp.OnToolCall(ctx, "Bash", ToolInput{})
+	_ = mp.OnToolCall(ctx, "Bash", ToolInput{})
+	_ = mp.OnToolCall(ctx, "WebFetch", ToolInput{})
+	_ = mp.OnToolCall(ctx, "Read", ToolInput{})
+
+	toolCost := mp.GetMetrics()["tool_cost"].(map[string]float64)
+	if toolCost["Bash"] != 0.5 || toolCost["WebFetch"] != 0.5 || toolCost["Read"] != 0 {
+		t.Errorf("unexpected per-tool costs: %v", toolCost)
+	}
+	var sum float64
+	for _, cost := range toolCost {
+		sum += cost
+	}
+	if sum != 1.0 {
+		t.Errorf("expected per-tool costs to sum to 1.0, got %v", sum)
+	}
+
+	mp.Reset()
+	if toolCost := mp.GetMetrics()["tool_cost"].(map[string]float64); len(toolCost) != 0 {
+		t.Errorf("expected tool cost to be cleared by Reset, got %v", toolCost)
+	}
+}
 func TestToolFilterPlugin(t *testing.T) {
 	blockedTools := map[string]string{
 		"Bash":  "shell commands blocked",
@@ -511,6 +892,137 @@ func TestToolFilterPlugin(t *testing.T) {
 	})
 }
 
+// panickingPlugin panics whenever it receives a message
+type panickingPlugin struct {
+	BasePlugin
+}
+
+func (p *panickingPlugin) OnMessage(ctx context.Context, msg Message) error {
+	panic("boom")
+}
+
+func TestPluginManager_PanicRecovery(t *testing.T) {
+	ctx := context.Background()
+	pm := NewPluginManager()
+	after := newMockPlugin("after", "1.0.0")
+	_ = pm.Register(&panickingPlugin{BasePlugin{PluginName: "bad", PluginVersion: "1.0.0"}}, &PluginConfig{Enabled: true, Priority: 1})
+	_ = pm.Register(after, &PluginConfig{Enabled: true, Priority: 2})
+
+	err := pm.OnMessage(ctx, Message{Type: "assistant"})
+	if !errors.Is(err, ErrPluginPanic) {
+		t.Fatalf("expected ErrPluginPanic, got %v", err)
+	}
+	for _, want := range []string{"bad", "OnMessage", "boom"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to mention %q, got %q", want, err.Error())
+		}
+	}
+
+	// Other hooks of the same plugin keep working
+	if err := pm.OnStreamStart(ctx, "prompt"); err != nil {
+		t.Errorf("OnStreamStart() error = %v", err)
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		pm.PanicAsError = false
+		defer func() {
+			if recover() == nil {
+				t.Error("expected panic to propagate with PanicAsError disabled")
+			}
+		}()
+		_ = pm.OnMessage(ctx, Message{Type: "assistant"})
+	})
+}
+
+// mutatingPlugin overwrites the result it completes with, recording what it saw first
+type mutatingPlugin struct {
+	BasePlugin
+	seen string
+}
+
+func (p *mutatingPlugin) OnComplete(ctx context.Context, result *ClaudeResult) error {
+	p.seen = result.Result
+	result.Result = "overwritten by " + p.PluginName
+	result.Usage.OutputTokens = 0
+	result.Metrics["tool_calls"].(map[string]int)["Bash"] = 99
+	return nil
+}
+
+func TestPluginManager_CloneResultPerPlugin(t *testing.T) {
+	newResult := func() *ClaudeResult {
+		return &ClaudeResult{
+			Result:  "original",
+			Usage:   &Usage{OutputTokens: 42},
+			Metrics: map[string]interface{}{"tool_calls": map[string]int{"Bash": 1}},
+		}
+	}
+
+	pm := NewPluginManager()
+	pm.CloneResultPerPlugin = true
+	first := &mutatingPlugin{BasePlugin: BasePlugin{PluginName: "first"}}
+	second := &mutatingPlugin{BasePlugin: BasePlugin{PluginName: "second"}}
+	_ = pm.Register(first, &PluginConfig{Enabled: true, Priority: 1})
+	_ = pm.Register(second, &PluginConfig{Enabled: true, Priority: 2})
+
+	result := newResult()
+	if err := pm.OnComplete(context.Background(), result); err != nil {
+		t.Fatalf("OnComplete() error = %v", err)
+	}
+	if first.seen != "original" || second.seen != "original" {
+		t.Errorf("expected each plugin to see the original result, got %q and %q", first.seen, second.seen)
+	}
+	if !reflect.DeepEqual(result, newResult()) {
+		t.Errorf("expected the caller's result to be untouched, got %+v", result)
+	}
+
+	// Without cloning the mutation leaks to the next plugin
+	pm.CloneResultPerPlugin = false
+	if err := pm.OnComplete(context.Background(), result); err != nil {
+		t.Fatalf("OnComplete() error = %v", err)
+	}
+	if second.seen != "overwritten by first" {
+		t.Errorf("expected shared result without cloning, got %q", second.seen)
+	}
+}
+
+func TestToolLimitPlugin(t *testing.T) {
+	ctx := context.Background()
+	pm := NewPluginManager()
+	plugin := NewToolLimitPlugin(2)
+	_ = pm.Register(plugin, nil)
+
+	_ = pm.OnStreamStart(ctx, "first run")
+	for i := 0; i < 2; i++ {
+		if err := pm.OnToolCall(ctx, "Read", ToolInput{}); err != nil {
+			t.Fatalf("call %d: unexpected error %v", i+1, err)
+		}
+	}
+	err := pm.OnToolCall(ctx, "Bash", ToolInput{Command: "ls"})
+	if !errors.Is(err, ErrToolLimitExceeded) {
+		t.Fatalf("expected ErrToolLimitExceeded on the third call, got %v", err)
+	}
+
+	_ = pm.OnStreamStart(ctx, "second run")
+	if plugin.Calls() != 0 {
+		t.Errorf("expected count reset on stream start, got %d", plugin.Calls())
+	}
+	if err := pm.OnToolCall(ctx, "Read", ToolInput{}); err != nil {
+		t.Errorf("expected calls to be allowed in a new run, got %v", err)
+	}
+
+	t.Run("zero is unlimited", func(t *testing.T) {
+		unlimited := NewToolLimitPlugin(0)
+		for i := 0; i < 50; i++ {
+			if err := unlimited.OnToolCall(ctx, "Read", ToolInput{}); err != nil {
+				t.Fatalf("call %d: expected no limit, got %v", i+1, err)
+			}
+		}
+		if unlimited.Calls() != 50 {
+			t.Errorf("expected calls to still be counted, got %d", unlimited.Calls())
+		}
+	})
+}
+
 func TestAuditPlugin(t *testing.T) {
 	// Mock time for consistent testing
 	originalTimeNow := timeNow
@@ -553,6 +1065,89 @@ func TestAuditPlugin(t *testing.T) {
 	}
 }
 
+func TestAuditPluginHashChain(t *testing.T) {
+	ctx := context.Background()
+	record := func() *AuditPlugin {
+		ap := NewAuditPlugin(0)
+		ap.HashChain = true
+		_ = ap.OnToolCall(ctx, "Read", ToolInput{Raw: map[string]interface{}{"file_path": "a.go"}})
+		_ = ap.OnToolCall(ctx, "Bash", ToolInput{Raw: map[string]interface{}{"command": "ls"}})
+		_ = ap.OnToolCall(ctx, "Write", ToolInput{Raw: map[string]interface{}{"file_path": "b.go"}})
+		return ap
+	}
+
+	t.Run("intact chain verifies", func(t *testing.T) {
+		ap := record()
+		if err := ap.VerifyChain(); err != nil {
+			t.Fatalf("expected intact chain, got %v", err)
+		}
+		records := ap.GetRecords()
+		if records[0].PrevHash != "" || records[1].PrevHash != records[0].Hash || records[0].Hash == "" {
+			t.Errorf("records are not chained: %+v", records)
+		}
+	})
+
+	t.Run("mutated record fails", func(t *testing.T) {
+		ap := record()
+		ap.Records[1].Input["command"] = "rm -rf /"
+		if err := ap.VerifyChain(); !errors.Is(err, ErrAuditChainBroken) {
+			t.Errorf("expected ErrAuditChainBroken, got %v", err)
+		}
+	})
+
+	t.Run("caller mutations do not reach records", func(t *testing.T) {
+		ap := NewAuditPlugin(0)
+		ap.HashChain = true
+		raw := map[string]interface{}{"edits": []interface{}{map[string]interface{}{"old_string": "a"}}}
+		_ = ap.OnToolCall(ctx, "MultiEdit", ToolInput{Raw: raw})
+		raw["file_path"] = "c.go"
+		raw["edits"].([]interface{})[0].(map[string]interface{})["old_string"] = "b"
+		ap.GetRecords()[0].Input["edits"] = nil
+		if err := ap.VerifyChain(); err != nil {
+			t.Errorf("expected the chain to survive caller mutations, got %v", err)
+		}
+	})
+
+	t.Run("rehashed record breaks the link", func(t *testing.T) {
+		ap := record()
+		ap.Records[1].ToolName = "Glob"
+		ap.Records[1].Hash, _ = ap.Records[1].computeHash()
+		if err := ap.VerifyChain(); !errors.Is(err, ErrAuditChainBroken) {
+			t.Errorf("expected ErrAuditChainBroken, got %v", err)
+		}
+	})
+
+	t.Run("dropped record fails", func(t *testing.T) {
+		ap := record()
+		ap.Records = ap.Records[:2]
+		if err := ap.VerifyChain(); !errors.Is(err, ErrAuditChainBroken) {
+			t.Errorf("expected ErrAuditChainBroken, got %v", err)
+		}
+	})
+
+	t.Run("trimmed chain still verifies", func(t *testing.T) {
+		ap := NewAuditPlugin(2)
+		ap.HashChain = true
+		for i := 0; i < 5; i++ {
+			_ = ap.OnToolCall(ctx, fmt.Sprintf("tool%d", i), ToolInput{})
+		}
+		if err := ap.VerifyChain(); err != nil {
+			t.Errorf("expected trimmed chain to verify, got %v", err)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		ap := NewAuditPlugin(0)
+		_ = ap.OnToolCall(ctx, "Read", ToolInput{})
+		if ap.GetRecords()[0].Hash != "" {
+			t.Error("expected no hash without HashChain")
+		}
+		if err := ap.VerifyChain(); err == nil {
+			t.Error("expected error when hash chaining is disabled")
+		}
+	})
+}
+
 func TestAuditPluginUnlimited(t *testing.T) {
 	ap := NewAuditPlugin(0) // 0 = unlimited
 
@@ -670,6 +1265,30 @@ func TestPluginConfigDefaults(t *testing.T) {
 	}
 }
 
+func TestPluginManagerDefaultPriority(t *testing.T) {
+	pm := NewPluginManager()
+	if pm.DefaultPriority != 100 {
+		t.Fatalf("expected default priority 100, got %d", pm.DefaultPriority)
+	}
+
+	pm.DefaultPriority = 200
+	_ = pm.Register(newMockPlugin("defaulted", "1.0.0"), nil)
+	_ = pm.Register(newMockPlugin("explicit", "1.0.0"), &PluginConfig{Enabled: true, Priority: 150})
+	_ = pm.Register(newMockPlugin("zero", "1.0.0"), &PluginConfig{Enabled: true})
+
+	names := pm.List()
+	expected := []string{"explicit", "defaulted", "zero"}
+	for i, name := range names {
+		if name != expected[i] {
+			t.Errorf("expected %s at index %d, got %s", expected[i], i, name)
+		}
+	}
+
+	if pm.plugins[1].config.Priority != 200 {
+		t.Errorf("expected nil config to get priority 200, got %d", pm.plugins[1].config.Priority)
+	}
+}
+
 func TestPluginManagerList(t *testing.T) {
 	pm := NewPluginManager()
 	_ = pm.Register(newMockPlugin("alpha", "1.0.0"), &PluginConfig{Priority: 100})
@@ -703,3 +1322,269 @@ func TestRunOptionsPluginManager(t *testing.T) {
 		t.Errorf("expected 1 plugin, got %d", opts.PluginManager.Count())
 	}
 }
+
+func TestPluginManagerOnPermission(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("dispatches to enabled plugins", func(t *testing.T) {
+		pm := NewPluginManager()
+		enabled := newMockPlugin("enabled", "1.0.0")
+		disabled := newMockPlugin("disabled", "1.0.0")
+		_ = pm.Register(enabled, nil)
+		_ = pm.Register(disabled, &PluginConfig{Enabled: false, Priority: 1})
+
+		if err := pm.OnPermission(ctx, "Bash", ToolInput{Command: "ls"}, Deny("no shell")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(enabled.permissions) != 1 || enabled.permissions[0].Behavior != PermissionDeny {
+			t.Errorf("expected enabled plugin to observe deny, got %+v", enabled.permissions)
+		}
+		if len(disabled.permissions) != 0 {
+			t.Errorf("expected disabled plugin to be skipped, got %+v", disabled.permissions)
+		}
+	})
+
+	t.Run("plugin error vetoes", func(t *testing.T) {
+		pm := NewPluginManager()
+		plugin := newMockPlugin("veto", "1.0.0")
+		plugin.permissionErr = errors.New("not today")
+		_ = pm.Register(plugin, nil)
+
+		err := pm.OnPermission(ctx, "Bash", ToolInput{}, Allow())
+		if err == nil || !strings.Contains(err.Error(), "veto") {
+			t.Errorf("expected veto error, got %v", err)
+		}
+	})
+}
+
+func TestPluginManagerMaxInputBytes(t *testing.T) {
+	ctx := context.Background()
+	large := strings.Repeat("x", 1024)
+
+	t.Run("truncates oversized input", func(t *testing.T) {
+		pm := NewPluginManager()
+		pm.MaxInputBytes = 16
+		plugin := newMockPlugin("audit", "1.0.0")
+		_ = pm.Register(plugin, nil)
+
+		input := ToolInput{
+			FilePath: "/tmp/big.txt",
+			Content:  large,
+			Raw:      map[string]interface{}{"file_path": "/tmp/big.txt", "content": large},
+		}
+		if err := pm.OnToolCall(ctx, "Write", input); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		got := plugin.toolInputs[0]
+		if len(got.Content) != 16 {
+			t.Errorf("expected content truncated to 16 bytes, got %d", len(got.Content))
+		}
+		if raw, _ := got.Raw["content"].(string); len(raw) != 16 {
+			t.Errorf("expected raw content truncated to 16 bytes, got %d", len(raw))
+		}
+		if got.Raw[TruncatedInputKey] != true {
+			t.Error("expected truncated marker")
+		}
+		if got.FilePath != "/tmp/big.txt" || got.Raw["file_path"] != "/tmp/big.txt" {
+			t.Errorf("expected short fields untouched, got %+v", got.Raw["file_path"])
+		}
+
+		if len(input.Content) != 1024 || len(input.Raw["content"].(string)) != 1024 {
+			t.Error("original input was mutated")
+		}
+		if _, ok := input.Raw[TruncatedInputKey]; ok {
+			t.Error("original raw map was mutated")
+		}
+	})
+
+	t.Run("truncates on a rune boundary", func(t *testing.T) {
+		pm := NewPluginManager()
+		pm.MaxInputBytes = 16
+		plugin := newMockPlugin("audit", "1.0.0")
+		_ = pm.Register(plugin, nil)
+
+		// Each "é" is two bytes and the 16th byte falls inside the eighth one
+		accented := "x" + strings.Repeat("é", 20)
+		_ = pm.OnToolCall(ctx, "Write", ToolInput{Content: accented, Raw: map[string]interface{}{"content": accented}})
+
+		got := plugin.toolInputs[0]
+		raw, _ := got.Raw["content"].(string)
+		for _, s := range []string{got.Content, raw} {
+			if !utf8.ValidString(s) || s != "x"+strings.Repeat("é", 7) {
+				t.Errorf("expected a rune-safe cut, got %q", s)
+			}
+		}
+	})
+
+	t.Run("bounds nested values", func(t *testing.T) {
+		pm := NewPluginManager()
+		pm.MaxInputBytes = 16
+		plugin := newMockPlugin("audit", "1.0.0")
+		_ = pm.Register(plugin, nil)
+
+		edits := []interface{}{
+			map[string]interface{}{"old_string": large, "new_string": "short"},
+		}
+		input := ToolInput{Raw: map[string]interface{}{"file_path": "/tmp/a.go", "edits": edits, "truncated": "tool value"}}
+		_ = pm.OnToolCall(ctx, "MultiEdit", input)
+
+		got := plugin.toolInputs[0]
+		edit := got.Raw["edits"].([]interface{})[0].(map[string]interface{})
+		if len(edit["old_string"].(string)) != 16 || edit["new_string"] != "short" {
+			t.Errorf("expected nested strings bounded to 16 bytes, got %+v", edit)
+		}
+		if got.Raw[TruncatedInputKey] != true || got.Raw["truncated"] != "tool value" {
+			t.Errorf("expected the marker alongside the tool's own truncated key, got %+v", got.Raw)
+		}
+		if len(edits[0].(map[string]interface{})["old_string"].(string)) != 1024 {
+			t.Error("original nested value was mutated")
+		}
+	})
+
+	t.Run("small input passes through", func(t *testing.T) {
+		pm := NewPluginManager()
+		pm.MaxInputBytes = 16
+		plugin := newMockPlugin("audit", "1.0.0")
+		_ = pm.Register(plugin, nil)
+
+		_ = pm.OnPermission(ctx, "Bash", ToolInput{Command: "ls"}, Allow())
+		_ = pm.OnToolCall(ctx, "Bash", ToolInput{Command: "ls"})
+		if plugin.toolInputs[0].Raw != nil {
+			t.Errorf("expected no marker on small input, got %+v", plugin.toolInputs[0].Raw)
+		}
+	})
+
+	t.Run("unlimited by default", func(t *testing.T) {
+		pm := NewPluginManager()
+		plugin := newMockPlugin("audit", "1.0.0")
+		_ = pm.Register(plugin, nil)
+
+		_ = pm.OnToolCall(ctx, "Write", ToolInput{Content: large})
+		if len(plugin.toolInputs[0].Content) != 1024 {
+			t.Errorf("expected untruncated content, got %d bytes", len(plugin.toolInputs[0].Content))
+		}
+	})
+}
+
+// orderPlugin records the order in which OnComplete reaches each plugin
+type orderPlugin struct {
+	BasePlugin
+	order *[]string
+}
+
+func (op *orderPlugin) OnComplete(ctx context.Context, result *ClaudeResult) error {
+	*op.order = append(*op.order, op.PluginName)
+	return nil
+}
+
+func TestPluginManagerCompleteReverseOrder(t *testing.T) {
+	var order []string
+	pm := NewPluginManager()
+	for i, name := range []string{"flush", "encode", "close"} {
+		plugin := &orderPlugin{BasePlugin: BasePlugin{PluginName: name, PluginVersion: "1.0.0"}, order: &order}
+		_ = pm.Register(plugin, &PluginConfig{Enabled: true, Priority: (i + 1) * 10})
+	}
+
+	if pm.CompleteReverseOrder() {
+		t.Fatal("expected forward order by default")
+	}
+	_ = pm.OnComplete(context.Background(), &ClaudeResult{})
+	if strings.Join(order, ",") != "flush,encode,close" {
+		t.Errorf("expected priority order, got %v", order)
+	}
+
+	order = nil
+	pm.SetCompleteReverseOrder(true)
+	_ = pm.OnComplete(context.Background(), &ClaudeResult{})
+	if strings.Join(order, ",") != "close,encode,flush" {
+		t.Errorf("expected reverse order, got %v", order)
+	}
+}
+
+func TestPluginFactoryRegistry(t *testing.T) {
+	RegisterPluginFactory("test-factory", func(cfg map[string]interface{}) (Plugin, error) {
+		name, _ := cfg["name"].(string)
+		if name == "" {
+			return nil, errors.New("name is required")
+		}
+		return newMockPlugin(name, "1.0.0"), nil
+	})
+
+	plugin, err := NewPluginFromConfig("test-factory", map[string]interface{}{"name": "custom"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if plugin.Name() != "custom" {
+		t.Errorf("expected plugin named custom, got %s", plugin.Name())
+	}
+	if _, err := NewPluginFromConfig("test-factory", nil); err == nil || !strings.Contains(err.Error(), "name is required") {
+		t.Errorf("expected factory error to be returned, got %v", err)
+	}
+
+	for _, name := range []string{"logging", "metrics", "tool-filter", "tool-limit", "audit"} {
+		if _, err := NewPluginFromConfig(name, nil); err != nil {
+			t.Errorf("built-in %s failed with empty config: %v", name, err)
+		}
+	}
+
+	filter, err := NewPluginFromConfig("tool-filter", map[string]interface{}{"blocked_tools": []interface{}{"Bash"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := filter.OnToolCall(context.Background(), "Bash", ToolInput{}); err == nil {
+		t.Error("expected Bash to be blocked by the configured filter")
+	}
+
+	audit, err := NewPluginFromConfig("audit", map[string]interface{}{"max_size": float64(5), "hash_chain": true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ap := audit.(*AuditPlugin); !ap.HashChain {
+		t.Error("expected hash_chain to be applied")
+	}
+	if _, err := NewPluginFromConfig("audit", map[string]interface{}{"max_size": "big"}); err == nil {
+		t.Error("expected error for non-numeric max_size")
+	}
+
+	_, err = NewPluginFromConfig("does-not-exist", nil)
+	var notFound *PluginNotFoundError
+	if !errors.As(err, &notFound) || notFound.Name != "does-not-exist" {
+		t.Errorf("expected PluginNotFoundError, got %v", err)
+	}
+}
+
+func TestPluginManager_OrderingMode(t *testing.T) {
+	register := func(pm *PluginManager) {
+		_ = pm.Register(newMockPlugin("late", "1.0.0"), &PluginConfig{Enabled: true, Priority: 30})
+		_ = pm.Register(newMockPlugin("early", "1.0.0"), &PluginConfig{Enabled: true, Priority: 10})
+		_ = pm.Register(newMockPlugin("post", "1.0.0"), &PluginConfig{Enabled: true, Priority: 5, Phase: PhasePost})
+		_ = pm.Register(newMockPlugin("middle", "1.0.0"), &PluginConfig{Enabled: true, Priority: 20})
+	}
+
+	pm := NewPluginManager()
+	if pm.OrderingMode() != OrderPriority {
+		t.Fatal("expected priority ordering by default")
+	}
+	register(pm)
+	if got := strings.Join(pm.List(), ","); got != "early,middle,late,post" {
+		t.Errorf("priority mode: got %s", got)
+	}
+
+	pm.SetOrderingMode(OrderRegistration)
+	if got := strings.Join(pm.List(), ","); got != "late,early,post,middle" {
+		t.Errorf("switching to registration mode: got %s", got)
+	}
+	pm.SetOrderingMode(OrderPriority)
+	if got := strings.Join(pm.List(), ","); got != "early,middle,late,post" {
+		t.Errorf("switching back to priority mode: got %s", got)
+	}
+
+	pm = NewPluginManager()
+	pm.SetOrderingMode(OrderRegistration)
+	register(pm)
+	if got := strings.Join(pm.List(), ","); got != "late,early,post,middle" {
+		t.Errorf("registration mode: got %s", got)
+	}
+}
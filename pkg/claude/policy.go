@@ -0,0 +1,112 @@
+package claude
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// DefaultHTTPPolicyTimeout bounds each policy request when HTTPPolicyOptions.Timeout is unset
+const DefaultHTTPPolicyTimeout = 5 * time.Second
+
+// HTTPPolicyOptions configures HTTPPolicyCallbackWith
+type HTTPPolicyOptions struct {
+	// Client sends the policy requests; nil uses http.DefaultClient
+	Client *http.Client
+	// Timeout bounds each request; zero uses DefaultHTTPPolicyTimeout
+	Timeout time.Duration
+	// FailOpen allows tool calls when the policy service cannot be reached or answers badly
+	// By default such calls are denied
+	FailOpen bool
+}
+
+// httpPolicyRequest is the body POSTed to the policy service
+type httpPolicyRequest struct {
+	ToolName string    `json:"tool_name"`
+	Input    ToolInput `json:"input"`
+}
+
+// httpPolicyResponse accepts a bare decision or one wrapped in "result", as OPA's data API returns
+type httpPolicyResponse struct {
+	PermissionResult
+	Result *PermissionResult `json:"result,omitempty"`
+}
+
+// HTTPPolicyCallback returns a permission callback that asks an external policy service, failing closed
+// See HTTPPolicyCallbackWith for the request and response format
+func HTTPPolicyCallback(endpoint string, client *http.Client) PermissionCallback {
+	return HTTPPolicyCallbackWith(endpoint, HTTPPolicyOptions{Client: client})
+}
+
+// HTTPPolicyCallbackWith returns a permission callback that POSTs {"tool_name": ..., "input": ...} to endpoint
+// and expects {"behavior": "allow"|"deny"|"ask", "message": ...}, optionally wrapped in {"result": ...}
+// Transport errors, non-2xx statuses and malformed decisions deny the call unless opts.FailOpen is set
+func HTTPPolicyCallbackWith(endpoint string, opts HTTPPolicyOptions) PermissionCallback {
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHTTPPolicyTimeout
+	}
+
+	return func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
+		result, err := queryHTTPPolicy(ctx, client, endpoint, timeout, toolName, input)
+		if err != nil {
+			if opts.FailOpen {
+				return Allow(), nil
+			}
+			return Deny(fmt.Sprintf("policy service unavailable: %v", err)), nil
+		}
+		return result, nil
+	}
+}
+
+// queryHTTPPolicy performs one policy request and validates the decision
+func queryHTTPPolicy(ctx context.Context, client *http.Client, endpoint string, timeout time.Duration, toolName string, input ToolInput) (PermissionResult, error) {
+	body, err := json.Marshal(httpPolicyRequest{ToolName: toolName, Input: input})
+	if err != nil {
+		return PermissionResult{}, fmt.Errorf("failed to encode policy request: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return PermissionResult{}, fmt.Errorf("failed to create policy request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return PermissionResult{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return PermissionResult{}, fmt.Errorf("policy service returned %s", resp.Status)
+	}
+
+	var decoded httpPolicyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return PermissionResult{}, fmt.Errorf("failed to decode policy response: %w", err)
+	}
+	result := decoded.PermissionResult
+	if decoded.Result != nil {
+		result = *decoded.Result
+	}
+
+	switch result.Behavior {
+	case PermissionAllow, PermissionDeny, PermissionAsk:
+		return result, nil
+	default:
+		return PermissionResult{}, fmt.Errorf("policy service returned unknown behavior %q", result.Behavior)
+	}
+}
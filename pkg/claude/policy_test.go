@@ -0,0 +1,112 @@
+package claude
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPPolicyCallback(t *testing.T) {
+	var received httpPolicyRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("failed to decode policy request: %v", err)
+		}
+		switch received.ToolName {
+		case "Read":
+			_, _ = w.Write([]byte(`{"behavior":"allow"}`))
+		case "Bash":
+			_, _ = w.Write([]byte(`{"behavior":"deny","message":"no shell"}`))
+		case "Write":
+			_, _ = w.Write([]byte(`{"result":{"behavior":"ask","message":"confirm write"}}`))
+		case "Edit":
+			_, _ = w.Write([]byte(`{"behavior":"maybe"}`))
+		default:
+			http.Error(w, "boom", http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	cb := HTTPPolicyCallback(server.URL, server.Client())
+
+	tests := []struct {
+		tool     string
+		behavior PermissionBehavior
+		message  string
+	}{
+		{"Read", PermissionAllow, ""},
+		{"Bash", PermissionDeny, "no shell"},
+		{"Write", PermissionAsk, "confirm write"},
+		{"Edit", PermissionDeny, "policy service unavailable"},
+		{"Glob", PermissionDeny, "500"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tool, func(t *testing.T) {
+			result, err := cb(ctx, tt.tool, ToolInput{Command: "ls", Raw: map[string]interface{}{"command": "ls"}})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result.Behavior != tt.behavior || !strings.Contains(result.Message, tt.message) {
+				t.Errorf("got %+v, want %s containing %q", result, tt.behavior, tt.message)
+			}
+			if received.ToolName != tt.tool || received.Input.Command != "ls" {
+				t.Errorf("policy service received %+v", received)
+			}
+		})
+	}
+
+	failOpen := HTTPPolicyCallbackWith(server.URL, HTTPPolicyOptions{Client: server.Client(), FailOpen: true})
+	if result, _ := failOpen(ctx, "Glob", ToolInput{}); result.Behavior != PermissionAllow {
+		t.Errorf("expected FailOpen to allow on a server error, got %+v", result)
+	}
+	if result, _ := failOpen(ctx, "Bash", ToolInput{}); result.Behavior != PermissionDeny {
+		t.Errorf("expected FailOpen to keep explicit denials, got %+v", result)
+	}
+}
+
+func TestHTTPPolicyCallback_Outage(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	ctx := context.Background()
+	cb := HTTPPolicyCallbackWith(slow.URL, HTTPPolicyOptions{Client: slow.Client(), Timeout: 50 * time.Millisecond})
+	if result, err := cb(ctx, "Bash", ToolInput{}); err != nil || result.Behavior != PermissionDeny {
+		t.Errorf("expected a timed-out policy request to deny, got %+v, %v", result, err)
+	}
+
+	// A caller cancellation propagates to the request
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	cb = HTTPPolicyCallback(slow.URL, slow.Client())
+	if result, _ := cb(cancelled, "Bash", ToolInput{}); result.Behavior != PermissionDeny {
+		t.Errorf("expected a cancelled policy request to deny, got %+v", result)
+	}
+
+	// A closed server simulates the service being down
+	down := httptest.NewServer(http.NotFoundHandler())
+	url := down.URL
+	down.Close()
+
+	if result, _ := HTTPPolicyCallback(url, nil)(ctx, "Bash", ToolInput{}); result.Behavior != PermissionDeny {
+		t.Errorf("expected fail-closed deny when the service is down, got %+v", result)
+	}
+	failOpen := HTTPPolicyCallbackWith(url, HTTPPolicyOptions{FailOpen: true})
+	if result, _ := failOpen(ctx, "Bash", ToolInput{}); result.Behavior != PermissionAllow {
+		t.Errorf("expected fail-open allow when the service is down, got %+v", result)
+	}
+}
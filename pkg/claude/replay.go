@@ -0,0 +1,62 @@
+package claude
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+)
+
+// Replay plays back a stream-json transcript recorded with RunOptions.RecordTo using the client's DefaultOptions
+func (c *ClaudeClient) Replay(reader io.Reader) (<-chan Message, <-chan error) {
+	return c.ReplayCtx(context.Background(), reader, c.DefaultOptions)
+}
+
+// ReplayCtx plays back a recorded stream-json transcript through the same pipeline as a live StreamPrompt run:
+// plugins and the permission callback fire as if the CLI had produced the lines, so bug reports can be reproduced
+// without calling Claude. OnStreamStart receives an empty prompt since transcripts do not record it
+func (c *ClaudeClient) ReplayCtx(ctx context.Context, reader io.Reader, opts *RunOptions) (<-chan Message, <-chan error) {
+	if opts == nil {
+		opts = &RunOptions{}
+	}
+	// A recorded transcript already holds any re-issued tool calls, so there is nothing to retry
+	replayOpts := *opts
+	replayOpts.ToolRetry = nil
+	opts = &replayOpts
+
+	messageCh := make(chan Message, streamBufferSize(opts))
+	errCh := make(chan error, 1)
+
+	go func() {
+		defer close(messageCh)
+		defer close(errCh)
+
+		if opts.PluginManager != nil {
+			if err := opts.PluginManager.OnStreamStart(ctx, ""); err != nil {
+				errCh <- &CancelCause{Reason: CancelPlugin, Err: err}
+				return
+			}
+		}
+
+		// Transcripts replay instantly, so tool timeouts never fire and there is no process to kill
+		watch := newToolWatch(opts, func() {})
+		defer watch.stop()
+
+		scanner := bufio.NewScanner(reader)
+		const maxScannerBuffer = 10 * 1024 * 1024
+		scanner.Buffer(make([]byte, 64*1024), maxScannerBuffer)
+
+		state := &streamState{}
+		for scanner.Scan() {
+			if err := handleStreamLine(ctx, scanner.Text(), opts, messageCh, state, watch); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			errCh <- fmt.Errorf("failed to read transcript: %w", err)
+		}
+	}()
+
+	return messageCh, errCh
+}
@@ -0,0 +1,81 @@
+package claude
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReplay_RecordedStream(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	script := streamScript{lines: []string{
+		`{"type":"system","subtype":"init","session_id":"replay-session"}`,
+		`{"type":"assistant","message":{"content":[{"type":"thinking","thinking":"plan"},{"type":"text","text":"Listing files"}]},"session_id":"replay-session"}`,
+		`{"type":"assistant","message":{"content":[{"type":"tool_use","id":"tool-1","name":"Bash","input":{"command":"ls"}}]},"session_id":"replay-session"}`,
+		`{"type":"user","message":{"content":[{"type":"tool_result","tool_use_id":"tool-1","content":"main.go"}]},"session_id":"replay-session"}`,
+		`{"type":"result","subtype":"success","total_cost_usd":0.002,"result":"main.go","session_id":"replay-session"}`,
+	}}
+	command, _ := mockStreamCommand(script)
+	execCommand = command
+
+	var transcript bytes.Buffer
+	client := &ClaudeClient{BinPath: "claude"}
+	live, err := collectStream(client.StreamPrompt(context.Background(), "List files", &RunOptions{RecordTo: &transcript}))
+	if err != nil {
+		t.Fatalf("live run failed: %v", err)
+	}
+	if got := strings.TrimSpace(transcript.String()); got != strings.Join(script.lines, "\n") {
+		t.Errorf("transcript does not match the CLI output:\n%s", got)
+	}
+
+	// Replay must not touch the CLI
+	execCommand = nil
+	metrics := NewMetricsPlugin()
+	pm := NewPluginManager()
+	_ = pm.Register(metrics, nil)
+	var checked []string
+	opts := &RunOptions{
+		PluginManager: pm,
+		PermissionCallback: func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
+			checked = append(checked, toolName+":"+input.Command)
+			return Allow(), nil
+		},
+	}
+
+	replayed, err := collectStream(client.ReplayCtx(context.Background(), bytes.NewReader(transcript.Bytes()), opts))
+	if err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	if !reflect.DeepEqual(replayed, live) {
+		t.Errorf("replayed messages differ from the live run:\n got %+v\nwant %+v", replayed, live)
+	}
+	if len(checked) != 1 || checked[0] != "Bash:ls" {
+		t.Errorf("expected the permission callback to see the replayed tool call, got %v", checked)
+	}
+	stats := metrics.GetMetrics()
+	if stats["tool_calls"].(map[string]int)["Bash"] != 1 || stats["execution_count"].(int) != 1 {
+		t.Errorf("expected plugins to observe the replayed run, got %v", stats)
+	}
+
+	// Policies apply on replay as they would live
+	opts.PermissionCallback = func(ctx context.Context, toolName string, input ToolInput) (PermissionResult, error) {
+		return Deny("no shell"), nil
+	}
+	_, err = collectStream(client.ReplayCtx(context.Background(), bytes.NewReader(transcript.Bytes()), opts))
+	var deniedErr *PermissionDeniedError
+	if !errors.As(err, &deniedErr) || deniedErr.ToolName != "Bash" {
+		t.Errorf("expected the replayed tool call to be denied, got %v", err)
+	}
+
+	client.DefaultOptions = &RunOptions{}
+	if _, err := collectStream(client.Replay(strings.NewReader("not json\n"))); err == nil {
+		t.Error("expected an error for a malformed transcript")
+	}
+}
@@ -0,0 +1,68 @@
+package claude
+
+import "context"
+
+// Runner executes prompts; ClaudeClient is the CLI-backed implementation
+// Depend on Runner instead of *ClaudeClient to allow substituting a MockClient in tests
+type Runner interface {
+	RunPromptCtx(ctx context.Context, prompt string, opts *RunOptions) (*ClaudeResult, error)
+	StreamPrompt(ctx context.Context, prompt string, opts *RunOptions) (<-chan Message, <-chan error)
+}
+
+var _ Runner = (*ClaudeClient)(nil)
+
+// MockClient is a Runner that answers prompts with a responder function and never spawns a process
+// Options are validated as for a real run, but plugins and budget trackers are not invoked
+type MockClient struct {
+	responder func(prompt string, opts *RunOptions) (*ClaudeResult, error)
+}
+
+// NewMockClient creates a MockClient; a nil responder answers every prompt with an empty success result
+func NewMockClient(responder func(prompt string, opts *RunOptions) (*ClaudeResult, error)) *MockClient {
+	return &MockClient{responder: responder}
+}
+
+// RunPromptCtx returns the responder's result for prompt
+func (m *MockClient) RunPromptCtx(ctx context.Context, prompt string, opts *RunOptions) (*ClaudeResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := PreprocessOptions(opts); err != nil {
+		return nil, err
+	}
+	opts = budgetAdjusted(opts)
+	if m.responder == nil {
+		return &ClaudeResult{Type: "result", Subtype: "success", EffectiveOptions: EffectiveOptions(opts)}, nil
+	}
+	result, err := m.responder(prompt, opts)
+	if result != nil && result.EffectiveOptions == nil {
+		result.EffectiveOptions = EffectiveOptions(opts)
+	}
+	return result, err
+}
+
+// StreamPrompt streams the responder's result as a single result message
+func (m *MockClient) StreamPrompt(ctx context.Context, prompt string, opts *RunOptions) (<-chan Message, <-chan error) {
+	result, err := m.RunPromptCtx(ctx, prompt, opts)
+	if err != nil {
+		return failedStream(err)
+	}
+
+	messageCh := make(chan Message, 1)
+	errCh := make(chan error)
+	messageCh <- Message{
+		Type:          "result",
+		Subtype:       result.Subtype,
+		Result:        result.Result,
+		CostUSD:       result.CostUSD,
+		DurationMS:    result.DurationMS,
+		DurationAPIMS: result.DurationAPIMS,
+		IsError:       result.IsError,
+		NumTurns:      result.NumTurns,
+		SessionID:     result.SessionID,
+		Usage:         result.Usage,
+	}
+	close(messageCh)
+	close(errCh)
+	return messageCh, errCh
+}
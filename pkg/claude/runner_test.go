@@ -0,0 +1,113 @@
+package claude
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMockClient_RunAgent(t *testing.T) {
+	var gotPrompt string
+	var gotOpts *RunOptions
+	client := NewMockClient(func(prompt string, opts *RunOptions) (*ClaudeResult, error) {
+		gotPrompt, gotOpts = prompt, opts
+		return &ClaudeResult{Type: "result", Subtype: "success", Result: "LGTM", CostUSD: 0.01, SessionID: "mock-session"}, nil
+	})
+
+	manager := NewSubagentManager(client)
+	_ = manager.RegisterAgent("reviewer", CodeReviewerAgent())
+
+	result, err := manager.RunAgent(context.Background(), "reviewer", "Review main.go", &RunOptions{ModelAlias: "opus"})
+	if err != nil {
+		t.Fatalf("RunAgent() error = %v", err)
+	}
+	if result.Result != "LGTM" || result.SessionID != "mock-session" {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if gotPrompt != "Review main.go" {
+		t.Errorf("responder prompt = %q", gotPrompt)
+	}
+	if gotOpts.SystemPrompt != CodeReviewerAgent().Prompt || gotOpts.ModelAlias != "sonnet" {
+		t.Errorf("responder received unexpected options: %+v", gotOpts)
+	}
+
+	t.Run("errors propagate", func(t *testing.T) {
+		wantErr := errors.New("overloaded")
+		manager := NewSubagentManager(NewMockClient(func(prompt string, opts *RunOptions) (*ClaudeResult, error) {
+			return nil, wantErr
+		}))
+		_ = manager.RegisterAgent("reviewer", CodeReviewerAgent())
+
+		if _, err := manager.RunAgent(context.Background(), "reviewer", "Review", nil); !errors.Is(err, wantErr) {
+			t.Errorf("RunAgent() error = %v, want %v", err, wantErr)
+		}
+	})
+
+	t.Run("streams a result message", func(t *testing.T) {
+		messages, err := collectStream(manager.StreamAgent(context.Background(), "reviewer", "Review", nil))
+		if err != nil {
+			t.Fatalf("StreamAgent() error = %v", err)
+		}
+		if len(messages) != 1 || messages[0].Type != "result" || messages[0].Result != "LGTM" {
+			t.Errorf("unexpected messages: %+v", messages)
+		}
+	})
+
+	t.Run("nil responder", func(t *testing.T) {
+		result, err := NewMockClient(nil).RunPromptCtx(context.Background(), "hi", nil)
+		if err != nil || result.Subtype != "success" {
+			t.Errorf("expected empty success result, got %+v, %v", result, err)
+		}
+	})
+}
+
+// fakeRunner is a hand-written Runner that fails a fixed number of times before succeeding
+type fakeRunner struct {
+	failures int
+	calls    int
+}
+
+func (f *fakeRunner) RunPromptCtx(ctx context.Context, prompt string, opts *RunOptions) (*ClaudeResult, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return nil, NewClaudeError(ErrorNetwork, "connection reset")
+	}
+	return &ClaudeResult{Result: "ok after " + prompt}, nil
+}
+
+func (f *fakeRunner) StreamPrompt(ctx context.Context, prompt string, opts *RunOptions) (<-chan Message, <-chan error) {
+	result, err := f.RunPromptCtx(ctx, prompt, opts)
+	if err != nil {
+		return failedStream(err)
+	}
+	return NewMockClient(func(string, *RunOptions) (*ClaudeResult, error) { return result, nil }).StreamPrompt(ctx, prompt, opts)
+}
+
+func TestRunWithRetry_FakeRunner(t *testing.T) {
+	policy := &RetryPolicy{MaxRetries: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, BackoffFactor: 1}
+
+	runner := &fakeRunner{failures: 2}
+	result, err := RunWithRetry(context.Background(), runner, "retry", nil, policy)
+	if err != nil {
+		t.Fatalf("RunWithRetry() error = %v", err)
+	}
+	if result.Result != "ok after retry" || runner.calls != 3 {
+		t.Errorf("expected success on the third call, got %q after %d calls", result.Result, runner.calls)
+	}
+
+	runner = &fakeRunner{failures: 10}
+	if _, err := RunWithRetry(context.Background(), runner, "retry", nil, policy); err == nil {
+		t.Error("expected error once retries are exhausted")
+	}
+	if runner.calls != policy.MaxRetries+1 {
+		t.Errorf("expected %d calls, got %d", policy.MaxRetries+1, runner.calls)
+	}
+
+	// Consumers accept any Runner
+	manager := NewSubagentManager(&fakeRunner{})
+	_ = manager.RegisterAgent("tester", TestAnalystAgent())
+	if result, err := manager.RunAgent(context.Background(), "tester", "agents", nil); err != nil || result.Result != "ok after agents" {
+		t.Errorf("RunAgent() through fake runner = %+v, %v", result, err)
+	}
+}
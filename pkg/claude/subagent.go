@@ -1,11 +1,53 @@
 package claude
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"strings"
 	"sync"
+	"time"
 )
 
+// ErrSessionDeadlineExceeded is returned when a subagent run is attempted after the session deadline
+var ErrSessionDeadlineExceeded = errors.New("subagent session deadline exceeded")
+
+// ErrOutputSchemaMismatch is returned when a subagent's structured output does not match its OutputSchema
+var ErrOutputSchemaMismatch = errors.New("subagent output does not match schema")
+
+// ErrSubagentDepthExceeded is returned when nested subagent runs exceed SubagentManager.MaxDepth
+var ErrSubagentDepthExceeded = errors.New("subagent depth limit exceeded")
+
+// ErrAgentUnhealthy is returned by HealthCheck when an agent does not answer the probe successfully
+var ErrAgentUnhealthy = errors.New("subagent health check failed")
+
+// DefaultMinRunEstimateUSD is the budget pre-flight estimate used when SubagentManager.MinRunEstimateUSD is not positive
+const DefaultMinRunEstimateUSD = 0.01
+
+// DefaultMaxContextBytes is the combined ContextFiles size limit used when MaxContextBytes is not positive
+const DefaultMaxContextBytes = 256 * 1024
+
+// HealthCheckTimeout bounds each HealthCheck run
+const HealthCheckTimeout = 30 * time.Second
+
+// healthCheckPrompt is the trivial prompt sent by HealthCheck
+const healthCheckPrompt = "Respond with OK."
+
+// DefaultSubagentMaxDepth is the nesting limit used when SubagentManager.MaxDepth is not positive
+const DefaultSubagentMaxDepth = 3
+
+// subagentDepthKey is the context key carrying the current subagent nesting depth
+type subagentDepthKey struct{}
+
+// subagentDepth returns the number of subagent runs enclosing ctx
+func subagentDepth(ctx context.Context) int {
+	depth, _ := ctx.Value(subagentDepthKey{}).(int)
+	return depth
+}
+
 // SubagentConfig defines a specialized sub-agent configuration
 type SubagentConfig struct {
 	// Description explains when to use this agent
@@ -20,6 +62,11 @@ type SubagentConfig struct {
 	// Supports both standard tools ("Read", "Bash") and MCP tools ("mcp__server__tool")
 	Tools []string `json:"tools,omitempty"`
 
+	// AdditionalTools are appended to the effective tool set after inheritance
+	// The base set is Tools, or the parent's AllowedTools when Tools is empty;
+	// an unrestricted base stays unrestricted
+	AdditionalTools []string `json:"additional_tools,omitempty"`
+
 	// Model specifies the model alias to use (sonnet, opus, haiku)
 	// If empty, inherits from the parent query's model
 	Model string `json:"model,omitempty"`
@@ -31,6 +78,21 @@ type SubagentConfig struct {
 	// WorkingDirectory overrides the working directory for this agent
 	// If empty, uses the parent query's working directory
 	WorkingDirectory string `json:"working_directory,omitempty"`
+
+	// RequiredMCPServers lists MCP servers that must be configured in the parent's MCP config
+	// Runs fail before spawning the CLI if any are missing
+	RequiredMCPServers []string `json:"required_mcp_servers,omitempty"`
+
+	// ContextFiles are read at the start of each run and prepended to the prompt
+	// A missing file fails the run; their combined size is capped by MaxContextBytes
+	ContextFiles []string `json:"context_files,omitempty"`
+
+	// MaxContextBytes caps the combined size of ContextFiles (0 = DefaultMaxContextBytes)
+	MaxContextBytes int `json:"max_context_bytes,omitempty"`
+
+	// OutputSchema is a JSON schema describing the agent's final answer
+	// RunAgentStructured instructs the agent to answer with JSON matching it
+	OutputSchema string `json:"output_schema,omitempty"`
 }
 
 // Validate checks that the SubagentConfig is valid
@@ -44,12 +106,47 @@ func (sc *SubagentConfig) Validate() error {
 	if sc.Model != "" && !isValidModelAlias(sc.Model) {
 		return fmt.Errorf("invalid model alias: %s (must be sonnet, opus, or haiku)", sc.Model)
 	}
+	if sc.MaxContextBytes < 0 {
+		return fmt.Errorf("subagent max context bytes cannot be negative")
+	}
+	if sc.OutputSchema != "" && !json.Valid([]byte(sc.OutputSchema)) {
+		return fmt.Errorf("subagent output schema is not valid JSON")
+	}
 	// Validate tool names if MCP tools are specified
 	for _, tool := range sc.Tools {
 		if err := validateMCPTools([]string{tool}); err != nil {
 			return err
 		}
 	}
+	if err := validateMCPTools(sc.AdditionalTools); err != nil {
+		return err
+	}
+	return nil
+}
+
+// subagentConfigJSON has SubagentConfig's fields without its JSON methods, avoiding recursion
+type subagentConfigJSON SubagentConfig
+
+// MarshalJSON encodes the config, omitting unset optional fields
+func (sc SubagentConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(subagentConfigJSON(sc))
+}
+
+// UnmarshalJSON decodes a config strictly, rejecting unknown fields, and validates the result
+// so typos and invalid settings in config files surface when they are loaded
+func (sc *SubagentConfig) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	var decoded subagentConfigJSON
+	if err := dec.Decode(&decoded); err != nil {
+		return fmt.Errorf("failed to decode subagent config: %w", err)
+	}
+	config := SubagentConfig(decoded)
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid subagent config: %w", err)
+	}
+	*sc = config
 	return nil
 }
 
@@ -62,8 +159,11 @@ func (sc *SubagentConfig) ToRunOptions(parentOpts *RunOptions) *RunOptions {
 	}
 
 	// Use subagent's model or inherit from parent
+	// A subagent alias must not be paired with the parent's full model name,
+	// otherwise the CLI could receive conflicting model selections
 	if sc.Model != "" {
 		opts.ModelAlias = sc.Model
+		opts.Model = ""
 	} else if parentOpts != nil {
 		opts.ModelAlias = parentOpts.ModelAlias
 		opts.Model = parentOpts.Model
@@ -79,31 +179,209 @@ func (sc *SubagentConfig) ToRunOptions(parentOpts *RunOptions) *RunOptions {
 	// Use subagent's working directory or inherit from parent
 	// Note: WorkingDirectory would need to be added to RunOptions if needed
 
+	if len(sc.AdditionalTools) > 0 {
+		opts.AllowedTools = sc.effectiveTools(parentOpts)
+	}
+
 	// Inherit MCP config from parent
 	if parentOpts != nil {
 		opts.MCPConfigPath = parentOpts.MCPConfigPath
+		opts.MCPConfig = parentOpts.MCPConfig
 		opts.PermissionMode = parentOpts.PermissionMode
 		opts.PermissionCallback = parentOpts.PermissionCallback
 		opts.BudgetTracker = parentOpts.BudgetTracker
+		opts.LatencyTracker = parentOpts.LatencyTracker
+		opts.StreamBufferSize = parentOpts.StreamBufferSize
+		opts.DisallowedTools = copyStrings(parentOpts.DisallowedTools)
+		if len(parentOpts.AdditionalDirs) > 0 {
+			opts.AdditionalDirs = append([]string(nil), parentOpts.AdditionalDirs...)
+		}
 	}
 
 	return opts
 }
 
+// effectiveTools returns the base tool set extended with AdditionalTools, without duplicates
+func (sc *SubagentConfig) effectiveTools(parentOpts *RunOptions) []string {
+	base := sc.Tools
+	if len(base) == 0 && parentOpts != nil {
+		base = parentOpts.AllowedTools
+	}
+	if len(base) == 0 {
+		return nil
+	}
+
+	tools := make([]string, 0, len(base)+len(sc.AdditionalTools))
+	seen := make(map[string]bool, cap(tools))
+	for _, tool := range append(append([]string(nil), base...), sc.AdditionalTools...) {
+		if !seen[tool] {
+			seen[tool] = true
+			tools = append(tools, tool)
+		}
+	}
+	return tools
+}
+
+// ValidateAgainstParent checks that the agent does not request tools the parent's DisallowedTools block outright
+// A parent entry with a command or path constraint, such as "Bash(rm:*)", only blocks part of a tool and is not a conflict
+func (sc *SubagentConfig) ValidateAgainstParent(parentOpts *RunOptions) error {
+	if parentOpts == nil {
+		return nil
+	}
+	var conflicts []string
+	for _, tool := range append(append([]string(nil), sc.Tools...), sc.AdditionalTools...) {
+		if disallowedByParent(tool, parentOpts.DisallowedTools) {
+			conflicts = append(conflicts, tool)
+		}
+	}
+	if len(conflicts) > 0 {
+		return NewValidationError(fmt.Sprintf("subagent requests tools disallowed by the parent: %s", strings.Join(conflicts, ", ")),
+			"Tools", conflicts)
+	}
+	return nil
+}
+
+// disallowedByParent reports whether tool is blocked outright by one of the disallowed entries
+func disallowedByParent(tool string, disallowed []string) bool {
+	requested, err := ParseToolPermission(tool)
+	for _, entry := range disallowed {
+		if entry == tool {
+			return true
+		}
+		if err != nil {
+			continue
+		}
+		blocked, parseErr := ParseToolPermission(entry)
+		if parseErr == nil && !blocked.HasCommand() && !blocked.HasPattern() && blocked.MatchesTool(requested.Tool) {
+			return true
+		}
+	}
+	return false
+}
+
+// agentRunOptions builds an agent's RunOptions, enforcing the parent's DisallowedTools and required MCP servers
+func (sm *SubagentManager) agentRunOptions(config *SubagentConfig, parentOpts *RunOptions) (*RunOptions, error) {
+	opts := config.ToRunOptions(parentOpts)
+	if err := config.ValidateAgainstParent(parentOpts); err != nil {
+		if !sm.StripDisallowedTools || len(opts.AllowedTools) == 0 {
+			return nil, err
+		}
+		allowed := make([]string, 0, len(opts.AllowedTools))
+		for _, tool := range opts.AllowedTools {
+			if !disallowedByParent(tool, parentOpts.DisallowedTools) {
+				allowed = append(allowed, tool)
+			}
+		}
+		if len(allowed) == 0 {
+			return nil, err
+		}
+		opts.AllowedTools = allowed
+	}
+	if err := config.checkRequiredMCPServers(opts); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// withContext prepends the current contents of ContextFiles to prompt
+func (sc *SubagentConfig) withContext(prompt string) (string, error) {
+	if len(sc.ContextFiles) == 0 {
+		return prompt, nil
+	}
+	limit := sc.MaxContextBytes
+	if limit <= 0 {
+		limit = DefaultMaxContextBytes
+	}
+
+	var b strings.Builder
+	total := 0
+	for _, path := range sc.ContextFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read context file %s: %w", path, err)
+		}
+		if total += len(data); total > limit {
+			return "", NewValidationError(fmt.Sprintf("context files exceed %d bytes", limit), "ContextFiles", path)
+		}
+		fmt.Fprintf(&b, "<context file=%q>\n%s\n</context>\n\n", path, strings.TrimRight(string(data), "\n"))
+	}
+	b.WriteString(prompt)
+	return b.String(), nil
+}
+
+// checkRequiredMCPServers verifies every required MCP server is defined in the run's MCP config
+func (sc *SubagentConfig) checkRequiredMCPServers(opts *RunOptions) error {
+	if len(sc.RequiredMCPServers) == 0 {
+		return nil
+	}
+
+	servers := make(map[string]struct{})
+	source := "MCPConfig"
+	switch {
+	case opts.MCPConfig != nil:
+		for name := range opts.MCPConfig.MCPServers {
+			servers[name] = struct{}{}
+		}
+	case opts.MCPConfigPath != "":
+		source = opts.MCPConfigPath
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return fmt.Errorf("failed to read MCP config %s: %w", source, err)
+		}
+		var config struct {
+			MCPServers map[string]json.RawMessage `json:"mcpServers"`
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return fmt.Errorf("failed to parse MCP config %s: %w", source, err)
+		}
+		for name := range config.MCPServers {
+			servers[name] = struct{}{}
+		}
+	default:
+		return NewValidationError(fmt.Sprintf("subagent requires MCP servers %v but no MCP config is set", sc.RequiredMCPServers),
+			"RequiredMCPServers", sc.RequiredMCPServers)
+	}
+
+	for _, server := range sc.RequiredMCPServers {
+		if _, ok := servers[server]; !ok {
+			return NewValidationError(fmt.Sprintf("required MCP server %q is not configured in %s", server, source),
+				"RequiredMCPServers", server)
+		}
+	}
+	return nil
+}
+
 // SubagentManager manages the lifecycle and execution of subagents
 type SubagentManager struct {
 	mu       sync.RWMutex
 	agents   map[string]*SubagentConfig
-	client   *ClaudeClient
-	sessions map[string]string // agentName -> sessionID
+	client   Runner
+	sessions map[string]string      // sessionKey(agentName, key) -> sessionID
+	deadline time.Time              // shared wall-clock deadline for all runs (zero = none)
+	parents  map[string]*RunOptions // default parent options bound with SetDefaultParentOptions
+
+	// MaxDepth limits how deeply subagent runs may nest through their contexts
+	// Values <= 0 use DefaultSubagentMaxDepth
+	MaxDepth int
+
+	// MinRunEstimateUSD is the spend an agent run must be able to afford under the parent's BudgetTracker;
+	// runs that cannot are rejected with ErrBudgetExceeded before starting. Values <= 0 use DefaultMinRunEstimateUSD
+	MinRunEstimateUSD float64
+
+	// StripDisallowedTools drops agent tools that the parent's DisallowedTools block instead of rejecting the run
+	// A run whose tool list would be left empty, and so unrestricted, is still rejected
+	StripDisallowedTools bool
 }
 
-// NewSubagentManager creates a new SubagentManager
-func NewSubagentManager(client *ClaudeClient) *SubagentManager {
+// NewSubagentManager creates a new SubagentManager that runs agents with client
+// Pass a MockClient to exercise agents without the CLI
+func NewSubagentManager(client Runner) *SubagentManager {
 	return &SubagentManager{
 		agents:   make(map[string]*SubagentConfig),
 		client:   client,
 		sessions: make(map[string]string),
+		parents:  make(map[string]*RunOptions),
+		MaxDepth: DefaultSubagentMaxDepth,
 	}
 }
 
@@ -142,7 +420,33 @@ func (sm *SubagentManager) UnregisterAgent(name string) {
 	defer sm.mu.Unlock()
 
 	delete(sm.agents, name)
-	delete(sm.sessions, name)
+	delete(sm.parents, name)
+	sm.clearAgentSessions(name)
+}
+
+// SetDefaultParentOptions binds default parent options to an agent, used by runs of that agent
+// Parent options passed to a run are merged over the defaults with MergeOptions; nil opts removes the binding
+func (sm *SubagentManager) SetDefaultParentOptions(name string, opts *RunOptions) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if opts == nil {
+		delete(sm.parents, name)
+		return
+	}
+	sm.parents[name] = opts
+}
+
+// parentOptions returns the parent options for a run of agentName, merged over its bound defaults
+func (sm *SubagentManager) parentOptions(agentName string, parentOpts *RunOptions) *RunOptions {
+	sm.mu.RLock()
+	defaults := sm.parents[agentName]
+	sm.mu.RUnlock()
+
+	if defaults == nil {
+		return parentOpts
+	}
+	return MergeOptions(defaults, parentOpts)
 }
 
 // GetAgent returns a registered subagent configuration
@@ -179,31 +483,319 @@ func (sm *SubagentManager) GetAgentDescriptions() map[string]string {
 	return descriptions
 }
 
+// Agents returns copies of all registered subagent configurations
+// Mutating the returned configs does not affect the manager
+func (sm *SubagentManager) Agents() map[string]SubagentConfig {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	agents := make(map[string]SubagentConfig, len(sm.agents))
+	for name, config := range sm.agents {
+		agent := *config
+		if config.Tools != nil {
+			agent.Tools = append([]string(nil), config.Tools...)
+		}
+		if config.AdditionalTools != nil {
+			agent.AdditionalTools = append([]string(nil), config.AdditionalTools...)
+		}
+		if config.RequiredMCPServers != nil {
+			agent.RequiredMCPServers = append([]string(nil), config.RequiredMCPServers...)
+		}
+		if config.ContextFiles != nil {
+			agent.ContextFiles = append([]string(nil), config.ContextFiles...)
+		}
+		agents[name] = agent
+	}
+	return agents
+}
+
+// PreviewRunOptions returns the validated RunOptions a subagent would run with
+// given the parent options, without executing anything
+func (sm *SubagentManager) PreviewRunOptions(agentName string, parentOpts *RunOptions) (*RunOptions, error) {
+	config, ok := sm.GetAgent(agentName)
+	if !ok {
+		return nil, &UnknownAgentError{Name: agentName}
+	}
+
+	opts, err := sm.agentRunOptions(config, sm.parentOptions(agentName, parentOpts))
+	if err != nil {
+		return nil, err
+	}
+	if err := PreprocessOptions(opts); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// SetSessionDeadline sets a wall-clock deadline shared across all subsequent runs
+// Once the deadline has passed, RunAgent, ResumeAgent and StreamAgent fail fast with ErrSessionDeadlineExceeded
+// A zero time clears the deadline
+func (sm *SubagentManager) SetSessionDeadline(deadline time.Time) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.deadline = deadline
+}
+
+// SessionDeadline returns the shared session deadline, if one is set
+func (sm *SubagentManager) SessionDeadline() (time.Time, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	return sm.deadline, !sm.deadline.IsZero()
+}
+
+// withSessionDeadline bounds ctx by the remaining session time
+// It returns ErrSessionDeadlineExceeded if the deadline has already passed
+func (sm *SubagentManager) withSessionDeadline(ctx context.Context) (context.Context, context.CancelFunc, error) {
+	deadline, ok := sm.SessionDeadline()
+	if !ok {
+		return ctx, func() {}, nil
+	}
+
+	remaining := deadline.Sub(timeNow())
+	if remaining <= 0 {
+		return nil, nil, ErrSessionDeadlineExceeded
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, remaining)
+	return ctx, cancel, nil
+}
+
+// enterSubagent returns ctx annotated with one more level of subagent nesting
+// It refuses with ErrSubagentDepthExceeded once the run would exceed MaxDepth
+func (sm *SubagentManager) enterSubagent(ctx context.Context, agentName string) (context.Context, error) {
+	maxDepth := sm.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = DefaultSubagentMaxDepth
+	}
+	depth := subagentDepth(ctx) + 1
+	if depth > maxDepth {
+		return nil, fmt.Errorf("%w: agent %s would run at depth %d (max %d)", ErrSubagentDepthExceeded, agentName, depth, maxDepth)
+	}
+	return context.WithValue(ctx, subagentDepthKey{}, depth), nil
+}
+
+// checkBudget rejects a run when the options' BudgetTracker cannot afford MinRunEstimateUSD
+func (sm *SubagentManager) checkBudget(agentName string, opts *RunOptions) error {
+	if opts == nil || opts.BudgetTracker == nil {
+		return nil
+	}
+	estimate := sm.MinRunEstimateUSD
+	if estimate <= 0 {
+		estimate = DefaultMinRunEstimateUSD
+	}
+	if !opts.BudgetTracker.CanSpend(estimate) {
+		return fmt.Errorf("%w: agent %s needs at least $%.*f but $%.*f remains",
+			ErrBudgetExceeded, agentName, costPrecision, estimate, costPrecision, opts.BudgetTracker.RemainingBudget())
+	}
+	return nil
+}
+
 // RunAgent executes a subagent with the given prompt
 func (sm *SubagentManager) RunAgent(ctx context.Context, agentName string, prompt string, parentOpts *RunOptions) (*ClaudeResult, error) {
+	opts, err := sm.PreviewRunOptions(agentName, parentOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	return sm.runAgent(ctx, agentName, prompt, opts)
+}
+
+// runAgent runs a subagent with prepared options under the depth limit and session deadline
+func (sm *SubagentManager) runAgent(ctx context.Context, agentName, prompt string, opts *RunOptions) (*ClaudeResult, error) {
+	if err := sm.checkBudget(agentName, opts); err != nil {
+		return nil, err
+	}
+	ctx, err := sm.enterSubagent(ctx, agentName)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel, err := sm.withSessionDeadline(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	if config, ok := sm.GetAgent(agentName); ok {
+		if prompt, err = config.withContext(prompt); err != nil {
+			return nil, fmt.Errorf("agent %s: %w", agentName, err)
+		}
+	}
+	return sm.client.RunPromptCtx(ctx, prompt, opts)
+}
+
+// RunAgentStructured runs a subagent that has an OutputSchema and decodes its final answer into out
+// The agent is instructed to reply with JSON only; output that is not JSON or violates the schema's
+// type, required and properties constraints is reported as ErrOutputSchemaMismatch
+func (sm *SubagentManager) RunAgentStructured(ctx context.Context, agentName string, prompt string, parentOpts *RunOptions, out interface{}) error {
 	config, ok := sm.GetAgent(agentName)
 	if !ok {
-		return nil, fmt.Errorf("unknown agent: %s", agentName)
+		return &UnknownAgentError{Name: agentName}
+	}
+	if config.OutputSchema == "" {
+		return fmt.Errorf("agent %s has no output schema", agentName)
 	}
 
-	opts := config.ToRunOptions(parentOpts)
-	return sm.client.RunPromptCtx(ctx, prompt, opts)
+	var schema map[string]interface{}
+	if err := json.Unmarshal([]byte(config.OutputSchema), &schema); err != nil {
+		return fmt.Errorf("invalid output schema for agent %s: %w", agentName, err)
+	}
+
+	opts, err := sm.PreviewRunOptions(agentName, parentOpts)
+	if err != nil {
+		return err
+	}
+	opts.Format = JSONOutput
+	opts.AppendPrompt = "Respond with a single JSON value that conforms to this JSON schema and nothing else:\n" + config.OutputSchema
+
+	result, err := sm.runAgent(ctx, agentName, prompt, opts)
+	if err != nil {
+		return err
+	}
+	if result.IsError {
+		return fmt.Errorf("agent %s failed: %s", agentName, result.Result)
+	}
+
+	output := stripCodeFence(result.Result)
+	var value interface{}
+	if err := json.Unmarshal([]byte(output), &value); err != nil {
+		return fmt.Errorf("%w: agent %s did not return JSON: %v", ErrOutputSchemaMismatch, agentName, err)
+	}
+	if err := checkSchema(schema, value, "$"); err != nil {
+		return fmt.Errorf("%w: agent %s: %v", ErrOutputSchemaMismatch, agentName, err)
+	}
+	if err := json.Unmarshal([]byte(output), out); err != nil {
+		return fmt.Errorf("%w: agent %s: %v", ErrOutputSchemaMismatch, agentName, err)
+	}
+	return nil
+}
+
+// stripCodeFence removes a surrounding Markdown code fence, which models often add around JSON
+func stripCodeFence(s string) string {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "```") || !strings.HasSuffix(s, "```") || len(s) < 6 {
+		return s
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "```"), "```")
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[i+1:] // drop the language tag line
+	}
+	return strings.TrimSpace(s)
+}
+
+// checkSchema validates value against the type, required, properties and items keywords of schema
+// Other JSON schema keywords are ignored
+func checkSchema(schema map[string]interface{}, value interface{}, path string) error {
+	if want, ok := schema["type"].(string); ok && !schemaTypeMatches(want, value) {
+		return fmt.Errorf("%s: expected %s, got %s", path, want, jsonTypeName(value))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if key, ok := name.(string); ok {
+					if _, present := v[key]; !present {
+						return fmt.Errorf("%s: missing required property %q", path, key)
+					}
+				}
+			}
+		}
+		if properties, ok := schema["properties"].(map[string]interface{}); ok {
+			for key, sub := range properties {
+				subSchema, ok := sub.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if field, present := v[key]; present {
+					if err := checkSchema(subSchema, field, path+"."+key); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := checkSchema(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// schemaTypeMatches reports whether a decoded JSON value has the given JSON schema type
+func schemaTypeMatches(want string, value interface{}) bool {
+	got := jsonTypeName(value)
+	if want == "integer" {
+		n, ok := value.(float64)
+		return ok && n == float64(int64(n))
+	}
+	return want == got
+}
+
+// jsonTypeName returns the JSON schema type name of a decoded JSON value
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
 }
 
 // StreamAgent executes a subagent and streams the results
 func (sm *SubagentManager) StreamAgent(ctx context.Context, agentName string, prompt string, parentOpts *RunOptions) (<-chan Message, <-chan error) {
 	config, ok := sm.GetAgent(agentName)
 	if !ok {
-		errCh := make(chan error, 1)
-		errCh <- fmt.Errorf("unknown agent: %s", agentName)
-		close(errCh)
-		msgCh := make(chan Message)
-		close(msgCh)
-		return msgCh, errCh
+		return failedStream(&UnknownAgentError{Name: agentName})
 	}
 
-	opts := config.ToRunOptions(parentOpts)
-	return sm.client.StreamPrompt(ctx, prompt, opts)
+	opts, err := sm.agentRunOptions(config, sm.parentOptions(agentName, parentOpts))
+	if err != nil {
+		return failedStream(err)
+	}
+	if err := sm.checkBudget(agentName, opts); err != nil {
+		return failedStream(err)
+	}
+	ctx, err = sm.enterSubagent(ctx, agentName)
+	if err != nil {
+		return failedStream(err)
+	}
+	if prompt, err = config.withContext(prompt); err != nil {
+		return failedStream(fmt.Errorf("agent %s: %w", agentName, err))
+	}
+
+	ctx, cancel, err := sm.withSessionDeadline(ctx)
+	if err != nil {
+		return failedStream(err)
+	}
+	// The deadline context is released once the stream has ended
+	messageCh, errCh := sm.client.StreamPrompt(ctx, prompt, opts)
+	return observeStream(ctx, messageCh, errCh, func(error) { cancel() })
+}
+
+// failedStream returns closed streaming channels that report err
+func failedStream(err error) (<-chan Message, <-chan error) {
+	errCh := make(chan error, 1)
+	errCh <- err
+	close(errCh)
+	msgCh := make(chan Message)
+	close(msgCh)
+	return msgCh, errCh
 }
 
 // SetSession stores a session ID for a subagent (for conversation continuity)
@@ -223,12 +815,115 @@ func (sm *SubagentManager) GetSession(agentName string) (string, bool) {
 	return sessionID, ok
 }
 
-// ClearSession removes the session ID for a subagent
+// ClearSession removes the session ID for a subagent, including any forked sessions
 func (sm *SubagentManager) ClearSession(agentName string) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
+	sm.clearAgentSessions(agentName)
+}
+
+// clearAgentSessions removes the default and keyed sessions of an agent
+// Must be called with the lock held
+func (sm *SubagentManager) clearAgentSessions(agentName string) {
 	delete(sm.sessions, agentName)
+	prefix := agentName + "\x00"
+	for k := range sm.sessions {
+		if strings.HasPrefix(k, prefix) {
+			delete(sm.sessions, k)
+		}
+	}
+}
+
+// sessionKey returns the sessions map key for one of an agent's sessions
+// The empty key is the agent's default session used by SetSession and ResumeAgent
+func sessionKey(agentName, key string) string {
+	if key == "" {
+		return agentName
+	}
+	return agentName + "\x00" + key
+}
+
+// SetSessionKey stores a session ID for a subagent under a named key
+func (sm *SubagentManager) SetSessionKey(agentName, key, sessionID string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.sessions[sessionKey(agentName, key)] = sessionID
+}
+
+// GetSessionKey retrieves the session ID stored for a subagent under a named key
+func (sm *SubagentManager) GetSessionKey(agentName, key string) (string, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	sessionID, ok := sm.sessions[sessionKey(agentName, key)]
+	return sessionID, ok
+}
+
+// ForkSession copies the session stored under sourceKey to newKey so that subsequent
+// RunAgentSession calls with each key continue independently
+// An empty key refers to the agent's default session
+// This only clones the local session reference; whether the two continuations truly diverge
+// on the server depends on the CLI's support for forking resumed sessions
+func (sm *SubagentManager) ForkSession(agentName, sourceKey, newKey string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if _, ok := sm.agents[agentName]; !ok {
+		return &UnknownAgentError{Name: agentName}
+	}
+	if sourceKey == newKey {
+		return fmt.Errorf("cannot fork session %q of agent %s onto itself", sourceKey, agentName)
+	}
+	sessionID, ok := sm.sessions[sessionKey(agentName, sourceKey)]
+	if !ok {
+		return fmt.Errorf("no session found for agent: %s (key %q)", agentName, sourceKey)
+	}
+
+	sm.sessions[sessionKey(agentName, newKey)] = sessionID
+	return nil
+}
+
+// RunAgentSession runs a subagent within the session stored under key, resuming it if present
+// The session ID reported by the run is stored back under key
+func (sm *SubagentManager) RunAgentSession(ctx context.Context, agentName, key, prompt string, parentOpts *RunOptions) (*ClaudeResult, error) {
+	opts, err := sm.PreviewRunOptions(agentName, parentOpts)
+	if err != nil {
+		return nil, err
+	}
+	if err := sm.checkBudget(agentName, opts); err != nil {
+		return nil, err
+	}
+
+	// A resumed session already carries the agent's context files in its history
+	if sessionID, ok := sm.GetSessionKey(agentName, key); ok {
+		opts.ResumeID = sessionID
+	} else if config, ok := sm.GetAgent(agentName); ok {
+		if prompt, err = config.withContext(prompt); err != nil {
+			return nil, fmt.Errorf("agent %s: %w", agentName, err)
+		}
+	}
+
+	ctx, err = sm.enterSubagent(ctx, agentName)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel, err := sm.withSessionDeadline(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	result, err := sm.client.RunPromptCtx(ctx, prompt, opts)
+	if err != nil {
+		return nil, err
+	}
+	if result.SessionID != "" {
+		sm.SetSessionKey(agentName, key, result.SessionID)
+	}
+	return result, nil
 }
 
 // ClearAllSessions removes all stored session IDs
@@ -241,6 +936,12 @@ func (sm *SubagentManager) ClearAllSessions() {
 
 // ResumeAgent resumes a subagent's previous conversation
 func (sm *SubagentManager) ResumeAgent(ctx context.Context, agentName string, prompt string, parentOpts *RunOptions) (*ClaudeResult, error) {
+	return sm.ResumeAgentWith(ctx, agentName, prompt, parentOpts, nil)
+}
+
+// ResumeAgentWith resumes a subagent's previous conversation, overriding its system prompt with resume
+// The session history is kept, so the agent continues the same conversation under the new instructions
+func (sm *SubagentManager) ResumeAgentWith(ctx context.Context, agentName string, prompt string, parentOpts *RunOptions, resume *ResumeOptions) (*ClaudeResult, error) {
 	sessionID, ok := sm.GetSession(agentName)
 	if !ok {
 		return nil, fmt.Errorf("no session found for agent: %s", agentName)
@@ -248,14 +949,56 @@ func (sm *SubagentManager) ResumeAgent(ctx context.Context, agentName string, pr
 
 	config, configOk := sm.GetAgent(agentName)
 	if !configOk {
-		return nil, fmt.Errorf("unknown agent: %s", agentName)
+		return nil, &UnknownAgentError{Name: agentName}
+	}
+	parentOpts = sm.parentOptions(agentName, parentOpts)
+	if err := sm.checkBudget(agentName, config.ToRunOptions(parentOpts)); err != nil {
+		return nil, err
 	}
 
-	opts := config.ToRunOptions(parentOpts)
+	ctx, err := sm.enterSubagent(ctx, agentName)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel, err := sm.withSessionDeadline(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	opts, err := sm.agentRunOptions(config, parentOpts)
+	if err != nil {
+		return nil, err
+	}
+	resume.apply(opts)
 	opts.ResumeID = sessionID
 	return sm.client.RunPromptCtx(ctx, prompt, opts)
 }
 
+// HealthCheck verifies an agent responds by running it once with a trivial prompt, e.g. as a readiness probe
+// The run is limited to one turn and HealthCheckTimeout; configuration errors such as an unknown agent
+// are returned as is, while failed runs and error results wrap ErrAgentUnhealthy
+func (sm *SubagentManager) HealthCheck(ctx context.Context, name string) error {
+	opts, err := sm.PreviewRunOptions(name, nil)
+	if err != nil {
+		return err
+	}
+	opts.MaxTurns = 1
+
+	ctx, cancel := context.WithTimeout(ctx, HealthCheckTimeout)
+	defer cancel()
+
+	result, err := sm.runAgent(ctx, name, healthCheckPrompt, opts)
+	if err != nil {
+		return fmt.Errorf("%w: agent %s: %w", ErrAgentUnhealthy, name, err)
+	}
+	if result.IsError {
+		return fmt.Errorf("%w: agent %s returned an error result: %s", ErrAgentUnhealthy, name, result.Result)
+	}
+	return nil
+}
+
 // AgentCount returns the number of registered subagents
 func (sm *SubagentManager) AgentCount() int {
 	sm.mu.RLock()
@@ -2,8 +2,16 @@ package claude
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestSubagentConfig_Validate(t *testing.T) {
@@ -147,6 +155,38 @@ func TestSubagentConfig_ToRunOptions(t *testing.T) {
 		}
 	})
 
+	t.Run("subagent model clears parent full model", func(t *testing.T) {
+		config := &SubagentConfig{
+			Description: "Test agent",
+			Prompt:      "You are a test agent",
+			Model:       "haiku",
+		}
+
+		parentOpts := &RunOptions{
+			Model: "claude-3-opus-20240229",
+		}
+
+		opts := config.ToRunOptions(parentOpts)
+
+		if opts.Model != "" {
+			t.Errorf("Model = %q, want empty when subagent sets an alias", opts.Model)
+		}
+
+		modelFlags := 0
+		args := BuildArgs("test", opts)
+		for i, arg := range args {
+			if arg == "--model" {
+				modelFlags++
+				if i+1 < len(args) && args[i+1] != "haiku" {
+					t.Errorf("--model = %q, want %q", args[i+1], "haiku")
+				}
+			}
+		}
+		if modelFlags != 1 {
+			t.Errorf("expected exactly one --model flag, got %d", modelFlags)
+		}
+	})
+
 	t.Run("subagent overrides parent", func(t *testing.T) {
 		config := &SubagentConfig{
 			Description: "Test agent",
@@ -171,6 +211,54 @@ func TestSubagentConfig_ToRunOptions(t *testing.T) {
 	})
 }
 
+func TestSubagentConfig_AdditionalTools(t *testing.T) {
+	parent := &RunOptions{AllowedTools: []string{"Read", "Grep", "Glob"}}
+
+	t.Run("adds to inherited tools", func(t *testing.T) {
+		config := &SubagentConfig{
+			Description:     "Runner",
+			Prompt:          "You run tests",
+			AdditionalTools: []string{"Bash", "Read"},
+		}
+
+		opts := config.ToRunOptions(parent)
+		want := []string{"Read", "Grep", "Glob", "Bash"}
+		if strings.Join(opts.AllowedTools, ",") != strings.Join(want, ",") {
+			t.Errorf("AllowedTools = %v, want %v", opts.AllowedTools, want)
+		}
+		if len(parent.AllowedTools) != 3 {
+			t.Errorf("parent tools were modified: %v", parent.AllowedTools)
+		}
+	})
+
+	t.Run("adds to own tools", func(t *testing.T) {
+		config := &SubagentConfig{
+			Description:     "Runner",
+			Prompt:          "You run tests",
+			Tools:           []string{"Read"},
+			AdditionalTools: []string{"Bash"},
+		}
+
+		opts := config.ToRunOptions(parent)
+		if strings.Join(opts.AllowedTools, ",") != "Read,Bash" {
+			t.Errorf("AllowedTools = %v, want [Read Bash]", opts.AllowedTools)
+		}
+	})
+
+	t.Run("unrestricted base stays unrestricted", func(t *testing.T) {
+		config := &SubagentConfig{Description: "Runner", Prompt: "You run tests", AdditionalTools: []string{"Bash"}}
+		if opts := config.ToRunOptions(nil); opts.AllowedTools != nil {
+			t.Errorf("AllowedTools = %v, want nil", opts.AllowedTools)
+		}
+	})
+
+	t.Run("validated like tools", func(t *testing.T) {
+		config := &SubagentConfig{Description: "Runner", Prompt: "You run tests", AdditionalTools: []string{"mcp__broken"}}
+		if err := config.Validate(); err == nil {
+			t.Error("expected invalid MCP tool name to be rejected")
+		}
+	})
+}
 func TestNewSubagentManager(t *testing.T) {
 	client := NewClient("mock-claude")
 	manager := NewSubagentManager(client)
@@ -343,6 +431,44 @@ func TestSubagentManager_GetAgentDescriptions(t *testing.T) {
 	}
 }
 
+func TestSubagentManager_Agents(t *testing.T) {
+	client := NewClient("mock-claude")
+	manager := NewSubagentManager(client)
+
+	_ = manager.RegisterAgent("security", &SubagentConfig{
+		Description: "Security expert",
+		Prompt:      "You are a security expert",
+		Tools:       []string{"Read", "Grep"},
+		Model:       "opus",
+	})
+
+	agents := manager.Agents()
+	if len(agents) != 1 {
+		t.Fatalf("Agents() returned %d agents, want 1", len(agents))
+	}
+	if got := agents["security"]; got.Model != "opus" || len(got.Tools) != 2 {
+		t.Errorf("Agents()[security] = %+v, want full config", got)
+	}
+
+	// Mutate everything reachable from the returned map
+	agent := agents["security"]
+	agent.Tools[0] = "Bash"
+	agent.Description = "Compromised"
+	agents["security"] = agent
+	agents["rogue"] = SubagentConfig{Description: "Rogue", Prompt: "Rogue"}
+
+	internal, _ := manager.GetAgent("security")
+	if internal.Tools[0] != "Read" {
+		t.Errorf("internal Tools[0] = %q, want %q", internal.Tools[0], "Read")
+	}
+	if internal.Description != "Security expert" {
+		t.Errorf("internal Description = %q, want %q", internal.Description, "Security expert")
+	}
+	if manager.AgentCount() != 1 {
+		t.Errorf("AgentCount() = %d, want 1", manager.AgentCount())
+	}
+}
+
 func TestSubagentManager_Sessions(t *testing.T) {
 	client := NewClient("mock-claude")
 	manager := NewSubagentManager(client)
@@ -454,6 +580,34 @@ func TestSubagentManager_ResumeAgent(t *testing.T) {
 	})
 }
 
+func TestSubagentManager_ResumeAgentWith(t *testing.T) {
+	var gotOpts *RunOptions
+	manager := NewSubagentManager(NewMockClient(func(prompt string, opts *RunOptions) (*ClaudeResult, error) {
+		gotOpts = opts
+		return &ClaudeResult{Result: "ok", SessionID: "review-session"}, nil
+	}))
+	_ = manager.RegisterAgent("reviewer", &SubagentConfig{Description: "Reviewer", Prompt: "Review for style"})
+	manager.SetSession("reviewer", "review-session")
+
+	resume := &ResumeOptions{SystemPrompt: "Now review for security", AppendPrompt: "Be brief"}
+	if _, err := manager.ResumeAgentWith(context.Background(), "reviewer", "Continue", nil, resume); err != nil {
+		t.Fatalf("ResumeAgentWith() error = %v", err)
+	}
+	if gotOpts.SystemPrompt != "Now review for security" || gotOpts.AppendPrompt != "Be brief" {
+		t.Errorf("expected overridden prompts, got system %q append %q", gotOpts.SystemPrompt, gotOpts.AppendPrompt)
+	}
+	if gotOpts.ResumeID != "review-session" {
+		t.Errorf("expected ResumeID to be preserved, got %q", gotOpts.ResumeID)
+	}
+
+	if _, err := manager.ResumeAgent(context.Background(), "reviewer", "Continue", nil); err != nil {
+		t.Fatalf("ResumeAgent() error = %v", err)
+	}
+	if gotOpts.SystemPrompt != "Review for style" || gotOpts.ResumeID != "review-session" {
+		t.Errorf("expected the agent's own prompt without overrides, got %q (resume %q)", gotOpts.SystemPrompt, gotOpts.ResumeID)
+	}
+}
+
 func TestSubagentManager_Concurrent(t *testing.T) {
 	client := NewClient("mock-claude")
 	manager := NewSubagentManager(client)
@@ -568,3 +722,754 @@ func findSubstring(s, substr string) bool {
 	}
 	return false
 }
+
+func TestSubagentManager_PreviewRunOptions(t *testing.T) {
+	client := NewClient("mock-claude")
+	manager := NewSubagentManager(client)
+	_ = manager.RegisterAgent("reviewer", &SubagentConfig{
+		Description: "Reviewer",
+		Prompt:      "You review code",
+		Tools:       []string{"Read", "Grep"},
+	})
+
+	parentOpts := &RunOptions{
+		ModelAlias:    "opus",
+		MCPConfigPath: "/path/to/mcp.json",
+		MaxTurns:      4,
+	}
+
+	t.Run("inherits parent options", func(t *testing.T) {
+		opts, err := manager.PreviewRunOptions("reviewer", parentOpts)
+		if err != nil {
+			t.Fatalf("PreviewRunOptions() error = %v", err)
+		}
+		if opts.ModelAlias != "opus" {
+			t.Errorf("ModelAlias = %q, want inherited %q", opts.ModelAlias, "opus")
+		}
+		if opts.MCPConfigPath != "/path/to/mcp.json" {
+			t.Errorf("MCPConfigPath = %q, want inherited %q", opts.MCPConfigPath, "/path/to/mcp.json")
+		}
+		if len(opts.ParsedAllowedTools) != 2 {
+			t.Errorf("ParsedAllowedTools length = %d, want 2 (options should be preprocessed)", len(opts.ParsedAllowedTools))
+		}
+	})
+
+	t.Run("matches what RunAgent executes", func(t *testing.T) {
+		originalExecCommand := execCommand
+		defer func() {
+			execCommand = originalExecCommand
+		}()
+
+		opts, err := manager.PreviewRunOptions("reviewer", parentOpts)
+		if err != nil {
+			t.Fatalf("PreviewRunOptions() error = %v", err)
+		}
+		execCommand = mockExecCommandContext(t, BuildArgs("review this", opts), "done", 0)
+
+		if _, err := manager.RunAgent(context.Background(), "reviewer", "review this", parentOpts); err != nil {
+			t.Fatalf("RunAgent() error = %v", err)
+		}
+	})
+
+	t.Run("unknown agent", func(t *testing.T) {
+		_, err := manager.PreviewRunOptions("unknown", parentOpts)
+		if err == nil || !containsSubstring(err.Error(), "unknown agent") {
+			t.Errorf("expected unknown agent error, got %v", err)
+		}
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		_, err := manager.PreviewRunOptions("reviewer", &RunOptions{ModelAlias: "gpt"})
+		if err == nil {
+			t.Error("expected validation error for invalid parent options")
+		}
+	})
+}
+
+func TestSubagentManager_ParentDisallowedTools(t *testing.T) {
+	var gotOpts *RunOptions
+	manager := NewSubagentManager(NewMockClient(func(prompt string, opts *RunOptions) (*ClaudeResult, error) {
+		gotOpts = opts
+		return &ClaudeResult{Result: "done"}, nil
+	}))
+	_ = manager.RegisterAgent("shell", &SubagentConfig{
+		Description: "Runs commands",
+		Prompt:      "You run commands",
+		Tools:       []string{"Read", "Bash(git:*)"},
+	})
+	_ = manager.RegisterAgent("reader", &SubagentConfig{
+		Description: "Reads files",
+		Prompt:      "You read files",
+		Tools:       []string{"Read", "Grep"},
+	})
+	_ = manager.RegisterAgent("bash-only", &SubagentConfig{
+		Description: "Only runs commands",
+		Prompt:      "You only run commands",
+		Tools:       []string{"Bash"},
+	})
+
+	ctx := context.Background()
+	parent := &RunOptions{DisallowedTools: []string{"Bash", "Write(*.env)"}}
+
+	_, err := manager.RunAgent(ctx, "shell", "status", parent)
+	var claudeErr *ClaudeError
+	if !errors.As(err, &claudeErr) || claudeErr.Type != ErrorValidation || !containsSubstring(err.Error(), "Bash(git:*)") {
+		t.Fatalf("expected a subagent requesting a parent-disallowed tool to be rejected, got %v", err)
+	}
+	if gotOpts != nil {
+		t.Error("expected the rejected agent not to run")
+	}
+
+	if _, err := manager.RunAgent(ctx, "reader", "look", parent); err != nil {
+		t.Fatalf("expected an agent without conflicts to run, got %v", err)
+	}
+	if !reflect.DeepEqual(gotOpts.DisallowedTools, parent.DisallowedTools) {
+		t.Errorf("expected the parent's DisallowedTools to be inherited, got %v", gotOpts.DisallowedTools)
+	}
+
+	// A constrained parent entry only blocks part of a tool, so it is not a conflict
+	if err := (&SubagentConfig{Tools: []string{"Write"}}).ValidateAgainstParent(parent); err != nil {
+		t.Errorf("expected Write to be allowed next to Write(*.env), got %v", err)
+	}
+
+	manager.StripDisallowedTools = true
+	if _, err := manager.RunAgent(ctx, "shell", "status", parent); err != nil {
+		t.Fatalf("expected the disallowed tool to be stripped, got %v", err)
+	}
+	if !reflect.DeepEqual(gotOpts.AllowedTools, []string{"Read"}) {
+		t.Errorf("expected only Read to remain, got %v", gotOpts.AllowedTools)
+	}
+	if _, err := collectStream(manager.StreamAgent(ctx, "bash-only", "status", parent)); !errors.As(err, &claudeErr) || claudeErr.Type != ErrorValidation {
+		t.Errorf("expected an agent left without tools to be rejected, got %v", err)
+	}
+}
+
+func TestSubagentManager_DefaultParentOptions(t *testing.T) {
+	var gotOpts *RunOptions
+	manager := NewSubagentManager(NewMockClient(func(prompt string, opts *RunOptions) (*ClaudeResult, error) {
+		gotOpts = opts
+		return &ClaudeResult{Result: "done"}, nil
+	}))
+	for _, name := range []string{"reviewer", "writer"} {
+		_ = manager.RegisterAgent(name, &SubagentConfig{
+			Description: "Reviews code",
+			Prompt:      "You review code",
+			Tools:       []string{"Read"},
+		})
+	}
+	manager.SetDefaultParentOptions("reviewer", &RunOptions{
+		Model:           "claude-haiku-4-5",
+		MaxTurns:        3,
+		PermissionMode:  PermissionModeAcceptEdits,
+		DisallowedTools: []string{"Bash"},
+	})
+
+	ctx := context.Background()
+	if _, err := manager.RunAgent(ctx, "reviewer", "review", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if gotOpts.Model != "claude-haiku-4-5" || gotOpts.MaxTurns != 3 || gotOpts.PermissionMode != PermissionModeAcceptEdits {
+		t.Errorf("expected the bound defaults to apply, got model %q, %d turns, mode %q", gotOpts.Model, gotOpts.MaxTurns, gotOpts.PermissionMode)
+	}
+
+	if _, err := manager.RunAgent(ctx, "reviewer", "review", &RunOptions{Model: "claude-opus-4-1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if gotOpts.Model != "claude-opus-4-1" || gotOpts.MaxTurns != 3 || !reflect.DeepEqual(gotOpts.DisallowedTools, []string{"Bash"}) {
+		t.Errorf("expected explicit options to override only the fields they set, got model %q, %d turns, disallowed %v", gotOpts.Model, gotOpts.MaxTurns, gotOpts.DisallowedTools)
+	}
+
+	if _, err := collectStream(manager.StreamAgent(ctx, "writer", "write", nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if gotOpts.Model != "" || gotOpts.MaxTurns != 0 {
+		t.Errorf("expected defaults to be bound to one agent only, got model %q, %d turns", gotOpts.Model, gotOpts.MaxTurns)
+	}
+
+	manager.SetDefaultParentOptions("reviewer", nil)
+	if opts, _ := manager.PreviewRunOptions("reviewer", nil); opts.Model != "" {
+		t.Errorf("expected nil to remove the binding, got model %q", opts.Model)
+	}
+}
+
+func TestSubagentManager_SessionDeadline(t *testing.T) {
+	originalExecCommand := execCommand
+	originalTimeNow := timeNow
+	defer func() {
+		execCommand = originalExecCommand
+		timeNow = originalTimeNow
+	}()
+
+	now := time.Unix(1700000000, 0)
+	timeNow = func() time.Time { return now }
+
+	client := NewClient("mock-claude")
+	manager := NewSubagentManager(client)
+	_ = manager.RegisterAgent("worker", &SubagentConfig{
+		Description: "Worker",
+		Prompt:      "You do work",
+	})
+
+	if _, ok := manager.SessionDeadline(); ok {
+		t.Error("SessionDeadline() should be unset by default")
+	}
+
+	manager.SetSessionDeadline(now.Add(time.Minute))
+
+	opts, _ := manager.PreviewRunOptions("worker", nil)
+	execCommand = mockExecCommandContext(t, BuildArgs("step one", opts), "ok", 0)
+	if _, err := manager.RunAgent(context.Background(), "worker", "step one", nil); err != nil {
+		t.Fatalf("first RunAgent() error = %v", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	execCommand = func(_ context.Context, name string, arg ...string) *exec.Cmd {
+		t.Error("process should not be spawned after the deadline")
+		return exec.Command(name, arg...)
+	}
+
+	_, err := manager.RunAgent(context.Background(), "worker", "step two", nil)
+	if !errors.Is(err, ErrSessionDeadlineExceeded) {
+		t.Errorf("second RunAgent() error = %v, want ErrSessionDeadlineExceeded", err)
+	}
+
+	manager.SetSession("worker", "session-123")
+	_, err = manager.ResumeAgent(context.Background(), "worker", "step three", nil)
+	if !errors.Is(err, ErrSessionDeadlineExceeded) {
+		t.Errorf("ResumeAgent() error = %v, want ErrSessionDeadlineExceeded", err)
+	}
+
+	messages, err := collectStream(manager.StreamAgent(context.Background(), "worker", "step four", nil))
+	if !errors.Is(err, ErrSessionDeadlineExceeded) || len(messages) != 0 {
+		t.Errorf("StreamAgent() = %d messages, %v, want ErrSessionDeadlineExceeded", len(messages), err)
+	}
+
+	// A stream started before the deadline is cut off when it arrives
+	manager.SetSessionDeadline(now.Add(100 * time.Millisecond))
+	execCommand, _ = mockStreamCommand(streamScript{lines: []string{`{"type":"system","subtype":"init","session_id":"s"}`, "sleep 30s"}})
+	start := time.Now()
+	_, err = collectStream(manager.StreamAgent(context.Background(), "worker", "step five", nil))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("StreamAgent() error = %v, want the stream bounded by the session deadline", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expected the stream to stop at the deadline, took %v", elapsed)
+	}
+
+	manager.SetSessionDeadline(time.Time{})
+	if _, ok := manager.SessionDeadline(); ok {
+		t.Error("SessionDeadline() should be cleared by a zero time")
+	}
+}
+
+func TestSubagentManager_RequiredMCPServers(t *testing.T) {
+	dir := t.TempDir()
+	mcpConfig := filepath.Join(dir, "mcp.json")
+	fixture := `{"mcpServers": {"filesystem": {"command": "npx", "args": []}}}`
+	if err := os.WriteFile(mcpConfig, []byte(fixture), 0o600); err != nil {
+		t.Fatalf("failed to write fixture: %v", err)
+	}
+
+	manager := NewSubagentManager(NewClient("mock-claude"))
+	_ = manager.RegisterAgents(map[string]*SubagentConfig{
+		"db": {
+			Description:        "Database analyst",
+			Prompt:             "You query databases",
+			Tools:              []string{"mcp__db__query"},
+			RequiredMCPServers: []string{"db"},
+		},
+		"files": {
+			Description:        "File reader",
+			Prompt:             "You read files",
+			RequiredMCPServers: []string{"filesystem"},
+		},
+	})
+
+	t.Run("missing server fails before running", func(t *testing.T) {
+		_, err := manager.RunAgent(context.Background(), "db", "count users", &RunOptions{MCPConfigPath: mcpConfig})
+		var claudeErr *ClaudeError
+		if !errors.As(err, &claudeErr) || claudeErr.Type != ErrorValidation {
+			t.Fatalf("expected validation error, got %v", err)
+		}
+		if !containsSubstring(claudeErr.Message, `"db"`) {
+			t.Errorf("expected missing server in message, got %q", claudeErr.Message)
+		}
+
+		_, errCh := manager.StreamAgent(context.Background(), "db", "count users", &RunOptions{MCPConfigPath: mcpConfig})
+		if err := <-errCh; !errors.As(err, &claudeErr) {
+			t.Errorf("expected StreamAgent validation error, got %v", err)
+		}
+	})
+
+	t.Run("no MCP config", func(t *testing.T) {
+		if _, err := manager.PreviewRunOptions("db", nil); err == nil {
+			t.Error("expected error without MCP config")
+		}
+	})
+
+	t.Run("configured server passes", func(t *testing.T) {
+		opts, err := manager.PreviewRunOptions("files", &RunOptions{MCPConfigPath: mcpConfig})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if opts.MCPConfigPath != mcpConfig {
+			t.Errorf("MCPConfigPath = %q, want %q", opts.MCPConfigPath, mcpConfig)
+		}
+	})
+}
+
+func TestSubagentManager_MaxDepth(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	manager := NewSubagentManager(NewClient("mock-claude"))
+	_ = manager.RegisterAgent("delegator", &SubagentConfig{
+		Description: "Delegates to itself",
+		Prompt:      "You delegate",
+	})
+
+	if manager.MaxDepth != DefaultSubagentMaxDepth {
+		t.Errorf("MaxDepth = %d, want default %d", manager.MaxDepth, DefaultSubagentMaxDepth)
+	}
+
+	// Each spawned process invokes the subagent again through the run's context
+	var depths []int
+	var nestedErr error
+	command, _ := mockStreamCommand(streamScript{lines: []string{"ok"}})
+	execCommand = func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+		depths = append(depths, subagentDepth(ctx))
+		if _, err := manager.RunAgent(ctx, "delegator", "go deeper", nil); err != nil {
+			nestedErr = err
+		}
+		return command(ctx, name, arg...)
+	}
+
+	if _, err := manager.RunAgent(context.Background(), "delegator", "start", nil); err != nil {
+		t.Fatalf("RunAgent() error = %v", err)
+	}
+	if len(depths) != DefaultSubagentMaxDepth {
+		t.Errorf("expected %d nested runs, got depths %v", DefaultSubagentMaxDepth, depths)
+	}
+	if !errors.Is(nestedErr, ErrSubagentDepthExceeded) {
+		t.Errorf("nested RunAgent() error = %v, want ErrSubagentDepthExceeded", nestedErr)
+	}
+
+	t.Run("custom limit", func(t *testing.T) {
+		manager.MaxDepth = 1
+		ctx := context.WithValue(context.Background(), subagentDepthKey{}, 1)
+
+		_, err := manager.RunAgent(ctx, "delegator", "nested", nil)
+		if !errors.Is(err, ErrSubagentDepthExceeded) {
+			t.Errorf("RunAgent() error = %v, want ErrSubagentDepthExceeded", err)
+		}
+		manager.SetSession("delegator", "session-1")
+		if _, err := manager.ResumeAgent(ctx, "delegator", "nested", nil); !errors.Is(err, ErrSubagentDepthExceeded) {
+			t.Errorf("ResumeAgent() error = %v, want ErrSubagentDepthExceeded", err)
+		}
+		_, errCh := manager.StreamAgent(ctx, "delegator", "nested", nil)
+		if err := <-errCh; !errors.Is(err, ErrSubagentDepthExceeded) {
+			t.Errorf("StreamAgent() error = %v, want ErrSubagentDepthExceeded", err)
+		}
+	})
+}
+
+func TestSubagentManager_RunAgentStructured(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() {
+		execCommand = originalExecCommand
+	}()
+
+	schema := `{
+		"type": "object",
+		"required": ["findings"],
+		"properties": {
+			"findings": {
+				"type": "array",
+				"items": {
+					"type": "object",
+					"required": ["file", "severity"],
+					"properties": {"file": {"type": "string"}, "line": {"type": "integer"}, "severity": {"type": "string"}}
+				}
+			}
+		}
+	}`
+
+	manager := NewSubagentManager(NewClient("mock-claude"))
+	if err := manager.RegisterAgent("reviewer", &SubagentConfig{
+		Description:  "Reviews code",
+		Prompt:       "You review code",
+		OutputSchema: schema,
+	}); err != nil {
+		t.Fatalf("RegisterAgent() error = %v", err)
+	}
+
+	type finding struct {
+		File     string `json:"file"`
+		Line     int    `json:"line"`
+		Severity string `json:"severity"`
+	}
+	type report struct {
+		Findings []finding `json:"findings"`
+	}
+
+	resultLine := func(output string) string {
+		data, _ := json.Marshal(map[string]interface{}{"type": "result", "subtype": "success", "result": output, "session_id": "s1"})
+		return string(data)
+	}
+
+	t.Run("valid output", func(t *testing.T) {
+		output := "```json\n{\"findings\":[{\"file\":\"main.go\",\"line\":12,\"severity\":\"high\"}]}\n```"
+		command, calls := mockStreamCommand(streamScript{lines: []string{resultLine(output)}})
+		execCommand = command
+
+		var got report
+		if err := manager.RunAgentStructured(context.Background(), "reviewer", "Review main.go", nil, &got); err != nil {
+			t.Fatalf("RunAgentStructured() error = %v", err)
+		}
+		if len(got.Findings) != 1 || got.Findings[0].File != "main.go" || got.Findings[0].Line != 12 {
+			t.Errorf("unexpected findings: %+v", got.Findings)
+		}
+
+		args := strings.Join(calls()[0], " ")
+		if !containsSubstring(args, "--output-format json") || !containsSubstring(args, `"required": ["findings"]`) {
+			t.Errorf("expected JSON output and schema instructions, got %v", args)
+		}
+	})
+
+	t.Run("schema mismatch", func(t *testing.T) {
+		outputs := []string{
+			`I found one issue in main.go`,
+			`{"issues": []}`,
+			`{"findings": [{"file": "main.go", "line": 1.5, "severity": "low"}]}`,
+		}
+		for _, output := range outputs {
+			command, _ := mockStreamCommand(streamScript{lines: []string{resultLine(output)}})
+			execCommand = command
+
+			var got report
+			err := manager.RunAgentStructured(context.Background(), "reviewer", "Review main.go", nil, &got)
+			if !errors.Is(err, ErrOutputSchemaMismatch) {
+				t.Errorf("output %q: error = %v, want ErrOutputSchemaMismatch", output, err)
+			}
+		}
+	})
+
+	t.Run("agent without schema", func(t *testing.T) {
+		_ = manager.RegisterAgent("plain", &SubagentConfig{Description: "Plain", Prompt: "You answer"})
+		var got report
+		if err := manager.RunAgentStructured(context.Background(), "plain", "hi", nil, &got); err == nil {
+			t.Error("expected error for agent without OutputSchema")
+		}
+	})
+
+	t.Run("invalid schema rejected", func(t *testing.T) {
+		err := manager.RegisterAgent("broken", &SubagentConfig{Description: "Broken", Prompt: "x", OutputSchema: "{not json"})
+		if err == nil {
+			t.Error("expected RegisterAgent to reject invalid schema")
+		}
+	})
+}
+
+func TestSubagentManager_ForkSession(t *testing.T) {
+	manager := NewSubagentManager(NewClient("claude"))
+	_ = manager.RegisterAgent("planner", &SubagentConfig{Description: "Planner", Prompt: "You plan"})
+	manager.SetSession("planner", "session-root")
+
+	t.Run("copies default session", func(t *testing.T) {
+		if err := manager.ForkSession("planner", "", "branch-a"); err != nil {
+			t.Fatalf("ForkSession() error = %v", err)
+		}
+		if err := manager.ForkSession("planner", "branch-a", "branch-b"); err != nil {
+			t.Fatalf("ForkSession() error = %v", err)
+		}
+
+		for _, key := range []string{"branch-a", "branch-b"} {
+			if id, ok := manager.GetSessionKey("planner", key); !ok || id != "session-root" {
+				t.Errorf("GetSessionKey(%q) = %q, %v, want session-root", key, id, ok)
+			}
+		}
+
+		// Branches are independent references
+		manager.SetSessionKey("planner", "branch-a", "session-a2")
+		if id, _ := manager.GetSessionKey("planner", "branch-b"); id != "session-root" {
+			t.Errorf("branch-b changed to %q after updating branch-a", id)
+		}
+		if id, _ := manager.GetSession("planner"); id != "session-root" {
+			t.Errorf("default session changed to %q", id)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		var agentErr *UnknownAgentError
+		if err := manager.ForkSession("ghost", "", "x"); !errors.As(err, &agentErr) {
+			t.Errorf("expected UnknownAgentError, got %v", err)
+		}
+		if err := manager.ForkSession("planner", "missing", "x"); err == nil {
+			t.Error("expected error for missing source session")
+		}
+		if err := manager.ForkSession("planner", "branch-a", "branch-a"); err == nil {
+			t.Error("expected error when forking onto the same key")
+		}
+	})
+
+	t.Run("run resumes forked session", func(t *testing.T) {
+		originalExecCommand := execCommand
+		defer func() {
+			execCommand = originalExecCommand
+		}()
+		command, calls := mockStreamCommand(streamScript{lines: []string{"ok"}})
+		execCommand = command
+
+		if _, err := manager.RunAgentSession(context.Background(), "planner", "branch-b", "Next step", nil); err != nil {
+			t.Fatalf("RunAgentSession() error = %v", err)
+		}
+		if args := calls()[0]; !containsSubstring(strings.Join(args, " "), "--resume session-root") {
+			t.Errorf("expected --resume session-root, got %v", args)
+		}
+	})
+
+	t.Run("clear removes forks", func(t *testing.T) {
+		manager.ClearSession("planner")
+		if _, ok := manager.GetSessionKey("planner", "branch-a"); ok {
+			t.Error("expected forked sessions to be cleared")
+		}
+	})
+}
+
+func TestSubagentConfig_JSON(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		original := &SubagentConfig{
+			Description: "Reviews code",
+			Prompt:      "You review code",
+			Tools:       []string{"Read", "Grep"},
+			Model:       "haiku",
+		}
+		data, err := json.Marshal(original)
+		if err != nil {
+			t.Fatalf("Marshal() error = %v", err)
+		}
+		expected := `{"description":"Reviews code","prompt":"You review code","tools":["Read","Grep"],"model":"haiku"}`
+		if string(data) != expected {
+			t.Errorf("Marshal() = %s, want %s", data, expected)
+		}
+
+		var decoded SubagentConfig
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("Unmarshal() error = %v", err)
+		}
+		if !reflect.DeepEqual(&decoded, original) {
+			t.Errorf("round trip = %+v, want %+v", decoded, original)
+		}
+	})
+
+	t.Run("agents map", func(t *testing.T) {
+		var agents map[string]*SubagentConfig
+		data := `{"reviewer":{"description":"Reviews code","prompt":"Review","max_turns":3}}`
+		if err := json.Unmarshal([]byte(data), &agents); err != nil {
+			t.Fatalf("Unmarshal() error = %v", err)
+		}
+		if agents["reviewer"] == nil || agents["reviewer"].MaxTurns != 3 {
+			t.Errorf("unexpected agents: %+v", agents)
+		}
+	})
+
+	invalid := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"missing prompt", `{"description":"Reviews code"}`, "prompt is required"},
+		{"invalid model", `{"description":"d","prompt":"p","model":"gpt-4"}`, "invalid model alias"},
+		{"unknown field", `{"description":"d","prompt":"p","max_turn":3}`, "unknown field"},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			var config SubagentConfig
+			err := json.Unmarshal([]byte(tt.data), &config)
+			if err == nil || !containsSubstring(err.Error(), tt.want) {
+				t.Errorf("Unmarshal() error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunAgent_EffectiveOptions(t *testing.T) {
+	originalExecCommand := execCommand
+	defer func() { execCommand = originalExecCommand }()
+	command, _ := mockStreamCommand(streamScript{lines: []string{"done"}})
+	execCommand = command
+
+	manager := NewSubagentManager(&ClaudeClient{BinPath: "claude"})
+	_ = manager.RegisterAgent("reviewer", &SubagentConfig{
+		Description: "Reviews code",
+		Prompt:      "You review code",
+		Tools:       []string{"Read", "Grep"},
+		Model:       "haiku",
+	})
+
+	parentOpts := &RunOptions{
+		ModelAlias:         "opus",
+		AllowedTools:       []string{"Bash"},
+		MCPConfigPath:      "/etc/claude/mcp.json",
+		PermissionCallback: ReadOnlyCallback(),
+	}
+	result, err := manager.RunAgent(context.Background(), "reviewer", "Review", parentOpts)
+	if err != nil {
+		t.Fatalf("RunAgent() error = %v", err)
+	}
+
+	effective := result.EffectiveOptions
+	if effective == nil {
+		t.Fatal("expected EffectiveOptions to be captured")
+	}
+	if effective.ModelAlias != "haiku" || !reflect.DeepEqual(effective.AllowedTools, []string{"Read", "Grep"}) {
+		t.Errorf("expected subagent overrides, got model %q tools %v", effective.ModelAlias, effective.AllowedTools)
+	}
+	if effective.MCPConfigPath != parentOpts.MCPConfigPath {
+		t.Errorf("expected inherited MCP config %q, got %q", parentOpts.MCPConfigPath, effective.MCPConfigPath)
+	}
+	if effective.PermissionCallback != nil || effective.ParsedAllowedTools != nil {
+		t.Error("expected callbacks and parsed permissions to be stripped")
+	}
+	if effective.SystemPrompt != redactedValue {
+		t.Errorf("expected system prompt to be redacted, got %q", effective.SystemPrompt)
+	}
+}
+
+func TestRunAgent_ContextFiles(t *testing.T) {
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "go.mod")
+	if err := os.WriteFile(manifest, []byte("module example.com/app\n\nrequire golang.org/x/crypto v0.1.0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var prompts []string
+	manager := NewSubagentManager(NewMockClient(func(prompt string, opts *RunOptions) (*ClaudeResult, error) {
+		prompts = append(prompts, prompt)
+		return &ClaudeResult{Result: "ok"}, nil
+	}))
+	security := SecurityReviewerAgent()
+	security.ContextFiles = []string{manifest}
+	_ = manager.RegisterAgent("security", security)
+
+	if _, err := manager.RunAgent(context.Background(), "security", "Audit dependencies", nil); err != nil {
+		t.Fatalf("RunAgent() error = %v", err)
+	}
+	if len(prompts) != 1 || !strings.Contains(prompts[0], "golang.org/x/crypto v0.1.0") || !strings.HasSuffix(prompts[0], "Audit dependencies") {
+		t.Fatalf("expected manifest prepended to the prompt, got %q", prompts)
+	}
+
+	// Files are read fresh on each run
+	_ = os.WriteFile(manifest, []byte("module example.com/app\n\nrequire golang.org/x/crypto v0.2.0\n"), 0o644)
+	_, _ = manager.RunAgent(context.Background(), "security", "Audit dependencies", nil)
+	if len(prompts) != 2 || !strings.Contains(prompts[1], "v0.2.0") {
+		t.Errorf("expected updated manifest in the second run, got %q", prompts[len(prompts)-1])
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		missing := SecurityReviewerAgent()
+		missing.ContextFiles = []string{filepath.Join(dir, "package.json")}
+		_ = manager.RegisterAgent("missing", missing)
+
+		_, err := manager.RunAgent(context.Background(), "missing", "Audit", nil)
+		if !errors.Is(err, os.ErrNotExist) || !strings.Contains(err.Error(), "package.json") {
+			t.Errorf("expected a not-exist error naming the file, got %v", err)
+		}
+		if len(prompts) != 2 {
+			t.Error("expected the agent not to run")
+		}
+	})
+
+	t.Run("size cap", func(t *testing.T) {
+		capped := SecurityReviewerAgent()
+		capped.ContextFiles = []string{manifest}
+		capped.MaxContextBytes = 10
+		_ = manager.RegisterAgent("capped", capped)
+
+		if _, err := manager.RunAgent(context.Background(), "capped", "Audit", nil); err == nil || !strings.Contains(err.Error(), "exceed 10 bytes") {
+			t.Errorf("expected size cap error, got %v", err)
+		}
+	})
+}
+
+func TestRunAgent_BudgetPreflight(t *testing.T) {
+	runs := 0
+	manager := NewSubagentManager(NewMockClient(func(prompt string, opts *RunOptions) (*ClaudeResult, error) {
+		runs++
+		return &ClaudeResult{Result: "ok", SessionID: "budget-session"}, nil
+	}))
+	_ = manager.RegisterAgent("reviewer", CodeReviewerAgent())
+	manager.SetSession("reviewer", "budget-session")
+
+	tracker := NewBudgetTracker(&BudgetConfig{MaxBudgetUSD: 1.0})
+	defer tracker.Close()
+	_ = tracker.AddSpend("earlier", 1.0)
+	parentOpts := &RunOptions{BudgetTracker: tracker}
+
+	if _, err := manager.RunAgent(context.Background(), "reviewer", "Review", parentOpts); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("RunAgent() error = %v, want ErrBudgetExceeded", err)
+	}
+	if _, err := manager.ResumeAgent(context.Background(), "reviewer", "Continue", parentOpts); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("ResumeAgent() error = %v, want ErrBudgetExceeded", err)
+	}
+	if _, err := collectStream(manager.StreamAgent(context.Background(), "reviewer", "Review", parentOpts)); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("StreamAgent() error = %v, want ErrBudgetExceeded", err)
+	}
+	if runs != 0 {
+		t.Errorf("expected the agent never to run, ran %d times", runs)
+	}
+
+	// A configurable estimate governs how much room is required
+	tracker.Reset()
+	_ = tracker.AddSpend("earlier", 0.95)
+	manager.MinRunEstimateUSD = 0.10
+	if _, err := manager.RunAgent(context.Background(), "reviewer", "Review", parentOpts); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("expected $0.05 remaining to be too little for a $0.10 estimate, got %v", err)
+	}
+	manager.MinRunEstimateUSD = 0.05
+	if _, err := manager.RunAgent(context.Background(), "reviewer", "Review", parentOpts); err != nil || runs != 1 {
+		t.Errorf("expected the run to proceed, got %v after %d runs", err, runs)
+	}
+}
+
+func TestSubagentManager_HealthCheck(t *testing.T) {
+	var reply *ClaudeResult
+	var replyErr error
+	var gotPrompt string
+	var gotOpts *RunOptions
+	manager := NewSubagentManager(NewMockClient(func(prompt string, opts *RunOptions) (*ClaudeResult, error) {
+		gotPrompt, gotOpts = prompt, opts
+		return reply, replyErr
+	}))
+	_ = manager.RegisterAgent("reviewer", CodeReviewerAgent())
+
+	reply = &ClaudeResult{Result: "OK"}
+	if err := manager.HealthCheck(context.Background(), "reviewer"); err != nil {
+		t.Fatalf("expected healthy agent, got %v", err)
+	}
+	if gotPrompt != healthCheckPrompt {
+		t.Errorf("expected the health check prompt, got %q", gotPrompt)
+	}
+	if gotOpts.MaxTurns != 1 {
+		t.Errorf("expected health check to be limited to one turn, got %d", gotOpts.MaxTurns)
+	}
+
+	reply = &ClaudeResult{Result: "model overloaded", IsError: true}
+	if err := manager.HealthCheck(context.Background(), "reviewer"); !errors.Is(err, ErrAgentUnhealthy) {
+		t.Errorf("expected ErrAgentUnhealthy for an error result, got %v", err)
+	}
+
+	reply, replyErr = nil, NewClaudeError(ErrorNetwork, "connection refused")
+	err := manager.HealthCheck(context.Background(), "reviewer")
+	var claudeErr *ClaudeError
+	if !errors.Is(err, ErrAgentUnhealthy) || !errors.As(err, &claudeErr) {
+		t.Errorf("expected ErrAgentUnhealthy wrapping the run error, got %v", err)
+	}
+
+	var unknown *UnknownAgentError
+	if err := manager.HealthCheck(context.Background(), "missing"); !errors.As(err, &unknown) {
+		t.Errorf("expected UnknownAgentError for an unregistered agent, got %v", err)
+	}
+}